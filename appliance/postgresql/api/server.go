@@ -5,6 +5,7 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"regexp"
 
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/go-martini/martini"
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/martini-contrib/render"
@@ -37,6 +38,7 @@ func main() {
 	m.Map(db)
 
 	r.Post("/databases", createDatabase)
+	r.Delete("/databases/:id", dropDatabase)
 	r.Get("/ping", ping)
 
 	port := os.Getenv("PORT")
@@ -103,6 +105,45 @@ func createDatabase(db *postgres.DB, r render.Render) {
 	})
 }
 
+var databaseIDPattern = regexp.MustCompile(`^([0-9a-f]+):([0-9a-f]+)$`)
+
+func dropDatabase(db *postgres.DB, params martini.Params, w http.ResponseWriter) {
+	// the ID is username:database, as returned by createDatabase
+	m := databaseIDPattern.FindStringSubmatch(params["id"])
+	if m == nil {
+		w.WriteHeader(404)
+		return
+	}
+	username, database := m[1], m[2]
+
+	var exists bool
+	if err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM pg_database WHERE datname = $1)", database).Scan(&exists); err != nil {
+		log.Println(err)
+		w.WriteHeader(500)
+		return
+	}
+	if !exists {
+		w.WriteHeader(410)
+		return
+	}
+	if _, err := db.Exec(`SELECT pg_terminate_backend(pid) FROM pg_stat_activity WHERE datname = $1`, database); err != nil {
+		log.Println(err)
+		w.WriteHeader(500)
+		return
+	}
+	if _, err := db.Exec(fmt.Sprintf(`DROP DATABASE IF EXISTS "%s"`, database)); err != nil {
+		log.Println(err)
+		w.WriteHeader(500)
+		return
+	}
+	if _, err := db.Exec(fmt.Sprintf(`DROP USER IF EXISTS "%s"`, username)); err != nil {
+		log.Println(err)
+		w.WriteHeader(500)
+		return
+	}
+	w.WriteHeader(200)
+}
+
 func ping(db *postgres.DB, w http.ResponseWriter) {
 	if _, err := db.Exec("SELECT 1"); err != nil {
 		log.Println(err)
@@ -49,6 +49,7 @@ func (a *AddAppAction) Run(s *State) error {
 		return err
 	}
 	as.Artifact = data.Artifact
+	data.Release.AppID = a.App.ID
 	if err := client.CreateRelease(data.Release); err != nil {
 		return err
 	}
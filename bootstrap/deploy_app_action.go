@@ -96,6 +96,7 @@ func (a *DeployAppAction) Run(s *State) error {
 	}
 	as.Artifact = a.Artifact
 
+	a.Release.AppID = a.App.ID
 	a.Release.ArtifactID = a.Artifact.ID
 	if err := client.CreateRelease(a.Release); err != nil {
 		return err
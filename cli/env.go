@@ -15,22 +15,28 @@ import (
 func init() {
 	register("env", runEnv, `
 usage: flynn env [-t <proc>]
-       flynn env set [-t <proc>] <var>=<val>...
-       flynn env unset [-t <proc>] <var>...
+       flynn env set [-t <proc>] [-s] <var>=<val>...
+       flynn env unset [-t <proc>] [-s] <var>...
        flynn env get [-t <proc>] <var>
 
 Manage app environment variables.
 
 Options:
 	-t, --process-type <proc>  set or read env for specified process type
+	-s, --secret               set or unset secret variables
 
 Commands:
-	With no arguments, shows a list of environment variables.
+	With no arguments, shows a list of environment variables. The values of
+	secret variables are not shown.
 
 	set    sets value of one or more env variables
 	unset  deletes one or more variables
 	get    returns the value of variable
 
+Secret variables are stored encrypted by the controller and are only given
+to the app's jobs when they start. They apply to all process types, and
+their values can not be read back.
+
 Examples:
 
 	$ flynn env set FOO=bar BAZ=foobar
@@ -45,6 +51,13 @@ Examples:
 
 	$ flynn env unset FOO
 	Created release b1bbd9bc76d6436ea2fd245300bce72e.
+
+	$ flynn env set --secret DATABASE_PASSWORD=s3cret
+	Created release 9ae34e4bfbc14e3da83bff0dc97b1cc5.
+
+	$ flynn env
+	BAZ=foobar
+	DATABASE_PASSWORD=[secret]
 `)
 }
 
@@ -53,6 +66,9 @@ var envProc string
 func runEnv(args *docopt.Args, client *controller.Client) error {
 	envProc = args.String["--process-type"]
 
+	if args.Bool["--secret"] && envProc != "" {
+		return errors.New("secret variables can not be set for a process type")
+	}
 	if args.Bool["set"] {
 		return runEnvSet(args, client)
 	} else if args.Bool["unset"] {
@@ -78,10 +94,13 @@ func runEnv(args *docopt.Args, client *controller.Client) error {
 		}
 	}
 
-	vars := make([]string, 0, len(release.Env))
+	vars := make([]string, 0, len(release.Env)+len(release.Secrets))
 	for k, v := range release.Env {
 		vars = append(vars, k+"="+v)
 	}
+	for k := range release.Secrets {
+		vars = append(vars, k+"=[secret]")
+	}
 	sort.Strings(vars)
 
 	for _, v := range vars {
@@ -100,6 +119,9 @@ func runEnvSet(args *docopt.Args, client *controller.Client) error {
 		}
 		env[v[0]] = &v[1]
 	}
+	if args.Bool["--secret"] {
+		return setSecrets(client, env)
+	}
 	id, err := setEnv(client, envProc, env)
 	if err != nil {
 		return err
@@ -114,6 +136,9 @@ func runEnvUnset(args *docopt.Args, client *controller.Client) error {
 	for _, s := range vars {
 		env[s] = nil
 	}
+	if args.Bool["--secret"] {
+		return setSecrets(client, env)
+	}
 	id, err := setEnv(client, envProc, env)
 	if err != nil {
 		return err
@@ -133,6 +158,9 @@ func runEnvGet(args *docopt.Args, client *controller.Client) error {
 		return fmt.Errorf("process type %q not found in release %s", envProc, release.ID)
 	}
 
+	if _, ok := release.Secrets[arg]; ok {
+		return fmt.Errorf("var %q is a secret and can not be read", arg)
+	}
 	if v, ok := release.Env[arg]; ok {
 		fmt.Println(v)
 		return nil
@@ -146,49 +174,57 @@ func runEnvGet(args *docopt.Args, client *controller.Client) error {
 }
 
 func setEnv(client *controller.Client, proc string, env map[string]*string) (string, error) {
-	release, err := client.GetAppRelease(mustApp())
-	if err == controller.ErrNotFound {
-		artifact := &ct.Artifact{}
-		if err := client.CreateArtifact(artifact); err != nil {
-			return "", err
+	release, err := client.UpdateAppRelease(mustApp(), func(release *ct.Release) error {
+		if release.ID == "" {
+			// the app has no release yet
+			artifact := &ct.Artifact{}
+			if err := client.CreateArtifact(artifact); err != nil {
+				return err
+			}
+			release.ArtifactID = artifact.ID
+			if proc != "" {
+				release.Processes = make(map[string]ct.ProcessType)
+				release.Processes[proc] = ct.ProcessType{}
+			}
 		}
-		release = &ct.Release{ArtifactID: artifact.ID}
-		if proc != "" {
-			release.Processes = make(map[string]ct.ProcessType)
-			release.Processes[proc] = ct.ProcessType{}
-		}
-	} else if err != nil {
-		return "", err
-	}
 
-	var dest map[string]string
-	if proc != "" {
-		if _, ok := release.Processes[proc]; !ok {
-			return "", fmt.Errorf("process %q in release %s not found", proc, release.ID)
-		}
-		if release.Processes[proc].Env == nil {
-			p := release.Processes[proc]
-			p.Env = make(map[string]string, len(env))
-			release.Processes[proc] = p
-		}
-		dest = release.Processes[proc].Env
-	} else {
-		if release.Env == nil {
-			release.Env = make(map[string]string, len(env))
-		}
-		dest = release.Env
-	}
-	for k, v := range env {
-		if v == nil {
-			delete(dest, k)
+		var dest map[string]string
+		if proc != "" {
+			if _, ok := release.Processes[proc]; !ok {
+				return fmt.Errorf("process %q in release %s not found", proc, release.ID)
+			}
+			if release.Processes[proc].Env == nil {
+				p := release.Processes[proc]
+				p.Env = make(map[string]string, len(env))
+				release.Processes[proc] = p
+			}
+			dest = release.Processes[proc].Env
 		} else {
-			dest[k] = *v
+			if release.Env == nil {
+				release.Env = make(map[string]string, len(env))
+			}
+			dest = release.Env
 		}
+		for k, v := range env {
+			if v == nil {
+				delete(dest, k)
+			} else {
+				dest[k] = *v
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
 	}
+	return release.ID, nil
+}
 
-	release.ID = ""
-	if err := client.CreateRelease(release); err != nil {
-		return "", err
+func setSecrets(client *controller.Client, secrets map[string]*string) error {
+	release, err := client.UpdateAppSecrets(mustApp(), secrets)
+	if err != nil {
+		return err
 	}
-	return release.ID, client.SetAppRelease(mustApp(), release.ID)
+	log.Printf("Created release %s.", release.ID)
+	return nil
 }
@@ -1,8 +1,12 @@
 package main
 
 import (
+	"fmt"
 	"io"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-docopt"
 	"github.com/flynn/flynn/controller/client"
@@ -11,25 +15,34 @@ import (
 
 func init() {
 	register("log", runLog, `
-usage: flynn log [options] <job>
+usage: flynn log [options] [<job>]
 
-Stream log for a specific job.
+Stream log for a specific job, or the merged log of all running jobs of the
+app if no job is given.
 
 Options:
-	-s, --split-stderr  send stderr lines to stderr
-	-f, --follow        stream new lines after printing log buffer
+	-s, --split-stderr           send stderr lines to stderr
+	-f, --follow                 stream new lines after printing log buffer
+	-t, --type=<type>            only show the log of jobs of this process type
+	-n, --lines=<lines>          only show the last n lines of the app log buffer
+
+Each line of the app log is prefixed with its timestamp, process type and job ID.
 `)
 }
 
 func runLog(args *docopt.Args, client *controller.Client) error {
-	rc, err := client.GetJobLog(mustApp(), args.String["<job>"], args.Bool["--follow"])
-	if err != nil {
-		return err
-	}
 	var stderr io.Writer = os.Stdout
 	if args.Bool["--split-stderr"] {
 		stderr = os.Stderr
 	}
+	if args.String["<job>"] == "" {
+		return runAppLog(args, client, stderr)
+	}
+
+	rc, err := client.GetJobLog(mustApp(), args.String["<job>"], args.Bool["--follow"])
+	if err != nil {
+		return err
+	}
 	attachClient := cluster.NewAttachClient(struct {
 		io.Writer
 		io.ReadCloser
@@ -37,3 +50,35 @@ func runLog(args *docopt.Args, client *controller.Client) error {
 	attachClient.Receive(os.Stdout, stderr)
 	return nil
 }
+
+func runAppLog(args *docopt.Args, client *controller.Client, stderr io.Writer) error {
+	opts := &controller.AppLogOptions{
+		ProcessType: args.String["--type"],
+		Lines:       -1,
+		Follow:      args.Bool["--follow"],
+	}
+	if s := args.String["--lines"]; s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid number of lines: %q", s)
+		}
+		opts.Lines = n
+	}
+	stream, err := client.StreamAppLog(mustApp(), opts)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	for line := range stream.Lines {
+		w := io.Writer(os.Stdout)
+		if line.Stream == "stderr" {
+			w = stderr
+		}
+		prefix := fmt.Sprintf("%s %s[%s]: ", line.Timestamp.Format(time.RFC3339Nano), line.ProcessType, line.JobID)
+		for _, l := range strings.Split(strings.TrimSuffix(line.Message, "\n"), "\n") {
+			fmt.Fprintln(w, prefix+l)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-docopt"
+	"github.com/flynn/flynn/controller/client"
+	ct "github.com/flynn/flynn/controller/types"
+)
+
+func init() {
+	register("log-drain", runLogDrain, `
+usage: flynn log-drain
+       flynn log-drain add <url>
+       flynn log-drain remove <id>
+
+Manage log drains for application.
+
+The output of every job of the app is shipped to its log drains. Supported
+drains are syslog over TCP (syslog://host:port) or TLS (syslog+tls://host:port),
+and HTTP endpoints which receive batches of messages as a JSON array
+(http:// or https://).
+
+Commands:
+	With no arguments, shows a list of log drains.
+
+	add     adds a log drain to an app
+	remove  removes a log drain
+
+Examples:
+
+	$ flynn log-drain add syslog+tls://logs.example.com:6514
+`)
+}
+
+func runLogDrain(args *docopt.Args, client *controller.Client) error {
+	if args.Bool["add"] {
+		drain := &ct.LogDrain{URL: args.String["<url>"]}
+		if err := client.CreateLogDrain(mustApp(), drain); err != nil {
+			return err
+		}
+		fmt.Println(drain.ID)
+		return nil
+	} else if args.Bool["remove"] {
+		drainID := args.String["<id>"]
+		if err := client.DeleteLogDrain(mustApp(), drainID); err != nil {
+			return err
+		}
+		fmt.Printf("Log drain %s removed.\n", drainID)
+		return nil
+	}
+
+	drains, err := client.LogDrainList(mustApp())
+	if err != nil {
+		return err
+	}
+
+	w := tabWriter()
+	defer w.Flush()
+
+	listRec(w, "ID", "URL")
+	for _, d := range drains {
+		listRec(w, d.ID, d.URL)
+	}
+	return nil
+}
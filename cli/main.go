@@ -42,7 +42,8 @@ Commands:
 	apps      list apps
 	ps        list jobs
 	kill      kill a job
-	log       get job log
+	log       get app or job log
+	log-drain manage log drains
 	scale     change formation
 	run       run a job
 	env       manage env variables
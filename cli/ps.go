@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"sort"
 
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-docopt"
@@ -10,10 +11,16 @@ import (
 
 func init() {
 	register("ps", runPs, `
-usage: flynn ps
+usage: flynn ps [--stats]
 
 List flynn jobs.
 
+The number of jobs of each type which crashed after exceeding their memory limit
+is shown after the list.
+
+Options:
+	--stats  include the memory and CPU usage of each job
+
 Example:
 
 	$ flynn ps
@@ -21,6 +28,12 @@ Example:
 	flynn-bb97c7dac2fa455dad73459056fabac2  web
 	flynn-c59e02b3e6ad49809424848809d4749a  web
 	flynn-46f0d715a9684e4c822e248e84a5a418  web
+
+	$ flynn ps --stats
+	ID                                      TYPE  MEMORY               CPU
+	flynn-bb97c7dac2fa455dad73459056fabac2  web   24.1 MiB / 1.0 GiB   2.5%
+	flynn-c59e02b3e6ad49809424848809d4749a  web   23.8 MiB / 1.0 GiB   1.0%
+	flynn-46f0d715a9684e4c822e248e84a5a418  web   25.0 MiB / 1.0 GiB   0.0%
 `)
 }
 
@@ -34,23 +47,124 @@ func runPs(args *docopt.Args, client *controller.Client) error {
 	}
 	sort.Sort(jobsByType(jobs))
 
-	w := tabWriter()
-	defer w.Flush()
-
-	listRec(w, "ID", "TYPE")
+	var up []*ct.Job
+	var oom oomSummary
 	for _, j := range jobs {
 		if j.Type == "" {
 			j.Type = "run"
 		}
+		oom.add(j)
 		if j.State != "up" {
 			continue
 		}
-		listRec(w, j.ID, j.Type)
+		up = append(up, j)
 	}
 
+	defer oom.print()
+	w := tabWriter()
+	defer w.Flush()
+
+	if !args.Bool["--stats"] {
+		listRec(w, "ID", "TYPE")
+		for _, j := range up {
+			listRec(w, j.ID, j.Type)
+		}
+		return nil
+	}
+
+	type jobStats struct {
+		memory string
+		cpu    string
+	}
+	results := make([]chan jobStats, len(up))
+	for i, j := range up {
+		results[i] = make(chan jobStats, 1)
+		go func(id string, res chan jobStats) {
+			memory, cpu := sampleJobStats(client, id)
+			res <- jobStats{memory, cpu}
+		}(j.ID, results[i])
+	}
+
+	listRec(w, "ID", "TYPE", "MEMORY", "CPU")
+	for i, j := range up {
+		s := <-results[i]
+		listRec(w, j.ID, j.Type, s.memory, s.cpu)
+	}
 	return nil
 }
 
+// oomSummary counts the processes of each type killed for exceeding their
+// memory limit, which explains why a process type keeps crashing.
+type oomSummary struct {
+	types   []string
+	crashed map[string]int // jobs which crashed after an OOM kill
+	killed  map[string]int // OOM kills in running jobs
+}
+
+func (s *oomSummary) add(j *ct.Job) {
+	if j.State != "oom" && (j.State != "up" || j.OOMKills == 0) {
+		return
+	}
+	if s.crashed == nil {
+		s.crashed = make(map[string]int)
+		s.killed = make(map[string]int)
+	}
+	if s.crashed[j.Type] == 0 && s.killed[j.Type] == 0 {
+		s.types = append(s.types, j.Type)
+	}
+	if j.State == "oom" {
+		s.crashed[j.Type]++
+	} else {
+		s.killed[j.Type] += j.OOMKills
+	}
+}
+
+func (s *oomSummary) print() {
+	for _, typ := range s.types {
+		if n := s.crashed[typ]; n > 0 {
+			fmt.Printf("%d %s job(s) crashed after exceeding their memory limit\n", n, typ)
+		}
+		if n := s.killed[typ]; n > 0 {
+			fmt.Printf("%d process(es) in running %s jobs were killed for exceeding their memory limit\n", n, typ)
+		}
+	}
+}
+
+// sampleJobStats returns the memory usage of a job and its CPU usage between
+// the first two samples, or "-" if they are not available.
+func sampleJobStats(client *controller.Client, jobID string) (string, string) {
+	stream, err := client.StreamJobStats(mustApp(), jobID)
+	if err != nil {
+		return "-", "-"
+	}
+	defer stream.Close()
+
+	first, ok := <-stream.Stats
+	if !ok {
+		return "-", "-"
+	}
+	memory := fmt.Sprintf("%s / %s", formatBytes(first.MemoryUsage), formatBytes(first.MemoryLimit))
+	second, ok := <-stream.Stats
+	if !ok || !second.Time.After(first.Time) {
+		return memory, "-"
+	}
+	cpu := float64(second.CPUUsage-first.CPUUsage) / float64(second.Time.Sub(first.Time).Nanoseconds()) * 100
+	return memory, fmt.Sprintf("%.1f%%", cpu)
+}
+
+func formatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
 type jobsByType []*ct.Job
 
 func (p jobsByType) Len() int           { return len(p) }
@@ -5,6 +5,9 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"os"
+	"strconv"
+	"time"
 
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-docopt"
 	"github.com/flynn/flynn/controller/client"
@@ -13,15 +16,19 @@ import (
 
 func init() {
 	register("release", runRelease, `
-usage: flynn release add [-t <type>] [-f <file>] <uri>
+usage: flynn release [-n <limit>]
+       flynn release add [-t <type>] [-f <file>] <uri>
 
 Manage app releases.
 
 Options:
+	-n <limit>         maximum number of releases to list [default: 20]
 	-t <type>          type of the release. Currently only 'docker' is supported. [default: docker]
 	-f, --file <file>  release configuration file
 
 Commands:
+	With no arguments, lists the most recent releases of the app.
+
 	add   add a new release
 
 		Create a new release from a Docker image.
@@ -31,6 +38,10 @@ Commands:
 		release environment and processes (similar to a Procfile). It can take any
 		of the arguments the controller Release type can take.
 
+		If the release has a "release" process type, it is run as a one-off
+		job before the release is deployed, and the release is only deployed
+		if it succeeds. Its output is streamed to stdout.
+
 Examples:
 
 	Release an echo server using the flynn/slugbuilder image as a base, running socat.
@@ -60,7 +71,42 @@ func runRelease(args *docopt.Args, client *controller.Client) error {
 			return fmt.Errorf("Release type %s not supported.", args.String["-t"])
 		}
 	}
-	return fmt.Errorf("Top-level command not implemented.")
+	return runReleaseList(args, client)
+}
+
+func runReleaseList(args *docopt.Args, client *controller.Client) error {
+	limit, err := strconv.Atoi(args.String["-n"])
+	if err != nil || limit < 1 {
+		return fmt.Errorf("invalid limit %q", args.String["-n"])
+	}
+	// the controller caps the page size, so follow pages until the limit
+	var releases []*ct.Release
+	opts := &controller.ListOptions{}
+	for len(releases) < limit {
+		opts.Limit = limit - len(releases)
+		page, next, err := client.AppReleaseListPage(mustApp(), opts)
+		if err != nil {
+			return err
+		}
+		releases = append(releases, page...)
+		if next == "" {
+			break
+		}
+		opts.Cursor = next
+	}
+
+	w := tabWriter()
+	defer w.Flush()
+
+	listRec(w, "ID", "CREATED")
+	for _, r := range releases {
+		var created string
+		if r.CreatedAt != nil {
+			created = r.CreatedAt.Format(time.RFC3339)
+		}
+		listRec(w, r.ID, created)
+	}
+	return nil
 }
 
 func runReleaseAddDocker(args *docopt.Args, client *controller.Client) error {
@@ -83,12 +129,13 @@ func runReleaseAddDocker(args *docopt.Args, client *controller.Client) error {
 		return err
 	}
 
+	release.AppID = mustApp()
 	release.ArtifactID = artifact.ID
 	if err := client.CreateRelease(release); err != nil {
 		return err
 	}
 
-	if err := client.SetAppRelease(mustApp(), release.ID); err != nil {
+	if err := client.DeployAppRelease(mustApp(), release.ID, os.Stdout); err != nil {
 		return err
 	}
 
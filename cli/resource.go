@@ -12,11 +12,13 @@ import (
 func init() {
 	register("resource", runResource, `
 usage: flynn resource add <provider>
+       flynn resource remove <resource>
 
 Manage resources for the app.
 
 Commands:
-	add  provisions a new resource for the app using <provider>.
+	add     provisions a new resource for the app using <provider>.
+	remove  detaches <resource> from the app and removes its env.
 `)
 }
 
@@ -24,29 +26,37 @@ func runResource(args *docopt.Args, client *controller.Client) error {
 	if args.Bool["add"] {
 		return runResourceAdd(args, client)
 	}
+	if args.Bool["remove"] {
+		return runResourceRemove(args, client)
+	}
 	return fmt.Errorf("Top-level command not implemented.")
 }
 
 func runResourceAdd(args *docopt.Args, client *controller.Client) error {
 	provider := args.String["<provider>"]
 
-	res, err := client.ProvisionResource(&ct.ResourceReq{ProviderID: provider, Apps: []string{mustApp()}})
+	res, err := client.ProvisionResource(&ct.ResourceReq{ProviderID: provider})
 	if err != nil {
 		return err
 	}
-
-	env := make(map[string]*string)
-	for k, v := range res.Env {
-		s := v
-		env[k] = &s
+	if _, err := client.AttachResource(mustApp(), res.ID); err != nil {
+		return err
 	}
-
-	releaseID, err := setEnv(client, "", env)
+	release, err := client.GetAppRelease(mustApp())
 	if err != nil {
 		return err
 	}
 
-	log.Printf("Created resource %s and release %s.", res.ID, releaseID)
+	log.Printf("Created resource %s and release %s.", res.ID, release.ID)
 
 	return nil
 }
+
+func runResourceRemove(args *docopt.Args, client *controller.Client) error {
+	id := args.String["<resource>"]
+	if err := client.DetachResource(mustApp(), id); err != nil {
+		return err
+	}
+	log.Printf("Removed resource %s from %s.", id, mustApp())
+	return nil
+}
@@ -130,7 +130,7 @@ loop:
 			switch e.Job.State {
 			case "up":
 				current[e.Job.Type]++
-			case "down", "crashed":
+			case "down", "crashed", "oom":
 				current[e.Job.Type]--
 			}
 			if scalingComplete(current, processes) {
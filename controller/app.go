@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"log"
 	"regexp"
+	"time"
 
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-sql"
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/pq/hstore"
@@ -17,12 +18,18 @@ import (
 type AppRepo struct {
 	router        routerc.Client
 	defaultDomain string
+	resources     *ResourceRepo
+	logDrains     *LogDrainRepo
 
 	db *DB
 }
 
-func NewAppRepo(db *DB, defaultDomain string, router routerc.Client) *AppRepo {
-	return &AppRepo{db: db, defaultDomain: defaultDomain, router: router}
+// NewAppRepo returns a repo which deprovisions the resources which opted in to
+// it with resources when their last app is removed. If resources is nil the
+// resources of removed apps are only detached. The log drains of removed apps
+// are removed with logDrains if it is not nil.
+func NewAppRepo(db *DB, defaultDomain string, router routerc.Client, resources *ResourceRepo, logDrains *LogDrainRepo) *AppRepo {
+	return &AppRepo{db: db, defaultDomain: defaultDomain, router: router, resources: resources, logDrains: logDrains}
 }
 
 var appNamePattern = regexp.MustCompile(`^[a-z\d]+(-[a-z\d]+)*$`)
@@ -106,7 +113,9 @@ func (r *AppRepo) Get(id string) (interface{}, error) {
 	return selectApp(r.db, id, false)
 }
 
-func (r *AppRepo) Update(id string, data map[string]interface{}) (interface{}, error) {
+// Update updates the protected flag and metadata of an app if cond is met by
+// the app once it is locked.
+func (r *AppRepo) Update(id string, data map[string]interface{}, cond *precondition) (interface{}, error) {
 	tx, err := r.db.Begin()
 	if err != nil {
 		return nil, err
@@ -116,6 +125,10 @@ func (r *AppRepo) Update(id string, data map[string]interface{}) (interface{}, e
 		tx.Rollback()
 		return nil, err
 	}
+	if err := cond.check(app, nil); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
 
 	for k, v := range data {
 		switch k {
@@ -161,18 +174,25 @@ func (r *AppRepo) Update(id string, data map[string]interface{}) (interface{}, e
 }
 
 func (r *AppRepo) Remove(id string) error {
+	return r.RemoveIf(id, nil)
+}
+
+// RemoveIf removes an app if cond is met by the app once it is locked.
+func (r *AppRepo) RemoveIf(id string, cond *precondition) error {
 	tx, err := r.db.Begin()
 	if err != nil {
 		return err
 	}
 
-	if !idPattern.MatchString(id) {
-		app, err := selectApp(r.db, id, false)
-		if err != nil {
-			return err
-		}
-		id = app.ID
+	app, err := selectApp(tx, id, true)
+	if err == nil {
+		err = cond.check(app, nil)
 	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	id = app.ID
 	_, err = tx.Exec("UPDATE apps SET deleted_at = now() WHERE app_id = $1 AND deleted_at IS NULL", id)
 	if err != nil {
 		tx.Rollback()
@@ -184,36 +204,103 @@ func (r *AppRepo) Remove(id string) error {
 		tx.Rollback()
 		return err
 	}
-	_, err = tx.Exec("UPDATE app_resources SET deleted_at = now() WHERE app_id = $1 AND deleted_at IS NULL", id)
+	_, err = tx.Exec("UPDATE schedules SET deleted_at = now() WHERE app_id = $1 AND deleted_at IS NULL", id)
 	if err != nil {
 		tx.Rollback()
 		return err
 	}
-	return tx.Commit()
+	if r.logDrains != nil {
+		if err := r.logDrains.removeApp(tx, id); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	rows, err := tx.Query("UPDATE app_resources SET deleted_at = now() WHERE app_id = $1 AND deleted_at IS NULL RETURNING resource_id", id)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	var resourceIDs []string
+	for rows.Next() {
+		var resourceID string
+		if err := rows.Scan(&resourceID); err != nil {
+			rows.Close()
+			tx.Rollback()
+			return err
+		}
+		resourceIDs = append(resourceIDs, cleanUUID(resourceID))
+	}
+	if err := rows.Err(); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	if r.resources != nil {
+		r.resources.deprovisionUnused(resourceIDs)
+	}
+	return nil
 }
 
-func (r *AppRepo) List() (interface{}, error) {
-	rows, err := r.db.Query("SELECT app_id, name, protected, meta, created_at, updated_at FROM apps WHERE deleted_at IS NULL ORDER BY created_at DESC")
+func (r *AppRepo) List(opts *listOptions) (interface{}, string, error) {
+	if err := opts.checkFilters("name"); err != nil {
+		return nil, "", err
+	}
+	q := newListQuery("SELECT app_id, name, protected, meta, created_at, updated_at FROM apps WHERE deleted_at IS NULL", "app_id")
+	if name, ok := opts.filters["name"]; ok {
+		q.where("name = $%d", name)
+	}
+	query, args, err := q.build(opts)
 	if err != nil {
-		return nil, err
+		return nil, "", err
+	}
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return nil, "", err
 	}
 	apps := []*ct.App{}
 	for rows.Next() {
 		app, err := scanApp(rows)
 		if err != nil {
 			rows.Close()
-			return nil, err
+			return nil, "", err
 		}
 		apps = append(apps, app)
 	}
-	return apps, rows.Err()
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+	n, next := opts.page(len(apps), func(i int) (*time.Time, string) { return apps[i].CreatedAt, apps[i].ID })
+	return apps[:n], next, nil
 }
 
-func (r *AppRepo) SetRelease(appID string, releaseID string) error {
-	return r.db.Exec("UPDATE apps SET release_id = $2, updated_at = now() WHERE app_id = $1", appID, releaseID)
+// SetRelease makes releaseID the current release of an app if cond is met by
+// its current release once the app is locked.
+func (r *AppRepo) SetRelease(appID string, releaseID string, cond *precondition) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := selectApp(tx, appID, true); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := cond.check(scanRelease(tx.QueryRow(appReleaseQuery, appID))); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec("UPDATE apps SET release_id = $2, updated_at = now() WHERE app_id = $1", appID, releaseID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
 }
 
+const appReleaseQuery = "SELECT r.release_id, r.app_id, r.artifact_id, r.data, r.created_at FROM apps a JOIN releases r USING (release_id) WHERE a.app_id = $1"
+
 func (r *AppRepo) GetRelease(id string) (*ct.Release, error) {
-	row := r.db.QueryRow("SELECT r.release_id, r.artifact_id, r.data, r.created_at FROM apps a JOIN releases r USING (release_id) WHERE a.app_id = $1", id)
+	row := r.db.QueryRow(appReleaseQuery, id)
 	return scanRelease(row)
 }
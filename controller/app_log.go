@@ -0,0 +1,355 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/host/types"
+	"github.com/flynn/flynn/pkg/cluster"
+)
+
+var (
+	// appLogMergeDelay is how long a followed line is buffered before it is
+	// sent, so that lines arriving from different hosts at slightly different
+	// times are sent in timestamp order.
+	appLogMergeDelay = 500 * time.Millisecond
+
+	// appLogPollInterval is how often the cluster is checked for new jobs of
+	// the app while following.
+	appLogPollInterval = 2 * time.Second
+)
+
+// appLogOptions are the query parameters of GET /apps/:apps_id/log.
+type appLogOptions struct {
+	processType string
+	jobID       string
+	lines       int // the number of previous lines to send, -1 sends all of them
+	follow      bool
+}
+
+func (o *appLogOptions) match(hostID string, job *host.Job, appID string) bool {
+	if job.Metadata["flynn-controller.app"] != appID {
+		return false
+	}
+	if o.processType != "" && job.Metadata["flynn-controller.type"] != o.processType {
+		return false
+	}
+	return o.jobID == "" || o.jobID == hostID+"-"+job.ID
+}
+
+// appLogLine is a line received from one of the job log streams.
+type appLogLine struct {
+	*ct.LogLine
+	history  bool // written before the request was made
+	received time.Time
+}
+
+type sortLogLines []*appLogLine
+
+func (s sortLogLines) Len() int           { return len(s) }
+func (s sortLogLines) Less(i, j int) bool { return s[i].Timestamp.Before(s[j].Timestamp) }
+func (s sortLogLines) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// appLogStreamer fans in the logs of the jobs of an app.
+type appLogStreamer struct {
+	cl    clusterClient
+	app   *ct.App
+	opts  *appLogOptions
+	start time.Time
+
+	// lines receives the lines of all jobs when following, otherwise
+	// sources receives the lines of each job
+	lines   chan *appLogLine
+	sources []chan *appLogLine
+	done    chan struct{}
+	wg      sync.WaitGroup
+
+	mtx     sync.Mutex
+	hosts   map[string]cluster.Host
+	streams map[string]cluster.Stream // full job ID -> log stream
+}
+
+// update starts streaming the logs of jobs which match the request and are
+// not already being streamed. Jobs found after the initial update started
+// after the request was made, so all of their output is sent.
+func (s *appLogStreamer) update(initial bool) error {
+	hosts, err := s.cl.ListHosts()
+	if err != nil {
+		return err
+	}
+	for hostID, h := range hosts {
+		for _, job := range h.Jobs {
+			id := hostID + "-" + job.ID
+			s.mtx.Lock()
+			_, ok := s.streams[id]
+			s.mtx.Unlock()
+			if ok || !s.opts.match(hostID, job, s.app.ID) {
+				continue
+			}
+			hc, err := s.dialHost(hostID)
+			if err != nil {
+				return err
+			}
+			req := &host.LogReq{JobID: job.ID, Lines: -1, Follow: s.opts.follow}
+			if initial {
+				req.Lines = s.opts.lines
+			}
+			ch := make(chan *host.LogLine)
+			stream := hc.StreamLog(req, ch)
+			s.mtx.Lock()
+			s.streams[id] = stream
+			s.mtx.Unlock()
+			out := s.lines
+			if !s.opts.follow {
+				out = make(chan *appLogLine)
+				s.sources = append(s.sources, out)
+			}
+			s.wg.Add(1)
+			go s.forward(id, job.Metadata["flynn-controller.type"], initial, ch, out)
+		}
+	}
+	return nil
+}
+
+func (s *appLogStreamer) dialHost(id string) (cluster.Host, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if hc, ok := s.hosts[id]; ok {
+		return hc, nil
+	}
+	hc, err := s.cl.DialHost(id)
+	if err != nil {
+		return nil, err
+	}
+	s.hosts[id] = hc
+	return hc, nil
+}
+
+func (s *appLogStreamer) forward(jobID, typ string, initial bool, ch chan *host.LogLine, out chan *appLogLine) {
+	defer s.wg.Done()
+	if !s.opts.follow {
+		// out is only shared by the jobs when following
+		defer close(out)
+	}
+	for l := range ch {
+		line := &appLogLine{
+			LogLine: &ct.LogLine{
+				JobID:       jobID,
+				ProcessType: typ,
+				Stream:      "stdout",
+				Timestamp:   l.Timestamp,
+				Message:     l.Message,
+			},
+			history:  initial && l.Timestamp.Before(s.start),
+			received: time.Now(),
+		}
+		if l.Stream == 2 {
+			line.Stream = "stderr"
+		}
+		select {
+		case out <- line:
+		case <-s.done:
+			// drain the channel so the stream can be closed
+			for range ch {
+			}
+			return
+		}
+	}
+}
+
+func (s *appLogStreamer) close() {
+	close(s.done)
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for _, stream := range s.streams {
+		stream.Close()
+	}
+	for _, hc := range s.hosts {
+		hc.Close()
+	}
+}
+
+// mergeLogLines calls send with the lines received from sources, which are
+// each in timestamp order, in timestamp order. It only holds one line of each
+// source at a time.
+func mergeLogLines(sources []chan *appLogLine, send func(*appLogLine) error) error {
+	heads := make([]*appLogLine, len(sources))
+	for {
+		next := -1
+		for i, src := range sources {
+			if heads[i] == nil && src != nil {
+				line, ok := <-src
+				if !ok {
+					sources[i] = nil
+					continue
+				}
+				heads[i] = line
+			}
+			if heads[i] != nil && (next == -1 || heads[i].Timestamp.Before(heads[next].Timestamp)) {
+				next = i
+			}
+		}
+		if next == -1 {
+			return nil
+		}
+		if err := send(heads[next]); err != nil {
+			return err
+		}
+		heads[next] = nil
+	}
+}
+
+// tailLines returns the last n lines in timestamp order, or all of them if n
+// is -1.
+func tailLines(lines []*appLogLine, n int) []*appLogLine {
+	sort.Stable(sortLogLines(lines))
+	if n >= 0 && len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return lines
+}
+
+func writeLogLine(w http.ResponseWriter, line *ct.LogLine) error {
+	if _, err := w.Write([]byte("data: ")); err != nil {
+		return err
+	}
+	if err := json.NewEncoder(w).Encode(line); err != nil {
+		return err
+	}
+	_, err := w.Write([]byte("\n"))
+	return err
+}
+
+// appLog streams the logs of the running jobs of an app, merged in timestamp
+// order, as server-sent events.
+func appLog(req *http.Request, app *ct.App, cl clusterClient, w http.ResponseWriter, r ResponseHelper) {
+	opts := &appLogOptions{
+		processType: req.FormValue("process_type"),
+		jobID:       req.FormValue("job_id"),
+		lines:       -1,
+		follow:      req.FormValue("follow") != "",
+	}
+	if s := req.FormValue("lines"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			r.Error(ct.ValidationError{Field: "lines", Message: "must be a non-negative integer"})
+			return
+		}
+		opts.lines = n
+	}
+
+	s := &appLogStreamer{
+		cl:      cl,
+		app:     app,
+		opts:    opts,
+		start:   time.Now(),
+		lines:   make(chan *appLogLine),
+		done:    make(chan struct{}),
+		hosts:   make(map[string]cluster.Host),
+		streams: make(map[string]cluster.Stream),
+	}
+	if err := s.update(true); err != nil {
+		s.close()
+		r.Error(err)
+		return
+	}
+	defer s.close()
+
+	w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+	w.WriteHeader(200)
+	w.(http.Flusher).Flush()
+
+	if !opts.follow {
+		// all lines are written as they are merged, the last n lines are
+		// kept until every job has sent its lines
+		var last []*appLogLine
+		err := mergeLogLines(s.sources, func(line *appLogLine) error {
+			if opts.lines == -1 {
+				return writeLogLine(w, line.LogLine)
+			}
+			last = append(last, line)
+			if len(last) > opts.lines {
+				last = last[1:]
+			}
+			return nil
+		})
+		if err != nil {
+			return
+		}
+		for _, line := range last {
+			if err := writeLogLine(w, line.LogLine); err != nil {
+				return
+			}
+		}
+		w.Write([]byte("event: eof\ndata: {}\n\n"))
+		return
+	}
+
+	var closed <-chan bool
+	if cn, ok := w.(http.CloseNotifier); ok {
+		closed = cn.CloseNotify()
+	}
+	ticker := time.NewTicker(appLogMergeDelay / 5)
+	defer ticker.Stop()
+	poll := time.NewTicker(appLogPollInterval)
+	defer poll.Stop()
+
+	// history holds lines written before the request until they are all
+	// received, pending holds followed lines until appLogMergeDelay passes.
+	var history, pending []*appLogLine
+	historySent := false
+	lastReceived := time.Now()
+	for {
+		select {
+		case line := <-s.lines:
+			lastReceived = line.received
+			if line.history && !historySent {
+				history = append(history, line)
+			} else {
+				pending = append(pending, line)
+			}
+			continue
+		case <-ticker.C:
+		case <-poll.C:
+			// hosts may be unavailable for a moment, so errors are ignored
+			// and the next poll tries again
+			s.update(false)
+			continue
+		case <-closed:
+			return
+		}
+
+		cutoff := time.Now().Add(-appLogMergeDelay)
+		var send []*appLogLine
+		if !historySent {
+			// the history is complete once the streams go quiet or a
+			// followed line has been waiting for the full delay
+			if lastReceived.After(cutoff) && (len(pending) == 0 || pending[0].received.After(cutoff)) {
+				continue
+			}
+			send = tailLines(history, opts.lines)
+			history = nil
+			historySent = true
+		}
+		sort.Stable(sortLogLines(pending))
+		n := 0
+		for ; n < len(pending) && !pending[n].received.After(cutoff); n++ {
+		}
+		send = append(send, pending[:n]...)
+		pending = pending[n:]
+		if len(send) == 0 {
+			continue
+		}
+		for _, line := range send {
+			if err := writeLogLine(w, line.LogLine); err != nil {
+				return
+			}
+		}
+		w.(http.Flusher).Flush()
+	}
+}
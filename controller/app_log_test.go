@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	. "github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-check"
+	tu "github.com/flynn/flynn/controller/testutils"
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/host/types"
+	"github.com/flynn/flynn/pkg/random"
+	"github.com/flynn/flynn/pkg/sse"
+)
+
+func (s *S) readAppLog(c *C, appID, query string) []*ct.LogLine {
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s/apps/%s/log?%s", s.srv.URL, appID, query), nil)
+	c.Assert(err, IsNil)
+	req.SetBasicAuth("", authKey)
+	req.Header.Set("Accept", "text/event-stream")
+	res, err := http.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	defer res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 200)
+
+	var lines []*ct.LogLine
+	dec := sse.NewDecoder(bufio.NewReader(res.Body))
+	for {
+		line := &ct.LogLine{}
+		if err := dec.Decode(line); err == io.EOF {
+			break
+		} else {
+			c.Assert(err, IsNil)
+		}
+		if line.JobID != "" { // eof event
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+func (s *S) TestAppLog(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "app-log"})
+	other := s.createTestApp(c, &ct.App{Name: "app-log-other"})
+
+	newJob := func(appID, typ string) *host.Job {
+		return &host.Job{ID: random.UUID(), Metadata: map[string]string{
+			"flynn-controller.app":  appID,
+			"flynn-controller.type": typ,
+		}}
+	}
+	host1, host2 := random.UUID(), random.UUID()
+	web, worker, otherWeb := newJob(app.ID, "web"), newJob(app.ID, "worker"), newJob(other.ID, "web")
+	s.cc.SetHosts(map[string]host.Host{
+		host1: {ID: host1, Jobs: []*host.Job{web, otherWeb}},
+		host2: {ID: host2, Jobs: []*host.Job{worker}},
+	})
+
+	now := time.Now().UTC().Add(-time.Minute)
+	line := func(job *host.Job, stream, offset int, msg string) *host.LogLine {
+		return &host.LogLine{JobID: job.ID, Stream: stream, Timestamp: now.Add(time.Duration(offset) * time.Second), Message: msg}
+	}
+	hc1, hc2 := tu.NewFakeHostClient(host1), tu.NewFakeHostClient(host2)
+	hc1.SetLog(web.ID, []*host.LogLine{line(web, 1, 0, "web 1\n"), line(web, 2, 2, "web 2\n")})
+	hc1.SetLog(otherWeb.ID, []*host.LogLine{line(otherWeb, 1, 1, "other\n")})
+	hc2.SetLog(worker.ID, []*host.LogLine{line(worker, 1, 1, "worker 1\n"), line(worker, 1, 3, "worker 2\n")})
+	s.cc.SetHostClient(host1, hc1)
+	s.cc.SetHostClient(host2, hc2)
+
+	messages := func(lines []*ct.LogLine) []string {
+		res := make([]string, len(lines))
+		for i, l := range lines {
+			res[i] = l.Message
+		}
+		return res
+	}
+
+	lines := s.readAppLog(c, app.ID, "")
+	c.Assert(messages(lines), DeepEquals, []string{"web 1\n", "worker 1\n", "web 2\n", "worker 2\n"})
+	c.Assert(lines[0].JobID, Equals, host1+"-"+web.ID)
+	c.Assert(lines[0].ProcessType, Equals, "web")
+	c.Assert(lines[0].Stream, Equals, "stdout")
+	c.Assert(lines[2].Stream, Equals, "stderr")
+
+	c.Assert(messages(s.readAppLog(c, app.ID, "lines=2")), DeepEquals, []string{"web 2\n", "worker 2\n"})
+	c.Assert(messages(s.readAppLog(c, app.ID, "process_type=worker")), DeepEquals, []string{"worker 1\n", "worker 2\n"})
+	c.Assert(messages(s.readAppLog(c, app.ID, "job_id="+host1+"-"+web.ID)), DeepEquals, []string{"web 1\n", "web 2\n"})
+
+	res, _ := s.Get("/apps/"+app.ID+"/log?lines=foo", &struct{}{})
+	c.Assert(res.StatusCode, Equals, 400)
+}
+
+func (s *S) TestAppLogFollow(c *C) {
+	defer func(delay, interval time.Duration) {
+		appLogMergeDelay, appLogPollInterval = delay, interval
+	}(appLogMergeDelay, appLogPollInterval)
+	appLogMergeDelay, appLogPollInterval = 50*time.Millisecond, 100*time.Millisecond
+
+	app := s.createTestApp(c, &ct.App{Name: "app-log-follow"})
+	newJob := func(typ string) *host.Job {
+		return &host.Job{ID: random.UUID(), Metadata: map[string]string{
+			"flynn-controller.app":  app.ID,
+			"flynn-controller.type": typ,
+		}}
+	}
+	hostID := random.UUID()
+	web := newJob("web")
+	s.cc.SetHosts(map[string]host.Host{hostID: {ID: hostID, Jobs: []*host.Job{web}}})
+
+	now := time.Now().UTC().Add(-time.Minute)
+	line := func(job *host.Job, offset int, msg string) *host.LogLine {
+		return &host.LogLine{JobID: job.ID, Stream: 1, Timestamp: now.Add(time.Duration(offset) * time.Second), Message: msg}
+	}
+	follow := make(chan *host.LogLine)
+	hc := tu.NewFakeHostClient(hostID)
+	hc.SetLog(web.ID, []*host.LogLine{line(web, 0, "web 1\n"), line(web, 1, "web 2\n"), line(web, 2, "web 3\n")})
+	hc.SetLogFollow(web.ID, follow)
+	s.cc.SetHostClient(hostID, hc)
+
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s/apps/%s/log?follow=true&lines=2", s.srv.URL, app.ID), nil)
+	c.Assert(err, IsNil)
+	req.SetBasicAuth("", authKey)
+	req.Header.Set("Accept", "text/event-stream")
+	res, err := http.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	defer res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 200)
+
+	lines := make(chan *ct.LogLine)
+	go func() {
+		defer close(lines)
+		dec := sse.NewDecoder(bufio.NewReader(res.Body))
+		for {
+			line := &ct.LogLine{}
+			if err := dec.Decode(line); err != nil {
+				return
+			}
+			lines <- line
+		}
+	}()
+	expect := func(msg string) {
+		select {
+		case line, ok := <-lines:
+			c.Assert(ok, Equals, true)
+			c.Assert(line.Message, Equals, msg)
+		case <-time.After(5 * time.Second):
+			c.Fatalf("timed out waiting for log line %q", msg)
+		}
+	}
+
+	// the history is limited to the last lines
+	expect("web 2\n")
+	expect("web 3\n")
+
+	// lines written after the request are streamed
+	follow <- line(web, 3, "web 4\n")
+	expect("web 4\n")
+
+	// the output of new jobs is streamed once they are found
+	worker := newJob("worker")
+	hc.SetLog(worker.ID, []*host.LogLine{line(worker, 4, "worker 1\n")})
+	_, err = s.cc.AddJobs(&host.AddJobsReq{HostJobs: map[string][]*host.Job{hostID: {worker}}})
+	c.Assert(err, IsNil)
+	expect("worker 1\n")
+}
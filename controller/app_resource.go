@@ -0,0 +1,123 @@
+package main
+
+import (
+	"reflect"
+
+	ct "github.com/flynn/flynn/controller/types"
+)
+
+// attachResource attaches a resource to an app and deploys a new release of
+// the app which has the env of the resource.
+func attachResource(app *ct.App, resource *ct.Resource, resources *ResourceRepo, apps *AppRepo, releases *ReleaseRepo, artifacts *ArtifactRepo, formations *FormationRepo, r ResponseHelper) {
+	if err := resources.AddApp(resource.ID, app.ID); err != nil {
+		r.Error(err)
+		return
+	}
+	err := updateAppEnv(app, apps, releases, artifacts, formations, func(env map[string]string) {
+		for k, v := range resource.Env {
+			env[k] = v
+		}
+	})
+	if err != nil {
+		r.Error(err)
+		return
+	}
+	res, err := resources.Get(resource.ID)
+	if err != nil {
+		r.Error(err)
+		return
+	}
+	r.JSON(200, res)
+}
+
+// detachResource detaches a resource from an app and deploys a new release of
+// the app without the env of the resource. Variables which were changed since
+// the resource was attached or which are also set by another resource of the
+// app are kept, so that attaching a new resource and then detaching the old
+// one rotates its credentials.
+func detachResource(app *ct.App, resource *ct.Resource, resources *ResourceRepo, apps *AppRepo, releases *ReleaseRepo, artifacts *ArtifactRepo, formations *FormationRepo, r ResponseHelper) {
+	var attached bool
+	for _, id := range resource.Apps {
+		if id == app.ID {
+			attached = true
+			break
+		}
+	}
+	if !attached {
+		r.Error(ErrNotFound)
+		return
+	}
+	if err := resources.RemoveApp(resource.ID, app.ID); err != nil {
+		r.Error(err)
+		return
+	}
+	// variables the app still gets from other resources are kept
+	remaining, _, err := resources.AppList(app.ID, &listOptions{})
+	if err != nil {
+		r.Error(err)
+		return
+	}
+	err = updateAppEnv(app, apps, releases, artifacts, formations, func(env map[string]string) {
+	outer:
+		for k, v := range resource.Env {
+			if env[k] != v {
+				continue
+			}
+			for _, other := range remaining {
+				if other.Env[k] == v {
+					continue outer
+				}
+			}
+			delete(env, k)
+		}
+	})
+	if err != nil {
+		r.Error(err)
+		return
+	}
+	res, err := resources.Get(resource.ID)
+	if err != nil {
+		r.Error(err)
+		return
+	}
+	r.JSON(200, res)
+}
+
+// updateAppEnv deploys a copy of the current release of app with the env
+// changed by update. Nothing is deployed if the env is unchanged.
+func updateAppEnv(app *ct.App, apps *AppRepo, releases *ReleaseRepo, artifacts *ArtifactRepo, formations *FormationRepo, update func(map[string]string)) error {
+	release, err := apps.GetRelease(app.ID)
+	if err == ErrNotFound {
+		release = &ct.Release{}
+	} else if err != nil {
+		return err
+	}
+
+	env := make(map[string]string, len(release.Env))
+	for k, v := range release.Env {
+		env[k] = v
+	}
+	update(env)
+	if len(env) == 0 && len(release.Env) == 0 || reflect.DeepEqual(env, release.Env) {
+		return nil
+	}
+
+	newRelease := *release
+	newRelease.ID = ""
+	newRelease.AppID = app.ID
+	newRelease.CreatedAt = nil
+	newRelease.Env = env
+	if newRelease.ArtifactID == "" {
+		// the app has no release yet, so create one with an empty artifact
+		// like `flynn env set` does
+		artifact := &ct.Artifact{}
+		if err := artifacts.Add(artifact); err != nil {
+			return err
+		}
+		newRelease.ArtifactID = artifact.ID
+	}
+	if err := releases.Add(&newRelease); err != nil {
+		return err
+	}
+	return deployRelease(app, &newRelease, nil, apps, releases, formations)
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"time"
+
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-sql"
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/pq"
 	ct "github.com/flynn/flynn/controller/types"
@@ -21,10 +23,37 @@ func (r *ArtifactRepo) Add(data interface{}) error {
 	if a.ID == "" {
 		a.ID = random.UUID()
 	}
-	err := r.db.QueryRow("INSERT INTO artifacts (artifact_id, type, uri) VALUES ($1, $2, $3) RETURNING created_at",
+
+	// an artifact with the same URI is returned instead of adding another,
+	// and restored if it was garbage collected
+	var id string
+	var deleted bool
+	err := r.db.QueryRow("SELECT artifact_id, created_at, deleted_at IS NOT NULL FROM artifacts WHERE type = $1 AND uri = $2 ORDER BY deleted_at DESC NULLS FIRST LIMIT 1",
+		a.Type, a.URI).Scan(&id, &a.CreatedAt, &deleted)
+	switch {
+	case err == sql.ErrNoRows:
+	case err != nil:
+		return err
+	case deleted:
+		err = r.db.QueryRow("UPDATE artifacts SET deleted_at = NULL WHERE artifact_id = $1 RETURNING created_at", id).Scan(&a.CreatedAt)
+		if err == nil {
+			a.ID = cleanUUID(id)
+			return nil
+		}
+		// the artifact was added again concurrently, which the insert
+		// below finds
+		if e, ok := err.(*pq.Error); !ok || e.Code.Name() != "unique_violation" {
+			return err
+		}
+	default:
+		a.ID = cleanUUID(id)
+		return nil
+	}
+
+	err = r.db.QueryRow("INSERT INTO artifacts (artifact_id, type, uri) VALUES ($1, $2, $3) RETURNING created_at",
 		a.ID, a.Type, a.URI).Scan(&a.CreatedAt)
 	if e, ok := err.(*pq.Error); ok && e.Code.Name() == "unique_violation" {
-		err = r.db.QueryRow("SELECT artifact_id, created_at FROM artifacts WHERE type = $1 AND uri = $2",
+		err = r.db.QueryRow("SELECT artifact_id, created_at FROM artifacts WHERE type = $1 AND uri = $2 AND deleted_at IS NULL",
 			a.Type, a.URI).Scan(&a.ID, &a.CreatedAt)
 		if err != nil {
 			return err
@@ -49,19 +78,40 @@ func (r *ArtifactRepo) Get(id string) (interface{}, error) {
 	return scanArtifact(row)
 }
 
-func (r *ArtifactRepo) List() (interface{}, error) {
-	rows, err := r.db.Query("SELECT artifact_id, type, uri, created_at FROM artifacts WHERE deleted_at IS NULL ORDER BY created_at DESC")
+func (r *ArtifactRepo) List(opts *listOptions) (interface{}, string, error) {
+	if err := opts.checkFilters("type", "app"); err != nil {
+		return nil, "", err
+	}
+	q := newListQuery("SELECT artifact_id, type, uri, created_at FROM artifacts WHERE deleted_at IS NULL", "artifact_id")
+	if typ, ok := opts.filters["type"]; ok {
+		q.where("type = $%d", typ)
+	}
+	if appID, ok := opts.filters["app"]; ok {
+		if !idPattern.MatchString(appID) {
+			return nil, "", ct.ValidationError{Field: "app", Message: "is invalid"}
+		}
+		q.where("artifact_id IN (SELECT artifact_id FROM releases WHERE app_id = $%d AND deleted_at IS NULL)", appID)
+	}
+	query, args, err := q.build(opts)
 	if err != nil {
-		return nil, err
+		return nil, "", err
+	}
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return nil, "", err
 	}
 	artifacts := []*ct.Artifact{}
 	for rows.Next() {
 		artifact, err := scanArtifact(rows)
 		if err != nil {
 			rows.Close()
-			return nil, err
+			return nil, "", err
 		}
 		artifacts = append(artifacts, artifact)
 	}
-	return artifacts, nil
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+	n, next := opts.page(len(artifacts), func(i int) (*time.Time, string) { return artifacts[i].CreatedAt, artifacts[i].ID })
+	return artifacts[:n], next, nil
 }
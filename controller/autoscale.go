@@ -0,0 +1,451 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-sql"
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/pq"
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/discoverd/client"
+	"github.com/flynn/flynn/host/types"
+	routerc "github.com/flynn/flynn/router/client"
+	"github.com/flynn/flynn/router/types"
+)
+
+const (
+	// autoscaleInterval is how often the metrics of autoscaled process types
+	// are sampled. The metrics are averaged over the time between samples.
+	autoscaleInterval = 30 * time.Second
+
+	// autoscaleTolerance is how far the metric may be from its target, as a
+	// fraction of the target, before the count is changed.
+	autoscaleTolerance = 0.1
+
+	defaultScaleUpCooldown   = time.Minute
+	defaultScaleDownCooldown = 5 * time.Minute
+)
+
+type AutoscaleRepo struct {
+	db         *DB
+	apps       *AppRepo
+	releases   *ReleaseRepo
+	formations *FormationRepo
+	cluster    clusterClient
+
+	// routerStats returns the request counters of a router service.
+	routerStats func(service string) (*router.ServiceStats, error)
+}
+
+func NewAutoscaleRepo(db *DB, apps *AppRepo, releases *ReleaseRepo, formations *FormationRepo, cluster clusterClient, routerStats func(string) (*router.ServiceStats, error)) *AutoscaleRepo {
+	return &AutoscaleRepo{db: db, apps: apps, releases: releases, formations: formations, cluster: cluster, routerStats: routerStats}
+}
+
+// clusterRouterStats returns the request counters of a service summed across
+// all the routers of the cluster, as each router only counts the requests
+// which it proxies.
+func clusterRouterStats(dc *discoverd.Client) func(string) (*router.ServiceStats, error) {
+	return func(service string) (*router.ServiceStats, error) {
+		routers, err := dc.Services("router-api", 5*time.Second)
+		if err != nil {
+			return nil, err
+		}
+		res := &router.ServiceStats{Service: service}
+		for _, r := range routers {
+			stats, err := routerc.NewWithAddr(r.Addr).ServiceStats(service)
+			if err != nil {
+				return nil, err
+			}
+			res.Requests += stats.Requests
+			res.ResponseTime += stats.ResponseTime
+		}
+		return res, nil
+	}
+}
+
+// validateAutoscale checks the autoscale configuration of a formation.
+func validateAutoscale(release *ct.Release, f *ct.Formation) error {
+	for typ, conf := range f.Autoscale {
+		field := "autoscale." + typ
+		if _, ok := release.Processes[typ]; !ok {
+			return ct.ValidationError{Field: field, Message: "is not a process type of the release"}
+		}
+		if conf == nil {
+			return ct.ValidationError{Field: field, Message: "must not be null"}
+		}
+		// a process type without jobs has no metrics to be scaled up by
+		if conf.Min < 1 || conf.Min > conf.Max {
+			return ct.ValidationError{Field: field, Message: "must have 1 <= min <= max"}
+		}
+		switch conf.Metric {
+		case ct.AutoscaleRequests, ct.AutoscaleLatency, ct.AutoscaleCPU:
+		default:
+			return ct.ValidationError{Field: field + ".metric", Message: fmt.Sprintf("must be %s, %s or %s", ct.AutoscaleRequests, ct.AutoscaleLatency, ct.AutoscaleCPU)}
+		}
+		if conf.Target <= 0 {
+			return ct.ValidationError{Field: field + ".target", Message: "must be positive"}
+		}
+		if conf.ScaleUpCooldown < 0 || conf.ScaleDownCooldown < 0 {
+			return ct.ValidationError{Field: field, Message: "cooldowns must not be negative"}
+		}
+	}
+	return nil
+}
+
+// start periodically adjusts the counts of autoscaled process types.
+func (r *AutoscaleRepo) start() {
+	go func() {
+		for {
+			if err := r.autoscale(time.Now()); err != nil {
+				log.Printf("Error autoscaling formations: %s", err)
+			}
+			time.Sleep(autoscaleInterval)
+		}
+	}()
+}
+
+// autoscale samples the metrics of all autoscaled process types at now, and
+// scales those whose metric has moved away from its target.
+func (r *AutoscaleRepo) autoscale(now time.Time) error {
+	rows, err := r.db.Query("SELECT " + formationColumns + " FROM formations WHERE autoscale IS NOT NULL AND deleted_at IS NULL")
+	if err != nil {
+		return err
+	}
+	var formations []*ct.Formation
+	for rows.Next() {
+		f, err := scanFormation(rows)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		formations = append(formations, f)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, f := range formations {
+		for typ, conf := range f.Autoscale {
+			if err := r.scale(f, typ, conf, now); err != nil {
+				log.Printf("Error autoscaling %s processes of app %s: %s", typ, f.AppID, err)
+			}
+		}
+	}
+	return nil
+}
+
+// autoscaleSample is a sample of the cumulative counters which the metrics
+// of a process type are computed from.
+type autoscaleSample struct {
+	Requests     uint64            `json:"requests,omitempty"`
+	ResponseTime uint64            `json:"response_time,omitempty"`
+	CPUUsage     map[string]uint64 `json:"cpu_usage,omitempty"` // by job ID
+}
+
+func (r *AutoscaleRepo) scale(f *ct.Formation, typ string, conf *ct.AutoscaleConfig, now time.Time) error {
+	data, err := r.apps.Get(f.AppID)
+	if err != nil {
+		return err
+	}
+	app := data.(*ct.App)
+	data, err = r.releases.Get(f.ReleaseID)
+	if err != nil {
+		return err
+	}
+	// the configuration may have been copied to a release without the type
+	if _, ok := data.(*ct.Release).Processes[typ]; !ok {
+		return nil
+	}
+
+	sample, err := r.sample(app, f, typ, conf)
+	if err != nil {
+		return err
+	}
+	prev, prevAt, err := r.swapSample(f, typ, sample, now)
+	if err != nil || prev == nil {
+		return err
+	}
+	current := f.Processes[typ]
+	value, ok := autoscaleMetric(conf.Metric, prev, sample, now.Sub(prevAt), current)
+	if !ok {
+		return nil
+	}
+	count := autoscaleCount(conf, current, value)
+	if count == current {
+		return nil
+	}
+
+	cooldown := time.Duration(conf.ScaleUpCooldown) * time.Second
+	if cooldown == 0 {
+		cooldown = defaultScaleUpCooldown
+	}
+	if count < current {
+		cooldown = time.Duration(conf.ScaleDownCooldown) * time.Second
+		if cooldown == 0 {
+			cooldown = defaultScaleDownCooldown
+		}
+	}
+	var last time.Time
+	err = r.db.QueryRow("SELECT created_at FROM autoscale_decisions WHERE app_id = $1 AND process_type = $2 ORDER BY created_at DESC LIMIT 1", f.AppID, typ).Scan(&last)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if err == nil && now.Sub(last) < cooldown {
+		return nil
+	}
+
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE formations SET processes = COALESCE(processes, ''::hstore) || hstore($3, $4), updated_at = now() WHERE app_id = $1 AND release_id = $2 AND deleted_at IS NULL",
+		f.AppID, f.ReleaseID, typ, fmt.Sprint(count)); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec("INSERT INTO autoscale_decisions (app_id, release_id, process_type, metric, value, target, previous_count, count, created_at) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)",
+		f.AppID, f.ReleaseID, typ, conf.Metric, value, conf.Target, current, count, now); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// sample reads the counters of the metric of a process type.
+func (r *AutoscaleRepo) sample(app *ct.App, f *ct.Formation, typ string, conf *ct.AutoscaleConfig) (*autoscaleSample, error) {
+	if conf.Metric != ct.AutoscaleCPU {
+		service := conf.Service
+		if service == "" {
+			service = app.Name + "-" + typ
+		}
+		stats, err := r.routerStats(service)
+		if err != nil {
+			return nil, err
+		}
+		return &autoscaleSample{Requests: stats.Requests, ResponseTime: stats.ResponseTime}, nil
+	}
+
+	rows, err := r.db.Query("SELECT host_id, job_id FROM job_cache WHERE app_id = $1 AND release_id = $2 AND process_type = $3 AND state = 'up'", f.AppID, f.ReleaseID, typ)
+	if err != nil {
+		return nil, err
+	}
+	type job struct{ hostID, jobID string }
+	var jobs []job
+	for rows.Next() {
+		var j job
+		if err := rows.Scan(&j.hostID, &j.jobID); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		jobs = append(jobs, j)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	s := &autoscaleSample{CPUUsage: make(map[string]uint64, len(jobs))}
+	for _, j := range jobs {
+		usage, err := r.cpuUsage(j.hostID, j.jobID)
+		if err != nil {
+			// the job may have just stopped
+			continue
+		}
+		s.CPUUsage[j.hostID+"-"+j.jobID] = usage
+	}
+	return s, nil
+}
+
+// cpuUsage returns the total CPU time used by a running job in nanoseconds.
+func (r *AutoscaleRepo) cpuUsage(hostID, jobID string) (uint64, error) {
+	client, err := r.cluster.DialHost(hostID)
+	if err != nil {
+		return 0, err
+	}
+	defer client.Close()
+	ch := make(chan *host.JobStats)
+	stream := client.JobStats(jobID, ch)
+	defer func() {
+		stream.Close()
+		// drain channel to prevent deadlock
+		go func() {
+			for range ch {
+			}
+		}()
+	}()
+	stats, ok := <-ch
+	if !ok {
+		if err := stream.Err(); err != nil {
+			return 0, err
+		}
+		return 0, ErrNotFound
+	}
+	return stats.CPUUsage, nil
+}
+
+// swapSample stores the sample of a process type taken at now, and returns
+// the previous one and when it was taken. The previous sample is nil if there
+// is none, or if another controller has taken a sample within the last half
+// interval, in which case the process type is left to it.
+func (r *AutoscaleRepo) swapSample(f *ct.Formation, typ string, s *autoscaleSample, now time.Time) (*autoscaleSample, time.Time, error) {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	var prevData string
+	var prevAt time.Time
+	err = r.db.QueryRow("SELECT data, sampled_at FROM autoscale_samples WHERE app_id = $1 AND release_id = $2 AND process_type = $3", f.AppID, f.ReleaseID, typ).Scan(&prevData, &prevAt)
+	if err == sql.ErrNoRows {
+		err = r.db.Exec("INSERT INTO autoscale_samples (app_id, release_id, process_type, data, sampled_at) VALUES ($1, $2, $3, $4, $5)", f.AppID, f.ReleaseID, typ, string(data), now)
+		if e, ok := err.(*pq.Error); ok && e.Code.Name() == "unique_violation" {
+			err = nil
+		}
+		return nil, time.Time{}, err
+	} else if err != nil {
+		return nil, time.Time{}, err
+	}
+	if now.Sub(prevAt) < autoscaleInterval/2 {
+		return nil, time.Time{}, nil
+	}
+	var id string
+	err = r.db.QueryRow("UPDATE autoscale_samples SET data = $4, sampled_at = $5 WHERE app_id = $1 AND release_id = $2 AND process_type = $3 AND sampled_at = $6 RETURNING process_type",
+		f.AppID, f.ReleaseID, typ, string(data), now, prevAt).Scan(&id)
+	if err == sql.ErrNoRows {
+		// sampled by another controller
+		return nil, time.Time{}, nil
+	} else if err != nil {
+		return nil, time.Time{}, err
+	}
+	prev := &autoscaleSample{}
+	if err := json.Unmarshal([]byte(prevData), prev); err != nil {
+		return nil, time.Time{}, err
+	}
+	return prev, prevAt, nil
+}
+
+// autoscaleMetric computes the value of a metric between two samples taken
+// elapsed apart, while count jobs were running. It returns false if there is
+// no value, such as when no requests were made or a router restarted.
+func autoscaleMetric(metric string, prev, cur *autoscaleSample, elapsed time.Duration, count int) (float64, bool) {
+	if elapsed <= 0 {
+		return 0, false
+	}
+	switch metric {
+	case ct.AutoscaleRequests:
+		if cur.Requests < prev.Requests {
+			return 0, false
+		}
+		rate := float64(cur.Requests-prev.Requests) / elapsed.Seconds()
+		return rate / math.Max(float64(count), 1), true
+	case ct.AutoscaleLatency:
+		if cur.Requests <= prev.Requests || cur.ResponseTime < prev.ResponseTime {
+			return 0, false
+		}
+		mean := float64(cur.ResponseTime-prev.ResponseTime) / float64(cur.Requests-prev.Requests)
+		return mean / float64(time.Millisecond), true
+	case ct.AutoscaleCPU:
+		// only jobs which were running at both samples are measured
+		var total float64
+		var n int
+		for id, usage := range cur.CPUUsage {
+			if p, ok := prev.CPUUsage[id]; ok && usage >= p {
+				total += float64(usage - p)
+				n++
+			}
+		}
+		if n == 0 {
+			return 0, false
+		}
+		return total / float64(elapsed) / float64(n), true
+	}
+	return 0, false
+}
+
+// autoscaleCount returns the count which brings the metric of a process type
+// with current jobs to its target, assuming that the metric is proportional
+// to the load on each job, bounded by the configured minimum and maximum.
+func autoscaleCount(conf *ct.AutoscaleConfig, current int, value float64) int {
+	count := current
+	ratio := value / conf.Target
+	if math.Abs(ratio-1) > autoscaleTolerance {
+		// the epsilon avoids rounding up exact results
+		count = int(math.Ceil(math.Max(float64(current), 1)*ratio - 1e-9))
+	}
+	if count < conf.Min {
+		count = conf.Min
+	}
+	if count > conf.Max {
+		count = conf.Max
+	}
+	return count
+}
+
+const autoscaleDecisionColumns = "decision_id, app_id, release_id, process_type, metric, value, target, previous_count, count, created_at"
+
+func scanAutoscaleDecision(s Scanner) (*ct.AutoscaleDecision, error) {
+	d := &ct.AutoscaleDecision{}
+	err := s.Scan(&d.ID, &d.AppID, &d.ReleaseID, &d.ProcessType, &d.Metric, &d.Value, &d.Target, &d.PreviousCount, &d.Count, &d.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	d.ID = cleanUUID(d.ID)
+	d.AppID = cleanUUID(d.AppID)
+	d.ReleaseID = cleanUUID(d.ReleaseID)
+	return d, nil
+}
+
+func (r *AutoscaleRepo) listDecisions(appID string, opts *listOptions) ([]*ct.AutoscaleDecision, string, error) {
+	if err := opts.checkFilters("type", "release"); err != nil {
+		return nil, "", err
+	}
+	q := newListQuery("SELECT "+autoscaleDecisionColumns+" FROM autoscale_decisions WHERE app_id = $1", "decision_id")
+	q.args = append(q.args, appID)
+	if typ, ok := opts.filters["type"]; ok {
+		q.where("process_type = $%d", typ)
+	}
+	if releaseID, ok := opts.filters["release"]; ok {
+		if !idPattern.MatchString(releaseID) {
+			return nil, "", ct.ValidationError{Field: "release", Message: "is invalid"}
+		}
+		q.where("release_id = $%d", releaseID)
+	}
+	query, args, err := q.build(opts)
+	if err != nil {
+		return nil, "", err
+	}
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return nil, "", err
+	}
+	decisions := []*ct.AutoscaleDecision{}
+	for rows.Next() {
+		d, err := scanAutoscaleDecision(rows)
+		if err != nil {
+			rows.Close()
+			return nil, "", err
+		}
+		decisions = append(decisions, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+	n, next := opts.page(len(decisions), func(i int) (*time.Time, string) { return decisions[i].CreatedAt, decisions[i].ID })
+	return decisions[:n], next, nil
+}
+
+func listAutoscaleDecisions(req *http.Request, w http.ResponseWriter, app *ct.App, repo *AutoscaleRepo, r ResponseHelper) {
+	opts, err := parseListOptions(req)
+	if err != nil {
+		r.Error(err)
+		return
+	}
+	list, next, err := repo.listDecisions(app.ID, opts)
+	if err != nil {
+		r.Error(err)
+		return
+	}
+	setNextPage(w, req, next)
+	r.JSON(200, list)
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"time"
+
+	. "github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-check"
+	tu "github.com/flynn/flynn/controller/testutils"
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/host/types"
+	"github.com/flynn/flynn/pkg/random"
+	routerc "github.com/flynn/flynn/router/client"
+	"github.com/flynn/flynn/router/types"
+)
+
+func (s *S) TestAutoscaleCount(c *C) {
+	conf := &ct.AutoscaleConfig{Min: 1, Max: 10, Metric: ct.AutoscaleRequests, Target: 10}
+	for _, t := range []struct {
+		current int
+		value   float64
+		count   int
+	}{
+		{2, 10, 2},
+		{2, 10.5, 2}, // within the tolerance
+		{2, 15, 3},
+		{2, 20, 4},
+		{4, 5, 2},
+		{2, 0, 1},
+		{0, 35, 4},
+		{4, 100, 10},
+	} {
+		c.Assert(autoscaleCount(conf, t.current, t.value), Equals, t.count, Commentf("%d jobs at %v", t.current, t.value))
+	}
+}
+
+func (s *S) TestFormationAutoscaleValidation(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "autoscale-validation"})
+	release := s.createTestRelease(c, &ct.Release{Processes: map[string]ct.ProcessType{"web": {Cmd: []string{"start"}}}})
+	path := formationPath(app.ID, release.ID)
+
+	for _, conf := range []map[string]*ct.AutoscaleConfig{
+		{"worker": {Min: 1, Max: 2, Metric: ct.AutoscaleCPU, Target: 0.5}},
+		{"web": {Min: 0, Max: 2, Metric: ct.AutoscaleCPU, Target: 0.5}},
+		{"web": {Min: 3, Max: 2, Metric: ct.AutoscaleCPU, Target: 0.5}},
+		{"web": {Min: 1, Max: 2, Metric: "memory", Target: 0.5}},
+		{"web": {Min: 1, Max: 2, Metric: ct.AutoscaleLatency}},
+	} {
+		res, err := s.Put(path, &ct.Formation{Autoscale: conf}, &ct.Formation{})
+		c.Assert(err, IsNil)
+		c.Assert(res.StatusCode, Equals, 400, Commentf("%#v", conf))
+	}
+
+	conf := &ct.AutoscaleConfig{Min: 1, Max: 4, Metric: ct.AutoscaleLatency, Target: 200, ScaleDownCooldown: 600}
+	s.createTestFormation(c, &ct.Formation{AppID: app.ID, ReleaseID: release.ID, Autoscale: map[string]*ct.AutoscaleConfig{"web": conf}})
+	defer s.Delete(path)
+	formation := &ct.Formation{}
+	_, err := s.Get(path, formation)
+	c.Assert(err, IsNil)
+	c.Assert(formation.Autoscale, DeepEquals, map[string]*ct.AutoscaleConfig{"web": conf})
+}
+
+// autoscaleFormation creates a formation of an app with a single process
+// type. It should be deleted by the test so that it is not autoscaled by
+// other tests.
+func (s *S) autoscaleFormation(c *C, appName, typ string, count int, conf *ct.AutoscaleConfig) *ct.Formation {
+	app := s.createTestApp(c, &ct.App{Name: appName})
+	release := s.createTestRelease(c, &ct.Release{Processes: map[string]ct.ProcessType{typ: {Cmd: []string{"start"}}}})
+	s.setAppRelease(c, app.ID, release.ID)
+	f := s.createTestFormation(c, &ct.Formation{
+		AppID:     app.ID,
+		ReleaseID: release.ID,
+		Processes: map[string]int{typ: count},
+		Autoscale: map[string]*ct.AutoscaleConfig{typ: conf},
+	})
+	return f
+}
+
+func (s *S) processCount(c *C, f *ct.Formation, typ string) int {
+	current := &ct.Formation{}
+	_, err := s.Get(formationPath(f.AppID, f.ReleaseID), current)
+	c.Assert(err, IsNil)
+	return current.Processes[typ]
+}
+
+func (s *S) autoscaleDecisions(c *C, appID string) []*ct.AutoscaleDecision {
+	var decisions []*ct.AutoscaleDecision
+	_, err := s.Get(fmt.Sprintf("/apps/%s/autoscale_decisions?order=asc", appID), &decisions)
+	c.Assert(err, IsNil)
+	return decisions
+}
+
+func (s *S) TestAutoscaleRequests(c *C) {
+	repo := s.m.Get(reflect.TypeOf(&AutoscaleRepo{})).Interface().(*AutoscaleRepo)
+	rtr := s.m.Get(reflect.TypeOf((*routerc.Client)(nil)).Elem()).Interface().(*fakeRouter)
+	f := s.autoscaleFormation(c, "autoscale-requests", "web", 1, &ct.AutoscaleConfig{Min: 1, Max: 5, Metric: ct.AutoscaleRequests, Target: 10})
+	defer s.Delete(formationPath(f.AppID, f.ReleaseID))
+
+	// the first sample has nothing to be compared with
+	now := time.Now().Add(time.Hour)
+	stats := &router.ServiceStats{Service: "autoscale-requests-web", Requests: 1000}
+	rtr.setServiceStats(stats)
+	c.Assert(repo.autoscale(now), IsNil)
+	c.Assert(s.processCount(c, f, "web"), Equals, 1)
+
+	// 35 requests per second are served by 4 jobs
+	now = now.Add(autoscaleInterval)
+	stats.Requests += 35 * 30
+	rtr.setServiceStats(stats)
+	c.Assert(repo.autoscale(now), IsNil)
+	c.Assert(s.processCount(c, f, "web"), Equals, 4)
+	decisions := s.autoscaleDecisions(c, f.AppID)
+	c.Assert(decisions, HasLen, 1)
+	c.Assert(decisions[0].ReleaseID, Equals, f.ReleaseID)
+	c.Assert(decisions[0].ProcessType, Equals, "web")
+	c.Assert(decisions[0].Metric, Equals, ct.AutoscaleRequests)
+	c.Assert(decisions[0].Value, Equals, float64(35))
+	c.Assert(decisions[0].PreviousCount, Equals, 1)
+	c.Assert(decisions[0].Count, Equals, 4)
+
+	// without requests the count is kept until the scale down cooldown has
+	// passed since the last change
+	now = now.Add(autoscaleInterval)
+	c.Assert(repo.autoscale(now), IsNil)
+	c.Assert(s.processCount(c, f, "web"), Equals, 4)
+	now = now.Add(defaultScaleDownCooldown)
+	c.Assert(repo.autoscale(now), IsNil)
+	c.Assert(s.processCount(c, f, "web"), Equals, 1)
+	c.Assert(s.autoscaleDecisions(c, f.AppID), HasLen, 2)
+
+	// a sample taken again within half an interval is skipped, as it would
+	// have been by another controller
+	stats.Requests += 1000
+	rtr.setServiceStats(stats)
+	c.Assert(repo.autoscale(now.Add(time.Second)), IsNil)
+	c.Assert(s.processCount(c, f, "web"), Equals, 1)
+}
+
+func (s *S) TestAutoscaleCPU(c *C) {
+	repo := s.m.Get(reflect.TypeOf(&AutoscaleRepo{})).Interface().(*AutoscaleRepo)
+	hostID := random.UUID()
+	hc := tu.NewFakeHostClient(hostID)
+	s.cc.SetHostClient(hostID, hc)
+	s.cc.SetHosts(map[string]host.Host{hostID: {}})
+	f := s.autoscaleFormation(c, "autoscale-cpu", "worker", 2, &ct.AutoscaleConfig{Min: 1, Max: 5, Metric: ct.AutoscaleCPU, Target: 0.5})
+	defer s.Delete(formationPath(f.AppID, f.ReleaseID))
+	for _, id := range []string{"job0", "job1"} {
+		s.createTestJob(c, &ct.Job{ID: hostID + "-" + id, AppID: f.AppID, ReleaseID: f.ReleaseID, Type: "worker", State: "up"})
+		hc.SetJobStats(id, []*host.JobStats{{JobID: id}})
+	}
+
+	now := time.Now().Add(time.Hour)
+	c.Assert(repo.autoscale(now), IsNil)
+
+	// each job used 0.75 cores, so 3 jobs are needed to use 0.5 each
+	now = now.Add(autoscaleInterval)
+	for _, id := range []string{"job0", "job1"} {
+		hc.SetJobStats(id, []*host.JobStats{{JobID: id, CPUUsage: uint64(3 * autoscaleInterval / 4)}})
+	}
+	c.Assert(repo.autoscale(now), IsNil)
+	c.Assert(s.processCount(c, f, "worker"), Equals, 3)
+	decisions := s.autoscaleDecisions(c, f.AppID)
+	c.Assert(decisions, HasLen, 1)
+	c.Assert(decisions[0].Value, Equals, 0.75)
+}
@@ -10,6 +10,7 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"reflect"
 	"strconv"
 	"strings"
 	"time"
@@ -34,6 +35,100 @@ type Client struct {
 // ErrNotFound is returned when a resource is not found (HTTP status 404).
 var ErrNotFound = errors.New("controller: resource not found")
 
+// ErrPreconditionFailed is returned when a conditional request fails because
+// the resource was changed by someone else (HTTP status 412).
+var ErrPreconditionFailed = errors.New("controller: precondition failed")
+
+// maxUpdateAttempts is the number of times UpdateAppRelease and
+// UpdateFormation try to apply a change before giving up.
+const maxUpdateAttempts = 5
+
+// ListOptions are the pagination, filter and sort options of a list request.
+// Lists are ordered by creation time.
+type ListOptions struct {
+	// Cursor is the cursor of the page to get, as returned with the previous
+	// page. The first page is returned if it is empty.
+	Cursor string
+	// Limit is the maximum number of items in the page. The controller's
+	// default page size is used if it is zero, and it caps larger limits.
+	Limit int
+	// Ascending returns the oldest items first instead of the newest.
+	Ascending bool
+	// Filters are the values which fields of the items must have, e.g.
+	// {"state": "up"} for jobs.
+	Filters map[string]string
+}
+
+func (o *ListOptions) query() string {
+	if o == nil {
+		return ""
+	}
+	q := make(url.Values, len(o.Filters)+3)
+	for k, v := range o.Filters {
+		q.Set(k, v)
+	}
+	if o.Cursor != "" {
+		q.Set("cursor", o.Cursor)
+	}
+	if o.Limit > 0 {
+		q.Set("limit", strconv.Itoa(o.Limit))
+	}
+	if o.Ascending {
+		q.Set("order", "asc")
+	}
+	if len(q) == 0 {
+		return ""
+	}
+	return "?" + q.Encode()
+}
+
+// getPage gets a page of the list at path into out, returning the cursor of
+// the next page from the Link header of the response.
+func (c *Client) getPage(path string, opts *ListOptions, out interface{}) (string, error) {
+	res, err := c.RawReq("GET", path+opts.query(), nil, nil, out)
+	if err != nil {
+		return "", err
+	}
+	return nextCursor(res.Header.Get("Link")), nil
+}
+
+// getAll gets all pages of the list at path into out, a pointer to a slice,
+// following the Link header of each response.
+func (c *Client) getAll(path string, out interface{}) error {
+	list := reflect.ValueOf(out).Elem()
+	opts := &ListOptions{}
+	for {
+		page := reflect.New(list.Type())
+		next, err := c.getPage(path, opts, page.Interface())
+		if err != nil {
+			return err
+		}
+		list.Set(reflect.AppendSlice(list, page.Elem()))
+		if next == "" {
+			return nil
+		}
+		opts.Cursor = next
+	}
+}
+
+// nextCursor returns the cursor of a Link header like:
+//
+//	</releases?cursor=xxx&limit=10>; rel="next"
+func nextCursor(link string) string {
+	for _, l := range strings.Split(link, ",") {
+		parts := strings.Split(l, ";")
+		if len(parts) < 2 || strings.TrimSpace(parts[1]) != `rel="next"` {
+			continue
+		}
+		u, err := url.Parse(strings.Trim(strings.TrimSpace(parts[0]), "<>"))
+		if err != nil {
+			return ""
+		}
+		return u.Query().Get("cursor")
+	}
+	return ""
+}
+
 // newClient creates a generic Client object, additional attributes must
 // be set by the caller
 func newClient(addr string, key string, url string, http *http.Client) *Client {
@@ -199,13 +294,13 @@ func (c *Client) GetResource(providerID, resourceID string) (*ct.Resource, error
 // ResourceList returns all resources under providerID.
 func (c *Client) ResourceList(providerID string) ([]*ct.Resource, error) {
 	var resources []*ct.Resource
-	return resources, c.Get(fmt.Sprintf("/providers/%s/resources", providerID), &resources)
+	return resources, c.getAll(fmt.Sprintf("/providers/%s/resources", providerID), &resources)
 }
 
 // AppResourceList returns a list of all resources under appID.
 func (c *Client) AppResourceList(appID string) ([]*ct.Resource, error) {
 	var resources []*ct.Resource
-	return resources, c.Get(fmt.Sprintf("/apps/%s/resources", appID), &resources)
+	return resources, c.getAll(fmt.Sprintf("/apps/%s/resources", appID), &resources)
 }
 
 // PutResource updates a resource.
@@ -216,6 +311,25 @@ func (c *Client) PutResource(resource *ct.Resource) error {
 	return c.Put(fmt.Sprintf("/providers/%s/resources/%s", resource.ProviderID, resource.ID), resource, resource)
 }
 
+// AttachResource attaches the resource identified by resourceID to appID and
+// deploys a new release of the app with the env of the resource.
+func (c *Client) AttachResource(appID, resourceID string) (*ct.Resource, error) {
+	res := &ct.Resource{}
+	return res, c.Put(fmt.Sprintf("/apps/%s/resources/%s", appID, resourceID), nil, res)
+}
+
+// DetachResource detaches the resource identified by resourceID from appID and
+// deploys a new release of the app without the env of the resource.
+func (c *Client) DetachResource(appID, resourceID string) error {
+	return c.Delete(fmt.Sprintf("/apps/%s/resources/%s", appID, resourceID))
+}
+
+// DeleteResource deprovisions the resource identified by resourceID under
+// providerID and detaches it from its apps.
+func (c *Client) DeleteResource(providerID, resourceID string) error {
+	return c.Delete(fmt.Sprintf("/providers/%s/resources/%s", providerID, resourceID))
+}
+
 // PutFormation updates an existing formation.
 func (c *Client) PutFormation(formation *ct.Formation) error {
 	if formation.AppID == "" || formation.ReleaseID == "" {
@@ -224,6 +338,15 @@ func (c *Client) PutFormation(formation *ct.Formation) error {
 	return c.Put(fmt.Sprintf("/apps/%s/formations/%s", formation.AppID, formation.ReleaseID), formation, formation)
 }
 
+// AutoscaleDecisionListPage returns a page of the changes which the autoscaler
+// has made to the process counts of an app with the given options, and the
+// cursor of the next page.
+func (c *Client) AutoscaleDecisionListPage(appID string, opts *ListOptions) ([]*ct.AutoscaleDecision, string, error) {
+	var decisions []*ct.AutoscaleDecision
+	next, err := c.getPage(fmt.Sprintf("/apps/%s/autoscale_decisions", appID), opts, &decisions)
+	return decisions, next, err
+}
+
 // PutJob updates an existing job.
 func (c *Client) PutJob(job *ct.Job) error {
 	if job.ID == "" || job.AppID == "" {
@@ -242,12 +365,97 @@ func (c *Client) SetAppRelease(appID, releaseID string) error {
 	return c.Put(fmt.Sprintf("/apps/%s/release", appID), &ct.Release{ID: releaseID}, nil)
 }
 
+// DeployAppRelease sets the specified release as the current release for an
+// app like SetAppRelease, writing the output of its release phase, if it has
+// one, to output. It returns an error without deploying the release if the
+// release phase fails.
+func (c *Client) DeployAppRelease(appID, releaseID string, output io.Writer) error {
+	header := http.Header{"Accept": []string{"text/event-stream"}}
+	res, err := c.RawReq("PUT", fmt.Sprintf("/apps/%s/release", appID), header, &ct.Release{ID: releaseID}, nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if !strings.HasPrefix(res.Header.Get("Content-Type"), "text/event-stream") {
+		// the release has no release phase
+		return nil
+	}
+	dec := sse.NewDecoder(bufio.NewReader(res.Body))
+	for {
+		event := &ct.DeployEvent{}
+		if err := dec.Decode(event); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		switch {
+		case event.Data != "":
+			if _, err := io.WriteString(output, event.Data); err != nil {
+				return err
+			}
+		case event.Error != "":
+			return errors.New(event.Error)
+		case event.Release != nil:
+			return nil
+		}
+	}
+}
+
 // GetAppRelease returns the current release of an app.
 func (c *Client) GetAppRelease(appID string) (*ct.Release, error) {
 	release := &ct.Release{}
 	return release, c.Get(fmt.Sprintf("/apps/%s/release", appID), release)
 }
 
+// UpdateAppRelease creates and deploys a new release of an app, which update
+// makes from a copy of the current release. The release passed to update has
+// no ID or artifact if the app has no release yet. If the release of the app
+// is changed concurrently, update is called again with the new one.
+func (c *Client) UpdateAppRelease(appID string, update func(*ct.Release) error) (*ct.Release, error) {
+	path := fmt.Sprintf("/apps/%s/release", appID)
+	for i := 0; ; i++ {
+		release := &ct.Release{}
+		tag, err := c.getWithETag(path, release)
+		header := make(http.Header)
+		if err == ErrNotFound {
+			header.Set("If-None-Match", "*")
+		} else if err != nil {
+			return nil, err
+		} else {
+			header.Set("If-Match", tag)
+		}
+
+		if err := update(release); err != nil {
+			return nil, err
+		}
+		release.ID = ""
+		release.CreatedAt = nil
+		if err := c.CreateRelease(release); err != nil {
+			return nil, err
+		}
+		err = c.conditionalPut(path, header, &ct.Release{ID: release.ID}, nil)
+		if err == ErrPreconditionFailed && i+1 < maxUpdateAttempts {
+			continue
+		}
+		return release, err
+	}
+}
+
+// AppSecretList returns the keys and versions of the secrets of the current
+// release of an app.
+func (c *Client) AppSecretList(appID string) ([]*ct.Secret, error) {
+	var secrets []*ct.Secret
+	return secrets, c.Get(fmt.Sprintf("/apps/%s/secrets", appID), &secrets)
+}
+
+// UpdateAppSecrets sets the secrets of an app, deleting those which are nil,
+// and returns the new release of the app which refers to them.
+func (c *Client) UpdateAppSecrets(appID string, secrets map[string]*string) (*ct.Release, error) {
+	release := &ct.Release{}
+	return release, c.Put(fmt.Sprintf("/apps/%s/secrets", appID), secrets, release)
+}
+
 // RouteList returns all routes for an app.
 func (c *Client) RouteList(appID string) ([]*router.Route, error) {
 	var routes []*router.Route
@@ -270,6 +478,111 @@ func (c *Client) DeleteRoute(appID string, routeID string) error {
 	return c.Delete(fmt.Sprintf("/apps/%s/routes/%s", appID, routeID))
 }
 
+// LogDrainList returns the log drains of an app.
+func (c *Client) LogDrainList(appID string) ([]*ct.LogDrain, error) {
+	var drains []*ct.LogDrain
+	return drains, c.getAll(fmt.Sprintf("/apps/%s/log_drains", appID), &drains)
+}
+
+// GetLogDrain returns details for the drainID under the specified app.
+func (c *Client) GetLogDrain(appID, drainID string) (*ct.LogDrain, error) {
+	drain := &ct.LogDrain{}
+	return drain, c.Get(fmt.Sprintf("/apps/%s/log_drains/%s", appID, drainID), drain)
+}
+
+// CreateLogDrain creates a new log drain for the specified app.
+func (c *Client) CreateLogDrain(appID string, drain *ct.LogDrain) error {
+	return c.Post(fmt.Sprintf("/apps/%s/log_drains", appID), drain, drain)
+}
+
+// DeleteLogDrain deletes a log drain under the specified app.
+func (c *Client) DeleteLogDrain(appID, drainID string) error {
+	return c.Delete(fmt.Sprintf("/apps/%s/log_drains/%s", appID, drainID))
+}
+
+// CreateSchedule creates a schedule of one-off jobs of the specified app.
+func (c *Client) CreateSchedule(appID string, schedule *ct.Schedule) error {
+	return c.Post(fmt.Sprintf("/apps/%s/schedules", appID), schedule, schedule)
+}
+
+// ScheduleList returns a list of the schedules of the specified app.
+func (c *Client) ScheduleList(appID string) ([]*ct.Schedule, error) {
+	var schedules []*ct.Schedule
+	return schedules, c.getAll(fmt.Sprintf("/apps/%s/schedules", appID), &schedules)
+}
+
+// GetSchedule returns details for the scheduleID under the specified app.
+func (c *Client) GetSchedule(appID, scheduleID string) (*ct.Schedule, error) {
+	schedule := &ct.Schedule{}
+	return schedule, c.Get(fmt.Sprintf("/apps/%s/schedules/%s", appID, scheduleID), schedule)
+}
+
+// UpdateSchedule changes the fields of a schedule which are set in update,
+// and returns the updated schedule.
+func (c *Client) UpdateSchedule(appID, scheduleID string, update *ct.Schedule) (*ct.Schedule, error) {
+	schedule := &ct.Schedule{}
+	return schedule, c.Post(fmt.Sprintf("/apps/%s/schedules/%s", appID, scheduleID), update, schedule)
+}
+
+// DeleteSchedule deletes a schedule under the specified app. Jobs of its runs
+// which are running are not stopped.
+func (c *Client) DeleteSchedule(appID, scheduleID string) error {
+	return c.Delete(fmt.Sprintf("/apps/%s/schedules/%s", appID, scheduleID))
+}
+
+// ScheduleRunListPage returns a page of the history of runs of a schedule
+// with the given options, and the cursor of the next page.
+func (c *Client) ScheduleRunListPage(appID, scheduleID string, opts *ListOptions) ([]*ct.ScheduleRun, string, error) {
+	var runs []*ct.ScheduleRun
+	next, err := c.getPage(fmt.Sprintf("/apps/%s/schedules/%s/runs", appID, scheduleID), opts, &runs)
+	return runs, next, err
+}
+
+// CreateWebhook creates a webhook, which is sent the events of all apps if
+// hook.AppID is empty. A secret is generated if hook.Secret is empty.
+func (c *Client) CreateWebhook(hook *ct.Webhook) error {
+	return c.Post("/webhooks", hook, hook)
+}
+
+// GetWebhook returns details for the specified webhook.
+func (c *Client) GetWebhook(hookID string) (*ct.Webhook, error) {
+	hook := &ct.Webhook{}
+	return hook, c.Get(fmt.Sprintf("/webhooks/%s", hookID), hook)
+}
+
+// WebhookList returns a list of all webhooks.
+func (c *Client) WebhookList() ([]*ct.Webhook, error) {
+	var hooks []*ct.Webhook
+	return hooks, c.getAll("/webhooks", &hooks)
+}
+
+// AppWebhookList returns a list of the webhooks of the specified app, which
+// does not include cluster wide webhooks.
+func (c *Client) AppWebhookList(appID string) ([]*ct.Webhook, error) {
+	var hooks []*ct.Webhook
+	return hooks, c.getAll(fmt.Sprintf("/apps/%s/webhooks", appID), &hooks)
+}
+
+// DeleteWebhook deletes a webhook. Its pending deliveries are not attempted.
+func (c *Client) DeleteWebhook(hookID string) error {
+	return c.Delete(fmt.Sprintf("/webhooks/%s", hookID))
+}
+
+// WebhookDeliveryListPage returns a page of the delivery history of a webhook
+// with the given options, and the cursor of the next page.
+func (c *Client) WebhookDeliveryListPage(hookID string, opts *ListOptions) ([]*ct.WebhookDelivery, string, error) {
+	var deliveries []*ct.WebhookDelivery
+	next, err := c.getPage(fmt.Sprintf("/webhooks/%s/deliveries", hookID), opts, &deliveries)
+	return deliveries, next, err
+}
+
+// TestWebhook sends a ping event to a webhook and returns the delivery, which
+// has the result of the first attempt.
+func (c *Client) TestWebhook(hookID string) (*ct.WebhookDelivery, error) {
+	delivery := &ct.WebhookDelivery{}
+	return delivery, c.Post(fmt.Sprintf("/webhooks/%s/test", hookID), nil, delivery)
+}
+
 // GetFormation returns details for the specified formation under app and
 // release.
 func (c *Client) GetFormation(appID, releaseID string) (*ct.Formation, error) {
@@ -277,10 +590,65 @@ func (c *Client) GetFormation(appID, releaseID string) (*ct.Formation, error) {
 	return formation, c.Get(fmt.Sprintf("/apps/%s/formations/%s", appID, releaseID), formation)
 }
 
+// UpdateFormation changes the formation of an app and release with update.
+// The formation passed to update has no processes if it does not exist yet.
+// If the formation is changed concurrently, update is called again with its
+// new state.
+func (c *Client) UpdateFormation(appID, releaseID string, update func(*ct.Formation) error) (*ct.Formation, error) {
+	path := fmt.Sprintf("/apps/%s/formations/%s", appID, releaseID)
+	for i := 0; ; i++ {
+		formation := &ct.Formation{}
+		tag, err := c.getWithETag(path, formation)
+		header := make(http.Header)
+		if err == ErrNotFound {
+			formation = &ct.Formation{AppID: appID, ReleaseID: releaseID}
+			header.Set("If-None-Match", "*")
+		} else if err != nil {
+			return nil, err
+		} else {
+			header.Set("If-Match", tag)
+		}
+		if formation.Processes == nil {
+			formation.Processes = make(map[string]int)
+		}
+
+		if err := update(formation); err != nil {
+			return nil, err
+		}
+		err = c.conditionalPut(path, header, formation, formation)
+		if err == ErrPreconditionFailed && i+1 < maxUpdateAttempts {
+			continue
+		}
+		return formation, err
+	}
+}
+
+// getWithETag gets the resource at path into out, and returns its ETag.
+func (c *Client) getWithETag(path string, out interface{}) (string, error) {
+	res, err := c.RawReq("GET", path, nil, nil, out)
+	if err != nil {
+		return "", err
+	}
+	return res.Header.Get("ETag"), nil
+}
+
+// conditionalPut puts in to path with the precondition headers in header,
+// returning ErrPreconditionFailed if they are not met.
+func (c *Client) conditionalPut(path string, header http.Header, in, out interface{}) error {
+	res, err := c.RawReq("PUT", path, header, in, out)
+	if res != nil && res.StatusCode == http.StatusPreconditionFailed {
+		return ErrPreconditionFailed
+	}
+	if err == nil && out == nil {
+		res.Body.Close()
+	}
+	return err
+}
+
 // FormationList returns a list of all formations under appID.
 func (c *Client) FormationList(appID string) ([]*ct.Formation, error) {
 	var formations []*ct.Formation
-	return formations, c.Get(fmt.Sprintf("/apps/%s/formations", appID), &formations)
+	return formations, c.getAll(fmt.Sprintf("/apps/%s/formations", appID), &formations)
 }
 
 // DeleteFormation deletes the formation matching appID and releaseID.
@@ -373,6 +741,109 @@ func (c *Client) GetJobLogWithWait(appID, jobID string, tail bool) (io.ReadClose
 	return res.Body, nil
 }
 
+// GetJobStats returns a sample of the resource usage of a running job.
+func (c *Client) GetJobStats(appID, jobID string) (*ct.JobStats, error) {
+	stats := &ct.JobStats{}
+	return stats, c.Get(fmt.Sprintf("/apps/%s/jobs/%s/stats", appID, jobID), stats)
+}
+
+// JobStatsStream is a wrapper around a Stats channel, allowing us to close
+// the stream.
+type JobStatsStream struct {
+	Stats chan *ct.JobStats
+	body  io.ReadCloser
+}
+
+// Close closes the underlying stream.
+func (s *JobStatsStream) Close() {
+	s.body.Close()
+}
+
+// StreamJobStats returns a JobStatsStream of samples of the resource usage of
+// a running job, which is closed when the job stops.
+func (c *Client) StreamJobStats(appID, jobID string) (*JobStatsStream, error) {
+	header := http.Header{"Accept": []string{"text/event-stream"}}
+	res, err := c.RawReq("GET", fmt.Sprintf("/apps/%s/jobs/%s/stats", appID, jobID), header, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	stream := &JobStatsStream{Stats: make(chan *ct.JobStats), body: res.Body}
+	go func() {
+		defer close(stream.Stats)
+		dec := sse.NewDecoder(bufio.NewReader(stream.body))
+		for {
+			stats := &ct.JobStats{}
+			if err := dec.Decode(stats); err != nil {
+				return
+			}
+			stream.Stats <- stats
+		}
+	}()
+	return stream, nil
+}
+
+// AppLogOptions filter the output returned by StreamAppLog.
+type AppLogOptions struct {
+	ProcessType string
+	JobID       string
+	Lines       int // the number of previous lines to return, -1 returns all of them
+	Follow      bool
+}
+
+// AppLogStream is a wrapper around a Lines channel, allowing us to close the
+// stream.
+type AppLogStream struct {
+	Lines chan *ct.LogLine
+	body  io.ReadCloser
+}
+
+// Close closes the underlying stream.
+func (s *AppLogStream) Close() {
+	s.body.Close()
+}
+
+// StreamAppLog returns an AppLogStream of the output of the running jobs of an
+// app, merged in timestamp order. If opts.Follow is false the stream is closed
+// once the buffered output has been sent.
+func (c *Client) StreamAppLog(appID string, opts *AppLogOptions) (*AppLogStream, error) {
+	query := url.Values{}
+	if opts.ProcessType != "" {
+		query.Set("process_type", opts.ProcessType)
+	}
+	if opts.JobID != "" {
+		query.Set("job_id", opts.JobID)
+	}
+	if opts.Lines >= 0 {
+		query.Set("lines", strconv.Itoa(opts.Lines))
+	}
+	if opts.Follow {
+		query.Set("follow", "true")
+	}
+	path := fmt.Sprintf("/apps/%s/log", appID)
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+	header := http.Header{"Accept": []string{"text/event-stream"}}
+	res, err := c.RawReq("GET", path, header, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	stream := &AppLogStream{Lines: make(chan *ct.LogLine), body: res.Body}
+	go func() {
+		defer close(stream.Lines)
+		dec := sse.NewDecoder(bufio.NewReader(stream.body))
+		for {
+			line := &ct.LogLine{}
+			// the eof event sent after the buffered output has no job ID
+			if err := dec.Decode(line); err != nil || line.JobID == "" {
+				return
+			}
+			stream.Lines <- line
+		}
+	}()
+	return stream, nil
+}
+
 // RunJobAttached runs a new job under the specified app, attaching to the job
 // and returning a ReadWriteCloser stream, which can then be used for
 // communicating with the job.
@@ -413,31 +884,93 @@ func (c *Client) GetJob(appID, jobID string) (*ct.Job, error) {
 // JobList returns a list of all jobs.
 func (c *Client) JobList(appID string) ([]*ct.Job, error) {
 	var jobs []*ct.Job
-	return jobs, c.Get(fmt.Sprintf("/apps/%s/jobs", appID), &jobs)
+	return jobs, c.getAll(fmt.Sprintf("/apps/%s/jobs", appID), &jobs)
+}
+
+// JobListPage returns a page of the jobs of an app with the given options,
+// and the cursor of the next page, which is empty if it is the last page. It
+// supports the filters "state", "type" and "release".
+func (c *Client) JobListPage(appID string, opts *ListOptions) ([]*ct.Job, string, error) {
+	var jobs []*ct.Job
+	next, err := c.getPage(fmt.Sprintf("/apps/%s/jobs", appID), opts, &jobs)
+	return jobs, next, err
 }
 
 // AppList returns a list of all apps.
 func (c *Client) AppList() ([]*ct.App, error) {
 	var apps []*ct.App
-	return apps, c.Get("/apps", &apps)
+	return apps, c.getAll("/apps", &apps)
+}
+
+// AppListPage returns a page of apps with the given options, and the cursor
+// of the next page. It supports the filter "name".
+func (c *Client) AppListPage(opts *ListOptions) ([]*ct.App, string, error) {
+	var apps []*ct.App
+	next, err := c.getPage("/apps", opts, &apps)
+	return apps, next, err
 }
 
 // KeyList returns a list of all ssh public keys added.
 func (c *Client) KeyList() ([]*ct.Key, error) {
 	var keys []*ct.Key
-	return keys, c.Get("/keys", &keys)
+	return keys, c.getAll("/keys", &keys)
+}
+
+// KeyListPage returns a page of ssh public keys with the given options, and
+// the cursor of the next page.
+func (c *Client) KeyListPage(opts *ListOptions) ([]*ct.Key, string, error) {
+	var keys []*ct.Key
+	next, err := c.getPage("/keys", opts, &keys)
+	return keys, next, err
 }
 
 // ArtifactList returns a list of all artifacts
 func (c *Client) ArtifactList() ([]*ct.Artifact, error) {
 	var artifacts []*ct.Artifact
-	return artifacts, c.Get("/artifacts", &artifacts)
+	return artifacts, c.getAll("/artifacts", &artifacts)
+}
+
+// ArtifactListPage returns a page of artifacts with the given options, and
+// the cursor of the next page. It supports the filters "type" and "app".
+func (c *Client) ArtifactListPage(opts *ListOptions) ([]*ct.Artifact, string, error) {
+	var artifacts []*ct.Artifact
+	next, err := c.getPage("/artifacts", opts, &artifacts)
+	return artifacts, next, err
 }
 
 // ReleaseList returns a list of all releases
 func (c *Client) ReleaseList() ([]*ct.Release, error) {
 	var releases []*ct.Release
-	return releases, c.Get("/releases", &releases)
+	return releases, c.getAll("/releases", &releases)
+}
+
+// ReleaseListPage returns a page of releases with the given options, and the
+// cursor of the next page. It supports the filters "app" and "artifact".
+func (c *Client) ReleaseListPage(opts *ListOptions) ([]*ct.Release, string, error) {
+	var releases []*ct.Release
+	next, err := c.getPage("/releases", opts, &releases)
+	return releases, next, err
+}
+
+// AppReleaseList returns a list of the releases of an app.
+func (c *Client) AppReleaseList(appID string) ([]*ct.Release, error) {
+	var releases []*ct.Release
+	return releases, c.getAll(fmt.Sprintf("/apps/%s/releases", appID), &releases)
+}
+
+// AppReleaseListPage returns a page of the releases of an app with the given
+// options, and the cursor of the next page.
+func (c *Client) AppReleaseListPage(appID string, opts *ListOptions) ([]*ct.Release, string, error) {
+	var releases []*ct.Release
+	next, err := c.getPage(fmt.Sprintf("/apps/%s/releases", appID), opts, &releases)
+	return releases, next, err
+}
+
+// AppArtifactList returns a list of the artifacts used by the releases of an
+// app.
+func (c *Client) AppArtifactList(appID string) ([]*ct.Artifact, error) {
+	var artifacts []*ct.Artifact
+	return artifacts, c.getAll(fmt.Sprintf("/apps/%s/artifacts", appID), &artifacts)
 }
 
 // CreateKey uploads pubKey as the ssh public key.
@@ -460,5 +993,13 @@ func (c *Client) DeleteKey(id string) error {
 // ProviderList returns a list of all providers.
 func (c *Client) ProviderList() ([]*ct.Provider, error) {
 	var providers []*ct.Provider
-	return providers, c.Get("/providers", &providers)
+	return providers, c.getAll("/providers", &providers)
+}
+
+// ProviderListPage returns a page of providers with the given options, and
+// the cursor of the next page. It supports the filter "name".
+func (c *Client) ProviderListPage(opts *ListOptions) ([]*ct.Provider, string, error) {
+	var providers []*ct.Provider
+	next, err := c.getPage("/providers", opts, &providers)
+	return providers, next, err
 }
@@ -10,6 +10,7 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
@@ -74,7 +75,17 @@ func main() {
 		discoverd.Unregister("flynn-controller", addr)
 	})
 
-	handler, _ := appHandler(handlerConfig{db: db, cc: cc, sc: sc, dc: discoverd.DefaultClient, key: os.Getenv("AUTH_KEY")})
+	var secretsKey *[32]byte
+	if key := os.Getenv("SECRETS_KEY"); key != "" {
+		res, err := hex.DecodeString(key)
+		if err != nil || len(res) != 32 {
+			log.Fatalln("error decoding SECRETS_KEY: must be 32 hex encoded bytes")
+		}
+		secretsKey = &[32]byte{}
+		copy(secretsKey[:], res)
+	}
+
+	handler, _ := appHandler(handlerConfig{db: db, cc: cc, sc: sc, dc: discoverd.DefaultClient, key: os.Getenv("AUTH_KEY"), secretsKey: secretsKey})
 	log.Fatal(http.ListenAndServe(addr, handler))
 }
 
@@ -85,11 +96,13 @@ type dbWrapper interface {
 }
 
 type handlerConfig struct {
-	db  dbWrapper
-	cc  clusterClient
-	sc  routerc.Client
-	dc  *discoverd.Client
-	key string
+	db         dbWrapper
+	cc         clusterClient
+	sc         routerc.Client
+	dc         *discoverd.Client
+	rdc        resource.DiscoverdClient // finds resource providers, dc if nil
+	key        string
+	secretsKey *[32]byte
 }
 
 type ResponseHelper interface {
@@ -114,6 +127,10 @@ func (r *responseHelper) Error(err error) {
 			r.WriteHeader(404)
 			return
 		}
+		if err == ErrPreconditionFailed {
+			r.WriteHeader(412)
+			return
+		}
 		log.Println(err)
 		r.JSON(500, struct{}{})
 	}
@@ -137,33 +154,61 @@ func appHandler(c handlerConfig) (http.Handler, *martini.Martini) {
 
 	providerRepo := NewProviderRepo(d)
 	keyRepo := NewKeyRepo(d)
-	resourceRepo := NewResourceRepo(d)
-	appRepo := NewAppRepo(d, os.Getenv("DEFAULT_ROUTE_DOMAIN"), c.sc)
+	var rdc resource.DiscoverdClient = c.dc
+	if c.rdc != nil {
+		rdc = c.rdc
+	}
+	resourceRepo := NewResourceRepo(d, providerRepo, rdc)
+	logDrainRepo := NewLogDrainRepo(d, c.dc)
+	appRepo := NewAppRepo(d, os.Getenv("DEFAULT_ROUTE_DOMAIN"), c.sc, resourceRepo, logDrainRepo)
 	artifactRepo := NewArtifactRepo(d)
-	releaseRepo := NewReleaseRepo(d)
+	releaseRepo := NewReleaseRepo(d, artifactRepo, c.cc)
+	if n, err := strconv.Atoi(os.Getenv("RELEASE_RETENTION")); err == nil {
+		releaseRepo.retention = n
+	}
 	jobRepo := NewJobRepo(d)
-	formationRepo := NewFormationRepo(d, appRepo, releaseRepo, artifactRepo)
+	secretRepo := NewSecretRepo(d, c.secretsKey)
+	formationRepo := NewFormationRepo(d, appRepo, releaseRepo, artifactRepo, secretRepo)
+	webhookRepo := NewWebhookRepo(d, jobRepo, formationRepo)
+	if err := webhookRepo.start(); err != nil {
+		log.Printf("Error starting webhook deliveries: %s", err)
+	}
+	scheduleRepo := NewScheduleRepo(d, appRepo, releaseRepo, artifactRepo, secretRepo, c.cc)
+	scheduleRepo.start()
+	routerStats := c.sc.ServiceStats
+	if c.dc != nil {
+		routerStats = clusterRouterStats(c.dc)
+	}
+	autoscaleRepo := NewAutoscaleRepo(d, appRepo, releaseRepo, formationRepo, c.cc, routerStats)
+	autoscaleRepo.start()
 	m.Map(resourceRepo)
 	m.Map(appRepo)
 	m.Map(artifactRepo)
 	m.Map(releaseRepo)
 	m.Map(jobRepo)
 	m.Map(formationRepo)
+	m.Map(logDrainRepo)
+	m.Map(webhookRepo)
+	m.Map(scheduleRepo)
+	m.Map(autoscaleRepo)
+	m.Map(secretRepo)
 	m.Map(c.dc)
 	m.MapTo(c.cc, (*clusterClient)(nil))
 	m.MapTo(c.sc, (*routerc.Client)(nil))
-	m.MapTo(c.dc, (*resource.DiscoverdClient)(nil))
+	m.MapTo(rdc, (*resource.DiscoverdClient)(nil))
 
 	getAppMiddleware := crud("apps", ct.App{}, appRepo, r)
 	getReleaseMiddleware := crud("releases", ct.Release{}, releaseRepo, r)
 	getProviderMiddleware := crud("providers", ct.Provider{}, providerRepo, r)
 	crud("artifacts", ct.Artifact{}, artifactRepo, r)
 	crud("keys", ct.Key{}, keyRepo, r)
+	getWebhookMiddleware := crud("webhooks", ct.Webhook{}, webhookRepo, r)
 
 	r.Put("/apps/:apps_id/formations/:releases_id", getAppMiddleware, getReleaseMiddleware, binding.Bind(ct.Formation{}), putFormation)
 	r.Get("/apps/:apps_id/formations/:releases_id", getAppMiddleware, getFormationMiddleware, getFormation)
 	r.Delete("/apps/:apps_id/formations/:releases_id", getAppMiddleware, getFormationMiddleware, deleteFormation)
 	r.Get("/apps/:apps_id/formations", getAppMiddleware, listFormations)
+	r.Get("/apps/:apps_id/autoscale_decisions", getAppMiddleware, listAutoscaleDecisions)
 
 	r.Post("/apps/:apps_id/jobs", getAppMiddleware, binding.Bind(ct.NewJob{}), runJob)
 	r.Get("/apps/:apps_id/jobs/:jobs_id", getAppMiddleware, getJob)
@@ -171,21 +216,50 @@ func appHandler(c handlerConfig) (http.Handler, *martini.Martini) {
 	r.Get("/apps/:apps_id/jobs", getAppMiddleware, listJobs)
 	r.Delete("/apps/:apps_id/jobs/:jobs_id", getAppMiddleware, connectHostMiddleware, killJob)
 	r.Get("/apps/:apps_id/jobs/:jobs_id/log", getAppMiddleware, connectHostMiddleware, jobLog)
+	r.Get("/apps/:apps_id/jobs/:jobs_id/stats", getAppMiddleware, connectHostMiddleware, jobStats)
+	r.Get("/apps/:apps_id/log", getAppMiddleware, appLog)
+
+	r.Post("/apps/:apps_id/schedules", getAppMiddleware, binding.Bind(ct.Schedule{}), createSchedule)
+	r.Get("/apps/:apps_id/schedules", getAppMiddleware, listSchedules)
+	r.Get("/apps/:apps_id/schedules/:schedules_id", getAppMiddleware, getScheduleMiddleware, getSchedule)
+	r.Post("/apps/:apps_id/schedules/:schedules_id", getAppMiddleware, getScheduleMiddleware, binding.Bind(ct.Schedule{}), updateSchedule)
+	r.Delete("/apps/:apps_id/schedules/:schedules_id", getAppMiddleware, getScheduleMiddleware, deleteSchedule)
+	r.Get("/apps/:apps_id/schedules/:schedules_id/runs", getAppMiddleware, getScheduleMiddleware, listScheduleRuns)
 
 	r.Put("/apps/:apps_id/release", getAppMiddleware, binding.Bind(releaseID{}), setAppRelease)
 	r.Get("/apps/:apps_id/release", getAppMiddleware, getAppRelease)
+	r.Get("/apps/:apps_id/releases", getAppMiddleware, listAppReleases)
+	r.Get("/apps/:apps_id/artifacts", getAppMiddleware, listAppArtifacts)
+	r.Get("/apps/:apps_id/releases/:releases_id/secrets", getReleaseSecrets)
+
+	r.Get("/apps/:apps_id/secrets", getAppMiddleware, listAppSecrets)
+	r.Put("/apps/:apps_id/secrets", getAppMiddleware, updateAppSecrets)
 
 	r.Post("/providers/:providers_id/resources", getProviderMiddleware, binding.Bind(ct.ResourceReq{}), resourceServerMiddleware, provisionResource)
 	r.Get("/providers/:providers_id/resources", getProviderMiddleware, getProviderResources)
 	r.Get("/providers/:providers_id/resources/:resources_id", getProviderMiddleware, getResourceMiddleware, getResource)
 	r.Put("/providers/:providers_id/resources/:resources_id", getProviderMiddleware, binding.Bind(ct.Resource{}), putResource)
+	r.Delete("/providers/:providers_id/resources/:resources_id", getProviderMiddleware, getResourceMiddleware, deleteResource)
 	r.Get("/apps/:apps_id/resources", getAppMiddleware, getAppResources)
+	r.Put("/apps/:apps_id/resources/:resources_id", getAppMiddleware, getResourceMiddleware, attachResource)
+	r.Delete("/apps/:apps_id/resources/:resources_id", getAppMiddleware, getResourceMiddleware, detachResource)
+
+	r.Post("/apps/:apps_id/log_drains", getAppMiddleware, binding.Bind(ct.LogDrain{}), createLogDrain)
+	r.Get("/apps/:apps_id/log_drains", getAppMiddleware, listLogDrains)
+	r.Get("/apps/:apps_id/log_drains/:log_drains_id", getAppMiddleware, getLogDrainMiddleware, getLogDrain)
+	r.Delete("/apps/:apps_id/log_drains/:log_drains_id", getAppMiddleware, getLogDrainMiddleware, deleteLogDrain)
 
 	r.Post("/apps/:apps_id/routes", getAppMiddleware, binding.Bind(router.Route{}), createRoute)
 	r.Get("/apps/:apps_id/routes", getAppMiddleware, getRouteList)
 	r.Get("/apps/:apps_id/routes/:routes_type/:routes_id", getAppMiddleware, getRouteMiddleware, getRoute)
 	r.Delete("/apps/:apps_id/routes/:routes_type/:routes_id", getAppMiddleware, getRouteMiddleware, deleteRoute)
 
+	r.Post("/apps/:apps_id/webhooks", getAppMiddleware, binding.Bind(ct.Webhook{}), createAppWebhook)
+	r.Get("/apps/:apps_id/webhooks", getAppMiddleware, listAppWebhooks)
+	r.Get("/webhooks/:webhooks_id/deliveries", getWebhookMiddleware, listWebhookDeliveries)
+	r.Get("/webhooks/:webhooks_id/deliveries/:deliveries_id", getWebhookMiddleware, getWebhookDelivery)
+	r.Post("/webhooks/:webhooks_id/test", getWebhookMiddleware, testWebhook)
+
 	return rpcMuxHandler(m, rpcHandler(formationRepo), c.key), m
 }
 
@@ -205,6 +279,11 @@ func rpcMuxHandler(main http.Handler, rpch http.Handler, authKey string) http.Ha
 			w.WriteHeader(200)
 			return
 		}
+		// hosts fetching secrets are authorized by the handler
+		if r.Method == "GET" && secretsPathPattern.MatchString(r.URL.Path) {
+			main.ServeHTTP(w, r)
+			return
+		}
 		_, password, _ := parseBasicAuth(r.Header)
 		if password == "" && strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
 			password = r.URL.Query().Get("key")
@@ -221,7 +300,7 @@ func rpcMuxHandler(main http.Handler, rpch http.Handler, authKey string) http.Ha
 	})
 }
 
-func putFormation(formation ct.Formation, app *ct.App, release *ct.Release, repo *FormationRepo, r ResponseHelper) {
+func putFormation(req *http.Request, w http.ResponseWriter, formation ct.Formation, app *ct.App, release *ct.Release, repo *FormationRepo, releases *ReleaseRepo, r ResponseHelper) {
 	formation.AppID = app.ID
 	formation.ReleaseID = release.ID
 	if app.Protected {
@@ -232,7 +311,15 @@ func putFormation(formation ct.Formation, app *ct.App, release *ct.Release, repo
 			}
 		}
 	}
-	if err := repo.Add(&formation); err != nil {
+	if err := validateAutoscale(release, &formation); err != nil {
+		r.Error(err)
+		return
+	}
+	if err := releases.SetApp(release.ID, app.ID); err != nil {
+		r.Error(err)
+		return
+	}
+	if err := repo.AddIf(&formation, requestPrecondition(req)); err != nil {
 		r.Error(err)
 		return
 	}
@@ -248,12 +335,21 @@ func getFormationMiddleware(c martini.Context, app *ct.App, params martini.Param
 	c.Map(formation)
 }
 
-func getFormation(formation *ct.Formation, r ResponseHelper) {
+func getFormation(req *http.Request, w http.ResponseWriter, formation *ct.Formation, r ResponseHelper) {
+	tag, err := entityTag(formation)
+	if err != nil {
+		r.Error(err)
+		return
+	}
+	if !checkPreconditions(req, w, tag) {
+		return
+	}
+	w.Header().Set("ETag", tag)
 	r.JSON(200, formation)
 }
 
-func deleteFormation(formation *ct.Formation, repo *FormationRepo, r ResponseHelper) {
-	err := repo.Remove(formation.AppID, formation.ReleaseID)
+func deleteFormation(req *http.Request, formation *ct.Formation, repo *FormationRepo, r ResponseHelper) {
+	err := repo.RemoveIf(formation.AppID, formation.ReleaseID, requestPrecondition(req))
 	if err != nil {
 		r.Error(err)
 		return
@@ -261,12 +357,18 @@ func deleteFormation(formation *ct.Formation, repo *FormationRepo, r ResponseHel
 	r.WriteHeader(200)
 }
 
-func listFormations(app *ct.App, repo *FormationRepo, r ResponseHelper) {
-	list, err := repo.List(app.ID)
+func listFormations(req *http.Request, w http.ResponseWriter, app *ct.App, repo *FormationRepo, r ResponseHelper) {
+	opts, err := parseListOptions(req)
+	if err != nil {
+		r.Error(err)
+		return
+	}
+	list, next, err := repo.List(app.ID, opts)
 	if err != nil {
 		r.Error(err)
 		return
 	}
+	setNextPage(w, req, next)
 	r.JSON(200, list)
 }
 
@@ -274,7 +376,14 @@ type releaseID struct {
 	ID string `json:"id"`
 }
 
-func setAppRelease(app *ct.App, rid releaseID, apps *AppRepo, releases *ReleaseRepo, formations *FormationRepo, r ResponseHelper) {
+func setAppRelease(req *http.Request, w http.ResponseWriter, app *ct.App, rid releaseID, apps *AppRepo, releases *ReleaseRepo, formations *FormationRepo, artifacts *ArtifactRepo, secrets *SecretRepo, cl clusterClient, r ResponseHelper) {
+	// the precondition is checked before a release phase is run, and again
+	// when the release is deployed
+	cond := requestPrecondition(req)
+	if err := cond.check(apps.GetRelease(app.ID)); err != nil {
+		r.Error(err)
+		return
+	}
 	rel, err := releases.Get(rid.ID)
 	if err != nil {
 		if err == ErrNotFound {
@@ -286,41 +395,105 @@ func setAppRelease(app *ct.App, rid releaseID, apps *AppRepo, releases *ReleaseR
 		return
 	}
 	release := rel.(*ct.Release)
-	apps.SetRelease(app.ID, release.ID)
+	if _, ok := release.Processes[ct.ReleasePhaseType]; ok {
+		deployWithReleasePhase(req, w, app, release, cond, apps, releases, formations, artifacts, secrets, cl, r)
+		return
+	}
+	if err := deployRelease(app, release, cond, apps, releases, formations); err != nil {
+		r.Error(err)
+		return
+	}
+	r.JSON(200, release)
+}
+
+// deployRelease makes release the current release of app if cond is met by
+// the app's current release, moving the processes of the app's formation to
+// it, and then garbage collects the app's old releases.
+func deployRelease(app *ct.App, release *ct.Release, cond *precondition, apps *AppRepo, releases *ReleaseRepo, formations *FormationRepo) error {
+	if err := releases.SetApp(release.ID, app.ID); err != nil {
+		return err
+	}
+	if release.AppID == "" {
+		release.AppID = app.ID
+	}
+	if err := apps.SetRelease(app.ID, release.ID, cond); err != nil {
+		return err
+	}
 
 	// TODO: use transaction/lock
-	fs, err := formations.List(app.ID)
+	fs, _, err := formations.List(app.ID, &listOptions{})
 	if err != nil {
-		r.Error(err)
-		return
+		return err
 	}
 	if len(fs) == 1 && fs[0].ReleaseID != release.ID {
 		if err := formations.Add(&ct.Formation{
 			AppID:     app.ID,
 			ReleaseID: release.ID,
 			Processes: fs[0].Processes,
+			Autoscale: fs[0].Autoscale,
 		}); err != nil {
-			r.Error(err)
-			return
+			return err
 		}
 		if err := formations.Remove(app.ID, fs[0].ReleaseID); err != nil {
-			r.Error(err)
-			return
+			return err
 		}
 	}
-
-	r.JSON(200, release)
+	if err := releases.collectGarbage(app.ID); err != nil {
+		log.Printf("Error collecting old releases of app %s: %s", app.ID, err)
+	}
+	return nil
 }
 
-func getAppRelease(app *ct.App, apps *AppRepo, r ResponseHelper) {
+func getAppRelease(req *http.Request, w http.ResponseWriter, app *ct.App, apps *AppRepo, r ResponseHelper) {
 	release, err := apps.GetRelease(app.ID)
 	if err != nil {
 		r.Error(err)
 		return
 	}
+	tag, err := entityTag(release)
+	if err != nil {
+		r.Error(err)
+		return
+	}
+	if !checkPreconditions(req, w, tag) {
+		return
+	}
+	w.Header().Set("ETag", tag)
 	r.JSON(200, release)
 }
 
+func listAppReleases(req *http.Request, w http.ResponseWriter, app *ct.App, repo *ReleaseRepo, r ResponseHelper) {
+	opts, err := parseListOptions(req)
+	if err != nil {
+		r.Error(err)
+		return
+	}
+	opts.filters["app"] = app.ID
+	list, next, err := repo.List(opts)
+	if err != nil {
+		r.Error(err)
+		return
+	}
+	setNextPage(w, req, next)
+	r.JSON(200, list)
+}
+
+func listAppArtifacts(req *http.Request, w http.ResponseWriter, app *ct.App, repo *ArtifactRepo, r ResponseHelper) {
+	opts, err := parseListOptions(req)
+	if err != nil {
+		r.Error(err)
+		return
+	}
+	opts.filters["app"] = app.ID
+	list, next, err := repo.List(opts)
+	if err != nil {
+		r.Error(err)
+		return
+	}
+	setNextPage(w, req, next)
+	r.JSON(200, list)
+}
+
 func resourceServerMiddleware(c martini.Context, p *ct.Provider, dc resource.DiscoverdClient, r ResponseHelper) {
 	server, err := resource.NewServerWithDiscoverd(p.URL, dc)
 	if err != nil {
@@ -356,10 +529,11 @@ func provisionResource(rs *resource.Server, p *ct.Provider, req ct.ResourceReq,
 	}
 
 	res := &ct.Resource{
-		ProviderID: p.ID,
-		ExternalID: data.ID,
-		Env:        data.Env,
-		Apps:       req.Apps,
+		ProviderID:          p.ID,
+		ExternalID:          data.ID,
+		Env:                 data.Env,
+		Apps:                req.Apps,
+		DeprovisionWithApps: req.DeprovisionWithApps,
 	}
 	if err := repo.Add(res); err != nil {
 		// TODO: attempt to "rollback" provisioning
@@ -382,21 +556,45 @@ func getResource(resource *ct.Resource, r ResponseHelper) {
 	r.JSON(200, resource)
 }
 
-func getProviderResources(p *ct.Provider, repo *ResourceRepo, r ResponseHelper) {
-	res, err := repo.ProviderList(p.ID)
+func deleteResource(p *ct.Provider, resource *ct.Resource, repo *ResourceRepo, r ResponseHelper) {
+	if resource.ProviderID != p.ID {
+		r.Error(ErrNotFound)
+		return
+	}
+	if err := repo.Deprovision(resource); err != nil {
+		r.Error(err)
+		return
+	}
+	r.JSON(200, resource)
+}
+
+func getProviderResources(req *http.Request, w http.ResponseWriter, p *ct.Provider, repo *ResourceRepo, r ResponseHelper) {
+	opts, err := parseListOptions(req)
+	if err != nil {
+		r.Error(err)
+		return
+	}
+	res, next, err := repo.ProviderList(p.ID, opts)
 	if err != nil {
 		r.Error(err)
 		return
 	}
+	setNextPage(w, req, next)
 	r.JSON(200, res)
 }
 
-func getAppResources(app *ct.App, repo *ResourceRepo, r ResponseHelper) {
-	res, err := repo.AppList(app.ID)
+func getAppResources(req *http.Request, w http.ResponseWriter, app *ct.App, repo *ResourceRepo, r ResponseHelper) {
+	opts, err := parseListOptions(req)
+	if err != nil {
+		r.Error(err)
+		return
+	}
+	res, next, err := repo.AppList(app.ID, opts)
 	if err != nil {
 		r.Error(err)
 		return
 	}
+	setNextPage(w, req, next)
 	r.JSON(200, res)
 }
 
@@ -7,16 +7,21 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	. "github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-check"
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-sql"
 	_ "github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/pq"
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/go-martini/martini"
+	"github.com/flynn/flynn/controller/client"
 	tu "github.com/flynn/flynn/controller/testutils"
 	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/host/types"
 	"github.com/flynn/flynn/pkg/random"
 	"github.com/flynn/flynn/pkg/rpcplus"
 )
@@ -25,9 +30,10 @@ import (
 func Test(t *testing.T) { TestingT(t) }
 
 type S struct {
-	cc  *tu.FakeCluster
-	srv *httptest.Server
-	m   *martini.Martini
+	cc        *tu.FakeCluster
+	providers *resourceDiscoverd
+	srv       *httptest.Server
+	m         *martini.Martini
 }
 
 var _ = Suite(&S{})
@@ -66,7 +72,8 @@ func (s *S) SetUpSuite(c *C) {
 	dbw := testDBWrapper{DB: db, dsn: dsn}
 
 	s.cc = tu.NewFakeCluster()
-	handler, m := appHandler(handlerConfig{db: dbw, cc: s.cc, sc: newFakeRouter(), key: "test"})
+	s.providers = &resourceDiscoverd{}
+	handler, m := appHandler(handlerConfig{db: dbw, cc: s.cc, sc: newFakeRouter(), rdc: s.providers, key: "test", secretsKey: &[32]byte{1, 2, 3}})
 	s.m = m
 	s.srv = httptest.NewServer(handler)
 }
@@ -354,6 +361,44 @@ func (s *S) TestCreateRelease(c *C) {
 	}
 }
 
+func (s *S) TestCreateReleaseResources(c *C) {
+	in := &ct.Release{Processes: map[string]ct.ProcessType{
+		"web": {Resources: &ct.ProcessResources{Memory: 512 * 1024, CPUShares: 512, CPUQuota: 50000, MaxPIDs: 100, MaxOpenFiles: 4096}},
+	}}
+	out := s.createTestRelease(c, in)
+	c.Assert(out.Processes["web"].Resources, DeepEquals, in.Processes["web"].Resources)
+
+	in = &ct.Release{
+		ArtifactID: out.ArtifactID,
+		Processes: map[string]ct.ProcessType{
+			"web": {Resources: &ct.ProcessResources{CPUShares: -1}},
+		},
+	}
+	res, err := s.Post("/releases", in, &ct.Release{})
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 400)
+}
+
+func (s *S) TestCreateReleasePrepull(c *C) {
+	hostID := random.UUID()
+	s.cc.AddHost(hostID, host.Host{ID: hostID})
+	hc := tu.NewFakeHostClient(hostID)
+	s.cc.SetHostClient(hostID, hc)
+
+	artifact := s.createTestArtifact(c, &ct.Artifact{Type: "docker", URI: "https://registry.example.com/prepull?id=" + random.UUID()})
+	s.createTestRelease(c, &ct.Release{ArtifactID: artifact.ID})
+
+	timeout := time.After(5 * time.Second)
+	for len(hc.Pulls()) == 0 {
+		select {
+		case <-timeout:
+			c.Fatal("timed out waiting for image pull")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	c.Assert(hc.Pulls(), DeepEquals, []string{artifact.URI})
+}
+
 func (s *S) TestCreateFormation(c *C) {
 	for i, useName := range []bool{false, true} {
 		release := s.createTestRelease(c, &ct.Release{})
@@ -509,6 +554,147 @@ func (s *S) TestReleaseList(c *C) {
 	c.Assert(list[0].ID, Not(Equals), "")
 }
 
+func (s *S) TestReleaseListPagination(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "release-list-pagination"})
+	releases := make([]*ct.Release, 3)
+	for i := range releases {
+		releases[i] = s.createTestRelease(c, &ct.Release{})
+		s.createTestFormation(c, &ct.Formation{ReleaseID: releases[i].ID, AppID: app.ID})
+	}
+	// a release of another app is not listed
+	s.createTestRelease(c, &ct.Release{})
+
+	var list []ct.Release
+	res, err := s.Get("/releases?limit=2&app="+app.ID, &list)
+	c.Assert(err, IsNil)
+	c.Assert(list, HasLen, 2)
+	c.Assert(list[0].ID, Equals, releases[2].ID)
+	c.Assert(list[1].ID, Equals, releases[1].ID)
+
+	link := res.Header.Get("Link")
+	c.Assert(strings.HasSuffix(link, `>; rel="next"`), Equals, true)
+	next := strings.TrimSuffix(strings.TrimPrefix(link, "<"), `>; rel="next"`)
+	list = nil
+	res, err = s.Get(next, &list)
+	c.Assert(err, IsNil)
+	c.Assert(list, HasLen, 1)
+	c.Assert(list[0].ID, Equals, releases[0].ID)
+	c.Assert(res.Header.Get("Link"), Equals, "")
+
+	list = nil
+	_, err = s.Get("/releases?order=asc&app="+app.ID, &list)
+	c.Assert(err, IsNil)
+	c.Assert(list, HasLen, 3)
+	for i, r := range list {
+		c.Assert(r.ID, Equals, releases[i].ID)
+	}
+
+	// formations of the app are paginated in the same way
+	var formations []*ct.Formation
+	res, err = s.Get("/apps/"+app.ID+"/formations?limit=2", &formations)
+	c.Assert(err, IsNil)
+	c.Assert(formations, HasLen, 2)
+	c.Assert(formations[0].ReleaseID, Equals, releases[2].ID)
+	link = res.Header.Get("Link")
+	next = strings.TrimSuffix(strings.TrimPrefix(link, "<"), `>; rel="next"`)
+	formations = nil
+	_, err = s.Get(next, &formations)
+	c.Assert(err, IsNil)
+	c.Assert(formations, HasLen, 1)
+	c.Assert(formations[0].ReleaseID, Equals, releases[0].ID)
+
+	invalidID := encodeListCursor(nil, "not-a-uuid")
+	for _, path := range []string{"/releases?foo=bar", "/releases?limit=-1", "/releases?order=up", "/releases?cursor=invalid", "/releases?app=invalid", "/releases?cursor=" + invalidID} {
+		res, err = s.Get(path, &list)
+		c.Assert(res.StatusCode, Equals, 400, Commentf("path = %s", path))
+	}
+}
+
+func (s *S) TestAppReleaseList(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "app-release-list"})
+	owned := s.createTestRelease(c, &ct.Release{AppID: app.Name})
+	c.Assert(owned.AppID, Equals, app.ID)
+	deployed := s.createTestRelease(c, &ct.Release{})
+	c.Assert(deployed.AppID, Equals, "")
+	s.setAppRelease(c, app.ID, deployed.ID)
+	s.createTestRelease(c, &ct.Release{})
+
+	var list []ct.Release
+	_, err := s.Get("/apps/"+app.ID+"/releases", &list)
+	c.Assert(err, IsNil)
+	c.Assert(list, HasLen, 2)
+	c.Assert(list[0].ID, Equals, deployed.ID)
+	c.Assert(list[0].AppID, Equals, app.ID)
+	c.Assert(list[1].ID, Equals, owned.ID)
+
+	res, err := s.Post("/releases", &ct.Release{AppID: "missing-app", ArtifactID: owned.ArtifactID}, &ct.Release{})
+	c.Assert(res.StatusCode, Equals, 400)
+}
+
+func (s *S) TestListPageSize(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "list-page-size"})
+	for i := 0; i < defaultListLimit+1; i++ {
+		s.createTestRelease(c, &ct.Release{AppID: app.ID})
+	}
+
+	// a list without a limit is paginated with the default page size
+	var list []ct.Release
+	res, err := s.Get("/apps/"+app.ID+"/releases", &list)
+	c.Assert(err, IsNil)
+	c.Assert(list, HasLen, defaultListLimit)
+	c.Assert(res.Header.Get("Link"), Not(Equals), "")
+
+	opts, err := parseListOptions(&http.Request{URL: &url.URL{RawQuery: "limit=1000000"}})
+	c.Assert(err, IsNil)
+	c.Assert(opts.limit, Equals, maxListLimit)
+
+	// the client follows the pages of a list
+	cc, err := controller.NewClient(s.srv.URL, authKey)
+	c.Assert(err, IsNil)
+	releases, err := cc.AppReleaseList(app.ID)
+	c.Assert(err, IsNil)
+	c.Assert(releases, HasLen, defaultListLimit+1)
+}
+
+func (s *S) TestReleaseGarbageCollection(c *C) {
+	repo := s.m.Get(reflect.TypeOf(&ReleaseRepo{})).Interface().(*ReleaseRepo)
+	defer func(n int) { repo.retention = n }(repo.retention)
+	repo.retention = 2
+
+	app := s.createTestApp(c, &ct.App{Name: "release-gc"})
+	other := s.createTestApp(c, &ct.App{Name: "release-gc-other"})
+	releases := make([]*ct.Release, 4)
+	for i := range releases {
+		artifact := s.createTestArtifact(c, &ct.Artifact{Type: "docker", URI: fmt.Sprintf("https://example.com/release-gc?id=%d", i)})
+		releases[i] = s.createTestRelease(c, &ct.Release{AppID: app.ID, ArtifactID: artifact.ID})
+		s.setAppRelease(c, app.ID, releases[i].ID)
+		if i == 0 {
+			// the first release is still used by another app
+			s.setAppRelease(c, other.ID, releases[0].ID)
+		}
+	}
+
+	// the two most recent releases are kept, and so is the one other uses
+	for i, deleted := range []bool{false, true, false, false} {
+		res, _ := s.Get("/releases/"+releases[i].ID, &ct.Release{})
+		expected := 200
+		if deleted {
+			expected = 404
+		}
+		c.Assert(res.StatusCode, Equals, expected, Commentf("release %d", i))
+		res, _ = s.Get("/artifacts/"+releases[i].ArtifactID, &ct.Artifact{})
+		c.Assert(res.StatusCode, Equals, expected, Commentf("artifact %d", i))
+	}
+
+	// a collected artifact is restored when it is added again
+	artifact := s.createTestArtifact(c, &ct.Artifact{Type: "docker", URI: "https://example.com/release-gc?id=1"})
+	c.Assert(artifact.ID, Equals, releases[1].ArtifactID)
+	res, _ := s.Get("/artifacts/"+artifact.ID, &ct.Artifact{})
+	c.Assert(res.StatusCode, Equals, 200)
+	artifact = s.createTestArtifact(c, &ct.Artifact{Type: "docker", URI: "https://example.com/release-gc?id=1"})
+	c.Assert(artifact.ID, Equals, releases[1].ArtifactID)
+}
+
 func (s *S) TestKeyList(c *C) {
 	s.createTestKey(c, &ct.Key{Key: "ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAABAQCqE9AJti/17eigkIhA7+6TF9rdTVxjPv80UxIT6ELaNPHegqib5m94Wab4UoZAGtBPLKJs9o8LRO3H29X5q5eXCU5mwx4qQhcMEYkILWj0Y1T39Xi2RI3jiWcTsphAAYmy+uT2Nt740OK1FaQxfdzYx4cjsjtb8L82e35BkJE2TdjXWkeHxZWDZxMlZXme56jTNsqB2OuC0gfbAbrjSCkolvK1RJbBZSSBgKQrYXiyYjjLfcw2O0ZAKPBeS8ckVf6PO8s/+azZzJZ0Kl7YGHYEX3xRi6sJS0gsI4Y6+sddT1zT5kh0Bg3C8cKnZ1NiVXLH0pPKz68PhjWhwpOVUehD"})
 
@@ -579,6 +765,8 @@ func (s *S) TestSetAppRelease(c *C) {
 	app := s.createTestApp(c, &ct.App{Name: "set-release"})
 
 	out := s.setAppRelease(c, app.ID, release.ID)
+	// the app becomes the owner of the release when it is first deployed
+	release.AppID = app.ID
 	c.Assert(out, DeepEquals, release)
 
 	gotRelease := &ct.Release{}
@@ -11,15 +11,21 @@ import (
 type Repository interface {
 	Add(thing interface{}) error
 	Get(id string) (interface{}, error)
-	List() (interface{}, error)
+	List(opts *listOptions) (list interface{}, next string, err error)
 }
 
 type Remover interface {
 	Remove(string) error
 }
 
+// ConditionalRemover is implemented by repos of things which change, so that
+// the precondition of a delete request is checked in its transaction.
+type ConditionalRemover interface {
+	RemoveIf(string, *precondition) error
+}
+
 type Updater interface {
-	Update(string, map[string]interface{}) (interface{}, error)
+	Update(string, map[string]interface{}, *precondition) (interface{}, error)
 }
 
 func crud(resource string, example interface{}, repo Repository, r martini.Router) interface{} {
@@ -53,21 +59,56 @@ func crud(resource string, example interface{}, repo Repository, r martini.Route
 	}
 
 	singletonPath := prefix + "/:" + resource + "_id"
-	r.Get(singletonPath, lookup, func(c martini.Context, r ResponseHelper) {
+	// checkCurrent evaluates the preconditions of a request against the
+	// current state of the thing found by lookup
+	checkCurrent := func(c martini.Context, req *http.Request, w http.ResponseWriter, r ResponseHelper) {
+		thing := c.Get(resourcePtr).Interface()
+		if req.Method != "GET" {
+			// things of repos which are not a ConditionalRemover don't
+			// change, so checking before the delete is enough
+			if err := requestPrecondition(req).check(thing, nil); err != nil {
+				r.Error(err)
+			}
+			return
+		}
+		tag, err := entityTag(thing)
+		if err != nil {
+			r.Error(err)
+			return
+		}
+		if checkPreconditions(req, w, tag) {
+			w.Header().Set("ETag", tag)
+		}
+	}
+
+	r.Get(singletonPath, lookup, checkCurrent, func(c martini.Context, r ResponseHelper) {
 		r.JSON(200, c.Get(resourcePtr).Interface())
 	})
 
-	r.Get(prefix, func(r ResponseHelper) {
-		list, err := repo.List()
+	r.Get(prefix, func(req *http.Request, w http.ResponseWriter, r ResponseHelper) {
+		opts, err := parseListOptions(req)
+		if err != nil {
+			r.Error(err)
+			return
+		}
+		list, next, err := repo.List(opts)
 		if err != nil {
 			r.Error(err)
 			return
 		}
+		setNextPage(w, req, next)
 		r.JSON(200, list)
 	})
 
-	if remover, ok := repo.(Remover); ok {
-		r.Delete(singletonPath, lookup, func(params martini.Params, r ResponseHelper) {
+	if remover, ok := repo.(ConditionalRemover); ok {
+		r.Delete(singletonPath, lookup, func(params martini.Params, req *http.Request, r ResponseHelper) {
+			if err := remover.RemoveIf(params[resource+"_id"], requestPrecondition(req)); err != nil {
+				r.Error(err)
+				return
+			}
+		})
+	} else if remover, ok := repo.(Remover); ok {
+		r.Delete(singletonPath, lookup, checkCurrent, func(params martini.Params, r ResponseHelper) {
 			if err := remover.Remove(params[resource+"_id"]); err != nil {
 				r.Error(err)
 				return
@@ -76,13 +117,13 @@ func crud(resource string, example interface{}, repo Repository, r martini.Route
 	}
 
 	if updater, ok := repo.(Updater); ok {
-		r.Post(singletonPath, func(params martini.Params, req *http.Request, r ResponseHelper) {
+		r.Post(singletonPath, lookup, func(params martini.Params, req *http.Request, r ResponseHelper) {
 			var data map[string]interface{}
 			if err := json.NewDecoder(req.Body).Decode(&data); err != nil {
 				r.Error(err)
 				return
 			}
-			app, err := updater.Update(params[resource+"_id"], data)
+			app, err := updater.Update(params[resource+"_id"], data, requestPrecondition(req))
 			if err != nil {
 				r.Error(err)
 				return
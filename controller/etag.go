@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// entityTag returns a strong entity tag of the JSON representation of v,
+// which changes whenever any field of v does.
+func entityTag(v interface{}) (string, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	sum := sha1.Sum(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`, nil
+}
+
+// currentEntityTag returns the entity tag of a resource as returned by a repo
+// lookup, which is empty if the lookup failed with ErrNotFound.
+func currentEntityTag(v interface{}, err error) (string, error) {
+	if err == ErrNotFound {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	return entityTag(v)
+}
+
+// ErrPreconditionFailed is returned by a conditional write when the current
+// state of the resource does not meet its precondition.
+var ErrPreconditionFailed = errors.New("controller: precondition failed")
+
+// precondition is the If-Match and If-None-Match headers of a write request.
+// Repos check it in the transaction of the write after locking the resource,
+// so that another write can't happen between the check and the write.
+type precondition struct {
+	ifMatch, ifNoneMatch string
+}
+
+// requestPrecondition returns the precondition of a request, which is nil if
+// it has neither header.
+func requestPrecondition(req *http.Request) *precondition {
+	p := &precondition{ifMatch: req.Header.Get("If-Match"), ifNoneMatch: req.Header.Get("If-None-Match")}
+	if p.ifMatch == "" && p.ifNoneMatch == "" {
+		return nil
+	}
+	return p
+}
+
+// met returns whether the precondition is met by the entity tag of the
+// current state of a resource, which is empty if it does not exist.
+func (p *precondition) met(current string) bool {
+	if p.ifMatch != "" && !matchTags(p.ifMatch, current, false) {
+		return false
+	}
+	return p.ifNoneMatch == "" || !matchTags(p.ifNoneMatch, current, true)
+}
+
+// check returns ErrPreconditionFailed if the precondition is not met by a
+// resource as returned by a repo lookup, or the error of the lookup unless it
+// is ErrNotFound. A nil precondition is always met.
+func (p *precondition) check(v interface{}, err error) error {
+	tag, err := currentEntityTag(v, err)
+	if err != nil || p == nil {
+		return err
+	}
+	if !p.met(tag) {
+		return ErrPreconditionFailed
+	}
+	return nil
+}
+
+// checkPreconditions evaluates the If-Match and If-None-Match headers of a
+// GET request against the entity tag of the current state of the resource.
+// If they are not met it responds with 304 Not Modified, or 412 Precondition
+// Failed if If-Match failed, and returns false. Writes check the
+// precondition of the request in their transaction instead.
+func checkPreconditions(req *http.Request, w http.ResponseWriter, current string) bool {
+	p := requestPrecondition(req)
+	if p == nil || p.met(current) {
+		return true
+	}
+	if p.ifMatch != "" && !matchTags(p.ifMatch, current, false) {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return false
+	}
+	w.Header().Set("ETag", current)
+	w.WriteHeader(http.StatusNotModified)
+	return false
+}
+
+// matchTags returns whether the comma separated list of entity tags in a
+// header matches tag, using the weak comparison if weak is set. "*" matches
+// any existing resource.
+func matchTags(header, tag string, weak bool) bool {
+	if tag == "" {
+		return false
+	}
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimSpace(t)
+		if t == "*" {
+			return true
+		}
+		if weak {
+			t = strings.TrimPrefix(t, "W/")
+		} else if strings.HasPrefix(t, "W/") {
+			continue
+		}
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
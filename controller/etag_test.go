@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+
+	. "github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-check"
+	"github.com/flynn/flynn/controller/client"
+	tu "github.com/flynn/flynn/controller/testutils"
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/host/types"
+	"github.com/flynn/flynn/pkg/cluster"
+	"github.com/flynn/flynn/pkg/random"
+)
+
+// conditional performs a request with the given precondition headers and
+// returns the response status code and ETag.
+func (s *S) conditional(c *C, method, path string, header http.Header, in interface{}) (int, string) {
+	var body []byte
+	if in != nil {
+		var err error
+		body, err = json.Marshal(in)
+		c.Assert(err, IsNil)
+	}
+	req, err := http.NewRequest(method, s.srv.URL+path, bytes.NewReader(body))
+	c.Assert(err, IsNil)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.SetBasicAuth("", authKey)
+	res, err := http.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	res.Body.Close()
+	return res.StatusCode, res.Header.Get("ETag")
+}
+
+func ifMatch(tag string) http.Header {
+	return http.Header{"If-Match": {tag}}
+}
+
+func (s *S) TestAppETag(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "app-etag"})
+	path := "/apps/" + app.ID
+
+	status, tag := s.conditional(c, "GET", path, nil, nil)
+	c.Assert(status, Equals, 200)
+	c.Assert(tag, Not(Equals), "")
+	status, _ = s.conditional(c, "GET", path, http.Header{"If-None-Match": {tag}}, nil)
+	c.Assert(status, Equals, 304)
+
+	update := map[string]interface{}{"meta": map[string]string{"foo": "bar"}}
+	status, _ = s.conditional(c, "POST", path, ifMatch(`"stale"`), update)
+	c.Assert(status, Equals, 412)
+	status, _ = s.conditional(c, "POST", path, ifMatch(tag), update)
+	c.Assert(status, Equals, 200)
+
+	// the tag changes with the app
+	status, newTag := s.conditional(c, "GET", path, nil, nil)
+	c.Assert(status, Equals, 200)
+	c.Assert(newTag, Not(Equals), tag)
+	status, _ = s.conditional(c, "DELETE", path, ifMatch(tag), nil)
+	c.Assert(status, Equals, 412)
+	status, _ = s.conditional(c, "DELETE", path, ifMatch(newTag), nil)
+	c.Assert(status, Equals, 200)
+}
+
+func (s *S) TestFormationETag(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "formation-etag"})
+	release := s.createTestRelease(c, &ct.Release{})
+	path := formationPath(app.ID, release.ID)
+	formation := &ct.Formation{Processes: map[string]int{"web": 1}}
+
+	status, _ := s.conditional(c, "PUT", path, ifMatch("*"), formation)
+	c.Assert(status, Equals, 412)
+	status, _ = s.conditional(c, "PUT", path, http.Header{"If-None-Match": {"*"}}, formation)
+	c.Assert(status, Equals, 200)
+	status, _ = s.conditional(c, "PUT", path, http.Header{"If-None-Match": {"*"}}, formation)
+	c.Assert(status, Equals, 412)
+
+	status, tag := s.conditional(c, "GET", path, nil, nil)
+	c.Assert(status, Equals, 200)
+	formation.Processes["web"] = 2
+	status, _ = s.conditional(c, "PUT", path, ifMatch(tag), formation)
+	c.Assert(status, Equals, 200)
+	status, _ = s.conditional(c, "PUT", path, ifMatch(tag), formation)
+	c.Assert(status, Equals, 412)
+	status, _ = s.conditional(c, "DELETE", path, ifMatch(tag), nil)
+	c.Assert(status, Equals, 412)
+}
+
+func (s *S) TestAppReleaseETag(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "app-release-etag"})
+	first := s.createTestRelease(c, &ct.Release{})
+	second := s.createTestRelease(c, &ct.Release{})
+	path := "/apps/" + app.ID + "/release"
+
+	status, _ := s.conditional(c, "PUT", path, http.Header{"If-None-Match": {"*"}}, &ct.Release{ID: first.ID})
+	c.Assert(status, Equals, 200)
+	status, tag := s.conditional(c, "GET", path, nil, nil)
+	c.Assert(status, Equals, 200)
+
+	status, _ = s.conditional(c, "PUT", path, ifMatch(tag), &ct.Release{ID: second.ID})
+	c.Assert(status, Equals, 200)
+	// a deploy based on the first release is rejected
+	status, _ = s.conditional(c, "PUT", path, ifMatch(tag), &ct.Release{ID: first.ID})
+	c.Assert(status, Equals, 412)
+}
+
+func (s *S) TestAppReleaseETagReleasePhase(c *C) {
+	// the release phase job runs until its exit status is written
+	hostID := random.UUID()
+	hc := tu.NewFakeHostClient(hostID)
+	attached := make(chan struct{})
+	pipeR, pipeW := io.Pipe()
+	hc.SetAttachFunc("*", func(req *host.AttachReq, wait bool) (cluster.AttachClient, error) {
+		close(attached)
+		return cluster.NewAttachClient(struct {
+			io.Reader
+			io.WriteCloser
+		}{pipeR, pipeW}), nil
+	})
+	s.cc.SetHostClient(hostID, hc)
+	s.cc.SetHosts(map[string]host.Host{hostID: {}})
+
+	app := s.createTestApp(c, &ct.App{Name: "app-release-etag-release-phase"})
+	s.setAppRelease(c, app.ID, s.createTestRelease(c, &ct.Release{}).ID)
+	path := "/apps/" + app.ID + "/release"
+	status, tag := s.conditional(c, "GET", path, nil, nil)
+	c.Assert(status, Equals, 200)
+
+	// a deploy with the same tag happens while the release phase runs
+	release := s.createReleasePhaseRelease(c)
+	statuses := make(chan int)
+	go func() {
+		status, _ := s.conditional(c, "PUT", path, ifMatch(tag), &ct.Release{ID: release.ID})
+		statuses <- status
+	}()
+	<-attached
+	other := s.createTestRelease(c, &ct.Release{})
+	status, _ = s.conditional(c, "PUT", path, ifMatch(tag), &ct.Release{ID: other.ID})
+	c.Assert(status, Equals, 200)
+
+	var exit [5]byte
+	exit[0] = host.AttachExit
+	go pipeW.Write(exit[:])
+	c.Assert(<-statuses, Equals, 412)
+
+	current := &ct.Release{}
+	res, err := s.Get(path, current)
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 200)
+	c.Assert(current.ID, Equals, other.ID)
+}
+
+func (s *S) TestClientUpdateAppRelease(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "client-update-release"})
+	cc, err := controller.NewClient(s.srv.URL, authKey)
+	c.Assert(err, IsNil)
+
+	set := func(k, v string) func(*ct.Release) error {
+		return func(r *ct.Release) error {
+			if r.ArtifactID == "" {
+				r.ArtifactID = s.createTestArtifact(c, &ct.Artifact{}).ID
+			}
+			if r.Env == nil {
+				r.Env = make(map[string]string)
+			}
+			r.Env[k] = v
+			return nil
+		}
+	}
+	_, err = cc.UpdateAppRelease(app.ID, set("A", "1"))
+	c.Assert(err, IsNil)
+
+	// another update which happens while B is set is not lost
+	var attempts int
+	release, err := cc.UpdateAppRelease(app.ID, func(r *ct.Release) error {
+		if attempts++; attempts == 1 {
+			_, err := cc.UpdateAppRelease(app.ID, set("C", "3"))
+			c.Assert(err, IsNil)
+		}
+		return set("B", "2")(r)
+	})
+	c.Assert(err, IsNil)
+	c.Assert(attempts, Equals, 2)
+	c.Assert(release.Env, DeepEquals, map[string]string{"A": "1", "B": "2", "C": "3"})
+
+	current, err := cc.GetAppRelease(app.ID)
+	c.Assert(err, IsNil)
+	c.Assert(current.ID, Equals, release.ID)
+}
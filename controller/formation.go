@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"strconv"
 	"strings"
@@ -22,18 +23,20 @@ type FormationRepo struct {
 	apps      *AppRepo
 	releases  *ReleaseRepo
 	artifacts *ArtifactRepo
+	secrets   *SecretRepo
 
 	subscriptions map[chan<- *ct.ExpandedFormation]struct{}
 	stopListener  chan struct{}
 	subMtx        sync.RWMutex
 }
 
-func NewFormationRepo(db *DB, appRepo *AppRepo, releaseRepo *ReleaseRepo, artifactRepo *ArtifactRepo) *FormationRepo {
+func NewFormationRepo(db *DB, appRepo *AppRepo, releaseRepo *ReleaseRepo, artifactRepo *ArtifactRepo, secretRepo *SecretRepo) *FormationRepo {
 	return &FormationRepo{
 		db:            db,
 		apps:          appRepo,
 		releases:      releaseRepo,
 		artifacts:     artifactRepo,
+		secrets:       secretRepo,
 		subscriptions: make(map[chan<- *ct.ExpandedFormation]struct{}),
 		stopListener:  make(chan struct{}),
 	}
@@ -48,25 +51,65 @@ func procsHstore(m map[string]int) hstore.Hstore {
 
 }
 
+const formationColumns = "app_id, release_id, processes, autoscale, created_at, updated_at"
+
 func (r *FormationRepo) Add(f *ct.Formation) error {
+	return r.AddIf(f, nil)
+}
+
+// AddIf adds or updates a formation if cond is met by the current formation.
+// The row of the app is locked, so that writes of the formations of an app
+// are serialized.
+func (r *FormationRepo) AddIf(f *ct.Formation, cond *precondition) error {
 	// TODO: actually validate
 	procs := procsHstore(f.Processes)
-	err := r.db.QueryRow("INSERT INTO formations (app_id, release_id, processes) VALUES ($1, $2, $3) RETURNING created_at, updated_at",
-		f.AppID, f.ReleaseID, procs).Scan(&f.CreatedAt, &f.UpdatedAt)
-	if e, ok := err.(*pq.Error); ok && e.Code.Name() == "unique_violation" {
-		err = r.db.QueryRow("UPDATE formations SET processes = $3, updated_at = now(), deleted_at = NULL WHERE app_id = $1 AND release_id = $2 RETURNING created_at, updated_at",
-			f.AppID, f.ReleaseID, procs).Scan(&f.CreatedAt, &f.UpdatedAt)
+	autoscale, err := autoscaleJSON(f.Autoscale)
+	if err != nil {
+		return err
 	}
+	tx, err := r.db.Begin()
 	if err != nil {
 		return err
 	}
-	return nil
+	if err := lockFormation(tx, f.AppID, f.ReleaseID, cond); err != nil {
+		tx.Rollback()
+		return err
+	}
+	err = tx.QueryRow("UPDATE formations SET processes = $3, autoscale = $4, updated_at = now(), deleted_at = NULL WHERE app_id = $1 AND release_id = $2 RETURNING created_at, updated_at",
+		f.AppID, f.ReleaseID, procs, autoscale).Scan(&f.CreatedAt, &f.UpdatedAt)
+	if err == sql.ErrNoRows {
+		err = tx.QueryRow("INSERT INTO formations (app_id, release_id, processes, autoscale) VALUES ($1, $2, $3, $4) RETURNING created_at, updated_at",
+			f.AppID, f.ReleaseID, procs, autoscale).Scan(&f.CreatedAt, &f.UpdatedAt)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// lockFormation locks the row of an app and checks cond against its formation
+// for a release.
+func lockFormation(tx *dbTx, appID, releaseID string, cond *precondition) error {
+	if _, err := tx.Exec("SELECT app_id FROM apps WHERE app_id = $1 FOR UPDATE", appID); err != nil {
+		return err
+	}
+	return cond.check(scanFormation(tx.QueryRow("SELECT "+formationColumns+" FROM formations WHERE app_id = $1 AND release_id = $2 AND deleted_at IS NULL", appID, releaseID)))
+}
+
+func autoscaleJSON(autoscale map[string]*ct.AutoscaleConfig) (sql.NullString, error) {
+	if len(autoscale) == 0 {
+		return sql.NullString{}, nil
+	}
+	data, err := json.Marshal(autoscale)
+	return sql.NullString{String: string(data), Valid: err == nil}, err
 }
 
 func scanFormation(s Scanner) (*ct.Formation, error) {
 	f := &ct.Formation{}
 	var procs hstore.Hstore
-	err := s.Scan(&f.AppID, &f.ReleaseID, &procs, &f.CreatedAt, &f.UpdatedAt)
+	var autoscale sql.NullString
+	err := s.Scan(&f.AppID, &f.ReleaseID, &procs, &autoscale, &f.CreatedAt, &f.UpdatedAt)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			err = ErrNotFound
@@ -80,39 +123,74 @@ func scanFormation(s Scanner) (*ct.Formation, error) {
 			f.Processes[k] = n
 		}
 	}
+	if autoscale.Valid {
+		if err := json.Unmarshal([]byte(autoscale.String), &f.Autoscale); err != nil {
+			return nil, err
+		}
+	}
 	f.AppID = cleanUUID(f.AppID)
 	f.ReleaseID = cleanUUID(f.ReleaseID)
 	return f, nil
 }
 
 func (r *FormationRepo) Get(appID, releaseID string) (*ct.Formation, error) {
-	row := r.db.QueryRow("SELECT app_id, release_id, processes, created_at, updated_at FROM formations WHERE app_id = $1 AND release_id = $2 AND deleted_at IS NULL", appID, releaseID)
+	row := r.db.QueryRow("SELECT "+formationColumns+" FROM formations WHERE app_id = $1 AND release_id = $2 AND deleted_at IS NULL", appID, releaseID)
 	return scanFormation(row)
 }
 
-func (r *FormationRepo) List(appID string) ([]*ct.Formation, error) {
-	rows, err := r.db.Query("SELECT app_id, release_id, processes, created_at, updated_at FROM formations WHERE app_id = $1 AND deleted_at IS NULL ORDER BY created_at DESC", appID)
+func (r *FormationRepo) List(appID string, opts *listOptions) ([]*ct.Formation, string, error) {
+	if err := opts.checkFilters(); err != nil {
+		return nil, "", err
+	}
+	q := newListQuery("SELECT "+formationColumns+" FROM formations WHERE app_id = $1 AND deleted_at IS NULL", "release_id")
+	q.args = append(q.args, appID)
+	query, args, err := q.build(opts)
 	if err != nil {
-		return nil, err
+		return nil, "", err
+	}
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return nil, "", err
 	}
 	formations := []*ct.Formation{}
 	for rows.Next() {
 		formation, err := scanFormation(rows)
 		if err != nil {
 			rows.Close()
-			return nil, err
+			return nil, "", err
 		}
 		formations = append(formations, formation)
 	}
-	return formations, nil
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+	n, next := opts.page(len(formations), func(i int) (*time.Time, string) { return formations[i].CreatedAt, formations[i].ReleaseID })
+	return formations[:n], next, nil
 }
 
 func (r *FormationRepo) Remove(appID, releaseID string) error {
-	err := r.db.Exec("UPDATE formations SET deleted_at = now(), processes = NULL, updated_at = now() WHERE app_id = $1 AND release_id = $2", appID, releaseID)
+	return r.RemoveIf(appID, releaseID, nil)
+}
+
+// RemoveIf removes a formation if cond is met by the current formation.
+func (r *FormationRepo) RemoveIf(appID, releaseID string, cond *precondition) error {
+	tx, err := r.db.Begin()
 	if err != nil {
 		return err
 	}
-	return nil
+	if err := lockFormation(tx, appID, releaseID, cond); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec("UPDATE formations SET deleted_at = now(), processes = NULL, autoscale = NULL, updated_at = now() WHERE app_id = $1 AND release_id = $2", appID, releaseID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM autoscale_samples WHERE app_id = $1 AND release_id = $2", appID, releaseID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
 }
 
 func (r *FormationRepo) publish(appID, releaseID string) {
@@ -161,6 +239,9 @@ func (r *FormationRepo) expandFormation(formation *ct.Formation) (*ct.ExpandedFo
 		Processes: formation.Processes,
 		UpdatedAt: *formation.UpdatedAt,
 	}
+	if len(f.Release.Secrets) > 0 {
+		f.SecretsToken = r.secrets.token(f.App.ID, f.Release.ID)
+	}
 	return f, nil
 }
 
@@ -208,7 +289,7 @@ func (r *FormationRepo) Subscribe(ch chan<- *ct.ExpandedFormation, since time.Ti
 }
 
 func (r *FormationRepo) sendUpdatedSince(ch chan<- *ct.ExpandedFormation, since time.Time) error {
-	rows, err := r.db.Query("SELECT app_id, release_id, processes, created_at, updated_at FROM formations WHERE updated_at >= $1 ORDER BY updated_at DESC", since)
+	rows, err := r.db.Query("SELECT "+formationColumns+" FROM formations WHERE updated_at >= $1 ORDER BY updated_at DESC", since)
 	if err != nil {
 		return err
 	}
@@ -29,7 +29,7 @@ func NewJobRepo(db *DB) *JobRepo {
 }
 
 func (r *JobRepo) Get(id string) (*ct.Job, error) {
-	row := r.db.QueryRow("SELECT concat(host_id, '-', job_id), app_id, release_id, process_type, state, created_at, updated_at FROM job_cache WHERE concat(host_id, '-', job_id) = $1", id)
+	row := r.db.QueryRow("SELECT concat(host_id, '-', job_id), app_id, release_id, process_type, state, oom_kills, exit_status, created_at, updated_at FROM job_cache WHERE concat(host_id, '-', job_id) = $1", id)
 	return scanJob(row)
 }
 
@@ -40,47 +40,98 @@ func (r *JobRepo) Add(job *ct.Job) error {
 		return ErrNotFound
 	}
 	// TODO: actually validate
-	err = r.db.QueryRow("INSERT INTO job_cache (job_id, host_id, app_id, release_id, process_type, state) VALUES ($1, $2, $3, $4, $5, $6) RETURNING created_at, updated_at",
-		jobID, hostID, job.AppID, job.ReleaseID, job.Type, job.State).Scan(&job.CreatedAt, &job.UpdatedAt)
+	// the run of the job of a schedule is updated first, as jobs of
+	// releases without a formation are not cached
+	if job.Meta["flynn-controller.schedule"] != "" {
+		if err := r.db.Exec("UPDATE schedule_runs SET job_state = $3, exit_status = $4, updated_at = now() WHERE job_id = $1 AND host_id = $2",
+			jobID, hostID, job.State, job.ExitStatus); err != nil {
+			return err
+		}
+	}
+	var prevState string
+	err = r.db.QueryRow("INSERT INTO job_cache (job_id, host_id, app_id, release_id, process_type, state, oom_kills, exit_status) VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING created_at, updated_at",
+		jobID, hostID, job.AppID, job.ReleaseID, job.Type, job.State, job.OOMKills, job.ExitStatus).Scan(&job.CreatedAt, &job.UpdatedAt)
 	if e, ok := err.(*pq.Error); ok && e.Code.Name() == "unique_violation" {
-		err = r.db.QueryRow("UPDATE job_cache SET state = $3, updated_at = now() WHERE job_id = $1 AND host_id = $2 RETURNING created_at, updated_at",
-			jobID, hostID, job.State).Scan(&job.CreatedAt, &job.UpdatedAt)
+		// prev is the row as it was before the update
+		err = r.db.QueryRow("UPDATE job_cache j SET state = $3, oom_kills = $4, exit_status = $5, updated_at = now() FROM job_cache prev WHERE j.job_id = $1 AND j.host_id = $2 AND prev.job_id = j.job_id AND prev.host_id = j.host_id RETURNING prev.state, j.created_at, j.updated_at",
+			jobID, hostID, job.State, job.OOMKills, job.ExitStatus).Scan(&prevState, &job.CreatedAt, &job.UpdatedAt)
 	}
 	if err != nil {
 		return err
 	}
+	// updates which do not change the state, like a count of OOM kills of a
+	// running job, are not events
+	if prevState == job.State {
+		return nil
+	}
 	return r.db.Exec("INSERT INTO job_events (job_id, host_id, app_id, state) VALUES ($1, $2, $3, $4)", jobID, hostID, job.AppID, job.State)
 }
 
 func scanJob(s Scanner) (*ct.Job, error) {
 	job := &ct.Job{}
-	err := s.Scan(&job.ID, &job.AppID, &job.ReleaseID, &job.Type, &job.State, &job.CreatedAt, &job.UpdatedAt)
+	var exitStatus sql.NullInt64
+	err := s.Scan(&job.ID, &job.AppID, &job.ReleaseID, &job.Type, &job.State, &job.OOMKills, &exitStatus, &job.CreatedAt, &job.UpdatedAt)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			err = ErrNotFound
 		}
 		return nil, err
 	}
+	if exitStatus.Valid {
+		status := int(exitStatus.Int64)
+		job.ExitStatus = &status
+	}
 	job.AppID = cleanUUID(job.AppID)
 	job.ReleaseID = cleanUUID(job.ReleaseID)
 	return job, nil
 }
 
-func (r *JobRepo) List(appID string) ([]*ct.Job, error) {
-	rows, err := r.db.Query("SELECT concat(host_id, '-', job_id), app_id, release_id, process_type, state, created_at, updated_at FROM job_cache WHERE app_id = $1 ORDER BY created_at DESC", appID)
+func (r *JobRepo) List(appID string, opts *listOptions) ([]*ct.Job, string, error) {
+	if err := opts.checkFilters("state", "type", "release"); err != nil {
+		return nil, "", err
+	}
+	q := newListQuery("SELECT concat(host_id, '-', job_id), app_id, release_id, process_type, state, oom_kills, exit_status, created_at, updated_at FROM job_cache WHERE app_id = $1", "concat(host_id, '-', job_id)")
+	q.textID = true
+	q.args = append(q.args, appID)
+	if state, ok := opts.filters["state"]; ok {
+		switch state {
+		case "starting", "up", "down", "crashed", "oom":
+		default:
+			return nil, "", ct.ValidationError{Field: "state", Message: "is invalid"}
+		}
+		q.where("state = $%d", state)
+	}
+	if typ, ok := opts.filters["type"]; ok {
+		q.where("process_type = $%d", typ)
+	}
+	if releaseID, ok := opts.filters["release"]; ok {
+		if !idPattern.MatchString(releaseID) {
+			return nil, "", ct.ValidationError{Field: "release", Message: "is invalid"}
+		}
+		q.where("release_id = $%d", releaseID)
+	}
+	query, args, err := q.build(opts)
 	if err != nil {
-		return nil, err
+		return nil, "", err
+	}
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return nil, "", err
 	}
 	jobs := []*ct.Job{}
 	for rows.Next() {
 		job, err := scanJob(rows)
 		if err != nil {
 			rows.Close()
-			return nil, err
+			return nil, "", err
 		}
 		jobs = append(jobs, job)
 	}
-	return jobs, nil
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+	n, next := opts.page(len(jobs), func(i int) (*time.Time, string) { return jobs[i].CreatedAt, jobs[i].ID })
+	return jobs[:n], next, nil
 }
 
 func (r *JobRepo) listEvents(appID string, sinceID int64, count int) ([]*ct.JobEvent, error) {
@@ -138,11 +189,17 @@ func listJobs(req *http.Request, w http.ResponseWriter, app *ct.App, repo *JobRe
 		}
 		return
 	}
-	list, err := repo.List(app.ID)
+	opts, err := parseListOptions(req)
+	if err != nil {
+		r.Error(err)
+		return
+	}
+	list, next, err := repo.List(app.ID, opts)
 	if err != nil {
 		r.Error(err)
 		return
 	}
+	setNextPage(w, req, next)
 	r.JSON(200, list)
 }
 
@@ -223,6 +280,77 @@ func jobLog(req *http.Request, app *ct.App, params martini.Params, hc cluster.Ho
 	}
 }
 
+func jobStats(req *http.Request, app *ct.App, params martini.Params, hc cluster.Host, w http.ResponseWriter, r ResponseHelper) {
+	ch := make(chan *host.JobStats)
+	stream := hc.JobStats(params["jobs_id"], ch)
+	defer func() {
+		stream.Close()
+		// drain channel to prevent deadlock
+		go func() {
+			for range ch {
+			}
+		}()
+	}()
+
+	convert := func(s *host.JobStats) *ct.JobStats {
+		return &ct.JobStats{
+			JobID:       params["host_id"] + "-" + s.JobID,
+			MemoryUsage: s.MemoryUsage,
+			MemoryLimit: s.MemoryLimit,
+			CPUUsage:    s.CPUUsage,
+			Time:        s.Time,
+		}
+	}
+
+	// the first stats are read before responding, so that an unknown job is
+	// a 404 whether or not the stats are streamed
+	stats, ok := <-ch
+	if !ok {
+		if err := stream.Err(); err != nil && err.Error() != host.ErrUnknownJob.Error() {
+			r.Error(err)
+		} else {
+			r.Error(ErrNotFound)
+		}
+		return
+	}
+	if !strings.Contains(req.Header.Get("Accept"), "text/event-stream") {
+		r.JSON(200, convert(stats))
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+	w.WriteHeader(200)
+
+	closed := w.(http.CloseNotifier).CloseNotify()
+	for {
+		if _, err := w.Write([]byte("data: ")); err != nil {
+			return
+		}
+		if err := json.NewEncoder(w).Encode(convert(stats)); err != nil {
+			return
+		}
+		if _, err := w.Write([]byte("\n")); err != nil {
+			return
+		}
+		w.(http.Flusher).Flush()
+
+		select {
+		case stats, ok = <-ch:
+			if !ok {
+				if stream.Err() != nil {
+					w.Write([]byte("event: error\ndata: {}\n\n"))
+				} else {
+					w.Write([]byte("event: eof\ndata: {}\n\n"))
+				}
+				w.(http.Flusher).Flush()
+				return
+			}
+		case <-closed:
+			return
+		}
+	}
+}
+
 func streamJobs(req *http.Request, w http.ResponseWriter, app *ct.App, repo *JobRepo) (err error) {
 	var lastID int64
 	if req.Header.Get("Last-Event-Id") != "" {
@@ -407,6 +535,7 @@ func connectHostMiddleware(c martini.Context, params martini.Params, cl clusterC
 		return
 	}
 	params["jobs_id"] = jobID
+	params["host_id"] = hostID
 
 	client, err := cl.DialHost(hostID)
 	if err != nil {
@@ -426,7 +555,7 @@ func killJob(app *ct.App, params martini.Params, client cluster.Host, r Response
 	}
 }
 
-func runJob(app *ct.App, newJob ct.NewJob, releases *ReleaseRepo, artifacts *ArtifactRepo, cl clusterClient, req *http.Request, w http.ResponseWriter, r ResponseHelper) {
+func runJob(app *ct.App, newJob ct.NewJob, releases *ReleaseRepo, artifacts *ArtifactRepo, secrets *SecretRepo, cl clusterClient, req *http.Request, w http.ResponseWriter, r ResponseHelper) {
 	data, err := releases.Get(newJob.ReleaseID)
 	if err != nil {
 		r.Error(err)
@@ -441,49 +570,14 @@ func runJob(app *ct.App, newJob ct.NewJob, releases *ReleaseRepo, artifacts *Art
 	artifact := data.(*ct.Artifact)
 	attach := strings.Contains(req.Header.Get("Accept"), "application/vnd.flynn.attach")
 
-	env := make(map[string]string, len(release.Env)+len(newJob.Env))
-	for k, v := range release.Env {
-		env[k] = v
-	}
-	for k, v := range newJob.Env {
-		env[k] = v
-	}
-	job := &host.Job{
-		ID: cluster.RandomJobID(""),
-		Metadata: map[string]string{
-			"flynn-controller.app":      app.ID,
-			"flynn-controller.app_name": app.Name,
-			"flynn-controller.release":  release.ID,
-		},
-		Artifact: host.Artifact{
-			Type: artifact.Type,
-			URI:  artifact.URI,
-		},
-		Config: host.ContainerConfig{
-			Cmd:   newJob.Cmd,
-			Env:   env,
-			TTY:   newJob.TTY,
-			Stdin: attach,
-		},
-	}
-	if len(newJob.Entrypoint) > 0 {
-		job.Config.Entrypoint = newJob.Entrypoint
-	}
+	job := newOneOffJob(app, release, artifact, &newJob, attach)
+	job.Config.Secrets = secrets.jobSecrets(app.ID, release)
 
-	hosts, err := cl.ListHosts()
+	hostID, err := pickHost(cl)
 	if err != nil {
 		r.Error(err)
 		return
 	}
-	// pick a random host
-	var hostID string
-	for hostID = range hosts {
-		break
-	}
-	if hostID == "" {
-		r.Error(errors.New("no hosts found"))
-		return
-	}
 
 	var attachClient cluster.AttachClient
 	if attach {
@@ -546,3 +640,52 @@ func runJob(app *ct.App, newJob ct.NewJob, releases *ReleaseRepo, artifacts *Art
 		})
 	}
 }
+
+// newOneOffJob returns a job which runs newJob with the artifact and env of
+// release, reading stdin if attach is set.
+func newOneOffJob(app *ct.App, release *ct.Release, artifact *ct.Artifact, newJob *ct.NewJob, attach bool) *host.Job {
+	env := make(map[string]string, len(release.Env)+len(newJob.Env))
+	for k, v := range release.Env {
+		env[k] = v
+	}
+	for k, v := range newJob.Env {
+		env[k] = v
+	}
+	job := &host.Job{
+		ID: cluster.RandomJobID(""),
+		Metadata: map[string]string{
+			"flynn-controller.app":      app.ID,
+			"flynn-controller.app_name": app.Name,
+			"flynn-controller.release":  release.ID,
+		},
+		Artifact: host.Artifact{
+			Type: artifact.Type,
+			URI:  artifact.URI,
+		},
+		Config: host.ContainerConfig{
+			Cmd:   newJob.Cmd,
+			Env:   env,
+			TTY:   newJob.TTY,
+			Stdin: attach,
+		},
+	}
+	if len(newJob.Entrypoint) > 0 {
+		job.Config.Entrypoint = newJob.Entrypoint
+	}
+	return job
+}
+
+// pickHost returns the ID of a random host which is not draining to run a
+// one-off job on.
+func pickHost(cl clusterClient) (string, error) {
+	hosts, err := cl.ListHosts()
+	if err != nil {
+		return "", err
+	}
+	for hostID, h := range hosts {
+		if !h.Draining {
+			return hostID, nil
+		}
+	}
+	return "", errors.New("no hosts found")
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/base64"
 	"encoding/json"
@@ -8,7 +9,9 @@ import (
 	"io"
 	"io/ioutil"
 	"net/http"
+	"reflect"
 	"strings"
+	"time"
 
 	. "github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-check"
 	tu "github.com/flynn/flynn/controller/testutils"
@@ -17,6 +20,7 @@ import (
 	"github.com/flynn/flynn/host/types"
 	"github.com/flynn/flynn/pkg/cluster"
 	"github.com/flynn/flynn/pkg/random"
+	"github.com/flynn/flynn/pkg/sse"
 )
 
 func (s *S) createTestJob(c *C, in *ct.Job) *ct.Job {
@@ -44,6 +48,67 @@ func (s *S) TestJobList(c *C) {
 	c.Assert(job.ReleaseID, Equals, release.ID)
 }
 
+func (s *S) TestJobListFilters(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "job-list-filters"})
+	release := s.createTestRelease(c, &ct.Release{})
+	s.createTestFormation(c, &ct.Formation{ReleaseID: release.ID, AppID: app.ID})
+	s.createTestJob(c, &ct.Job{ID: "host0-job-web-up", AppID: app.ID, ReleaseID: release.ID, Type: "web", State: "up"})
+	s.createTestJob(c, &ct.Job{ID: "host0-job-web-down", AppID: app.ID, ReleaseID: release.ID, Type: "web", State: "down"})
+	s.createTestJob(c, &ct.Job{ID: "host0-job-worker-up", AppID: app.ID, ReleaseID: release.ID, Type: "worker", State: "up"})
+
+	for query, expected := range map[string][]string{
+		"state=up":                           {"host0-job-worker-up", "host0-job-web-up"},
+		"type=web":                           {"host0-job-web-down", "host0-job-web-up"},
+		"type=web&state=up":                  {"host0-job-web-up"},
+		"release=" + release.ID + "&limit=1": {"host0-job-worker-up"},
+	} {
+		var list []ct.Job
+		_, err := s.Get("/apps/"+app.ID+"/jobs?"+query, &list)
+		c.Assert(err, IsNil)
+		ids := make([]string, len(list))
+		for i, job := range list {
+			ids[i] = job.ID
+		}
+		c.Assert(ids, DeepEquals, expected, Commentf("query = %s", query))
+	}
+
+	res, _ := s.Get("/apps/"+app.ID+"/jobs?state=invalid", nil)
+	c.Assert(res.StatusCode, Equals, 400)
+}
+
+func (s *S) TestJobOOMState(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "job-oom"})
+	release := s.createTestRelease(c, &ct.Release{})
+	s.createTestFormation(c, &ct.Formation{ReleaseID: release.ID, AppID: app.ID})
+	job := &ct.Job{ID: "host0-job-oom", AppID: app.ID, ReleaseID: release.ID, Type: "web", State: "up"}
+	s.createTestJob(c, job)
+
+	// an OOM kill of a running job updates the count without an event
+	job.OOMKills = 1
+	s.createTestJob(c, job)
+	got := &ct.Job{}
+	_, err := s.Get("/apps/"+app.ID+"/jobs/"+job.ID, got)
+	c.Assert(err, IsNil)
+	c.Assert(got.State, Equals, "up")
+	c.Assert(got.OOMKills, Equals, 1)
+	repo := s.m.Get(reflect.TypeOf(&JobRepo{})).Interface().(*JobRepo)
+	events, err := repo.listEvents(app.ID, 0, 0)
+	c.Assert(err, IsNil)
+	c.Assert(events, HasLen, 1)
+
+	job.State = "oom"
+	job.OOMKills = 2
+	s.createTestJob(c, job)
+	_, err = s.Get("/apps/"+app.ID+"/jobs/"+job.ID, got)
+	c.Assert(err, IsNil)
+	c.Assert(got.State, Equals, "oom")
+	c.Assert(got.OOMKills, Equals, 2)
+	events, err = repo.listEvents(app.ID, 0, 0)
+	c.Assert(err, IsNil)
+	c.Assert(events, HasLen, 2)
+	c.Assert(events[0].State, Equals, "oom")
+}
+
 func newFakeLog(r io.Reader) *fakeLog {
 	return &fakeLog{r}
 }
@@ -189,6 +254,65 @@ func (s *S) TestJobLogSSEStream(c *C) {
 	c.Assert(buf.String(), Equals, expected)
 }
 
+func (s *S) TestJobStats(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "job-stats"})
+	hostID, jobID := random.UUID(), random.UUID()
+	hc := tu.NewFakeHostClient(hostID)
+	now := time.Now().UTC()
+	hc.SetJobStats(jobID, []*host.JobStats{
+		{JobID: jobID, Time: now, MemoryUsage: 1024, MemoryLimit: 4096, CPUUsage: 1000},
+		{JobID: jobID, Time: now.Add(time.Second), MemoryUsage: 2048, MemoryLimit: 4096, CPUUsage: 5000},
+	})
+	s.cc.SetHostClient(hostID, hc)
+
+	stats := &ct.JobStats{}
+	res, err := s.Get(fmt.Sprintf("/apps/%s/jobs/%s-%s/stats", app.ID, hostID, jobID), stats)
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 200)
+	c.Assert(stats.JobID, Equals, hostID+"-"+jobID)
+	c.Assert(stats.MemoryUsage, Equals, uint64(1024))
+	c.Assert(stats.MemoryLimit, Equals, uint64(4096))
+	c.Assert(stats.CPUUsage, Equals, uint64(1000))
+
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s/apps/%s/jobs/%s-%s/stats", s.srv.URL, app.ID, hostID, jobID), nil)
+	c.Assert(err, IsNil)
+	req.SetBasicAuth("", authKey)
+	req.Header.Set("Accept", "text/event-stream")
+	res, err = http.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	defer res.Body.Close()
+
+	dec := sse.NewDecoder(bufio.NewReader(res.Body))
+	for _, expected := range []uint64{1024, 2048} {
+		stats := &ct.JobStats{}
+		c.Assert(dec.Decode(stats), IsNil)
+		c.Assert(stats.MemoryUsage, Equals, expected)
+	}
+	_, err = dec.Read()
+	c.Assert(err, IsNil) // eof event
+	_, err = dec.Read()
+	c.Assert(err, Equals, io.EOF)
+}
+
+func (s *S) TestJobStatsUnknownJob(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "job-stats-unknown"})
+	hostID, jobID := random.UUID(), random.UUID()
+	s.cc.SetHostClient(hostID, tu.NewFakeHostClient(hostID))
+
+	res, _ := s.Get(fmt.Sprintf("/apps/%s/jobs/%s-%s/stats", app.ID, hostID, jobID), &ct.JobStats{})
+	c.Assert(res.StatusCode, Equals, 404)
+
+	// streaming the stats of an unknown job is a 404 too
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s/apps/%s/jobs/%s-%s/stats", s.srv.URL, app.ID, hostID, jobID), nil)
+	c.Assert(err, IsNil)
+	req.SetBasicAuth("", authKey)
+	req.Header.Set("Accept", "text/event-stream")
+	res, err = http.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 404)
+}
+
 func (s *S) TestRunJobDetached(c *C) {
 	app := s.createTestApp(c, &ct.App{Name: "run-detached"})
 
@@ -301,3 +425,17 @@ func (s *S) TestRunJobAttached(c *C) {
 	c.Assert(job.Config.Env, DeepEquals, map[string]string{"FOO": "baz", "JOB": "true", "RELEASE": "true"})
 	c.Assert(job.Config.Stdin, Equals, true)
 }
+
+func (s *S) TestPickHostDraining(c *C) {
+	cl := tu.NewFakeCluster()
+	cl.SetHosts(map[string]host.Host{"draining": {Draining: true}, "active": {}})
+	for i := 0; i < 10; i++ {
+		hostID, err := pickHost(cl)
+		c.Assert(err, IsNil)
+		c.Assert(hostID, Equals, "active")
+	}
+
+	cl.SetHosts(map[string]host.Host{"draining": {Draining: true}})
+	_, err := pickHost(cl)
+	c.Assert(err, ErrorMatches, "no hosts found")
+}
@@ -5,6 +5,7 @@ import (
 	"crypto/md5"
 	"encoding/hex"
 	"errors"
+	"time"
 
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-sql"
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/pq"
@@ -66,19 +67,32 @@ func (r *KeyRepo) Remove(id string) error {
 	return r.db.Exec("UPDATE keys SET deleted_at = now() WHERE fingerprint = $1 AND deleted_at IS NULL", id)
 }
 
-func (r *KeyRepo) List() (interface{}, error) {
-	rows, err := r.db.Query("SELECT fingerprint, key, comment, created_at FROM keys WHERE deleted_at IS NULL ORDER BY created_at DESC")
+func (r *KeyRepo) List(opts *listOptions) (interface{}, string, error) {
+	if err := opts.checkFilters(); err != nil {
+		return nil, "", err
+	}
+	q := newListQuery("SELECT fingerprint, key, comment, created_at FROM keys WHERE deleted_at IS NULL", "fingerprint")
+	q.textID = true
+	query, args, err := q.build(opts)
+	if err != nil {
+		return nil, "", err
+	}
+	rows, err := r.db.Query(query, args...)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 	keys := []*ct.Key{}
 	for rows.Next() {
 		key, err := scanKey(rows)
 		if err != nil {
 			rows.Close()
-			return nil, err
+			return nil, "", err
 		}
 		keys = append(keys, key)
 	}
-	return keys, rows.Err()
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+	n, next := opts.page(len(keys), func(i int) (*time.Time, string) { return keys[i].CreatedAt, keys[i].ID })
+	return keys[:n], next, nil
 }
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	ct "github.com/flynn/flynn/controller/types"
+)
+
+const (
+	// defaultListLimit is the page size of list requests without a limit
+	defaultListLimit = 100
+	// maxListLimit is the largest page size a list request can ask for
+	maxListLimit = 1000
+)
+
+// listOptions are the pagination, filter and sort options of a list request.
+// Lists are ordered by creation time, with the id breaking ties so that a
+// cursor points at a unique position in the list. A zero limit lists all rows,
+// which only internal callers do as requests always have a limit.
+type listOptions struct {
+	limit   int
+	asc     bool
+	cursor  *listCursor
+	filters map[string]string
+}
+
+type listCursor struct {
+	createdAt time.Time
+	id        string
+}
+
+// parseListOptions parses list options from the query parameters limit,
+// cursor and order. All other parameters are filters, which are checked by
+// the repo being listed. The limit defaults to defaultListLimit and is capped
+// at maxListLimit, so that a request never loads a whole table.
+func parseListOptions(req *http.Request) (*listOptions, error) {
+	opts := &listOptions{limit: defaultListLimit, filters: make(map[string]string)}
+	for k, v := range req.URL.Query() {
+		if len(v) == 0 {
+			continue
+		}
+		switch k {
+		case "limit":
+			n, err := strconv.Atoi(v[0])
+			if err != nil || n < 0 {
+				return nil, ct.ValidationError{Field: "limit", Message: "must be a non-negative integer"}
+			}
+			switch {
+			case n > maxListLimit:
+				opts.limit = maxListLimit
+			case n > 0:
+				opts.limit = n
+			}
+		case "order":
+			switch v[0] {
+			case "asc":
+				opts.asc = true
+			case "desc", "":
+			default:
+				return nil, ct.ValidationError{Field: "order", Message: `must be "asc" or "desc"`}
+			}
+		case "cursor":
+			if v[0] == "" {
+				continue
+			}
+			c, err := decodeListCursor(v[0])
+			if err != nil {
+				return nil, ct.ValidationError{Field: "cursor", Message: "is invalid"}
+			}
+			opts.cursor = c
+		default:
+			opts.filters[k] = v[0]
+		}
+	}
+	return opts, nil
+}
+
+// checkFilters returns a validation error if any filter is not one of names.
+func (o *listOptions) checkFilters(names ...string) error {
+outer:
+	for k := range o.filters {
+		for _, name := range names {
+			if k == name {
+				continue outer
+			}
+		}
+		return ct.ValidationError{Field: k, Message: "is not a supported filter"}
+	}
+	return nil
+}
+
+// more returns whether a list of n items has another page after the first
+// limit items. Queries fetch limit+1 rows to find out.
+func (o *listOptions) more(n int) bool {
+	return o.limit > 0 && n > o.limit
+}
+
+// page returns the length of the page of a list of n items fetched with a
+// query built with o, and the cursor of the next page if there is one. item
+// returns the creation time and ID of the item at index i.
+func (o *listOptions) page(n int, item func(i int) (*time.Time, string)) (int, string) {
+	if !o.more(n) {
+		return n, ""
+	}
+	createdAt, id := item(o.limit - 1)
+	return o.limit, encodeListCursor(createdAt, id)
+}
+
+func encodeListCursor(createdAt *time.Time, id string) string {
+	var t time.Time
+	if createdAt != nil {
+		t = *createdAt
+	}
+	return base64.URLEncoding.EncodeToString([]byte(t.UTC().Format(time.RFC3339Nano) + "|" + id))
+}
+
+func decodeListCursor(s string) (*listCursor, error) {
+	b, err := base64.URLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.SplitN(string(b), "|", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return nil, fmt.Errorf("controller: invalid list cursor")
+	}
+	t, err := time.Parse(time.RFC3339Nano, parts[0])
+	if err != nil {
+		return nil, err
+	}
+	return &listCursor{createdAt: t, id: parts[1]}, nil
+}
+
+// listQuery builds a SELECT of a list of rows with a created_at column.
+type listQuery struct {
+	query string
+	id    string
+	conds []string
+	args  []interface{}
+
+	// textID is set if the id expression is not a uuid, otherwise the id of
+	// a cursor must be a uuid
+	textID bool
+}
+
+// newListQuery returns a query which appends conditions to query, a SELECT
+// with a WHERE clause, and orders by created_at and the id expression, which
+// is a uuid column unless textID is set.
+func newListQuery(query, id string) *listQuery {
+	return &listQuery{query: query, id: id}
+}
+
+// where adds a condition to the query. Each %d in cond is replaced by the
+// placeholder number of the corresponding arg.
+func (q *listQuery) where(cond string, args ...interface{}) {
+	nums := make([]interface{}, len(args))
+	for i, arg := range args {
+		q.args = append(q.args, arg)
+		nums[i] = len(q.args)
+	}
+	q.conds = append(q.conds, fmt.Sprintf(cond, nums...))
+}
+
+// build returns the query and its args with the cursor, order and limit of
+// opts applied.
+func (q *listQuery) build(opts *listOptions) (string, []interface{}, error) {
+	dir, cmp := "DESC", "<"
+	if opts.asc {
+		dir, cmp = "ASC", ">"
+	}
+	if opts.cursor != nil {
+		if !q.textID && !idPattern.MatchString(opts.cursor.id) {
+			return "", nil, ct.ValidationError{Field: "cursor", Message: "is invalid"}
+		}
+		q.where(fmt.Sprintf("(created_at, %s) %s ($%%d, $%%d)", q.id, cmp), opts.cursor.createdAt, opts.cursor.id)
+	}
+	query := q.query
+	for _, cond := range q.conds {
+		query += " AND " + cond
+	}
+	query += fmt.Sprintf(" ORDER BY created_at %s, %s %s", dir, q.id, dir)
+	if opts.limit > 0 {
+		q.args = append(q.args, opts.limit+1)
+		query += fmt.Sprintf(" LIMIT $%d", len(q.args))
+	}
+	return query, q.args, nil
+}
+
+// setNextPage sets a Link header pointing at the next page of a list if
+// cursor is not empty.
+func setNextPage(w http.ResponseWriter, req *http.Request, cursor string) {
+	if cursor == "" {
+		return
+	}
+	q := req.URL.Query()
+	q.Set("cursor", cursor)
+	next := url.URL{Path: req.URL.Path, RawQuery: q.Encode()}
+	w.Header().Set("Link", fmt.Sprintf(`<%s>; rel="next"`, next.String()))
+}
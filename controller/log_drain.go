@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-sql"
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/go-martini/martini"
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/discoverd/client"
+	"github.com/flynn/flynn/host/logdrain"
+	"github.com/flynn/flynn/host/types"
+)
+
+// drainKeyStore is the subset of the discoverd client used to publish the log
+// drains of each app to flynn-host.
+type drainKeyStore interface {
+	SetKey(key, value string) error
+	DeleteKey(key string) error
+}
+
+type LogDrainRepo struct {
+	db   *DB
+	keys drainKeyStore
+}
+
+// NewLogDrainRepo returns a repo which publishes log drain changes to dc. If
+// dc is nil the drains are only stored.
+func NewLogDrainRepo(db *DB, dc *discoverd.Client) *LogDrainRepo {
+	r := &LogDrainRepo{db: db}
+	if dc != nil {
+		r.keys = dc
+	}
+	return r
+}
+
+// Add stores a drain and publishes it, the drain is not stored if it can not
+// be published.
+func (r *LogDrainRepo) Add(drain *ct.LogDrain) error {
+	if err := logdrain.ValidURL(drain.URL); err != nil {
+		return ct.ValidationError{Field: "url", Message: "must be a syslog://, syslog+tls://, http:// or https:// URL"}
+	}
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	err = tx.QueryRow("INSERT INTO log_drains (app_id, url) VALUES ($1, $2) RETURNING drain_id, created_at", drain.AppID, drain.URL).Scan(&drain.ID, &drain.CreatedAt)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	drain.ID = cleanUUID(drain.ID)
+	if err := r.publish(tx, drain.AppID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func scanLogDrain(s Scanner) (*ct.LogDrain, error) {
+	drain := &ct.LogDrain{}
+	err := s.Scan(&drain.ID, &drain.AppID, &drain.URL, &drain.CreatedAt)
+	if err == sql.ErrNoRows {
+		err = ErrNotFound
+	}
+	drain.ID = cleanUUID(drain.ID)
+	drain.AppID = cleanUUID(drain.AppID)
+	return drain, err
+}
+
+func (r *LogDrainRepo) Get(appID, id string) (*ct.LogDrain, error) {
+	row := r.db.QueryRow("SELECT drain_id, app_id, url, created_at FROM log_drains WHERE app_id = $1 AND drain_id = $2 AND deleted_at IS NULL", appID, id)
+	return scanLogDrain(row)
+}
+
+func (r *LogDrainRepo) List(appID string, opts *listOptions) ([]*ct.LogDrain, string, error) {
+	if err := opts.checkFilters(); err != nil {
+		return nil, "", err
+	}
+	q := newListQuery("SELECT drain_id, app_id, url, created_at FROM log_drains WHERE app_id = $1 AND deleted_at IS NULL", "drain_id")
+	q.args = append(q.args, appID)
+	query, args, err := q.build(opts)
+	if err != nil {
+		return nil, "", err
+	}
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return nil, "", err
+	}
+	drains := []*ct.LogDrain{}
+	for rows.Next() {
+		drain, err := scanLogDrain(rows)
+		if err != nil {
+			rows.Close()
+			return nil, "", err
+		}
+		drains = append(drains, drain)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+	n, next := opts.page(len(drains), func(i int) (*time.Time, string) { return drains[i].CreatedAt, drains[i].ID })
+	return drains[:n], next, nil
+}
+
+// Remove deletes a drain and publishes the change, the drain is kept if the
+// change can not be published.
+func (r *LogDrainRepo) Remove(drain *ct.LogDrain) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE log_drains SET deleted_at = now() WHERE drain_id = $1 AND deleted_at IS NULL", drain.ID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := r.publish(tx, drain.AppID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// removeApp deletes the drains of an app which is being removed in tx.
+func (r *LogDrainRepo) removeApp(tx *dbTx, appID string) error {
+	if _, err := tx.Exec("UPDATE log_drains SET deleted_at = now() WHERE app_id = $1 AND deleted_at IS NULL", appID); err != nil {
+		return err
+	}
+	return r.publish(tx, appID)
+}
+
+// publish sets the discoverd key which flynn-host watches to the drain URLs of
+// an app as seen by tx, which is committed once they are published.
+func (r *LogDrainRepo) publish(tx *dbTx, appID string) error {
+	if r.keys == nil {
+		return nil
+	}
+	rows, err := tx.Query("SELECT url FROM log_drains WHERE app_id = $1 AND deleted_at IS NULL ORDER BY created_at DESC", appID)
+	if err != nil {
+		return err
+	}
+	var urls []string
+	for rows.Next() {
+		var u string
+		if err := rows.Scan(&u); err != nil {
+			rows.Close()
+			return err
+		}
+		urls = append(urls, u)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	key := host.LogDrainsKey + "/" + appID
+	if len(urls) == 0 {
+		if err := r.keys.DeleteKey(key); err != nil && err != discoverd.ErrKeyNotFound {
+			return err
+		}
+		return nil
+	}
+	data, err := json.Marshal(urls)
+	if err != nil {
+		return err
+	}
+	return r.keys.SetKey(key, string(data))
+}
+
+func createLogDrain(app *ct.App, drain ct.LogDrain, repo *LogDrainRepo, r ResponseHelper) {
+	drain.AppID = app.ID
+	if err := repo.Add(&drain); err != nil {
+		r.Error(err)
+		return
+	}
+	r.JSON(200, &drain)
+}
+
+func getLogDrainMiddleware(app *ct.App, c martini.Context, params martini.Params, repo *LogDrainRepo, r ResponseHelper) {
+	drain, err := repo.Get(app.ID, params["log_drains_id"])
+	if err != nil {
+		r.Error(err)
+		return
+	}
+	c.Map(drain)
+}
+
+func getLogDrain(drain *ct.LogDrain, r ResponseHelper) {
+	r.JSON(200, drain)
+}
+
+func listLogDrains(req *http.Request, w http.ResponseWriter, app *ct.App, repo *LogDrainRepo, r ResponseHelper) {
+	opts, err := parseListOptions(req)
+	if err != nil {
+		r.Error(err)
+		return
+	}
+	drains, next, err := repo.List(app.ID, opts)
+	if err != nil {
+		r.Error(err)
+		return
+	}
+	setNextPage(w, req, next)
+	r.JSON(200, drains)
+}
+
+func deleteLogDrain(drain *ct.LogDrain, repo *LogDrainRepo, r ResponseHelper) {
+	if err := repo.Remove(drain); err != nil {
+		r.Error(err)
+		return
+	}
+	r.WriteHeader(200)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"sync"
+
+	. "github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-check"
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/discoverd/client"
+	"github.com/flynn/flynn/host/types"
+	"github.com/flynn/flynn/pkg/random"
+)
+
+type fakeKeyStore struct {
+	mtx  sync.Mutex
+	keys map[string]string
+	err  error // returned by SetKey and DeleteKey if set
+}
+
+func (f *fakeKeyStore) SetKey(key, value string) error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if f.err != nil {
+		return f.err
+	}
+	f.keys[key] = value
+	return nil
+}
+
+func (f *fakeKeyStore) DeleteKey(key string) error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if f.err != nil {
+		return f.err
+	}
+	if _, ok := f.keys[key]; !ok {
+		return discoverd.ErrKeyNotFound
+	}
+	delete(f.keys, key)
+	return nil
+}
+
+func (f *fakeKeyStore) setErr(err error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.err = err
+}
+
+func (f *fakeKeyStore) drains(appID string) []string {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	value, ok := f.keys[host.LogDrainsKey+"/"+appID]
+	if !ok {
+		return nil
+	}
+	var urls []string
+	json.Unmarshal([]byte(value), &urls)
+	return urls
+}
+
+func (s *S) TestLogDrains(c *C) {
+	keys := &fakeKeyStore{keys: make(map[string]string)}
+	repo := s.m.Get(reflect.TypeOf(&LogDrainRepo{})).Interface().(*LogDrainRepo)
+	repo.keys = keys
+	defer func() { repo.keys = nil }()
+
+	app := s.createTestApp(c, &ct.App{Name: "log-drains"})
+	path := "/apps/" + app.ID + "/log_drains"
+
+	res, err := s.Post(path, &ct.LogDrain{URL: "ftp://example.com"}, &ct.LogDrain{})
+	c.Assert(res.StatusCode, Equals, 400)
+
+	drain := &ct.LogDrain{}
+	res, err = s.Post(path, &ct.LogDrain{URL: "syslog+tls://logs.example.com:514"}, drain)
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 200)
+	c.Assert(drain.ID, Not(Equals), "")
+	c.Assert(drain.AppID, Equals, app.ID)
+	c.Assert(keys.drains(app.ID), DeepEquals, []string{"syslog+tls://logs.example.com:514"})
+
+	gotDrain := &ct.LogDrain{}
+	res, err = s.Get(path+"/"+drain.ID, gotDrain)
+	c.Assert(err, IsNil)
+	c.Assert(gotDrain, DeepEquals, drain)
+
+	var list []*ct.LogDrain
+	res, err = s.Get(path, &list)
+	c.Assert(err, IsNil)
+	c.Assert(list, HasLen, 1)
+	c.Assert(list[0], DeepEquals, drain)
+
+	res, err = s.Delete(path + "/" + drain.ID)
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 200)
+	c.Assert(keys.drains(app.ID), IsNil)
+
+	res, err = s.Get(path+"/"+drain.ID, gotDrain)
+	c.Assert(res.StatusCode, Equals, 404)
+	res, err = s.Get(path+"/"+random.UUID(), gotDrain)
+	c.Assert(res.StatusCode, Equals, 404)
+
+	// drains are not stored if they can not be published
+	keys.setErr(errors.New("discoverd unavailable"))
+	res, err = s.Post(path, &ct.LogDrain{URL: "https://logs.example.com"}, &ct.LogDrain{})
+	c.Assert(res.StatusCode, Equals, 500)
+	list = nil
+	res, err = s.Get(path, &list)
+	c.Assert(err, IsNil)
+	c.Assert(list, HasLen, 0)
+	keys.setErr(nil)
+
+	// the drains of an app are removed with it
+	res, err = s.Post(path, &ct.LogDrain{URL: "https://logs.example.com"}, &ct.LogDrain{})
+	c.Assert(err, IsNil)
+	c.Assert(keys.drains(app.ID), DeepEquals, []string{"https://logs.example.com"})
+	res, err = s.Delete("/apps/" + app.ID)
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 200)
+	c.Assert(keys.drains(app.ID), IsNil)
+}
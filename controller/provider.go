@@ -2,6 +2,7 @@ package main
 
 import (
 	"errors"
+	"time"
 
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-sql"
 	ct "github.com/flynn/flynn/controller/types"
@@ -50,19 +51,34 @@ func (r *ProviderRepo) Get(id string) (interface{}, error) {
 	return scanProvider(row)
 }
 
-func (r *ProviderRepo) List() (interface{}, error) {
-	rows, err := r.db.Query("SELECT provider_id, name, url, created_at, updated_at FROM providers WHERE deleted_at IS NULL ORDER BY created_at DESC")
+func (r *ProviderRepo) List(opts *listOptions) (interface{}, string, error) {
+	if err := opts.checkFilters("name"); err != nil {
+		return nil, "", err
+	}
+	q := newListQuery("SELECT provider_id, name, url, created_at, updated_at FROM providers WHERE deleted_at IS NULL", "provider_id")
+	if name, ok := opts.filters["name"]; ok {
+		q.where("name = $%d", name)
+	}
+	query, args, err := q.build(opts)
 	if err != nil {
-		return nil, err
+		return nil, "", err
+	}
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return nil, "", err
 	}
 	providers := []*ct.Provider{}
 	for rows.Next() {
 		provider, err := scanProvider(rows)
 		if err != nil {
 			rows.Close()
-			return nil, err
+			return nil, "", err
 		}
 		providers = append(providers, provider)
 	}
-	return providers, rows.Err()
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+	n, next := opts.page(len(providers), func(i int) (*time.Time, string) { return providers[i].CreatedAt, providers[i].ID })
+	return providers[:n], next, nil
 }
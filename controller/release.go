@@ -2,24 +2,41 @@ package main
 
 import (
 	"encoding/json"
+	"log"
+	"time"
 
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-sql"
 	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/host/types"
 	"github.com/flynn/flynn/pkg/random"
 )
 
+// defaultReleaseRetention is the number of releases of each app which are
+// kept by garbage collection, in addition to those which are in use.
+const defaultReleaseRetention = 10
+
 type ReleaseRepo struct {
-	db *DB
+	db        *DB
+	artifacts *ArtifactRepo
+	cluster   clusterClient
+
+	// retention is the number of the most recent releases of each app which
+	// collectGarbage keeps, zero disables garbage collection
+	retention int
 }
 
-func NewReleaseRepo(db *DB) *ReleaseRepo {
-	return &ReleaseRepo{db}
+// NewReleaseRepo returns a repo which has the hosts of cluster pull the
+// artifact of each new release. If cluster is nil the releases are only
+// stored.
+func NewReleaseRepo(db *DB, artifacts *ArtifactRepo, cluster clusterClient) *ReleaseRepo {
+	return &ReleaseRepo{db: db, artifacts: artifacts, cluster: cluster, retention: defaultReleaseRetention}
 }
 
 func scanRelease(s Scanner) (*ct.Release, error) {
 	release := &ct.Release{}
 	var data []byte
-	err := s.Scan(&release.ID, &release.ArtifactID, &data, &release.CreatedAt)
+	var appID sql.NullString
+	err := s.Scan(&release.ID, &appID, &release.ArtifactID, &data, &release.CreatedAt)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			err = ErrNotFound
@@ -27,16 +44,37 @@ func scanRelease(s Scanner) (*ct.Release, error) {
 		return nil, err
 	}
 	release.ID = cleanUUID(release.ID)
+	release.AppID = cleanUUID(appID.String)
 	release.ArtifactID = cleanUUID(release.ArtifactID)
 	err = json.Unmarshal(data, release)
 	return release, err
 }
 
+func validateResources(release *ct.Release) error {
+	for name, t := range release.Processes {
+		r := t.Resources
+		if r == nil {
+			continue
+		}
+		if r.Memory < 0 || r.CPUShares < 0 || r.CPUQuota < 0 || r.MaxPIDs < 0 || r.MaxOpenFiles < 0 {
+			return ct.ValidationError{Field: "processes." + name + ".resources", Message: "must not be negative"}
+		}
+	}
+	return nil
+}
+
 func (r *ReleaseRepo) Add(data interface{}) error {
 	release := data.(*ct.Release)
+	if err := validateResources(release); err != nil {
+		return err
+	}
+	if err := validateSecrets(release); err != nil {
+		return err
+	}
 	releaseCopy := *release
 
 	releaseCopy.ID = ""
+	releaseCopy.AppID = ""
 	releaseCopy.ArtifactID = ""
 	releaseCopy.CreatedAt = nil
 	data, err := json.Marshal(&releaseCopy)
@@ -47,31 +85,163 @@ func (r *ReleaseRepo) Add(data interface{}) error {
 		release.ID = random.UUID()
 	}
 
-	err = r.db.QueryRow("INSERT INTO releases (release_id, artifact_id, data) VALUES ($1, $2, $3) RETURNING created_at",
-		release.ID, release.ArtifactID, data).Scan(&release.CreatedAt)
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	var appID *string
+	if release.AppID != "" {
+		app, err := selectApp(tx, release.AppID, false)
+		if err == ErrNotFound {
+			err = ct.ValidationError{Field: "app", Message: "not found"}
+		}
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		appID = &app.ID
+	}
+	err = tx.QueryRow("INSERT INTO releases (release_id, app_id, artifact_id, data) VALUES ($1, $2, $3, $4) RETURNING created_at",
+		release.ID, appID, release.ArtifactID, data).Scan(&release.CreatedAt)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	// the artifact may have been garbage collected since it was added
+	if _, err := tx.Exec("UPDATE artifacts SET deleted_at = NULL WHERE artifact_id = $1", release.ArtifactID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
 	release.ID = cleanUUID(release.ID)
+	if appID != nil {
+		release.AppID = cleanUUID(*appID)
+	}
 	release.ArtifactID = cleanUUID(release.ArtifactID)
-	return err
+	if r.cluster != nil && release.ArtifactID != "" {
+		go r.prepull(release)
+	}
+	return nil
+}
+
+// prepull pulls the image of a release on every host, so that the jobs of the
+// release start without waiting for the download once it is deployed.
+func (r *ReleaseRepo) prepull(release *ct.Release) {
+	a, err := r.artifacts.Get(release.ArtifactID)
+	if err != nil {
+		log.Printf("Error getting artifact of release %s: %s", release.ID, err)
+		return
+	}
+	artifact := a.(*ct.Artifact)
+	if artifact.Type != "docker" {
+		return
+	}
+	hosts, err := r.cluster.ListHosts()
+	if err != nil {
+		log.Printf("Error listing hosts to pull release %s: %s", release.ID, err)
+		return
+	}
+	for id := range hosts {
+		go func(id string) {
+			h, err := r.cluster.DialHost(id)
+			if err != nil {
+				log.Printf("Error connecting to host %s to pull release %s: %s", id, release.ID, err)
+				return
+			}
+			defer h.Close()
+			ch := make(chan *host.LayerPullInfo)
+			stream := h.PullImage(artifact.URI, ch)
+			for range ch {
+			}
+			if err := stream.Err(); err != nil {
+				log.Printf("Error pulling release %s on host %s: %s", release.ID, id, err)
+			}
+		}(id)
+	}
 }
 
 func (r *ReleaseRepo) Get(id string) (interface{}, error) {
-	row := r.db.QueryRow("SELECT release_id, artifact_id, data, created_at FROM releases WHERE release_id = $1 AND deleted_at IS NULL", id)
+	row := r.db.QueryRow("SELECT release_id, app_id, artifact_id, data, created_at FROM releases WHERE release_id = $1 AND deleted_at IS NULL", id)
 	return scanRelease(row)
 }
 
-func (r *ReleaseRepo) List() (interface{}, error) {
-	rows, err := r.db.Query("SELECT release_id, artifact_id, data, created_at FROM releases WHERE deleted_at IS NULL ORDER BY created_at DESC")
+func (r *ReleaseRepo) List(opts *listOptions) (interface{}, string, error) {
+	if err := opts.checkFilters("app", "artifact"); err != nil {
+		return nil, "", err
+	}
+	q := newListQuery("SELECT release_id, app_id, artifact_id, data, created_at FROM releases WHERE deleted_at IS NULL", "release_id")
+	if appID, ok := opts.filters["app"]; ok {
+		if !idPattern.MatchString(appID) {
+			return nil, "", ct.ValidationError{Field: "app", Message: "is invalid"}
+		}
+		q.where("app_id = $%d", appID)
+	}
+	if artifactID, ok := opts.filters["artifact"]; ok {
+		if !idPattern.MatchString(artifactID) {
+			return nil, "", ct.ValidationError{Field: "artifact", Message: "is invalid"}
+		}
+		q.where("artifact_id = $%d", artifactID)
+	}
+	query, args, err := q.build(opts)
 	if err != nil {
-		return nil, err
+		return nil, "", err
+	}
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return nil, "", err
 	}
 	releases := []*ct.Release{}
 	for rows.Next() {
 		release, err := scanRelease(rows)
 		if err != nil {
 			rows.Close()
-			return nil, err
+			return nil, "", err
 		}
 		releases = append(releases, release)
 	}
-	return releases, rows.Err()
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+	n, next := opts.page(len(releases), func(i int) (*time.Time, string) { return releases[i].CreatedAt, releases[i].ID })
+	return releases[:n], next, nil
+}
+
+// SetApp makes appID the owner of a release if it has none, which is the case
+// for releases created without an app before they are first deployed.
+func (r *ReleaseRepo) SetApp(releaseID, appID string) error {
+	return r.db.Exec("UPDATE releases SET app_id = $2 WHERE release_id = $1 AND app_id IS NULL", releaseID, appID)
+}
+
+// collectGarbage deletes the releases of an app which are neither among its
+// most recent ones nor used by any app or formation, and then the artifacts
+// which were only used by deleted releases.
+func (r *ReleaseRepo) collectGarbage(appID string) error {
+	if r.retention <= 0 {
+		return nil
+	}
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`
+UPDATE releases SET deleted_at = now()
+WHERE app_id = $1 AND deleted_at IS NULL
+AND release_id NOT IN (SELECT release_id FROM releases WHERE app_id = $1 AND deleted_at IS NULL ORDER BY created_at DESC LIMIT $2)
+AND release_id NOT IN (SELECT release_id FROM apps WHERE release_id IS NOT NULL AND deleted_at IS NULL)
+AND release_id NOT IN (SELECT release_id FROM formations WHERE deleted_at IS NULL)
+AND release_id NOT IN (SELECT release_id FROM schedules WHERE release_id IS NOT NULL AND deleted_at IS NULL)`, appID, r.retention); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec(`
+UPDATE artifacts a SET deleted_at = now()
+WHERE deleted_at IS NULL
+AND EXISTS (SELECT 1 FROM releases WHERE artifact_id = a.artifact_id AND deleted_at IS NOT NULL)
+AND NOT EXISTS (SELECT 1 FROM releases WHERE artifact_id = a.artifact_id AND deleted_at IS NULL)`); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
 }
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/host/types"
+	"github.com/flynn/flynn/pkg/sse"
+)
+
+// maxReleasePhaseOutput is how much of the end of the output of a failed
+// release phase is included in the error returned to clients which do not
+// stream it.
+const maxReleasePhaseOutput = 4096
+
+// releasePhaseTimeout is how long a release phase job may run before it is
+// stopped and the deploy fails.
+var releasePhaseTimeout = 30 * time.Minute
+
+var (
+	errReleasePhaseTimeout  = errors.New("release phase timed out")
+	errReleasePhaseCanceled = errors.New("release phase canceled, the client disconnected")
+)
+
+// tailBuffer is a ring buffer which keeps the last len(buf) bytes written to
+// it.
+type tailBuffer struct {
+	buf  []byte
+	pos  int
+	full bool
+}
+
+func newTailBuffer(size int) *tailBuffer {
+	return &tailBuffer{buf: make([]byte, size)}
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+	if len(p) > len(b.buf) {
+		p = p[len(p)-len(b.buf):]
+	}
+	for len(p) > 0 {
+		c := copy(b.buf[b.pos:], p)
+		p = p[c:]
+		b.pos += c
+		if b.pos == len(b.buf) {
+			b.pos = 0
+			b.full = true
+		}
+	}
+	return n, nil
+}
+
+// Bytes returns the bytes in the buffer in the order they were written.
+func (b *tailBuffer) Bytes() []byte {
+	if !b.full {
+		return b.buf[:b.pos]
+	}
+	return append(append([]byte(nil), b.buf[b.pos:]...), b.buf[:b.pos]...)
+}
+
+// releasePhase runs the release phase job of a release of an app, calling
+// started with the job ID once it starts, writes its output to stdout and
+// stderr, and returns its exit status. The job is stopped if it runs for
+// longer than releasePhaseTimeout or if canceled receives.
+func releasePhase(app *ct.App, release *ct.Release, artifacts *ArtifactRepo, secrets *SecretRepo, cl clusterClient, started func(jobID string), canceled <-chan bool, stdout, stderr io.Writer) (int, error) {
+	proc := release.Processes[ct.ReleasePhaseType]
+	data, err := artifacts.Get(release.ArtifactID)
+	if err != nil {
+		return 0, err
+	}
+	artifact := data.(*ct.Artifact)
+	job := newOneOffJob(app, release, artifact, &ct.NewJob{
+		Cmd:        proc.Cmd,
+		Entrypoint: proc.Entrypoint,
+		Env:        proc.Env,
+	}, false)
+	job.Metadata["flynn-controller.release_phase"] = "true"
+	job.Config.Secrets = secrets.jobSecrets(app.ID, release)
+
+	hostID, err := pickHost(cl)
+	if err != nil {
+		return 0, err
+	}
+	client, err := cl.DialHost(hostID)
+	if err != nil {
+		return 0, fmt.Errorf("host connect failed: %s", err)
+	}
+	defer client.Close()
+	// attach before the job is added so that no output is missed
+	attachClient, err := client.Attach(&host.AttachReq{
+		JobID: job.ID,
+		Flags: host.AttachFlagStdout | host.AttachFlagStderr | host.AttachFlagStream,
+	}, true)
+	if err != nil {
+		return 0, fmt.Errorf("attach failed: %s", err)
+	}
+	defer attachClient.Close()
+	if _, err := cl.AddJobs(&host.AddJobsReq{HostJobs: map[string][]*host.Job{hostID: {job}}}); err != nil {
+		return 0, fmt.Errorf("schedule failed: %s", err)
+	}
+	if err := attachClient.Wait(); err != nil {
+		return 0, fmt.Errorf("attach wait failed: %s", err)
+	}
+	started(hostID + "-" + job.ID)
+
+	var status int
+	var receiveErr error
+	done := make(chan struct{})
+	go func() {
+		status, receiveErr = attachClient.Receive(stdout, stderr)
+		close(done)
+	}()
+	timeout := time.NewTimer(releasePhaseTimeout)
+	defer timeout.Stop()
+	select {
+	case <-done:
+		return status, receiveErr
+	case <-timeout.C:
+		err = errReleasePhaseTimeout
+	case <-canceled:
+		err = errReleasePhaseCanceled
+	}
+	if stopErr := client.StopJob(job.ID); stopErr != nil {
+		log.Printf("Error stopping release phase job %s: %s", job.ID, stopErr)
+	}
+	// closing the attach client ends Receive if the job does not stop, it
+	// is waited for so that nothing is written to stdout or stderr after
+	// returning
+	attachClient.Close()
+	<-done
+	return 0, err
+}
+
+// deployWithReleasePhase runs the release phase of a release and deploys it if
+// the release phase exits 0. The output of the release phase is streamed as
+// server-sent DeployEvents if the client accepts them. Otherwise the response
+// is the deployed release, or a validation error including the end of the
+// output if the release phase failed. The release is only deployed if cond is
+// still met by the app's current release after the release phase.
+func deployWithReleasePhase(req *http.Request, w http.ResponseWriter, app *ct.App, release *ct.Release, cond *precondition, apps *AppRepo, releases *ReleaseRepo, formations *FormationRepo, artifacts *ArtifactRepo, secrets *SecretRepo, cl clusterClient, r ResponseHelper) {
+	canceled := w.(http.CloseNotifier).CloseNotify()
+	if !strings.Contains(req.Header.Get("Accept"), "text/event-stream") {
+		output := newTailBuffer(maxReleasePhaseOutput)
+		status, err := releasePhase(app, release, artifacts, secrets, cl, func(string) {}, canceled, output, output)
+		if err != nil {
+			r.Error(err)
+			return
+		}
+		if status != 0 {
+			r.Error(ct.ValidationError{
+				Field:   "release",
+				Message: fmt.Sprintf("release phase exited with status %d:\n%s", status, output.Bytes()),
+			})
+			return
+		}
+		if err := deployRelease(app, release, cond, apps, releases, formations); err != nil {
+			r.Error(err)
+			return
+		}
+		r.JSON(200, release)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+	w.WriteHeader(200)
+	sw := &sse.Writer{Writer: w}
+	send := func(e *ct.DeployEvent) {
+		data, err := json.Marshal(e)
+		if err != nil {
+			return
+		}
+		sw.Write(data)
+		sw.Flush()
+	}
+	sendError := func(err error) {
+		send(&ct.DeployEvent{Error: err.Error()})
+	}
+	sw.Flush()
+
+	logw := &sseLogWriter{SSEWriter: sw}
+	started := func(jobID string) { send(&ct.DeployEvent{JobID: jobID}) }
+	status, err := releasePhase(app, release, artifacts, secrets, cl, started, canceled, flushWriter{logw.Stream("stdout"), true}, flushWriter{logw.Stream("stderr"), true})
+	if err != nil {
+		sendError(err)
+		return
+	}
+	send(&ct.DeployEvent{ExitStatus: &status})
+	if status != 0 {
+		sendError(fmt.Errorf("release phase exited with status %d", status))
+		return
+	}
+	if err := deployRelease(app, release, cond, apps, releases, formations); err != nil {
+		sendError(err)
+		return
+	}
+	send(&ct.DeployEvent{Release: release})
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"strings"
+	"time"
+
+	. "github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-check"
+	"github.com/flynn/flynn/controller/client"
+	tu "github.com/flynn/flynn/controller/testutils"
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/host/types"
+	"github.com/flynn/flynn/pkg/cluster"
+	"github.com/flynn/flynn/pkg/random"
+)
+
+// setReleasePhaseHost sets up a host whose jobs write stdout to stdout and
+// exit with status.
+func (s *S) setReleasePhaseHost(c *C, stdout string, status int) string {
+	hostID := random.UUID()
+	hc := tu.NewFakeHostClient(hostID)
+	hc.SetAttachFunc("*", func(req *host.AttachReq, wait bool) (cluster.AttachClient, error) {
+		c.Assert(wait, Equals, true)
+		var frames bytes.Buffer
+		var length [4]byte
+		frames.Write([]byte{host.AttachData, 1})
+		binary.BigEndian.PutUint32(length[:], uint32(len(stdout)))
+		frames.Write(length[:])
+		frames.WriteString(stdout)
+		frames.WriteByte(host.AttachExit)
+		binary.BigEndian.PutUint32(length[:], uint32(status))
+		frames.Write(length[:])
+		_, pipeW := io.Pipe()
+		return cluster.NewAttachClient(struct {
+			io.Reader
+			io.WriteCloser
+		}{&frames, pipeW}), nil
+	})
+	s.cc.SetHostClient(hostID, hc)
+	s.cc.SetHosts(map[string]host.Host{hostID: {}})
+	return hostID
+}
+
+func (s *S) createReleasePhaseRelease(c *C) *ct.Release {
+	artifact := s.createTestArtifact(c, &ct.Artifact{Type: "docker", URI: "docker://foo/release-phase"})
+	return s.createTestRelease(c, &ct.Release{
+		ArtifactID: artifact.ID,
+		Processes: map[string]ct.ProcessType{
+			"web":     {Cmd: []string{"start"}},
+			"release": {Cmd: []string{"migrate"}},
+		},
+	})
+}
+
+func (s *S) TestReleasePhase(c *C) {
+	hostID := s.setReleasePhaseHost(c, "migrating\n", 0)
+	app := s.createTestApp(c, &ct.App{Name: "release-phase"})
+	release := s.createReleasePhaseRelease(c)
+
+	cc, err := controller.NewClient(s.srv.URL, authKey)
+	c.Assert(err, IsNil)
+	var output bytes.Buffer
+	c.Assert(cc.DeployAppRelease(app.ID, release.ID, &output), IsNil)
+	c.Assert(output.String(), Equals, "migrating\n")
+
+	job := s.cc.GetHost(hostID).Jobs[0]
+	c.Assert(job.Config.Cmd, DeepEquals, []string{"migrate"})
+	c.Assert(job.Metadata["flynn-controller.release_phase"], Equals, "true")
+
+	current, err := cc.GetAppRelease(app.ID)
+	c.Assert(err, IsNil)
+	c.Assert(current.ID, Equals, release.ID)
+}
+
+func (s *S) TestReleasePhaseFailure(c *C) {
+	s.setReleasePhaseHost(c, "migration failed\n", 1)
+	app := s.createTestApp(c, &ct.App{Name: "release-phase-failure"})
+	previous := s.createTestRelease(c, &ct.Release{})
+	s.setAppRelease(c, app.ID, previous.ID)
+	release := s.createReleasePhaseRelease(c)
+
+	// the output is included in the error of a request which is not streamed
+	res, err := s.Put("/apps/"+app.ID+"/release", &ct.Release{ID: release.ID}, nil)
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 400)
+	body, err := s.body(res)
+	c.Assert(err, IsNil)
+	c.Assert(body, Matches, `(?s).*release phase exited with status 1:\\nmigration failed.*`)
+
+	cc, err := controller.NewClient(s.srv.URL, authKey)
+	c.Assert(err, IsNil)
+	var output bytes.Buffer
+	err = cc.DeployAppRelease(app.ID, release.ID, &output)
+	c.Assert(err, ErrorMatches, "release phase exited with status 1")
+	c.Assert(output.String(), Equals, "migration failed\n")
+
+	current, err := cc.GetAppRelease(app.ID)
+	c.Assert(err, IsNil)
+	c.Assert(current.ID, Equals, previous.ID)
+}
+
+func (s *S) TestReleasePhaseTimeout(c *C) {
+	hostID := random.UUID()
+	hc := tu.NewFakeHostClient(hostID)
+	// the job runs until the attach client is closed
+	var jobID string
+	hc.SetAttachFunc("*", func(req *host.AttachReq, wait bool) (cluster.AttachClient, error) {
+		jobID = req.JobID
+		pipeR, pipeW := io.Pipe()
+		return cluster.NewAttachClient(struct {
+			io.Reader
+			io.WriteCloser
+		}{pipeR, pipeW}), nil
+	})
+	s.cc.SetHostClient(hostID, hc)
+	s.cc.SetHosts(map[string]host.Host{hostID: {}})
+	defer func(d time.Duration) { releasePhaseTimeout = d }(releasePhaseTimeout)
+	releasePhaseTimeout = 100 * time.Millisecond
+
+	app := s.createTestApp(c, &ct.App{Name: "release-phase-timeout"})
+	release := s.createReleasePhaseRelease(c)
+	res, err := s.Put("/apps/"+app.ID+"/release", &ct.Release{ID: release.ID}, nil)
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 500)
+
+	c.Assert(hc.IsStopped(jobID), Equals, true)
+	current := &ct.Release{}
+	res, err = s.Get("/apps/"+app.ID+"/release", current)
+	c.Assert(res.StatusCode, Equals, 404)
+}
+
+func (s *S) TestTailBuffer(c *C) {
+	b := newTailBuffer(4)
+	b.Write([]byte("ab"))
+	c.Assert(string(b.Bytes()), Equals, "ab")
+	b.Write([]byte("cde"))
+	c.Assert(string(b.Bytes()), Equals, "bcde")
+	b.Write([]byte("f"))
+	c.Assert(string(b.Bytes()), Equals, "cdef")
+	n, err := b.Write([]byte(strings.Repeat("x", 10) + "wxyz"))
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 14)
+	c.Assert(string(b.Bytes()), Equals, "wxyz")
+}
@@ -1,20 +1,27 @@
 package main
 
 import (
+	"log"
 	"strings"
+	"time"
 
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-sql"
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/pq/hstore"
 	ct "github.com/flynn/flynn/controller/types"
 	"github.com/flynn/flynn/pkg/random"
+	"github.com/flynn/flynn/pkg/resource"
 )
 
 type ResourceRepo struct {
-	db *DB
+	db        *DB
+	providers *ProviderRepo
+	dc        resource.DiscoverdClient
 }
 
-func NewResourceRepo(db *DB) *ResourceRepo {
-	return &ResourceRepo{db}
+// NewResourceRepo returns a repo which deprovisions resources by connecting to
+// their providers with dc.
+func NewResourceRepo(db *DB, providers *ProviderRepo, dc resource.DiscoverdClient) *ResourceRepo {
+	return &ResourceRepo{db: db, providers: providers, dc: dc}
 }
 
 func (rr *ResourceRepo) Add(r *ct.Resource) error {
@@ -25,10 +32,10 @@ func (rr *ResourceRepo) Add(r *ct.Resource) error {
 	if err != nil {
 		return err
 	}
-	err = tx.QueryRow(`INSERT INTO resources (resource_id, provider_id, external_id, env)
-					   VALUES ($1, $2, $3, $4)
+	err = tx.QueryRow(`INSERT INTO resources (resource_id, provider_id, external_id, env, deprovision_with_apps)
+					   VALUES ($1, $2, $3, $4, $5)
 					   RETURNING created_at`,
-		r.ID, r.ProviderID, r.ExternalID, envHstore(r.Env)).Scan(&r.CreatedAt)
+		r.ID, r.ProviderID, r.ExternalID, envHstore(r.Env), r.DeprovisionWithApps).Scan(&r.CreatedAt)
 	if err != nil {
 		tx.Rollback()
 		return err
@@ -74,7 +81,7 @@ func scanResource(s Scanner) (*ct.Resource, error) {
 	r := &ct.Resource{}
 	var env hstore.Hstore
 	var appIDs string
-	err := s.Scan(&r.ID, &r.ProviderID, &r.ExternalID, &env, &appIDs, &r.CreatedAt)
+	err := s.Scan(&r.ID, &r.ProviderID, &r.ExternalID, &env, &appIDs, &r.DeprovisionWithApps, &r.CreatedAt)
 	if err == sql.ErrNoRows {
 		err = ErrNotFound
 	}
@@ -99,26 +106,44 @@ func (r *ResourceRepo) Get(id string) (*ct.Resource, error) {
 								       FROM app_resources a
 									   WHERE a.resource_id = r.resource_id AND a.deleted_at IS NULL
 									   ORDER BY a.created_at DESC),
-								 created_at
+								 deprovision_with_apps, created_at
 						  FROM resources r
 						  WHERE resource_id = $1 AND deleted_at IS NULL`, id)
 	return scanResource(row)
 }
 
-func (r *ResourceRepo) ProviderList(providerID string) ([]*ct.Resource, error) {
-	rows, err := r.db.Query(`SELECT resource_id, provider_id, external_id, env,
+func (r *ResourceRepo) ProviderList(providerID string, opts *listOptions) ([]*ct.Resource, string, error) {
+	if err := opts.checkFilters(); err != nil {
+		return nil, "", err
+	}
+	q := newListQuery(`SELECT resource_id, provider_id, external_id, env,
 									ARRAY(SELECT a.app_id
 								          FROM app_resources a
                                           WHERE a.resource_id = r.resource_id AND a.deleted_at IS NULL
                                           ORDER BY a.created_at DESC),
-									created_at
+									deprovision_with_apps, created_at
 							 FROM resources r
-							 WHERE provider_id = $1 AND deleted_at IS NULL
-							 ORDER BY created_at DESC`, providerID)
+							 WHERE provider_id = $1 AND deleted_at IS NULL`, "resource_id")
+	q.args = append(q.args, providerID)
+	return r.list(q, opts)
+}
+
+// list returns the page of resources selected by q.
+func (r *ResourceRepo) list(q *listQuery, opts *listOptions) ([]*ct.Resource, string, error) {
+	query, args, err := q.build(opts)
+	if err != nil {
+		return nil, "", err
+	}
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return nil, "", err
+	}
+	resources, err := resourceList(rows)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
-	return resourceList(rows)
+	n, next := opts.page(len(resources), func(i int) (*time.Time, string) { return resources[i].CreatedAt, resources[i].ID })
+	return resources[:n], next, nil
 }
 
 func resourceList(rows *sql.Rows) ([]*ct.Resource, error) {
@@ -134,19 +159,100 @@ func resourceList(rows *sql.Rows) ([]*ct.Resource, error) {
 	return resources, rows.Err()
 }
 
-func (r *ResourceRepo) AppList(appID string) ([]*ct.Resource, error) {
-	rows, err := r.db.Query(`SELECT DISTINCT(r.resource_id), r.provider_id, r.external_id, r.env,
+func (r *ResourceRepo) AppList(appID string, opts *listOptions) ([]*ct.Resource, string, error) {
+	if err := opts.checkFilters(); err != nil {
+		return nil, "", err
+	}
+	// the app is matched with EXISTS rather than a join so that the
+	// columns of the list query are not ambiguous
+	q := newListQuery(`SELECT r.resource_id, r.provider_id, r.external_id, r.env,
 									ARRAY(SELECT a.app_id
 									      FROM app_resources a 
 										  WHERE a.resource_id = r.resource_id AND a.deleted_at IS NULL
 										  ORDER BY a.created_at DESC),
-									r.created_at
+									r.deprovision_with_apps, r.created_at
 							 FROM resources r
-							 JOIN app_resources a USING (resource_id)
-							 WHERE a.app_id = $1 AND r.deleted_at IS NULL
-							 ORDER BY r.created_at DESC`, appID)
+							 WHERE EXISTS (SELECT 1 FROM app_resources a WHERE a.resource_id = r.resource_id AND a.app_id = $1 AND a.deleted_at IS NULL)
+							 AND r.deleted_at IS NULL`, "resource_id")
+	q.args = append(q.args, appID)
+	return r.list(q, opts)
+}
+
+// Remove removes a resource and detaches it from its apps.
+func (rr *ResourceRepo) Remove(id string) error {
+	tx, err := rr.db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE resources SET deleted_at = now() WHERE resource_id = $1 AND deleted_at IS NULL", id); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec("UPDATE app_resources SET deleted_at = now() WHERE resource_id = $1 AND deleted_at IS NULL", id); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Deprovision destroys a resource with its provider, and then removes it.
+func (rr *ResourceRepo) Deprovision(r *ct.Resource) error {
+	p, err := rr.providers.Get(r.ProviderID)
+	if err != nil {
+		return err
+	}
+	server, err := resource.NewServerWithDiscoverd(p.(*ct.Provider).URL, rr.dc)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	defer server.Close()
+	if err := server.Deprovision(r.ExternalID); err != nil {
+		return err
 	}
-	return resourceList(rows)
+	return rr.Remove(r.ID)
+}
+
+// deprovisionUnused deprovisions the resources with the given IDs which were
+// provisioned with DeprovisionWithApps and are no longer used by an app.
+func (rr *ResourceRepo) deprovisionUnused(ids []string) {
+	for _, id := range ids {
+		r, err := rr.Get(id)
+		if err != nil {
+			log.Printf("Error getting resource %s: %s", id, err)
+			continue
+		}
+		if !r.DeprovisionWithApps || len(r.Apps) > 0 {
+			continue
+		}
+		if err := rr.Deprovision(r); err != nil {
+			log.Printf("Error deprovisioning resource %s: %s", id, err)
+		}
+	}
+}
+
+// AddApp attaches a resource to an app.
+func (rr *ResourceRepo) AddApp(resourceID, appID string) error {
+	tx, err := rr.db.Begin()
+	if err != nil {
+		return err
+	}
+	var exists bool
+	err = tx.QueryRow("SELECT deleted_at IS NULL FROM app_resources WHERE app_id = $1 AND resource_id = $2", appID, resourceID).Scan(&exists)
+	switch {
+	case err == sql.ErrNoRows:
+		_, err = tx.Exec("INSERT INTO app_resources (app_id, resource_id) VALUES ($1, $2)", appID, resourceID)
+	case err == nil && !exists:
+		// the resource was detached before
+		_, err = tx.Exec("UPDATE app_resources SET created_at = now(), deleted_at = NULL WHERE app_id = $1 AND resource_id = $2", appID, resourceID)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// RemoveApp detaches a resource from an app.
+func (rr *ResourceRepo) RemoveApp(resourceID, appID string) error {
+	return rr.db.Exec("UPDATE app_resources SET deleted_at = now() WHERE app_id = $1 AND resource_id = $2 AND deleted_at IS NULL", appID, resourceID)
 }
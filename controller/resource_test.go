@@ -7,13 +7,13 @@ import (
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"sync"
 
 	. "github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-check"
 	ct "github.com/flynn/flynn/controller/types"
 	"github.com/flynn/flynn/discoverd/agent"
 	"github.com/flynn/flynn/discoverd/client"
 	"github.com/flynn/flynn/pkg/random"
-	"github.com/flynn/flynn/pkg/resource"
 )
 
 type fakeServiceSet struct {
@@ -40,12 +40,34 @@ func (s *fakeServiceSet) Unwatch(chan *agent.ServiceUpdate) {}
 
 func (s *fakeServiceSet) Close() error { return nil }
 
+// resourceDiscoverd finds every resource provider at the address of srv.
 type resourceDiscoverd struct {
-	fn func() []*discoverd.Service
+	mtx sync.Mutex
+	srv *httptest.Server
 }
 
 func (d *resourceDiscoverd) NewServiceSet(name string) (discoverd.ServiceSet, error) {
-	return &fakeServiceSet{d.fn}, nil
+	d.mtx.Lock()
+	srv := d.srv
+	d.mtx.Unlock()
+	return &fakeServiceSet{func() []*discoverd.Service {
+		if srv == nil {
+			return nil
+		}
+		host, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+		return []*discoverd.Service{{
+			Addr: srv.Listener.Addr().String(),
+			Host: host,
+			Port: port,
+		}}
+	}}, nil
+}
+
+// serveProvider makes srv the server of every resource provider.
+func (s *S) serveProvider(srv *httptest.Server) {
+	s.providers.mtx.Lock()
+	s.providers.srv = srv
+	s.providers.mtx.Unlock()
 }
 
 func (s *S) provisionTestResource(c *C, name string, apps []string) (*ct.Resource, *ct.Provider) {
@@ -59,17 +81,7 @@ func (s *S) provisionTestResource(c *C, name string, apps []string) (*ct.Resourc
 	})
 	srv := httptest.NewServer(handler)
 	defer srv.Close()
-
-	host, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
-	s.m.MapTo(&resourceDiscoverd{
-		fn: func() []*discoverd.Service {
-			return []*discoverd.Service{{
-				Addr: srv.Listener.Addr().String(),
-				Host: host,
-				Port: port,
-			}}
-		},
-	}, (*resource.DiscoverdClient)(nil))
+	s.serveProvider(srv)
 
 	p := s.createTestProvider(c, &ct.Provider{URL: fmt.Sprintf("discoverd+http://%s/things", name), Name: name})
 	conf := json.RawMessage(data)
@@ -153,3 +165,194 @@ func (s *S) TestResourceLists(c *C) {
 		c.Assert(list[0].Apps, DeepEquals, apps)
 	}
 }
+
+// fakeProvider is a resource provider which records the resources it
+// deprovisions, responding with deleteStatus if it is set.
+type fakeProvider struct {
+	*httptest.Server
+	mtx          sync.Mutex
+	deleted      []string
+	deleteStatus int
+}
+
+func (s *S) newFakeProvider(c *C) *fakeProvider {
+	p := &fakeProvider{}
+	p.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case "POST":
+			id := random.UUID()
+			w.Write([]byte(fmt.Sprintf(`{"id":"/things/%s","env":{"HOST":"things.example.com","PASSWORD":"%s"}}`, id, id)))
+		case "DELETE":
+			p.mtx.Lock()
+			defer p.mtx.Unlock()
+			if p.deleteStatus != 0 {
+				w.WriteHeader(p.deleteStatus)
+				return
+			}
+			p.deleted = append(p.deleted, req.URL.Path)
+		default:
+			w.WriteHeader(405)
+		}
+	}))
+	s.serveProvider(p.Server)
+	return p
+}
+
+func (p *fakeProvider) setDeleteStatus(status int) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.deleteStatus = status
+}
+
+func (p *fakeProvider) Deleted() []string {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	return append([]string(nil), p.deleted...)
+}
+
+func (s *S) provisionFakeResource(c *C, p *ct.Provider, req *ct.ResourceReq) *ct.Resource {
+	out := &ct.Resource{}
+	res, err := s.Post("/providers/"+p.ID+"/resources", req, out)
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 200)
+	return out
+}
+
+func (s *S) TestDeleteResource(c *C) {
+	fp := s.newFakeProvider(c)
+	defer fp.Close()
+	app := s.createTestApp(c, &ct.App{Name: "delete-resource"})
+	provider := s.createTestProvider(c, &ct.Provider{URL: "discoverd+http://delete-resource/things", Name: "delete-resource"})
+	other := s.createTestProvider(c, &ct.Provider{URL: "discoverd+http://delete-resource-other/things", Name: "delete-resource-other"})
+	resource := s.provisionFakeResource(c, provider, &ct.ResourceReq{Apps: []string{app.ID}})
+
+	res, err := s.Delete(fmt.Sprintf("/providers/%s/resources/%s", other.ID, resource.ID))
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 404)
+	c.Assert(fp.Deleted(), HasLen, 0)
+
+	// a provider which doesn't know the resource or doesn't support
+	// deprovisioning fails the delete
+	path := fmt.Sprintf("/providers/%s/resources/%s", provider.ID, resource.ID)
+	fp.setDeleteStatus(404)
+	res, err = s.Delete(path)
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 500)
+	res, err = s.Get(path, &ct.Resource{})
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 200)
+
+	fp.setDeleteStatus(0)
+	res, err = s.Delete(path)
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 200)
+	c.Assert(fp.Deleted(), DeepEquals, []string{resource.ExternalID})
+
+	res, err = s.Get(path, &ct.Resource{})
+	c.Assert(res.StatusCode, Equals, 404)
+	var list []*ct.Resource
+	_, err = s.Get("/apps/"+app.ID+"/resources", &list)
+	c.Assert(err, IsNil)
+	c.Assert(list, HasLen, 0)
+}
+
+func (s *S) TestDeleteAppDeprovisionsResources(c *C) {
+	fp := s.newFakeProvider(c)
+	defer fp.Close()
+	app1 := s.createTestApp(c, &ct.App{Name: "deprovision-app1"})
+	app2 := s.createTestApp(c, &ct.App{Name: "deprovision-app2"})
+	provider := s.createTestProvider(c, &ct.Provider{URL: "discoverd+http://deprovision-app/things", Name: "deprovision-app"})
+
+	optedIn := s.provisionFakeResource(c, provider, &ct.ResourceReq{Apps: []string{app1.ID}, DeprovisionWithApps: true})
+	c.Assert(optedIn.DeprovisionWithApps, Equals, true)
+	shared := s.provisionFakeResource(c, provider, &ct.ResourceReq{Apps: []string{app1.ID, app2.ID}, DeprovisionWithApps: true})
+	kept := s.provisionFakeResource(c, provider, &ct.ResourceReq{Apps: []string{app1.ID}})
+
+	res, err := s.Delete("/apps/" + app1.ID)
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 200)
+	c.Assert(fp.Deleted(), DeepEquals, []string{optedIn.ExternalID})
+
+	path := func(r *ct.Resource) string {
+		return fmt.Sprintf("/providers/%s/resources/%s", provider.ID, r.ID)
+	}
+	res, err = s.Get(path(optedIn), &ct.Resource{})
+	c.Assert(res.StatusCode, Equals, 404)
+
+	got := &ct.Resource{}
+	_, err = s.Get(path(shared), got)
+	c.Assert(err, IsNil)
+	c.Assert(got.Apps, DeepEquals, []string{app2.ID})
+
+	got = &ct.Resource{}
+	_, err = s.Get(path(kept), got)
+	c.Assert(err, IsNil)
+	c.Assert(got.Apps, HasLen, 0)
+}
+
+func (s *S) TestAttachDetachResource(c *C) {
+	fp := s.newFakeProvider(c)
+	defer fp.Close()
+	provider := s.createTestProvider(c, &ct.Provider{URL: "discoverd+http://attach-resource/things", Name: "attach-resource"})
+	app := s.createTestApp(c, &ct.App{Name: "attach-resource"})
+	release := s.createTestRelease(c, &ct.Release{Env: map[string]string{"APP": "env"}})
+	s.setAppRelease(c, app.ID, release.ID)
+
+	appEnv := func() map[string]string {
+		release := &ct.Release{}
+		_, err := s.Get("/apps/"+app.ID+"/release", release)
+		c.Assert(err, IsNil)
+		return release.Env
+	}
+	path := func(r *ct.Resource) string {
+		return fmt.Sprintf("/apps/%s/resources/%s", app.ID, r.ID)
+	}
+
+	oldResource := s.provisionFakeResource(c, provider, &ct.ResourceReq{})
+	attached := &ct.Resource{}
+	res, err := s.Put(path(oldResource), nil, attached)
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 200)
+	c.Assert(attached.Apps, DeepEquals, []string{app.ID})
+	c.Assert(appEnv(), DeepEquals, map[string]string{
+		"APP":      "env",
+		"HOST":     "things.example.com",
+		"PASSWORD": oldResource.Env["PASSWORD"],
+	})
+
+	// rotate the credentials by attaching a new resource and detaching the
+	// old one
+	newResource := s.provisionFakeResource(c, provider, &ct.ResourceReq{})
+	res, err = s.Put(path(newResource), nil, &ct.Resource{})
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 200)
+	res, err = s.Delete(path(oldResource))
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 200)
+	c.Assert(appEnv(), DeepEquals, map[string]string{
+		"APP":      "env",
+		"HOST":     "things.example.com",
+		"PASSWORD": newResource.Env["PASSWORD"],
+	})
+
+	var list []*ct.Resource
+	_, err = s.Get("/apps/"+app.ID+"/resources", &list)
+	c.Assert(err, IsNil)
+	c.Assert(list, HasLen, 1)
+	c.Assert(list[0].ID, Equals, newResource.ID)
+
+	res, err = s.Delete(path(oldResource))
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 404)
+
+	res, err = s.Delete(path(newResource))
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 200)
+	c.Assert(appEnv(), DeepEquals, map[string]string{"APP": "env"})
+
+	// reattaching a detached resource
+	res, err = s.Put(path(oldResource), nil, attached)
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 200)
+	c.Assert(attached.Apps, DeepEquals, []string{app.ID})
+}
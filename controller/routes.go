@@ -1,18 +1,22 @@
 package main
 
 import (
+	"log"
+
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/go-martini/martini"
 	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/pkg/random"
 	routerc "github.com/flynn/flynn/router/client"
 	"github.com/flynn/flynn/router/types"
 )
 
-func createRoute(app *ct.App, router routerc.Client, route router.Route, r ResponseHelper) {
+func createRoute(app *ct.App, router routerc.Client, route router.Route, webhooks *WebhookRepo, r ResponseHelper) {
 	route.ParentRef = routeParentRef(app)
 	if err := router.CreateRoute(&route); err != nil {
 		r.Error(err)
 		return
 	}
+	emitRouteChange(webhooks, app, "create", &route)
 	r.JSON(200, &route)
 }
 
@@ -49,7 +53,7 @@ func getRouteList(app *ct.App, router routerc.Client, r ResponseHelper) {
 	r.JSON(200, routes)
 }
 
-func deleteRoute(route *router.Route, router routerc.Client, r ResponseHelper) {
+func deleteRoute(app *ct.App, route *router.Route, router routerc.Client, webhooks *WebhookRepo, r ResponseHelper) {
 	err := router.DeleteRoute(route.ID)
 	if err == routerc.ErrNotFound {
 		err = ErrNotFound
@@ -58,5 +62,16 @@ func deleteRoute(route *router.Route, router routerc.Client, r ResponseHelper) {
 		r.Error(err)
 		return
 	}
+	emitRouteChange(webhooks, app, "delete", route)
 	r.WriteHeader(200)
 }
+
+// emitRouteChange sends a route_change event to the webhooks of an app. The
+// router does not notify the controller of changes, so only changes made
+// through the controller are sent.
+func emitRouteChange(webhooks *WebhookRepo, app *ct.App, action string, route *router.Route) {
+	data := map[string]interface{}{"action": action, "route": route}
+	if err := webhooks.emit("route_change:"+random.UUID(), ct.WebhookEventRouteChange, app.ID, data); err != nil {
+		log.Printf("Error emitting route_change event of app %s: %s", app.ID, err)
+	}
+}
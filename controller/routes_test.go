@@ -14,12 +14,13 @@ import (
 )
 
 func newFakeRouter() routerc.Client {
-	return &fakeRouter{routes: make(map[string]*router.Route)}
+	return &fakeRouter{routes: make(map[string]*router.Route), stats: make(map[string]*router.ServiceStats)}
 }
 
 type fakeRouter struct {
 	mtx    sync.RWMutex
 	routes map[string]*router.Route
+	stats  map[string]*router.ServiceStats
 }
 
 func (r *fakeRouter) CreateRoute(route *router.Route) error {
@@ -77,6 +78,23 @@ func (r *fakeRouter) ListRoutes(parentRef string) ([]*router.Route, error) {
 	return routes, nil
 }
 
+func (r *fakeRouter) ServiceStats(service string) (*router.ServiceStats, error) {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	if stats, ok := r.stats[service]; ok {
+		res := *stats
+		return &res, nil
+	}
+	return &router.ServiceStats{Service: service}, nil
+}
+
+func (r *fakeRouter) setServiceStats(stats *router.ServiceStats) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	copy := *stats
+	r.stats[stats.Service] = &copy
+}
+
 func (r *fakeRouter) Close() error { return nil }
 
 func (s *S) createTestRoute(c *C, appID string, in *router.Route) *router.Route {
@@ -38,6 +38,7 @@ func (s *S) TestFormationStreaming(c *C) {
 		AppID:     app.ID,
 		Processes: map[string]int{"foo": 1},
 	})
+	release.AppID = app.ID
 
 	var out *ct.ExpandedFormation
 	select {
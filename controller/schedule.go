@@ -0,0 +1,528 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-sql"
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/go-martini/martini"
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/host/types"
+	"github.com/flynn/flynn/pkg/cluster"
+	"github.com/flynn/flynn/pkg/random"
+)
+
+const (
+	// scheduleInterval is how often schedules are checked for due runs.
+	// Schedules have a resolution of a minute.
+	scheduleInterval = 10 * time.Second
+
+	// scheduleStartTimeout is how long the job of a run is assumed to be
+	// running before its state is first reported.
+	scheduleStartTimeout = 5 * time.Minute
+)
+
+type ScheduleRepo struct {
+	db        *DB
+	apps      *AppRepo
+	releases  *ReleaseRepo
+	artifacts *ArtifactRepo
+	secrets   *SecretRepo
+	cluster   clusterClient
+}
+
+func NewScheduleRepo(db *DB, apps *AppRepo, releases *ReleaseRepo, artifacts *ArtifactRepo, secrets *SecretRepo, cluster clusterClient) *ScheduleRepo {
+	return &ScheduleRepo{db: db, apps: apps, releases: releases, artifacts: artifacts, secrets: secrets, cluster: cluster}
+}
+
+// scheduleData is the part of a schedule stored as JSON.
+type scheduleData struct {
+	Cmd []string          `json:"cmd,omitempty"`
+	Env map[string]string `json:"env,omitempty"`
+}
+
+// validate checks a schedule and sets its next run after now.
+func (r *ScheduleRepo) validate(s *ct.Schedule, now time.Time) error {
+	cron, err := parseCronSchedule(s.Schedule)
+	if err != nil {
+		return ct.ValidationError{Field: "schedule", Message: err.Error()}
+	}
+	next := cron.next(now)
+	s.NextRunAt = &next
+
+	switch s.ConcurrencyPolicy {
+	case "":
+		s.ConcurrencyPolicy = ct.ConcurrencyAllow
+	case ct.ConcurrencyAllow, ct.ConcurrencyForbid, ct.ConcurrencyReplace:
+	default:
+		return ct.ValidationError{Field: "concurrency_policy", Message: fmt.Sprintf("must be %s, %s or %s", ct.ConcurrencyAllow, ct.ConcurrencyForbid, ct.ConcurrencyReplace)}
+	}
+
+	if s.ReleaseID != "" {
+		data, err := r.releases.Get(s.ReleaseID)
+		if err == ErrNotFound {
+			return ct.ValidationError{Field: "release", Message: "not found"}
+		} else if err != nil {
+			return err
+		}
+		release := data.(*ct.Release)
+		if release.AppID != "" && release.AppID != s.AppID {
+			return ct.ValidationError{Field: "release", Message: "is a release of another app"}
+		}
+		s.ReleaseID = release.ID
+	}
+	return nil
+}
+
+func (r *ScheduleRepo) Add(s *ct.Schedule) error {
+	if err := r.validate(s, time.Now()); err != nil {
+		return err
+	}
+	data, err := json.Marshal(&scheduleData{Cmd: s.Cmd, Env: s.Env})
+	if err != nil {
+		return err
+	}
+	if s.ID == "" {
+		s.ID = random.UUID()
+	}
+	var releaseID *string
+	if s.ReleaseID != "" {
+		releaseID = &s.ReleaseID
+	}
+	err = r.db.QueryRow("INSERT INTO schedules (schedule_id, app_id, release_id, schedule, data, concurrency_policy, next_run_at) VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING created_at, updated_at",
+		s.ID, s.AppID, releaseID, s.Schedule, string(data), s.ConcurrencyPolicy, s.NextRunAt).Scan(&s.CreatedAt, &s.UpdatedAt)
+	s.ID = cleanUUID(s.ID)
+	return err
+}
+
+const scheduleColumns = "schedule_id, app_id, release_id, schedule, data, concurrency_policy, next_run_at, created_at, updated_at"
+
+func scanSchedule(row Scanner) (*ct.Schedule, error) {
+	s := &ct.Schedule{}
+	var releaseID sql.NullString
+	var data []byte
+	err := row.Scan(&s.ID, &s.AppID, &releaseID, &s.Schedule, &data, &s.ConcurrencyPolicy, &s.NextRunAt, &s.CreatedAt, &s.UpdatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			err = ErrNotFound
+		}
+		return nil, err
+	}
+	var sd scheduleData
+	if err := json.Unmarshal(data, &sd); err != nil {
+		return nil, err
+	}
+	s.ID = cleanUUID(s.ID)
+	s.AppID = cleanUUID(s.AppID)
+	s.ReleaseID = cleanUUID(releaseID.String)
+	s.Cmd = sd.Cmd
+	s.Env = sd.Env
+	return s, nil
+}
+
+func (r *ScheduleRepo) Get(appID, id string) (*ct.Schedule, error) {
+	if !idPattern.MatchString(id) {
+		return nil, ErrNotFound
+	}
+	row := r.db.QueryRow("SELECT "+scheduleColumns+" FROM schedules WHERE app_id = $1 AND schedule_id = $2 AND deleted_at IS NULL", appID, id)
+	return scanSchedule(row)
+}
+
+func (r *ScheduleRepo) List(appID string, opts *listOptions) ([]*ct.Schedule, string, error) {
+	if err := opts.checkFilters(); err != nil {
+		return nil, "", err
+	}
+	q := newListQuery("SELECT "+scheduleColumns+" FROM schedules WHERE app_id = $1 AND deleted_at IS NULL", "schedule_id")
+	q.args = append(q.args, appID)
+	query, args, err := q.build(opts)
+	if err != nil {
+		return nil, "", err
+	}
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return nil, "", err
+	}
+	schedules := []*ct.Schedule{}
+	for rows.Next() {
+		s, err := scanSchedule(rows)
+		if err != nil {
+			rows.Close()
+			return nil, "", err
+		}
+		schedules = append(schedules, s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+	n, next := opts.page(len(schedules), func(i int) (*time.Time, string) { return schedules[i].CreatedAt, schedules[i].ID })
+	return schedules[:n], next, nil
+}
+
+// Update changes the fields of s which are set in update.
+func (r *ScheduleRepo) Update(s *ct.Schedule, update *ct.Schedule) (*ct.Schedule, error) {
+	updated := *s
+	if update.Schedule != "" {
+		updated.Schedule = update.Schedule
+	}
+	if update.ReleaseID != "" {
+		updated.ReleaseID = update.ReleaseID
+	}
+	if update.Cmd != nil {
+		updated.Cmd = update.Cmd
+	}
+	if update.Env != nil {
+		updated.Env = update.Env
+	}
+	if update.ConcurrencyPolicy != "" {
+		updated.ConcurrencyPolicy = update.ConcurrencyPolicy
+	}
+	if err := r.validate(&updated, time.Now()); err != nil {
+		return nil, err
+	}
+	if updated.Schedule == s.Schedule {
+		// keep the next run of an unchanged schedule
+		updated.NextRunAt = s.NextRunAt
+	}
+	data, err := json.Marshal(&scheduleData{Cmd: updated.Cmd, Env: updated.Env})
+	if err != nil {
+		return nil, err
+	}
+	var releaseID *string
+	if updated.ReleaseID != "" {
+		releaseID = &updated.ReleaseID
+	}
+	err = r.db.QueryRow("UPDATE schedules SET release_id = $2, schedule = $3, data = $4, concurrency_policy = $5, next_run_at = $6, updated_at = now() WHERE schedule_id = $1 AND deleted_at IS NULL RETURNING updated_at",
+		updated.ID, releaseID, updated.Schedule, string(data), updated.ConcurrencyPolicy, updated.NextRunAt).Scan(&updated.UpdatedAt)
+	if err == sql.ErrNoRows {
+		err = ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &updated, nil
+}
+
+func (r *ScheduleRepo) Remove(id string) error {
+	return r.db.Exec("UPDATE schedules SET deleted_at = now() WHERE schedule_id = $1 AND deleted_at IS NULL", id)
+}
+
+const scheduleRunColumns = "run_id, schedule_id, host_id, job_id, state, job_state, exit_status, error, scheduled_at, created_at, updated_at"
+
+func scanScheduleRun(row Scanner) (*ct.ScheduleRun, error) {
+	run := &ct.ScheduleRun{}
+	var hostID, jobID, jobState sql.NullString
+	var exitStatus sql.NullInt64
+	err := row.Scan(&run.ID, &run.ScheduleID, &hostID, &jobID, &run.State, &jobState, &exitStatus, &run.Error, &run.ScheduledAt, &run.CreatedAt, &run.UpdatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			err = ErrNotFound
+		}
+		return nil, err
+	}
+	run.ID = cleanUUID(run.ID)
+	run.ScheduleID = cleanUUID(run.ScheduleID)
+	if jobID.Valid {
+		run.JobID = hostID.String + "-" + jobID.String
+	}
+	if exitStatus.Valid {
+		status := int(exitStatus.Int64)
+		run.ExitStatus = &status
+	}
+	if run.State == "started" {
+		switch jobState.String {
+		case "down":
+			run.State = "succeeded"
+		case "crashed", "oom":
+			run.State = "failed"
+		case "":
+			// the job is not running if its state was never reported
+			if run.CreatedAt.Before(time.Now().Add(-scheduleStartTimeout)) {
+				run.State = "failed"
+				run.Error = "the state of the job was not reported"
+			} else {
+				run.State = "running"
+			}
+		default:
+			run.State = "running"
+		}
+	}
+	return run, nil
+}
+
+// listRuns returns the history of runs of a schedule.
+func (r *ScheduleRepo) listRuns(scheduleID string, opts *listOptions) ([]*ct.ScheduleRun, string, error) {
+	if err := opts.checkFilters(); err != nil {
+		return nil, "", err
+	}
+	q := newListQuery("SELECT "+scheduleRunColumns+" FROM schedule_runs WHERE schedule_id = $1", "run_id")
+	q.args = append(q.args, scheduleID)
+	query, args, err := q.build(opts)
+	if err != nil {
+		return nil, "", err
+	}
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return nil, "", err
+	}
+	runs := []*ct.ScheduleRun{}
+	for rows.Next() {
+		run, err := scanScheduleRun(rows)
+		if err != nil {
+			rows.Close()
+			return nil, "", err
+		}
+		runs = append(runs, run)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+	n, next := opts.page(len(runs), func(i int) (*time.Time, string) { return runs[i].CreatedAt, runs[i].ID })
+	return runs[:n], next, nil
+}
+
+// start runs schedules when they are due.
+func (r *ScheduleRepo) start() {
+	go func() {
+		for {
+			if err := r.runDue(time.Now()); err != nil {
+				log.Printf("Error running schedules: %s", err)
+			}
+			time.Sleep(scheduleInterval)
+		}
+	}()
+}
+
+// runDue runs the schedules which are due at now. Each is claimed by moving
+// its next run forward, so that it is run by one controller only.
+func (r *ScheduleRepo) runDue(now time.Time) error {
+	rows, err := r.db.Query("SELECT "+scheduleColumns+" FROM schedules WHERE deleted_at IS NULL AND next_run_at <= $1 ORDER BY next_run_at", now)
+	if err != nil {
+		return err
+	}
+	var due []*ct.Schedule
+	for rows.Next() {
+		s, err := scanSchedule(rows)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		due = append(due, s)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, s := range due {
+		cron, err := parseCronSchedule(s.Schedule)
+		if err != nil {
+			log.Printf("Error parsing schedule %s: %s", s.ID, err)
+			continue
+		}
+		// runs missed while no controller was running are not made up for
+		next := cron.next(now)
+		var id string
+		err = r.db.QueryRow("UPDATE schedules SET next_run_at = $3 WHERE schedule_id = $1 AND next_run_at = $2 AND deleted_at IS NULL RETURNING schedule_id",
+			s.ID, s.NextRunAt, next).Scan(&id)
+		if err == sql.ErrNoRows {
+			// claimed by another controller
+			continue
+		} else if err != nil {
+			return err
+		}
+		if err := r.run(s, *s.NextRunAt); err != nil {
+			log.Printf("Error recording run of schedule %s: %s", s.ID, err)
+		}
+	}
+	return nil
+}
+
+// activeJobs returns the IDs of the jobs of runs of a schedule which are
+// still running.
+func (r *ScheduleRepo) activeJobs(scheduleID string) ([]string, error) {
+	rows, err := r.db.Query(`
+SELECT concat(host_id, '-', job_id) FROM schedule_runs
+WHERE schedule_id = $1 AND state = 'started'
+AND (job_state IN ('starting', 'up') OR (job_state IS NULL AND created_at > $2))`,
+		scheduleID, time.Now().Add(-scheduleStartTimeout))
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// run starts the job of a schedule which was due at scheduledAt, applying its
+// concurrency policy, and records the run. Errors starting the job are
+// recorded as a failed run.
+func (r *ScheduleRepo) run(s *ct.Schedule, scheduledAt time.Time) error {
+	active, err := r.activeJobs(s.ID)
+	if err != nil {
+		return err
+	}
+	if len(active) > 0 {
+		switch s.ConcurrencyPolicy {
+		case ct.ConcurrencyForbid:
+			return r.addRun(s.ID, "", "", "skipped", fmt.Sprintf("%d jobs of previous runs are running", len(active)), scheduledAt)
+		case ct.ConcurrencyReplace:
+			for _, id := range active {
+				if err := r.stopJob(id); err != nil {
+					return r.addRun(s.ID, "", "", "failed", fmt.Sprintf("error stopping job %s: %s", id, err), scheduledAt)
+				}
+			}
+		}
+	}
+
+	job, hostID, err := r.newJob(s)
+	if err != nil {
+		return r.addRun(s.ID, "", "", "failed", err.Error(), scheduledAt)
+	}
+	// the run is recorded first so that updates of the job are not missed
+	if err := r.addRun(s.ID, hostID, job.ID, "started", "", scheduledAt); err != nil {
+		return err
+	}
+	if _, err := r.cluster.AddJobs(&host.AddJobsReq{HostJobs: map[string][]*host.Job{hostID: {job}}}); err != nil {
+		return r.db.Exec("UPDATE schedule_runs SET state = 'failed', error = $3, updated_at = now() WHERE host_id = $1 AND job_id = $2",
+			hostID, job.ID, fmt.Sprintf("schedule failed: %s", err))
+	}
+	return nil
+}
+
+// newJob returns the job of a run of a schedule and the host to run it on.
+func (r *ScheduleRepo) newJob(s *ct.Schedule) (*host.Job, string, error) {
+	data, err := r.apps.Get(s.AppID)
+	if err != nil {
+		return nil, "", err
+	}
+	app := data.(*ct.App)
+	var release *ct.Release
+	if s.ReleaseID != "" {
+		data, err := r.releases.Get(s.ReleaseID)
+		if err != nil {
+			return nil, "", err
+		}
+		release = data.(*ct.Release)
+	} else {
+		release, err = r.apps.GetRelease(app.ID)
+		if err == ErrNotFound {
+			return nil, "", fmt.Errorf("app has no release")
+		} else if err != nil {
+			return nil, "", err
+		}
+	}
+	data, err = r.artifacts.Get(release.ArtifactID)
+	if err != nil {
+		return nil, "", err
+	}
+	artifact := data.(*ct.Artifact)
+
+	job := newOneOffJob(app, release, artifact, &ct.NewJob{Cmd: s.Cmd, Env: s.Env}, false)
+	job.Metadata["flynn-controller.schedule"] = s.ID
+	job.Config.Secrets = r.secrets.jobSecrets(app.ID, release)
+	hostID, err := pickHost(r.cluster)
+	if err != nil {
+		return nil, "", err
+	}
+	return job, hostID, nil
+}
+
+func (r *ScheduleRepo) stopJob(id string) error {
+	hostID, jobID, err := cluster.ParseJobID(id)
+	if err != nil {
+		return err
+	}
+	client, err := r.cluster.DialHost(hostID)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	return client.StopJob(jobID)
+}
+
+func (r *ScheduleRepo) addRun(scheduleID, hostID, jobID, state, errMsg string, scheduledAt time.Time) error {
+	var h, j *string
+	if jobID != "" {
+		h, j = &hostID, &jobID
+	}
+	return r.db.Exec("INSERT INTO schedule_runs (schedule_id, host_id, job_id, state, error, scheduled_at) VALUES ($1, $2, $3, $4, $5, $6)",
+		scheduleID, h, j, state, errMsg, scheduledAt)
+}
+
+func createSchedule(app *ct.App, schedule ct.Schedule, repo *ScheduleRepo, r ResponseHelper) {
+	schedule.AppID = app.ID
+	if err := repo.Add(&schedule); err != nil {
+		r.Error(err)
+		return
+	}
+	r.JSON(200, &schedule)
+}
+
+func listSchedules(req *http.Request, w http.ResponseWriter, app *ct.App, repo *ScheduleRepo, r ResponseHelper) {
+	opts, err := parseListOptions(req)
+	if err != nil {
+		r.Error(err)
+		return
+	}
+	list, next, err := repo.List(app.ID, opts)
+	if err != nil {
+		r.Error(err)
+		return
+	}
+	setNextPage(w, req, next)
+	r.JSON(200, list)
+}
+
+func getScheduleMiddleware(app *ct.App, c martini.Context, params martini.Params, repo *ScheduleRepo, r ResponseHelper) {
+	schedule, err := repo.Get(app.ID, params["schedules_id"])
+	if err != nil {
+		r.Error(err)
+		return
+	}
+	c.Map(schedule)
+}
+
+func getSchedule(schedule *ct.Schedule, r ResponseHelper) {
+	r.JSON(200, schedule)
+}
+
+func updateSchedule(schedule *ct.Schedule, update ct.Schedule, repo *ScheduleRepo, r ResponseHelper) {
+	updated, err := repo.Update(schedule, &update)
+	if err != nil {
+		r.Error(err)
+		return
+	}
+	r.JSON(200, updated)
+}
+
+func deleteSchedule(schedule *ct.Schedule, repo *ScheduleRepo, r ResponseHelper) {
+	if err := repo.Remove(schedule.ID); err != nil {
+		r.Error(err)
+		return
+	}
+	r.WriteHeader(200)
+}
+
+func listScheduleRuns(req *http.Request, w http.ResponseWriter, schedule *ct.Schedule, repo *ScheduleRepo, r ResponseHelper) {
+	opts, err := parseListOptions(req)
+	if err != nil {
+		r.Error(err)
+		return
+	}
+	list, next, err := repo.listRuns(schedule.ID, opts)
+	if err != nil {
+		r.Error(err)
+		return
+	}
+	setNextPage(w, req, next)
+	r.JSON(200, list)
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"time"
+
+	. "github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-check"
+	tu "github.com/flynn/flynn/controller/testutils"
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/host/types"
+	"github.com/flynn/flynn/pkg/random"
+)
+
+func (s *S) TestCronSchedule(c *C) {
+	from := time.Date(2015, time.January, 30, 10, 20, 30, 0, time.UTC)
+	for _, t := range []struct {
+		expr string
+		next time.Time
+	}{
+		{"* * * * *", time.Date(2015, time.January, 30, 10, 21, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2015, time.January, 30, 10, 30, 0, 0, time.UTC)},
+		{"5 */6 * * *", time.Date(2015, time.January, 30, 12, 5, 0, 0, time.UTC)},
+		{"0 9-17/4 * * 1-5", time.Date(2015, time.January, 30, 13, 0, 0, 0, time.UTC)},
+		{"30 2 * * 0", time.Date(2015, time.February, 1, 2, 30, 0, 0, time.UTC)},
+		{"30 2 * * 7", time.Date(2015, time.February, 1, 2, 30, 0, 0, time.UTC)},
+		{"0 0 31 * *", time.Date(2015, time.January, 31, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2016, time.February, 29, 0, 0, 0, 0, time.UTC)},
+		// either the day of month or the day of week matches
+		{"0 0 15 * 1", time.Date(2015, time.February, 2, 0, 0, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2015, time.January, 30, 11, 0, 0, 0, time.UTC)},
+		{"@monthly", time.Date(2015, time.February, 1, 0, 0, 0, 0, time.UTC)},
+	} {
+		sched, err := parseCronSchedule(t.expr)
+		c.Assert(err, IsNil, Commentf("%s", t.expr))
+		c.Assert(sched.next(from), Equals, t.next, Commentf("%s", t.expr))
+	}
+
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* * 0 * *", "5-1 * * * *", "*/0 * * * *", "a * * * *", "0 0 30 2 *"} {
+		_, err := parseCronSchedule(expr)
+		c.Assert(err, NotNil, Commentf("%q", expr))
+	}
+}
+
+func (s *S) createTestSchedule(c *C, appID string, in *ct.Schedule) *ct.Schedule {
+	out := &ct.Schedule{}
+	res, err := s.Post(fmt.Sprintf("/apps/%s/schedules", appID), in, out)
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 200)
+	return out
+}
+
+func (s *S) TestCreateSchedule(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "create-schedule"})
+	schedule := s.createTestSchedule(c, app.ID, &ct.Schedule{Schedule: "0 * * * *", Cmd: []string{"backup"}})
+	c.Assert(schedule.ID, Not(Equals), "")
+	c.Assert(schedule.AppID, Equals, app.ID)
+	c.Assert(schedule.ConcurrencyPolicy, Equals, ct.ConcurrencyAllow)
+	c.Assert(schedule.NextRunAt, NotNil)
+	c.Assert(schedule.NextRunAt.Minute(), Equals, 0)
+
+	path := fmt.Sprintf("/apps/%s/schedules/%s", app.ID, schedule.ID)
+	got := &ct.Schedule{}
+	_, err := s.Get(path, got)
+	c.Assert(err, IsNil)
+	c.Assert(got.Cmd, DeepEquals, []string{"backup"})
+
+	var list []*ct.Schedule
+	_, err = s.Get(fmt.Sprintf("/apps/%s/schedules", app.ID), &list)
+	c.Assert(err, IsNil)
+	c.Assert(list, HasLen, 1)
+	c.Assert(list[0].ID, Equals, schedule.ID)
+
+	updated := &ct.Schedule{}
+	_, err = s.Post(path, &ct.Schedule{ConcurrencyPolicy: ct.ConcurrencyForbid}, updated)
+	c.Assert(err, IsNil)
+	c.Assert(updated.ConcurrencyPolicy, Equals, ct.ConcurrencyForbid)
+	c.Assert(updated.Cmd, DeepEquals, []string{"backup"})
+	c.Assert(updated.NextRunAt.Equal(*schedule.NextRunAt), Equals, true)
+
+	other := s.createTestApp(c, &ct.App{Name: "create-schedule-other"})
+	release := s.createTestRelease(c, &ct.Release{})
+	s.setAppRelease(c, other.ID, release.ID)
+	for _, in := range []*ct.Schedule{
+		{Schedule: "foo"},
+		{Schedule: "@daily", ConcurrencyPolicy: "sometimes"},
+		{Schedule: "@daily", ReleaseID: random.UUID()},
+		{Schedule: "@daily", ReleaseID: release.ID},
+	} {
+		res, err := s.Post(fmt.Sprintf("/apps/%s/schedules", app.ID), in, &ct.Schedule{})
+		c.Assert(err, IsNil)
+		c.Assert(res.StatusCode, Equals, 400, Commentf("%#v", in))
+	}
+
+	_, err = s.Delete(path)
+	c.Assert(err, IsNil)
+	res, _ := s.Get(path, &ct.Schedule{})
+	c.Assert(res.StatusCode, Equals, 404)
+}
+
+func (s *S) scheduleRuns(c *C, appID, scheduleID string) []*ct.ScheduleRun {
+	var runs []*ct.ScheduleRun
+	_, err := s.Get(fmt.Sprintf("/apps/%s/schedules/%s/runs?order=asc", appID, scheduleID), &runs)
+	c.Assert(err, IsNil)
+	return runs
+}
+
+// runSchedule runs the schedules which are due at the next run of schedule.
+func (s *S) runSchedule(c *C, schedule *ct.Schedule) {
+	repo := s.m.Get(reflect.TypeOf(&ScheduleRepo{})).Interface().(*ScheduleRepo)
+	current := &ct.Schedule{}
+	_, err := s.Get(fmt.Sprintf("/apps/%s/schedules/%s", schedule.AppID, schedule.ID), current)
+	c.Assert(err, IsNil)
+	c.Assert(repo.runDue(*current.NextRunAt), IsNil)
+}
+
+func (s *S) TestScheduleRun(c *C) {
+	hostID := random.UUID()
+	s.cc.SetHosts(map[string]host.Host{hostID: {}})
+
+	app := s.createTestApp(c, &ct.App{Name: "schedule-run"})
+	artifact := s.createTestArtifact(c, &ct.Artifact{Type: "docker", URI: "docker://foo/schedule"})
+	release := s.createTestRelease(c, &ct.Release{ArtifactID: artifact.ID, Env: map[string]string{"FOO": "bar"}})
+	s.setAppRelease(c, app.ID, release.ID)
+	s.createTestFormation(c, &ct.Formation{AppID: app.ID, ReleaseID: release.ID})
+	schedule := s.createTestSchedule(c, app.ID, &ct.Schedule{Schedule: "@yearly", Cmd: []string{"report"}})
+
+	s.runSchedule(c, schedule)
+	jobs := s.cc.GetHost(hostID).Jobs
+	c.Assert(jobs, HasLen, 1)
+	job := jobs[0]
+	c.Assert(job.Metadata["flynn-controller.schedule"], Equals, schedule.ID)
+	c.Assert(job.Config.Cmd, DeepEquals, []string{"report"})
+	c.Assert(job.Config.Env, DeepEquals, map[string]string{"FOO": "bar"})
+
+	runs := s.scheduleRuns(c, app.ID, schedule.ID)
+	c.Assert(runs, HasLen, 1)
+	c.Assert(runs[0].State, Equals, "running")
+	c.Assert(runs[0].JobID, Equals, hostID+"-"+job.ID)
+	c.Assert(runs[0].ScheduledAt.Equal(*schedule.NextRunAt), Equals, true)
+
+	status := 3
+	s.createTestJob(c, &ct.Job{ID: runs[0].JobID, AppID: app.ID, ReleaseID: release.ID, State: "crashed", ExitStatus: &status, Meta: job.Metadata})
+	runs = s.scheduleRuns(c, app.ID, schedule.ID)
+	c.Assert(runs[0].State, Equals, "failed")
+	c.Assert(*runs[0].ExitStatus, Equals, 3)
+
+	// the next run is a year later
+	current := &ct.Schedule{}
+	_, err := s.Get(fmt.Sprintf("/apps/%s/schedules/%s", app.ID, schedule.ID), current)
+	c.Assert(err, IsNil)
+	c.Assert(current.NextRunAt.Equal(schedule.NextRunAt.AddDate(1, 0, 0)), Equals, true)
+}
+
+func (s *S) TestScheduleRunStateNotReported(c *C) {
+	hostID := random.UUID()
+	s.cc.SetHosts(map[string]host.Host{hostID: {}})
+
+	app := s.createTestApp(c, &ct.App{Name: "schedule-run-not-reported"})
+	artifact := s.createTestArtifact(c, &ct.Artifact{Type: "docker", URI: "docker://foo/schedule"})
+	release := s.createTestRelease(c, &ct.Release{ArtifactID: artifact.ID})
+	s.setAppRelease(c, app.ID, release.ID)
+
+	schedule := s.createTestSchedule(c, app.ID, &ct.Schedule{Schedule: "@yearly"})
+	defer s.Delete(fmt.Sprintf("/apps/%s/schedules/%s", app.ID, schedule.ID))
+	s.runSchedule(c, schedule)
+	runs := s.scheduleRuns(c, app.ID, schedule.ID)
+	c.Assert(runs, HasLen, 1)
+	c.Assert(runs[0].State, Equals, "running")
+
+	// a job without the metadata of the schedule does not update the run
+	s.createTestJob(c, &ct.Job{ID: runs[0].JobID, AppID: app.ID, ReleaseID: release.ID, State: "up"})
+
+	// the run has failed once its job state is overdue
+	repo := s.m.Get(reflect.TypeOf(&ScheduleRepo{})).Interface().(*ScheduleRepo)
+	c.Assert(repo.db.Exec("UPDATE schedule_runs SET created_at = $2 WHERE run_id = $1", runs[0].ID, time.Now().Add(-2*scheduleStartTimeout)), IsNil)
+	runs = s.scheduleRuns(c, app.ID, schedule.ID)
+	c.Assert(runs[0].State, Equals, "failed")
+	c.Assert(runs[0].Error, Not(Equals), "")
+}
+
+func (s *S) TestScheduleConcurrencyPolicy(c *C) {
+	hostID := random.UUID()
+	hc := tu.NewFakeHostClient(hostID)
+	s.cc.SetHostClient(hostID, hc)
+	s.cc.SetHosts(map[string]host.Host{hostID: {}})
+
+	app := s.createTestApp(c, &ct.App{Name: "schedule-concurrency"})
+	artifact := s.createTestArtifact(c, &ct.Artifact{Type: "docker", URI: "docker://foo/schedule"})
+	release := s.createTestRelease(c, &ct.Release{ArtifactID: artifact.ID})
+	s.setAppRelease(c, app.ID, release.ID)
+
+	// the schedules are deleted so that they are not run by other tests
+	forbid := s.createTestSchedule(c, app.ID, &ct.Schedule{Schedule: "@yearly", ConcurrencyPolicy: ct.ConcurrencyForbid})
+	defer s.Delete(fmt.Sprintf("/apps/%s/schedules/%s", app.ID, forbid.ID))
+	s.runSchedule(c, forbid)
+	s.runSchedule(c, forbid)
+	runs := s.scheduleRuns(c, app.ID, forbid.ID)
+	c.Assert(runs, HasLen, 2)
+	c.Assert(runs[0].State, Equals, "running")
+	c.Assert(runs[1].State, Equals, "skipped")
+	c.Assert(runs[1].JobID, Equals, "")
+
+	replace := s.createTestSchedule(c, app.ID, &ct.Schedule{Schedule: "@yearly", ConcurrencyPolicy: ct.ConcurrencyReplace})
+	defer s.Delete(fmt.Sprintf("/apps/%s/schedules/%s", app.ID, replace.ID))
+	s.runSchedule(c, replace)
+	s.runSchedule(c, replace)
+	runs = s.scheduleRuns(c, app.ID, replace.ID)
+	c.Assert(runs, HasLen, 2)
+	c.Assert(runs[0].State, Equals, "running")
+	c.Assert(runs[1].State, Equals, "running")
+	c.Assert(hc.IsStopped(runs[0].JobID[len(hostID)+1:]), Equals, true)
+	c.Assert(hc.IsStopped(runs[1].JobID[len(hostID)+1:]), Equals, false)
+}
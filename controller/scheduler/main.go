@@ -1,6 +1,8 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"log"
 	"os"
 	"sort"
@@ -15,9 +17,57 @@ import (
 	"github.com/flynn/flynn/host/types"
 	"github.com/flynn/flynn/pkg/attempt"
 	"github.com/flynn/flynn/pkg/cluster"
+	"github.com/flynn/flynn/pkg/random"
 )
 
-var backoffPeriod = 10 * time.Minute
+var (
+	backoffPeriod    = 10 * time.Minute
+	backoffPeriodMtx sync.RWMutex
+)
+
+// backoffPeriodKey is the discoverd configuration key which overrides
+// BACKOFF_PERIOD at runtime.
+const backoffPeriodKey = "flynn-controller-scheduler/BACKOFF_PERIOD"
+
+func getBackoffPeriod() time.Duration {
+	backoffPeriodMtx.RLock()
+	defer backoffPeriodMtx.RUnlock()
+	return backoffPeriod
+}
+
+func setBackoffPeriod(period time.Duration) {
+	backoffPeriodMtx.Lock()
+	backoffPeriod = period
+	backoffPeriodMtx.Unlock()
+}
+
+// watchBackoffPeriod updates the backoff period whenever backoffPeriodKey
+// changes in discoverd, restoring defaultPeriod when the key is deleted. The
+// watch is restarted if it can not be started or is closed.
+func watchBackoffPeriod(defaultPeriod time.Duration) {
+	g := grohl.NewContext(grohl.Data{"fn": "watchBackoffPeriod"})
+	for {
+		watch, err := discoverd.WatchKeys(backoffPeriodKey)
+		if err != nil {
+			g.Log(grohl.Data{"at": "error", "err": err})
+			time.Sleep(time.Second)
+			continue
+		}
+		for update := range watch.Chan() {
+			period := defaultPeriod
+			if !update.Deleted {
+				period, err = time.ParseDuration(update.Value)
+				if err != nil {
+					g.Log(grohl.Data{"at": "parse_error", "value": update.Value, "err": err})
+					continue
+				}
+			}
+			setBackoffPeriod(period)
+			g.Log(grohl.Data{"at": "backoff_period", "period": period.String()})
+		}
+		g.Log(grohl.Data{"at": "watch_closed"})
+	}
+}
 
 func main() {
 	grohl.AddContext("app", "controller-scheduler")
@@ -50,6 +100,8 @@ func main() {
 	<-leaderWait
 	grohl.Log(grohl.Data{"at": "leader"})
 
+	go watchBackoffPeriod(getBackoffPeriod())
+
 	// TODO: periodic full cluster sync for anti-entropy
 	c.watchFormations()
 }
@@ -170,6 +222,7 @@ func (c *context) syncCluster() {
 			})
 			j := f.jobs.Add(jobType, h.ID, job.ID)
 			j.Formation = f
+			j.volumes = jobVolumes(job)
 			c.jobs.Add(j)
 			rectify[f] = struct{}{}
 		}
@@ -179,6 +232,11 @@ func (c *context) syncCluster() {
 	for f := range rectify {
 		go f.Rectify()
 	}
+	for _, h := range hosts {
+		if h.Draining {
+			go c.drainHost(h.ID)
+		}
+	}
 }
 
 func (c *context) watchFormations() {
@@ -244,10 +302,18 @@ func (c *context) watchHosts() {
 		ch := make(chan *host.HostEvent)
 		c.StreamHostEvents(ch)
 		for event := range ch {
-			if event.Event != "add" {
+			switch event.Event {
+			case "add":
+				go c.watchHost(event.HostID)
+			case "drain":
+				go c.drainHost(event.HostID)
+				continue
+			case "remove":
+				go c.restartHostJobs(event.HostID)
+			case "undrain":
+			default:
 				continue
 			}
-			go c.watchHost(event.HostID)
 
 			c.omniMtx.RLock()
 			for f := range c.omni {
@@ -263,6 +329,32 @@ func (c *context) watchHosts() {
 
 }
 
+// drainHost moves the formation jobs running on a draining host to other
+// hosts.
+func (c *context) drainHost(id string) {
+	g := grohl.NewContext(grohl.Data{"fn": "drainHost", "host.id": id})
+	g.Log(grohl.Data{"at": "start"})
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	for _, f := range c.formations.List() {
+		f.Drain(id)
+	}
+	g.Log(grohl.Data{"at": "finish"})
+}
+
+// restartHostJobs restarts the formation jobs of a host which has left the
+// cluster on other hosts.
+func (c *context) restartHostJobs(id string) {
+	g := grohl.NewContext(grohl.Data{"fn": "restartHostJobs", "host.id": id})
+	g.Log(grohl.Data{"at": "start"})
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	for _, f := range c.formations.List() {
+		f.RestartHostJobs(id)
+	}
+	g.Log(grohl.Data{"at": "finish"})
+}
+
 var putJobAttempts = attempt.Strategy{
 	Total: 30 * time.Second,
 	Delay: 500 * time.Millisecond,
@@ -273,10 +365,17 @@ func jobState(event *host.Event) string {
 	case host.StatusStarting:
 		return "starting"
 	case host.StatusRunning:
+		// this includes "oom" events of running jobs, which only update
+		// the count of OOM kills
 		return "up"
 	case host.StatusDone:
 		return "down"
 	case host.StatusCrashed, host.StatusFailed:
+		// a crash after a process was killed for exceeding the memory limit
+		// is most likely caused by it
+		if event.Job.OOMKills > 0 {
+			return "oom"
+		}
 		return "crashed"
 	default:
 		return ""
@@ -318,6 +417,12 @@ func (c *context) watchHost(id string) {
 			ReleaseID: releaseID,
 			Type:      jobType,
 			State:     jobState(event),
+			OOMKills:  event.Job.OOMKills,
+			Meta:      meta,
+		}
+		if event.Event == "stop" {
+			status := event.Job.ExitStatus
+			job.ExitStatus = &status
 		}
 		g.Log(grohl.Data{"at": "event", "job.id": event.JobID, "event": event.Event})
 
@@ -447,6 +552,16 @@ func (fs *Formations) Get(appID, releaseID string) *Formation {
 	return fs.formations[formationKey{appID, releaseID}]
 }
 
+func (fs *Formations) List() []*Formation {
+	fs.mtx.RLock()
+	defer fs.mtx.RUnlock()
+	list := make([]*Formation, 0, len(fs.formations))
+	for _, f := range fs.formations {
+		list = append(list, f)
+	}
+	return list
+}
+
 func (fs *Formations) Add(f *Formation) *Formation {
 	fs.mtx.Lock()
 	defer fs.mtx.Unlock()
@@ -490,6 +605,10 @@ type Job struct {
 	restarts  int
 	timer     *time.Timer
 	startedAt time.Time
+
+	// volumes are the IDs of the persistent volumes mounted by the job, in the
+	// order of its mounts. They are reused when the job is restarted.
+	volumes []string
 }
 
 type jobTypeMap map[string]map[jobKey]*Job
@@ -558,14 +677,15 @@ func (f *Formation) RestartJob(typ, hostID, jobID string) {
 	}
 	// If the job was started more than backoffPeriod ago, reset it's restart count
 	// so that it will be restarted straight away
-	if job.startedAt.Before(time.Now().Add(-backoffPeriod)) {
+	period := getBackoffPeriod()
+	if job.startedAt.Before(time.Now().Add(-period)) {
 		job.restarts = 0
 	}
 	if job.restarts == 0 {
 		f.restart(job)
 	} else {
 		// wait backoffPeriod * 2 ^ (restarts - 1) before restarting
-		duration := backoffPeriod
+		duration := period
 		for i := 0; i < job.restarts-1; i++ {
 			duration *= 2
 		}
@@ -575,6 +695,65 @@ func (f *Formation) RestartJob(typ, hostID, jobID string) {
 	}
 }
 
+// Drain replaces the jobs running on a draining host with jobs on other hosts.
+// Each replacement is started before the original job is stopped. One-off and
+// omnipresent jobs are left running, as are jobs with volumes, which are local
+// to the host and would be lost.
+func (f *Formation) Drain(hostID string) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	g := grohl.NewContext(grohl.Data{"fn": "drain", "app.id": f.AppID, "release.id": f.Release.ID, "host.id": hostID})
+	for typ, jobs := range f.jobs {
+		if typ == "" || f.Release.Processes[typ].Omni {
+			continue
+		}
+		for _, job := range jobs {
+			if job.HostID != hostID {
+				continue
+			}
+			if len(job.volumes) > 0 {
+				g.Log(grohl.Data{"at": "data_job_not_moved", "job.id": job.ID, "volumes": job.volumes})
+				continue
+			}
+			newJob, err := f.start(typ, "", nil)
+			if err != nil {
+				g.Log(grohl.Data{"at": "error", "job.id": job.ID, "err": err})
+				continue
+			}
+			g.Log(grohl.Data{"at": "moved", "job.id": job.ID, "new.host.id": newJob.HostID, "new.job.id": newJob.ID})
+			if err := f.c.hosts.Get(job.HostID).StopJob(job.ID); err != nil {
+				g.Log(grohl.Data{"at": "error", "job.id": job.ID, "err": err.Error()})
+			}
+			f.jobs.Remove(job)
+		}
+	}
+}
+
+// RestartHostJobs restarts the jobs of a host which has left the cluster on
+// other hosts. Omnipresent and one-off jobs are forgotten.
+func (f *Formation) RestartHostJobs(hostID string) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	for typ, jobs := range f.jobs {
+		for _, job := range jobs {
+			if job.HostID != hostID {
+				continue
+			}
+			f.c.jobs.Remove(hostID, job.ID)
+			if job.timer != nil {
+				job.timer.Stop()
+			}
+			if typ == "" || f.Release.Processes[typ].Omni {
+				f.jobs.Remove(job)
+				continue
+			}
+			f.restart(job)
+		}
+	}
+}
+
 func (f *Formation) rectify() {
 	g := grohl.NewContext(grohl.Data{"fn": "rectify", "app.id": f.AppID, "release.id": f.Release.ID})
 
@@ -595,6 +774,9 @@ func (f *Formation) rectify() {
 			// get job counts per host
 			hostCounts := make(map[string]int, len(hosts))
 			for _, h := range hosts {
+				if h.Draining {
+					continue
+				}
 				hostCounts[h.ID] = 0
 				for _, job := range h.Jobs {
 					if f.jobType(job) != t {
@@ -641,10 +823,10 @@ func (f *Formation) rectify() {
 func (f *Formation) add(n int, name string, hostID string) {
 	g := grohl.NewContext(grohl.Data{"fn": "add", "app.id": f.AppID, "release.id": f.Release.ID})
 	for i := 0; i < n; i++ {
-		job, err := f.start(name, hostID)
+		job, err := f.start(name, hostID, nil)
 		if err != nil {
 			// TODO: handle error
-			g.Log(grohl.Data{"at": "error", "host.id": job.HostID, "job.id": job.ID, "err": err})
+			g.Log(grohl.Data{"at": "error", "host.id": hostID, "err": err})
 			continue
 		}
 		g.Log(grohl.Data{"at": "started", "host.id": job.HostID, "job.id": job.ID})
@@ -658,11 +840,24 @@ func (f *Formation) restart(stoppedJob *Job) error {
 	f.jobs.Remove(stoppedJob)
 
 	var hostID string
-	if f.Release.Processes[stoppedJob.Type].Omni {
+	volumes := stoppedJob.volumes
+	if f.Release.Processes[stoppedJob.Type].Omni || len(volumes) > 0 {
+		// data jobs must be restarted on the host which holds their volumes
 		hostID = stoppedJob.HostID
 	}
-	newJob, err := f.start(stoppedJob.Type, hostID)
+	if len(volumes) > 0 {
+		if hosts, err := f.c.ListHosts(); err == nil {
+			if _, ok := hosts[hostID]; !ok {
+				// the host holding the volumes has left the cluster, so the
+				// job is started on another host with new volumes
+				g.Log(grohl.Data{"at": "volumes_lost", "volumes": volumes})
+				hostID, volumes = "", nil
+			}
+		}
+	}
+	newJob, err := f.start(stoppedJob.Type, hostID, volumes)
 	if err != nil {
+		g.Log(grohl.Data{"at": "error", "err": err})
 		return err
 	}
 	newJob.restarts = stoppedJob.restarts + 1
@@ -670,9 +865,19 @@ func (f *Formation) restart(stoppedJob *Job) error {
 	return nil
 }
 
-func (f *Formation) start(typ string, hostID string) (job *Job, err error) {
+// start starts a job of the given type, on hostID if it is set. volumes are
+// the IDs of existing volumes to mount, new volumes are created for any other
+// data mounts.
+func (f *Formation) start(typ string, hostID string, volumes []string) (job *Job, err error) {
 	config := f.jobConfig(typ)
 	config.ID = cluster.RandomJobID("")
+	for i := range config.Config.Mounts {
+		if i < len(volumes) {
+			config.Config.Mounts[i].VolumeID = volumes[i]
+		} else {
+			config.Config.Mounts[i].VolumeID = random.UUID()
+		}
+	}
 
 	hosts, err := f.c.ListHosts()
 	if err != nil {
@@ -684,10 +889,19 @@ func (f *Formation) start(typ string, hostID string) (job *Job, err error) {
 	var h host.Host
 
 	if hostID != "" {
-		h = hosts[hostID]
+		var ok bool
+		if h, ok = hosts[hostID]; !ok {
+			return nil, fmt.Errorf("scheduler: host %s not found", hostID)
+		}
+		if h.Draining {
+			return nil, fmt.Errorf("scheduler: host %s is draining", hostID)
+		}
 	} else {
 		hostCounts := make(map[string]int, len(hosts))
 		for _, h := range hosts {
+			if h.Draining {
+				continue
+			}
 			hostCounts[h.ID] = 0
 			for _, job := range h.Jobs {
 				if f.jobType(job) != typ {
@@ -700,6 +914,9 @@ func (f *Formation) start(typ string, hostID string) (job *Job, err error) {
 		for id, count := range hostCounts {
 			sh = append(sh, sortHost{id, count})
 		}
+		if len(sh) == 0 {
+			return nil, errors.New("scheduler: no hosts available")
+		}
 		sh.Sort()
 
 		h = hosts[sh[0].ID]
@@ -707,6 +924,7 @@ func (f *Formation) start(typ string, hostID string) (job *Job, err error) {
 
 	job = f.jobs.Add(typ, h.ID, config.ID)
 	job.Formation = f
+	job.volumes = jobVolumes(config)
 	f.c.jobs.Add(job)
 
 	_, err = f.c.AddJobs(&host.AddJobsReq{HostJobs: map[string][]*host.Job{h.ID: {config}}})
@@ -718,6 +936,17 @@ func (f *Formation) start(typ string, hostID string) (job *Job, err error) {
 	return job, nil
 }
 
+// jobVolumes returns the IDs of the volumes mounted by a job.
+func jobVolumes(job *host.Job) []string {
+	var volumes []string
+	for _, m := range job.Config.Mounts {
+		if m.VolumeID != "" {
+			volumes = append(volumes, m.VolumeID)
+		}
+	}
+	return volumes
+}
+
 func (f *Formation) jobType(job *host.Job) string {
 	if job.Metadata["flynn-controller.app"] != f.AppID ||
 		job.Metadata["flynn-controller.release"] != f.Release.ID {
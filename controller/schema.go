@@ -135,5 +135,189 @@ $$ LANGUAGE plpgsql`,
 
 		`CREATE SEQUENCE name_ids MAXVALUE 4294967295`,
 	)
+	m.Add(2,
+		`CREATE TABLE log_drains (
+    drain_id uuid PRIMARY KEY DEFAULT uuid_generate_v4(),
+    app_id uuid NOT NULL REFERENCES apps (app_id),
+    url text NOT NULL,
+    created_at timestamptz NOT NULL DEFAULT now(),
+    deleted_at timestamptz
+)`,
+		`CREATE INDEX ON log_drains (app_id) WHERE deleted_at IS NULL`,
+	)
+	m.Add(3,
+		// ALTER TYPE ... ADD VALUE can't run in the migration transaction,
+		// so the type is replaced
+		`ALTER TYPE job_state RENAME TO job_state_old`,
+		`CREATE TYPE job_state AS ENUM ('starting', 'up', 'down', 'crashed', 'oom')`,
+		`ALTER TABLE job_cache ALTER COLUMN state TYPE job_state USING state::text::job_state`,
+		`ALTER TABLE job_events ALTER COLUMN state TYPE job_state USING state::text::job_state`,
+		`DROP TYPE job_state_old`,
+		`ALTER TABLE job_cache ADD COLUMN oom_kills integer NOT NULL DEFAULT 0`,
+	)
+	m.Add(4,
+		`ALTER TABLE resources ADD COLUMN deprovision_with_apps boolean NOT NULL DEFAULT false`,
+	)
+	// indexes for paginated lists, which are ordered by creation time
+	m.Add(5,
+		`CREATE INDEX ON apps (created_at, app_id) WHERE deleted_at IS NULL`,
+		`CREATE INDEX ON releases (created_at, release_id) WHERE deleted_at IS NULL`,
+		`CREATE INDEX ON artifacts (created_at, artifact_id) WHERE deleted_at IS NULL`,
+		`CREATE INDEX ON job_cache (app_id, created_at)`,
+	)
+	// releases are owned by the app which created or first ran them
+	m.Add(6,
+		`ALTER TABLE releases ADD COLUMN app_id uuid REFERENCES apps (app_id)`,
+		`UPDATE releases r SET app_id = a.app_id FROM apps a WHERE a.release_id = r.release_id`,
+		`UPDATE releases r SET app_id = f.app_id FROM formations f WHERE f.release_id = r.release_id AND r.app_id IS NULL`,
+		`CREATE INDEX ON releases (app_id, created_at) WHERE deleted_at IS NULL`,
+	)
+	m.Add(7,
+		`CREATE TABLE webhooks (
+    webhook_id uuid PRIMARY KEY DEFAULT uuid_generate_v4(),
+    app_id uuid REFERENCES apps (app_id),
+    url text NOT NULL,
+    secret text NOT NULL,
+    events text NOT NULL DEFAULT '',
+    created_at timestamptz NOT NULL DEFAULT now(),
+    deleted_at timestamptz
+)`,
+		`CREATE INDEX ON webhooks (app_id) WHERE deleted_at IS NULL`,
+		`CREATE TYPE webhook_delivery_state AS ENUM ('pending', 'succeeded', 'failed')`,
+		`CREATE TABLE webhook_deliveries (
+    delivery_id uuid PRIMARY KEY DEFAULT uuid_generate_v4(),
+    webhook_id uuid NOT NULL REFERENCES webhooks (webhook_id),
+    event_key text NOT NULL,
+    event text NOT NULL,
+    payload text NOT NULL,
+    state webhook_delivery_state NOT NULL DEFAULT 'pending',
+    attempts integer NOT NULL DEFAULT 0,
+    response_status integer NOT NULL DEFAULT 0,
+    error text NOT NULL DEFAULT '',
+    next_attempt_at timestamptz NOT NULL DEFAULT now(),
+    created_at timestamptz NOT NULL DEFAULT now(),
+    updated_at timestamptz NOT NULL DEFAULT now(),
+    UNIQUE (webhook_id, event_key)
+)`,
+		`CREATE INDEX ON webhook_deliveries (next_attempt_at) WHERE state = 'pending'`,
+		// job events and app release changes are also notified on cluster
+		// wide channels, which webhooks are driven by
+		`CREATE OR REPLACE FUNCTION notify_job_event() RETURNS TRIGGER AS $$
+    BEGIN
+    PERFORM pg_notify('job_events:' || NEW.app_id, NEW.event_id || '');
+    PERFORM pg_notify('job_events', NEW.event_id || '');
+        RETURN NULL;
+    END;
+$$ LANGUAGE plpgsql`,
+		`CREATE FUNCTION notify_app_release() RETURNS TRIGGER AS $$
+    BEGIN
+    PERFORM pg_notify('app_releases', NEW.app_id || ':' || NEW.release_id || ':' || COALESCE(OLD.release_id::text, '') || ':' || txid_current());
+        RETURN NULL;
+    END;
+$$ LANGUAGE plpgsql`,
+		`CREATE TRIGGER notify_app_release
+    AFTER UPDATE OF release_id ON apps
+    FOR EACH ROW WHEN (NEW.release_id IS NOT NULL AND OLD.release_id IS DISTINCT FROM NEW.release_id)
+    EXECUTE PROCEDURE notify_app_release()`,
+	)
+	m.Add(8,
+		`ALTER TABLE job_cache ADD COLUMN exit_status integer`,
+		`CREATE TYPE schedule_concurrency_policy AS ENUM ('allow', 'forbid', 'replace')`,
+		`CREATE TABLE schedules (
+    schedule_id uuid PRIMARY KEY DEFAULT uuid_generate_v4(),
+    app_id uuid NOT NULL REFERENCES apps (app_id),
+    release_id uuid REFERENCES releases (release_id),
+    schedule text NOT NULL,
+    data text NOT NULL,
+    concurrency_policy schedule_concurrency_policy NOT NULL DEFAULT 'allow',
+    next_run_at timestamptz NOT NULL,
+    created_at timestamptz NOT NULL DEFAULT now(),
+    updated_at timestamptz NOT NULL DEFAULT now(),
+    deleted_at timestamptz
+)`,
+		`CREATE INDEX ON schedules (app_id, created_at) WHERE deleted_at IS NULL`,
+		`CREATE INDEX ON schedules (next_run_at) WHERE deleted_at IS NULL`,
+		`CREATE TYPE schedule_run_state AS ENUM ('started', 'skipped', 'failed')`,
+		// the state and exit status of the job of a run are copied from job
+		// updates, as jobs of releases without a formation are not cached
+		`CREATE TABLE schedule_runs (
+    run_id uuid PRIMARY KEY DEFAULT uuid_generate_v4(),
+    schedule_id uuid NOT NULL REFERENCES schedules (schedule_id),
+    host_id text,
+    job_id text,
+    state schedule_run_state NOT NULL,
+    job_state job_state,
+    exit_status integer,
+    error text NOT NULL DEFAULT '',
+    scheduled_at timestamptz NOT NULL,
+    created_at timestamptz NOT NULL DEFAULT now(),
+    updated_at timestamptz NOT NULL DEFAULT now()
+)`,
+		`CREATE INDEX ON schedule_runs (schedule_id, created_at)`,
+		`CREATE UNIQUE INDEX ON schedule_runs (job_id, host_id)`,
+	)
+	m.Add(9,
+		`ALTER TABLE formations ADD COLUMN autoscale text`,
+		// the last sample of the metrics of each autoscaled process type,
+		// which the next one is compared with
+		`CREATE TABLE autoscale_samples (
+    app_id uuid NOT NULL,
+    release_id uuid NOT NULL,
+    process_type text NOT NULL,
+    data text NOT NULL,
+    sampled_at timestamptz NOT NULL,
+    PRIMARY KEY (app_id, release_id, process_type)
+)`,
+		`CREATE TABLE autoscale_decisions (
+    decision_id uuid PRIMARY KEY DEFAULT uuid_generate_v4(),
+    app_id uuid NOT NULL REFERENCES apps (app_id),
+    release_id uuid NOT NULL REFERENCES releases (release_id),
+    process_type text NOT NULL,
+    metric text NOT NULL,
+    value double precision NOT NULL,
+    target double precision NOT NULL,
+    previous_count integer NOT NULL,
+    count integer NOT NULL,
+    created_at timestamptz NOT NULL DEFAULT now()
+)`,
+		`CREATE INDEX ON autoscale_decisions (app_id, created_at)`,
+	)
+	m.Add(10,
+		// values are encrypted with SECRETS_KEY, and old versions are kept
+		// for the releases which refer to them
+		`CREATE TABLE app_secrets (
+    app_id uuid NOT NULL REFERENCES apps (app_id),
+    key text NOT NULL,
+    version integer NOT NULL,
+    value bytea NOT NULL,
+    created_at timestamptz NOT NULL DEFAULT now(),
+    PRIMARY KEY (app_id, key, version)
+)`,
+	)
+	m.Add(11,
+		// formation_scales is notified when the process counts of a
+		// formation change. A formation which is added or restored with
+		// the counts of another formation of the app, as when a release
+		// is deployed, is not scaled.
+		`CREATE FUNCTION notify_formation_scale() RETURNS TRIGGER AS $$
+    BEGIN
+        IF NEW.deleted_at IS NOT NULL THEN
+            RETURN NULL;
+        END IF;
+        IF TG_OP = 'UPDATE' AND OLD.deleted_at IS NULL THEN
+            IF NEW.processes IS NOT DISTINCT FROM OLD.processes THEN
+                RETURN NULL;
+            END IF;
+        ELSIF EXISTS (SELECT 1 FROM formations WHERE app_id = NEW.app_id AND release_id <> NEW.release_id AND deleted_at IS NULL AND processes = NEW.processes) THEN
+            RETURN NULL;
+        END IF;
+        PERFORM pg_notify('formation_scales', NEW.app_id || ':' || NEW.release_id);
+        RETURN NULL;
+    END;
+$$ LANGUAGE plpgsql`,
+		`CREATE TRIGGER notify_formation_scale
+    AFTER INSERT OR UPDATE ON formations
+    FOR EACH ROW EXECUTE PROCEDURE notify_formation_scale()`,
+	)
 	return m.Migrate(db)
 }
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/go-martini/martini"
+	"github.com/flynn/flynn/Godeps/_workspace/src/golang.org/x/crypto/nacl/secretbox"
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/controller/utils"
+	"github.com/flynn/flynn/host/types"
+)
+
+// secretsPathPattern matches the path which hosts fetch the secrets of a
+// release from. Requests to it are authorized with a secrets token rather than
+// the controller key.
+var secretsPathPattern = regexp.MustCompile(`^/apps/[^/]+/releases/[^/]+/secrets$`)
+
+var secretKeyPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+var errSecretsDisabled = ct.ValidationError{Message: "secrets are not enabled, SECRETS_KEY is not set"}
+
+// SecretRepo stores versions of the secrets of apps encrypted with key.
+// Releases refer to a version of each of their secrets, so that setting a
+// secret creates a new release and old releases keep their values.
+type SecretRepo struct {
+	db  *DB
+	key *[32]byte
+	// tokenKey authenticates secrets tokens, it is derived from key so that
+	// key is only used to encrypt secrets
+	tokenKey []byte
+}
+
+// NewSecretRepo returns a repo which encrypts secrets with key. If key is nil
+// secrets can not be set.
+func NewSecretRepo(db *DB, key *[32]byte) *SecretRepo {
+	r := &SecretRepo{db: db, key: key}
+	if key != nil {
+		mac := hmac.New(sha256.New, key[:])
+		mac.Write([]byte("flynn-controller secrets token key"))
+		r.tokenKey = mac.Sum(nil)
+	}
+	return r
+}
+
+// Add stores a new version of each of the secrets of an app and returns the
+// versions.
+func (r *SecretRepo) Add(appID string, secrets map[string]string) (map[string]int, error) {
+	if r.key == nil {
+		return nil, errSecretsDisabled
+	}
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	// the app is locked so that concurrent updates of its secrets do not
+	// pick the same versions
+	if _, err := selectApp(tx, appID, true); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	versions := make(map[string]int, len(secrets))
+	for k, v := range secrets {
+		value, err := r.seal(v)
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		var version int
+		if err := tx.QueryRow("INSERT INTO app_secrets (app_id, key, version, value) SELECT $1, $2, COALESCE(MAX(version), 0) + 1, $3 FROM app_secrets WHERE app_id = $1 AND key = $2 RETURNING version", appID, k, value).Scan(&version); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		versions[k] = version
+	}
+	return versions, tx.Commit()
+}
+
+// List returns the keys and versions of the secrets of a release of an app.
+func (r *SecretRepo) List(appID string, release *ct.Release) ([]*ct.Secret, error) {
+	keys := make([]string, 0, len(release.Secrets))
+	for k := range release.Secrets {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	secrets := make([]*ct.Secret, len(keys))
+	for i, k := range keys {
+		secret := &ct.Secret{Key: k, Version: release.Secrets[k]}
+		if err := r.db.QueryRow("SELECT created_at FROM app_secrets WHERE app_id = $1 AND key = $2 AND version = $3", appID, k, secret.Version).Scan(&secret.CreatedAt); err != nil {
+			return nil, err
+		}
+		secrets[i] = secret
+	}
+	return secrets, nil
+}
+
+// Values returns the decrypted secrets of a release of an app.
+func (r *SecretRepo) Values(appID string, release *ct.Release) (map[string]string, error) {
+	if len(release.Secrets) > 0 && r.key == nil {
+		return nil, errSecretsDisabled
+	}
+	values := make(map[string]string, len(release.Secrets))
+	for k, version := range release.Secrets {
+		var value []byte
+		if err := r.db.QueryRow("SELECT value FROM app_secrets WHERE app_id = $1 AND key = $2 AND version = $3", appID, k, version).Scan(&value); err != nil {
+			return nil, err
+		}
+		v, err := r.open(value)
+		if err != nil {
+			return nil, err
+		}
+		values[k] = v
+	}
+	return values, nil
+}
+
+// seal encrypts a value, prefixing it with its nonce.
+func (r *SecretRepo) seal(value string) ([]byte, error) {
+	var nonce [24]byte
+	if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
+		return nil, err
+	}
+	out := make([]byte, len(nonce), len(nonce)+len(value)+secretbox.Overhead)
+	copy(out, nonce[:])
+	return secretbox.Seal(out, []byte(value), &nonce, r.key), nil
+}
+
+func (r *SecretRepo) open(data []byte) (string, error) {
+	var nonce [24]byte
+	if len(data) < len(nonce) {
+		return "", errors.New("controller: invalid secret")
+	}
+	copy(nonce[:], data)
+	res, ok := secretbox.Open(nil, data[len(nonce):], &nonce, r.key)
+	if !ok {
+		return "", errors.New("controller: secret could not be decrypted")
+	}
+	return string(res), nil
+}
+
+// token returns the token which authorizes fetching the secrets of a release
+// of an app.
+func (r *SecretRepo) token(appID, releaseID string) string {
+	if r.key == nil {
+		return ""
+	}
+	mac := hmac.New(sha256.New, r.tokenKey)
+	mac.Write([]byte("secrets:" + appID + ":" + releaseID))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// jobSecrets returns where a job of a release of an app fetches its secrets
+// from, or nil if the release has none.
+func (r *SecretRepo) jobSecrets(appID string, release *ct.Release) *host.Secrets {
+	if len(release.Secrets) == 0 {
+		return nil
+	}
+	return &host.Secrets{URL: utils.SecretsURL(appID, release.ID), Token: r.token(appID, release.ID)}
+}
+
+// validateSecrets checks that the secrets of a release are not also plain
+// environment variables.
+func validateSecrets(release *ct.Release) error {
+	for k, version := range release.Secrets {
+		if version < 1 {
+			return ct.ValidationError{Field: "secrets." + k, Message: "must be a version of the secret"}
+		}
+		if _, ok := release.Env[k]; ok {
+			return ct.ValidationError{Field: "secrets." + k, Message: "must not also be set in env"}
+		}
+		for name, t := range release.Processes {
+			if _, ok := t.Env[k]; ok {
+				return ct.ValidationError{Field: "secrets." + k, Message: fmt.Sprintf("must not also be set in the env of process type %s", name)}
+			}
+		}
+	}
+	return nil
+}
+
+func listAppSecrets(app *ct.App, apps *AppRepo, secrets *SecretRepo, r ResponseHelper) {
+	release, err := apps.GetRelease(app.ID)
+	if err == ErrNotFound {
+		r.JSON(200, []*ct.Secret{})
+		return
+	} else if err != nil {
+		r.Error(err)
+		return
+	}
+	list, err := secrets.List(app.ID, release)
+	if err != nil {
+		r.Error(err)
+		return
+	}
+	r.JSON(200, list)
+}
+
+// updateAppSecrets sets the secrets in the request body, deleting those which
+// are null, and deploys a new release of the app which refers to them. Keys
+// which are set are removed from the plain env of the release.
+func updateAppSecrets(req *http.Request, w http.ResponseWriter, app *ct.App, apps *AppRepo, releases *ReleaseRepo, formations *FormationRepo, artifacts *ArtifactRepo, secrets *SecretRepo, cl clusterClient, r ResponseHelper) {
+	var update map[string]*string
+	if err := json.NewDecoder(req.Body).Decode(&update); err != nil {
+		r.Error(err)
+		return
+	}
+	if len(update) == 0 {
+		r.Error(ct.ValidationError{Message: "no secrets given"})
+		return
+	}
+	values := make(map[string]string, len(update))
+	for k, v := range update {
+		if !secretKeyPattern.MatchString(k) {
+			r.Error(ct.ValidationError{Field: "secrets." + k, Message: "must be a valid environment variable name"})
+			return
+		}
+		if v != nil {
+			values[k] = *v
+		}
+	}
+	current, err := apps.GetRelease(app.ID)
+	if err == ErrNotFound {
+		err = ct.ValidationError{Message: "app has no release"}
+	}
+	if err != nil {
+		r.Error(err)
+		return
+	}
+	versions, err := secrets.Add(app.ID, values)
+	if err != nil {
+		r.Error(err)
+		return
+	}
+
+	release := &ct.Release{
+		AppID:      app.ID,
+		ArtifactID: current.ArtifactID,
+		Env:        make(map[string]string, len(current.Env)),
+		Processes:  make(map[string]ct.ProcessType, len(current.Processes)),
+		Secrets:    make(map[string]int, len(current.Secrets)+len(versions)),
+	}
+	for k, v := range current.Env {
+		if _, ok := update[k]; !ok {
+			release.Env[k] = v
+		}
+	}
+	for name, t := range current.Processes {
+		if t.Env != nil {
+			env := make(map[string]string, len(t.Env))
+			for k, v := range t.Env {
+				if _, ok := update[k]; !ok {
+					env[k] = v
+				}
+			}
+			t.Env = env
+		}
+		release.Processes[name] = t
+	}
+	for k, version := range current.Secrets {
+		if _, ok := update[k]; !ok {
+			release.Secrets[k] = version
+		}
+	}
+	for k, version := range versions {
+		release.Secrets[k] = version
+	}
+	if err := releases.Add(release); err != nil {
+		r.Error(err)
+		return
+	}
+
+	if _, ok := release.Processes[ct.ReleasePhaseType]; ok {
+		deployWithReleasePhase(req, w, app, release, nil, apps, releases, formations, artifacts, secrets, cl, r)
+		return
+	}
+	if err := deployRelease(app, release, nil, apps, releases, formations); err != nil {
+		r.Error(err)
+		return
+	}
+	r.JSON(200, release)
+}
+
+// getReleaseSecrets responds with the values of the secrets of a release to
+// a host which is starting one of its jobs. The request is authorized by the
+// token of the release before anything is looked up, so that it does not tell
+// whether apps and releases exist.
+func getReleaseSecrets(req *http.Request, params martini.Params, releases *ReleaseRepo, secrets *SecretRepo, r ResponseHelper) {
+	appID, releaseID := params["apps_id"], params["releases_id"]
+	_, token, _ := parseBasicAuth(req.Header)
+	expected := secrets.token(appID, releaseID)
+	if expected == "" || len(token) != len(expected) || subtle.ConstantTimeCompare([]byte(token), []byte(expected)) != 1 {
+		r.WriteHeader(401)
+		return
+	}
+	data, err := releases.Get(releaseID)
+	if err != nil {
+		r.Error(err)
+		return
+	}
+	release := data.(*ct.Release)
+	if release.AppID != appID {
+		r.Error(ErrNotFound)
+		return
+	}
+	values, err := secrets.Values(appID, release)
+	if err != nil {
+		r.Error(err)
+		return
+	}
+	r.JSON(200, values)
+}
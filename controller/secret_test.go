@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+
+	. "github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-check"
+	"github.com/flynn/flynn/controller/client"
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/controller/utils"
+	"github.com/flynn/flynn/host/types"
+	"github.com/flynn/flynn/pkg/random"
+)
+
+// getSecrets fetches the secrets of a release like a host starting one of its
+// jobs.
+func (s *S) getSecrets(c *C, secrets *host.Secrets) (int, map[string]string) {
+	req, err := http.NewRequest("GET", s.srv.URL+secrets.URL[len("http://flynn-controller"):], nil)
+	c.Assert(err, IsNil)
+	req.SetBasicAuth("", secrets.Token)
+	res, err := http.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	defer res.Body.Close()
+	var values map[string]string
+	if res.StatusCode == 200 {
+		c.Assert(json.NewDecoder(res.Body).Decode(&values), IsNil)
+	}
+	return res.StatusCode, values
+}
+
+func (s *S) TestAppSecrets(c *C) {
+	hostID := random.UUID()
+	s.cc.SetHosts(map[string]host.Host{hostID: {}})
+	app := s.createTestApp(c, &ct.App{Name: "app-secrets"})
+	artifact := s.createTestArtifact(c, &ct.Artifact{Type: "docker", URI: "docker://foo/secrets"})
+	release := s.createTestRelease(c, &ct.Release{
+		ArtifactID: artifact.ID,
+		Env:        map[string]string{"FOO": "bar", "PASSWORD": "plain"},
+		Processes:  map[string]ct.ProcessType{"web": {Cmd: []string{"start"}}},
+	})
+	s.setAppRelease(c, app.ID, release.ID)
+	s.createTestFormation(c, &ct.Formation{AppID: app.ID, ReleaseID: release.ID, Processes: map[string]int{"web": 1}})
+
+	cc, err := controller.NewClient(s.srv.URL, authKey)
+	c.Assert(err, IsNil)
+	password, token := "s3cret", "t0ken"
+	secretRelease, err := cc.UpdateAppSecrets(app.ID, map[string]*string{"PASSWORD": &password, "TOKEN": &token})
+	c.Assert(err, IsNil)
+
+	// the new release is deployed without the secret values
+	current, err := cc.GetAppRelease(app.ID)
+	c.Assert(err, IsNil)
+	c.Assert(current.ID, Equals, secretRelease.ID)
+	c.Assert(current.Env, DeepEquals, map[string]string{"FOO": "bar"})
+	c.Assert(current.Secrets, DeepEquals, map[string]int{"PASSWORD": 1, "TOKEN": 1})
+	list, err := cc.AppSecretList(app.ID)
+	c.Assert(err, IsNil)
+	c.Assert(list, HasLen, 2)
+	c.Assert(list[0].Key, Equals, "PASSWORD")
+	c.Assert(list[0].Version, Equals, 1)
+	formations, err := cc.FormationList(app.ID)
+	c.Assert(err, IsNil)
+	c.Assert(formations, HasLen, 1)
+	c.Assert(formations[0].ReleaseID, Equals, current.ID)
+
+	// jobs of the formation fetch the values with the token of the release
+	repo := s.m.Get(reflect.TypeOf(&FormationRepo{})).Interface().(*FormationRepo)
+	f, err := repo.expandFormation(formations[0])
+	c.Assert(err, IsNil)
+	job := utils.JobConfig(f, "web")
+	c.Assert(job.Config.Env["PASSWORD"], Equals, "")
+	c.Assert(job.Config.Secrets, NotNil)
+	c.Assert(job.Config.Secrets.URL, Equals, utils.SecretsURL(app.ID, current.ID))
+	status, values := s.getSecrets(c, job.Config.Secrets)
+	c.Assert(status, Equals, 200)
+	c.Assert(values, DeepEquals, map[string]string{"PASSWORD": "s3cret", "TOKEN": "t0ken"})
+
+	// the controller key and the tokens of other releases are not accepted
+	status, _ = s.getSecrets(c, &host.Secrets{URL: job.Config.Secrets.URL, Token: authKey})
+	c.Assert(status, Equals, 401)
+	status, _ = s.getSecrets(c, &host.Secrets{URL: utils.SecretsURL(app.ID, release.ID), Token: job.Config.Secrets.Token})
+	c.Assert(status, Equals, 401)
+
+	// whether apps and releases exist is not revealed without a token
+	status, _ = s.getSecrets(c, &host.Secrets{URL: utils.SecretsURL(random.UUID(), random.UUID()), Token: authKey})
+	c.Assert(status, Equals, 401)
+
+	// rotating a secret creates a release with a new version, and deleting one
+	// removes it from the release
+	password = "n3w"
+	rotated, err := cc.UpdateAppSecrets(app.ID, map[string]*string{"PASSWORD": &password, "TOKEN": nil})
+	c.Assert(err, IsNil)
+	c.Assert(rotated.Secrets, DeepEquals, map[string]int{"PASSWORD": 2})
+	repoSecrets := s.m.Get(reflect.TypeOf(&SecretRepo{})).Interface().(*SecretRepo)
+	status, values = s.getSecrets(c, repoSecrets.jobSecrets(app.ID, rotated))
+	c.Assert(status, Equals, 200)
+	c.Assert(values, DeepEquals, map[string]string{"PASSWORD": "n3w"})
+
+	// one-off jobs also fetch the secrets
+	_, err = cc.RunJobDetached(app.ID, &ct.NewJob{ReleaseID: rotated.ID, Cmd: []string{"env"}})
+	c.Assert(err, IsNil)
+	jobs := s.cc.GetHost(hostID).Jobs
+	c.Assert(jobs, HasLen, 1)
+	c.Assert(jobs[0].Config.Secrets.URL, Equals, utils.SecretsURL(app.ID, rotated.ID))
+
+	// secrets must not also be plain env vars
+	res, err := s.Post("/releases", &ct.Release{Env: map[string]string{"PASSWORD": "x"}, Secrets: map[string]int{"PASSWORD": 1}}, &ct.Release{})
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 400)
+	res, err = s.Put(fmt.Sprintf("/apps/%s/secrets", app.ID), map[string]string{"NOT-VALID": "x"}, nil)
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 400)
+}
+
+func (s *S) TestConcurrentSecretVersions(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "concurrent-secrets"})
+	repo := s.m.Get(reflect.TypeOf(&SecretRepo{})).Interface().(*SecretRepo)
+
+	const n = 5
+	errs := make(chan error, n)
+	versions := make(chan int, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			v, err := repo.Add(app.ID, map[string]string{"KEY": "value"})
+			errs <- err
+			versions <- v["KEY"]
+		}()
+	}
+	seen := make(map[int]bool, n)
+	for i := 0; i < n; i++ {
+		c.Assert(<-errs, IsNil)
+		seen[<-versions] = true
+	}
+	c.Assert(seen, DeepEquals, map[int]bool{1: true, 2: true, 3: true, 4: true, 5: true})
+}
@@ -14,6 +14,9 @@ func NewFakeHostClient(hostID string) *FakeHostClient {
 		hostID:  hostID,
 		stopped: make(map[string]bool),
 		attach:  make(map[string]attachFunc),
+		stats:   make(map[string][]*host.JobStats),
+		logs:    make(map[string][]*host.LogLine),
+		follow:  make(map[string]<-chan *host.LogLine),
 	}
 }
 
@@ -21,6 +24,11 @@ type FakeHostClient struct {
 	hostID    string
 	stopped   map[string]bool
 	attach    map[string]attachFunc
+	stats     map[string][]*host.JobStats
+	logs      map[string][]*host.LogLine
+	follow    map[string]<-chan *host.LogLine
+	pulls     []string
+	pullMtx   sync.Mutex
 	cluster   *FakeCluster
 	listeners []chan<- *host.Event
 	listenMtx sync.RWMutex
@@ -52,6 +60,10 @@ func (c *FakeHostClient) GetJob(id string) (*host.ActiveJob, error) {
 	return nil, errors.New("job not found")
 }
 
+func (c *FakeHostClient) JobEvents(id string) ([]*host.JobEvent, error) {
+	return nil, errors.New("job events not implemented")
+}
+
 func (c *FakeHostClient) StreamEvents(id string, ch chan<- *host.Event) cluster.Stream {
 	c.listenMtx.Lock()
 	defer c.listenMtx.Unlock()
@@ -59,6 +71,99 @@ func (c *FakeHostClient) StreamEvents(id string, ch chan<- *host.Event) cluster.
 	return &FakeHostEventStream{ch: ch}
 }
 
+func (c *FakeHostClient) JobStats(id string, ch chan<- *host.JobStats) cluster.Stream {
+	stream := &FakeHostStatsStream{done: make(chan struct{})}
+	stats, ok := c.stats[id]
+	if !ok {
+		stream.err = host.ErrUnknownJob
+	}
+	go func() {
+		defer close(ch)
+		for _, s := range stats {
+			select {
+			case ch <- s:
+			case <-stream.done:
+				return
+			}
+		}
+	}()
+	return stream
+}
+
+func (c *FakeHostClient) StreamLog(req *host.LogReq, ch chan<- *host.LogLine) cluster.Stream {
+	stream := &FakeHostStatsStream{done: make(chan struct{})}
+	lines, ok := c.logs[req.JobID]
+	if !ok {
+		stream.err = host.ErrUnknownJob
+	}
+	if req.Lines >= 0 && len(lines) > req.Lines {
+		lines = lines[len(lines)-req.Lines:]
+	}
+	go func() {
+		defer close(ch)
+		for _, l := range lines {
+			select {
+			case ch <- l:
+			case <-stream.done:
+				return
+			}
+		}
+		if !req.Follow {
+			return
+		}
+		follow := c.follow[req.JobID]
+		for {
+			select {
+			case l, ok := <-follow:
+				if !ok {
+					return
+				}
+				select {
+				case ch <- l:
+				case <-stream.done:
+					return
+				}
+			case <-stream.done:
+				return
+			}
+		}
+	}()
+	return stream
+}
+
+func (c *FakeHostClient) PullImage(uri string, ch chan<- *host.LayerPullInfo) cluster.Stream {
+	c.pullMtx.Lock()
+	c.pulls = append(c.pulls, uri)
+	c.pullMtx.Unlock()
+	close(ch)
+	return &FakeHostStatsStream{done: make(chan struct{})}
+}
+
+// Pulls returns the URIs of the images pulled with PullImage.
+func (c *FakeHostClient) Pulls() []string {
+	c.pullMtx.Lock()
+	defer c.pullMtx.Unlock()
+	return append([]string(nil), c.pulls...)
+}
+
+func (c *FakeHostClient) CreateVolume(vol *host.Volume) (*host.Volume, error) {
+	return nil, errors.New("volumes not implemented")
+}
+
+func (c *FakeHostClient) GetVolume(id string) (*host.Volume, error) {
+	return nil, errors.New("volumes not implemented")
+}
+
+func (c *FakeHostClient) ListVolumes() ([]*host.Volume, error) { return nil, nil }
+
+func (c *FakeHostClient) SnapshotVolume(id string) (*host.Volume, error) {
+	return nil, errors.New("volumes not implemented")
+}
+
+func (c *FakeHostClient) DeleteVolume(id string) error {
+	return errors.New("volumes not implemented")
+}
+
 func (c *FakeHostClient) StopJob(id string) error {
 	c.stopped[id] = true
 	c.cluster.RemoveJob(c.hostID, id, false)
@@ -79,6 +184,22 @@ func (c *FakeHostClient) SetAttachFunc(id string, f attachFunc) {
 	c.attach[id] = f
 }
 
+// SetJobStats sets the samples streamed by JobStats for a job.
+func (c *FakeHostClient) SetJobStats(id string, stats []*host.JobStats) {
+	c.stats[id] = stats
+}
+
+// SetLog sets the output streamed by StreamLog for a job.
+func (c *FakeHostClient) SetLog(id string, lines []*host.LogLine) {
+	c.logs[id] = lines
+}
+
+// SetLogFollow sets the channel of lines streamed by StreamLog for a job
+// after its output when following.
+func (c *FakeHostClient) SetLogFollow(id string, ch <-chan *host.LogLine) {
+	c.follow[id] = ch
+}
+
 func (c *FakeHostClient) SendEvent(event, id string) {
 	c.listenMtx.RLock()
 	defer c.listenMtx.RUnlock()
@@ -106,3 +227,18 @@ func (h *FakeHostEventStream) Close() error {
 func (h *FakeHostEventStream) Err() error {
 	return nil
 }
+
+type FakeHostStatsStream struct {
+	done chan struct{}
+	once sync.Once
+	err  error
+}
+
+func (s *FakeHostStatsStream) Close() error {
+	s.once.Do(func() { close(s.done) })
+	return nil
+}
+
+func (s *FakeHostStatsStream) Err() error {
+	return s.err
+}
@@ -12,6 +12,10 @@ type ExpandedFormation struct {
 	Artifact  *Artifact      `json:"artifact,omitempty"`
 	Processes map[string]int `json:"processes,omitempty"`
 	UpdatedAt time.Time      `json:"updated_at,omitempty"`
+
+	// SecretsToken authorizes the hosts of the formation's jobs to fetch the
+	// secrets of the release.
+	SecretsToken string `json:"secrets_token,omitempty"`
 }
 
 type App struct {
@@ -25,9 +29,11 @@ type App struct {
 
 type Release struct {
 	ID         string                 `json:"id,omitempty"`
+	AppID      string                 `json:"app,omitempty"`
 	ArtifactID string                 `json:"artifact,omitempty"`
 	Env        map[string]string      `json:"env,omitempty"`
 	Processes  map[string]ProcessType `json:"processes,omitempty"`
+	Secrets    map[string]int         `json:"secrets,omitempty"` // secret key -> version
 	CreatedAt  *time.Time             `json:"created_at,omitempty"`
 }
 
@@ -38,6 +44,34 @@ type ProcessType struct {
 	Ports      []Port            `json:"ports,omitempty"`
 	Data       bool              `json:"data,omitempty"`
 	Omni       bool              `json:"omni,omitempty"` // omnipresent - present on all hosts
+	Resources  *ProcessResources `json:"resources,omitempty"`
+}
+
+// ReleasePhaseType is the process type which, if a release has it, is run as
+// a one-off job when the release is set as the current release of an app. The
+// release is only deployed if the job exits 0.
+const ReleasePhaseType = "release"
+
+// DeployEvent is an event streamed to a client setting the current release of
+// an app which has a release phase. The output of the release phase job is
+// followed by its exit status, and then by the deployed release or an error.
+type DeployEvent struct {
+	Stream     string   `json:"stream,omitempty"` // stdout or stderr
+	Data       string   `json:"data,omitempty"`
+	JobID      string   `json:"job,omitempty"`
+	ExitStatus *int     `json:"exit_status,omitempty"`
+	Release    *Release `json:"release,omitempty"`
+	Error      string   `json:"error,omitempty"`
+}
+
+// ProcessResources are the resource limits applied to each job of a process
+// type. Zero values use the host defaults.
+type ProcessResources struct {
+	Memory       int `json:"memory,omitempty"`         // in KiB
+	CPUShares    int `json:"cpu_shares,omitempty"`     // relative CPU weight, 1024 is one share
+	CPUQuota     int `json:"cpu_quota,omitempty"`      // in microseconds per 100ms period
+	MaxPIDs      int `json:"max_pids,omitempty"`       // maximum number of processes
+	MaxOpenFiles int `json:"max_open_files,omitempty"` // RLIMIT_NOFILE
 }
 
 type Port struct {
@@ -57,8 +91,53 @@ type Formation struct {
 	AppID     string         `json:"app,omitempty"`
 	ReleaseID string         `json:"release,omitempty"`
 	Processes map[string]int `json:"processes,omitempty"`
-	CreatedAt *time.Time     `json:"created_at,omitempty"`
-	UpdatedAt *time.Time     `json:"updated_at,omitempty"`
+	// Autoscale configures the process types whose counts in Processes are
+	// adjusted by the controller.
+	Autoscale map[string]*AutoscaleConfig `json:"autoscale,omitempty"`
+	CreatedAt *time.Time                  `json:"created_at,omitempty"`
+	UpdatedAt *time.Time                  `json:"updated_at,omitempty"`
+}
+
+// AutoscaleConfig keeps the count of a process type between Min and Max,
+// adjusting it so that Metric stays near Target. Min must be at least 1, as a
+// process type without jobs has no metrics to be scaled up by.
+type AutoscaleConfig struct {
+	Min    int    `json:"min"`
+	Max    int    `json:"max"`
+	Metric string `json:"metric"`
+	// Target is the requests per second per job, the mean response time in
+	// milliseconds or the CPU cores used per job, depending on Metric.
+	Target float64 `json:"target"`
+	// Service is the router service which requests to the process type are
+	// counted for. It defaults to "<app name>-<process type>".
+	Service string `json:"service,omitempty"`
+	// ScaleUpCooldown and ScaleDownCooldown are the minimum number of
+	// seconds after the count was last changed before it is increased or
+	// decreased again. They default to 60 and 300.
+	ScaleUpCooldown   int `json:"scale_up_cooldown,omitempty"`
+	ScaleDownCooldown int `json:"scale_down_cooldown,omitempty"`
+}
+
+// Autoscale metrics.
+const (
+	AutoscaleRequests = "requests" // router requests per second per job
+	AutoscaleLatency  = "latency"  // mean router response time
+	AutoscaleCPU      = "cpu"      // CPU usage per job
+)
+
+// AutoscaleDecision is a change of the count of a process type made by the
+// autoscaler, and the value of the metric it was based on.
+type AutoscaleDecision struct {
+	ID            string     `json:"id,omitempty"`
+	AppID         string     `json:"app,omitempty"`
+	ReleaseID     string     `json:"release,omitempty"`
+	ProcessType   string     `json:"type,omitempty"`
+	Metric        string     `json:"metric,omitempty"`
+	Value         float64    `json:"value"`
+	Target        float64    `json:"target"`
+	PreviousCount int        `json:"previous_count"`
+	Count         int        `json:"count"`
+	CreatedAt     *time.Time `json:"created_at,omitempty"`
 }
 
 type Key struct {
@@ -68,15 +147,46 @@ type Key struct {
 	CreatedAt *time.Time `json:"created_at,omitempty"`
 }
 
-type Job struct {
+// LogDrain is an external endpoint which the output of an app's jobs is
+// shipped to. URL is syslog://host:port, syslog+tls://host:port or an HTTP(S)
+// URL which receives batches of log messages as a JSON array.
+type LogDrain struct {
 	ID        string     `json:"id,omitempty"`
 	AppID     string     `json:"app,omitempty"`
-	ReleaseID string     `json:"release,omitempty"`
-	Type      string     `json:"type,omitempty"`
-	State     string     `json:"state,omitempty"`
-	Cmd       []string   `json:"cmd,omitempty"`
+	URL       string     `json:"url,omitempty"`
 	CreatedAt *time.Time `json:"created_at,omitempty"`
-	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+}
+
+type Job struct {
+	ID         string   `json:"id,omitempty"`
+	AppID      string   `json:"app,omitempty"`
+	ReleaseID  string   `json:"release,omitempty"`
+	Type       string   `json:"type,omitempty"`
+	State      string   `json:"state,omitempty"`
+	OOMKills   int      `json:"oom_kills,omitempty"`   // processes killed for exceeding the memory limit
+	ExitStatus *int     `json:"exit_status,omitempty"` // set once the job has stopped
+	Cmd        []string `json:"cmd,omitempty"`
+	// Meta is the metadata of the host job. It is not stored.
+	Meta      map[string]string `json:"meta,omitempty"`
+	CreatedAt *time.Time        `json:"created_at,omitempty"`
+	UpdatedAt *time.Time        `json:"updated_at,omitempty"`
+}
+
+type JobStats struct {
+	JobID       string    `json:"job_id,omitempty"`
+	MemoryUsage uint64    `json:"memory_usage"` // in bytes
+	MemoryLimit uint64    `json:"memory_limit"` // in bytes
+	CPUUsage    uint64    `json:"cpu_usage"`    // total CPU time in nanoseconds
+	Time        time.Time `json:"time"`
+}
+
+// LogLine is a chunk of output from one of the jobs of an app.
+type LogLine struct {
+	JobID       string    `json:"job_id"`
+	ProcessType string    `json:"process_type,omitempty"`
+	Stream      string    `json:"stream"` // "stdout" or "stderr"
+	Timestamp   time.Time `json:"timestamp"`
+	Message     string    `json:"message"`
 }
 
 type JobEvent struct {
@@ -110,18 +220,118 @@ type Provider struct {
 }
 
 type Resource struct {
-	ID         string            `json:"id,omitempty"`
-	ProviderID string            `json:"provider_id,omitempty"`
-	ExternalID string            `json:"external_id,omitempty"`
-	Env        map[string]string `json:"env,omitempty"`
-	Apps       []string          `json:"apps,omitempty"`
-	CreatedAt  *time.Time        `json:"created_at,omitempty"`
+	ID                  string            `json:"id,omitempty"`
+	ProviderID          string            `json:"provider_id,omitempty"`
+	ExternalID          string            `json:"external_id,omitempty"`
+	Env                 map[string]string `json:"env,omitempty"`
+	Apps                []string          `json:"apps,omitempty"`
+	DeprovisionWithApps bool              `json:"deprovision_with_apps,omitempty"` // deprovision when the last app is deleted
+	CreatedAt           *time.Time        `json:"created_at,omitempty"`
 }
 
 type ResourceReq struct {
-	ProviderID string           `json:"-"`
-	Apps       []string         `json:"apps,omitempty"`
-	Config     *json.RawMessage `json:"config"`
+	ProviderID          string           `json:"-"`
+	Apps                []string         `json:"apps,omitempty"`
+	Config              *json.RawMessage `json:"config"`
+	DeprovisionWithApps bool             `json:"deprovision_with_apps,omitempty"`
+}
+
+// Webhook is an HTTP(S) URL which is sent events of an app, or of all apps if
+// AppID is empty. Each delivery is a POST of a WebhookPayload signed with
+// Secret in the Flynn-Signature header as "sha256=" followed by the hex
+// HMAC-SHA256 of the body. Secret is only returned when the webhook is
+// created.
+type Webhook struct {
+	ID        string     `json:"id,omitempty"`
+	AppID     string     `json:"app,omitempty"`
+	URL       string     `json:"url,omitempty"`
+	Secret    string     `json:"secret,omitempty"`
+	Events    []string   `json:"events,omitempty"` // all events if empty
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+}
+
+// Webhook event types.
+const (
+	WebhookEventDeploy      = "deploy"
+	WebhookEventScale       = "scale"
+	WebhookEventJobCrash    = "job_crash"
+	WebhookEventRouteChange = "route_change"
+	WebhookEventPing        = "ping" // sent by test fires only
+)
+
+// WebhookPayload is the body of a webhook delivery.
+type WebhookPayload struct {
+	DeliveryID string           `json:"delivery_id"`
+	Event      string           `json:"event"`
+	AppID      string           `json:"app,omitempty"`
+	Data       *json.RawMessage `json:"data,omitempty"`
+	CreatedAt  time.Time        `json:"created_at"`
+}
+
+// WebhookDelivery is an attempt to deliver an event to a webhook, which is
+// retried with backoff until it succeeds or runs out of attempts.
+type WebhookDelivery struct {
+	ID             string           `json:"id,omitempty"`
+	WebhookID      string           `json:"webhook,omitempty"`
+	Event          string           `json:"event,omitempty"`
+	Payload        *json.RawMessage `json:"payload,omitempty"`
+	State          string           `json:"state,omitempty"` // pending, succeeded or failed
+	Attempts       int              `json:"attempts"`
+	ResponseStatus int              `json:"response_status,omitempty"`
+	Error          string           `json:"error,omitempty"`
+	CreatedAt      *time.Time       `json:"created_at,omitempty"`
+	UpdatedAt      *time.Time       `json:"updated_at,omitempty"`
+}
+
+// Schedule runs a one-off job of an app periodically. Schedule is a cron
+// expression of five fields (minute, hour, day of month, month and day of
+// week) or one of @yearly, @monthly, @weekly, @daily and @hourly, evaluated in
+// UTC.
+type Schedule struct {
+	ID        string            `json:"id,omitempty"`
+	AppID     string            `json:"app,omitempty"`
+	ReleaseID string            `json:"release,omitempty"` // the current release of the app if empty
+	Schedule  string            `json:"schedule,omitempty"`
+	Cmd       []string          `json:"cmd,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+	// ConcurrencyPolicy is what happens when a run is due while the job of
+	// a previous run is still running. It defaults to ConcurrencyAllow.
+	ConcurrencyPolicy string     `json:"concurrency_policy,omitempty"`
+	NextRunAt         *time.Time `json:"next_run_at,omitempty"`
+	CreatedAt         *time.Time `json:"created_at,omitempty"`
+	UpdatedAt         *time.Time `json:"updated_at,omitempty"`
+}
+
+// Schedule concurrency policies.
+const (
+	ConcurrencyAllow   = "allow"   // run the jobs concurrently
+	ConcurrencyForbid  = "forbid"  // skip the new run
+	ConcurrencyReplace = "replace" // stop the running jobs first
+)
+
+// ScheduleRun is a run of a schedule. Its state is running until its job
+// stops, then succeeded or failed depending on the exit status of the job. A
+// run is also failed if its job could not be started or its state was never
+// reported, or skipped because of the concurrency policy.
+type ScheduleRun struct {
+	ID          string     `json:"id,omitempty"`
+	ScheduleID  string     `json:"schedule,omitempty"`
+	JobID       string     `json:"job,omitempty"`
+	State       string     `json:"state,omitempty"`
+	ExitStatus  *int       `json:"exit_status,omitempty"`
+	Error       string     `json:"error,omitempty"`
+	ScheduledAt *time.Time `json:"scheduled_at,omitempty"`
+	CreatedAt   *time.Time `json:"created_at,omitempty"`
+	UpdatedAt   *time.Time `json:"updated_at,omitempty"`
+}
+
+// Secret is a version of an environment variable of an app which is stored
+// encrypted and only given to the app's jobs when they start. Values are never
+// included in API responses.
+type Secret struct {
+	Key       string     `json:"key"`
+	Version   int        `json:"version"`
+	CreatedAt *time.Time `json:"created_at,omitempty"`
 }
 
 type ValidationError struct {
@@ -2,6 +2,7 @@ package utils
 
 import (
 	"errors"
+	"fmt"
 	"net/url"
 	"strings"
 
@@ -78,12 +79,33 @@ func JobConfig(f *ct.ExpandedFormation, name string) *host.Job {
 		job.Config.Ports[i].Port = p.Port
 		job.Config.Ports[i].RangeEnd = p.RangeEnd
 	}
+	if r := t.Resources; r != nil {
+		job.Resources = host.JobResources{
+			Memory:       r.Memory,
+			CPUShares:    r.CPUShares,
+			CPUQuota:     r.CPUQuota,
+			MaxPIDs:      r.MaxPIDs,
+			MaxOpenFiles: r.MaxOpenFiles,
+		}
+	}
 	if t.Data {
 		job.Config.Mounts = []host.Mount{{Location: "/data", Writeable: true}}
 	}
+	if len(f.Release.Secrets) > 0 {
+		job.Config.Secrets = &host.Secrets{
+			URL:   SecretsURL(f.App.ID, f.Release.ID),
+			Token: f.SecretsToken,
+		}
+	}
 	return job
 }
 
+// SecretsURL returns the URL which the hosts of the jobs of a release fetch its
+// secrets from.
+func SecretsURL(appID, releaseID string) string {
+	return fmt.Sprintf("http://flynn-controller/apps/%s/releases/%s/secrets", appID, releaseID)
+}
+
 func ParseJobID(jobID string) (string, string) {
 	id := strings.SplitN(jobID, "-", 2)
 	if len(id) != 2 || id[0] == "" || id[1] == "" {
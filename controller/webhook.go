@@ -0,0 +1,615 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-sql"
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/pq"
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/go-martini/martini"
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/pkg/random"
+)
+
+var webhookEvents = []string{
+	ct.WebhookEventDeploy,
+	ct.WebhookEventScale,
+	ct.WebhookEventJobCrash,
+	ct.WebhookEventRouteChange,
+}
+
+const (
+	// webhookPollInterval is how often pending deliveries are checked for,
+	// in case they were queued by another controller or before a restart.
+	webhookPollInterval = 30 * time.Second
+
+	// webhookLease is how long a delivery which is being attempted is
+	// hidden from other workers.
+	webhookLease = time.Minute
+
+	webhookTimeout = 10 * time.Second
+)
+
+type WebhookRepo struct {
+	db         *DB
+	jobs       *JobRepo
+	formations *FormationRepo
+	client     *http.Client
+
+	// backoff returns how long to wait before retrying a delivery which
+	// has failed attempts times
+	backoff     func(attempts int) time.Duration
+	maxAttempts int
+
+	wake chan struct{}
+}
+
+// NewWebhookRepo returns a repo of webhooks, which delivers the events it is
+// notified of once start is called.
+func NewWebhookRepo(db *DB, jobs *JobRepo, formations *FormationRepo) *WebhookRepo {
+	return &WebhookRepo{
+		db:          db,
+		jobs:        jobs,
+		formations:  formations,
+		client:      &http.Client{Timeout: webhookTimeout},
+		backoff:     webhookBackoff,
+		maxAttempts: 8,
+		wake:        make(chan struct{}, 1),
+	}
+}
+
+// webhookBackoff doubles the delay after each failed attempt, starting at
+// ten seconds and up to an hour.
+func webhookBackoff(attempts int) time.Duration {
+	d := 10 * time.Second
+	for i := 1; i < attempts && d < time.Hour; i++ {
+		d *= 2
+	}
+	if d > time.Hour {
+		d = time.Hour
+	}
+	return d
+}
+
+func validWebhookEvent(event string) bool {
+	for _, e := range webhookEvents {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *WebhookRepo) Add(data interface{}) error {
+	hook := data.(*ct.Webhook)
+	u, err := url.Parse(hook.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return ct.ValidationError{Field: "url", Message: "must be an http or https URL"}
+	}
+	for _, e := range hook.Events {
+		if !validWebhookEvent(e) {
+			return ct.ValidationError{Field: "events", Message: fmt.Sprintf("%q is not one of %s", e, strings.Join(webhookEvents, ", "))}
+		}
+	}
+	var appID *string
+	if hook.AppID != "" {
+		app, err := selectApp(r.db, hook.AppID, false)
+		if err == ErrNotFound {
+			err = ct.ValidationError{Field: "app", Message: "not found"}
+		}
+		if err != nil {
+			return err
+		}
+		appID = &app.ID
+		hook.AppID = app.ID
+	}
+	if hook.ID == "" {
+		hook.ID = random.UUID()
+	}
+	if hook.Secret == "" {
+		hook.Secret = random.Hex(32)
+	}
+	err = r.db.QueryRow("INSERT INTO webhooks (webhook_id, app_id, url, secret, events) VALUES ($1, $2, $3, $4, $5) RETURNING created_at",
+		hook.ID, appID, hook.URL, hook.Secret, strings.Join(hook.Events, ",")).Scan(&hook.CreatedAt)
+	hook.ID = cleanUUID(hook.ID)
+	return err
+}
+
+// webhookColumns are the columns of webhooks which are returned by the API.
+// The secret is only included in the response to creating a webhook.
+const webhookColumns = "webhook_id, app_id, url, events, created_at"
+
+func scanWebhook(s Scanner) (*ct.Webhook, error) {
+	hook := &ct.Webhook{}
+	var appID sql.NullString
+	var events string
+	err := s.Scan(&hook.ID, &appID, &hook.URL, &events, &hook.CreatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			err = ErrNotFound
+		}
+		return nil, err
+	}
+	hook.ID = cleanUUID(hook.ID)
+	hook.AppID = cleanUUID(appID.String)
+	if events != "" {
+		hook.Events = strings.Split(events, ",")
+	}
+	return hook, nil
+}
+
+func (r *WebhookRepo) Get(id string) (interface{}, error) {
+	if !idPattern.MatchString(id) {
+		return nil, ErrNotFound
+	}
+	row := r.db.QueryRow("SELECT "+webhookColumns+" FROM webhooks WHERE webhook_id = $1 AND deleted_at IS NULL", id)
+	return scanWebhook(row)
+}
+
+func (r *WebhookRepo) Remove(id string) error {
+	return r.db.Exec("UPDATE webhooks SET deleted_at = now() WHERE webhook_id = $1 AND deleted_at IS NULL", id)
+}
+
+func (r *WebhookRepo) List(opts *listOptions) (interface{}, string, error) {
+	if err := opts.checkFilters("app"); err != nil {
+		return nil, "", err
+	}
+	q := newListQuery("SELECT "+webhookColumns+" FROM webhooks WHERE deleted_at IS NULL", "webhook_id")
+	if appID, ok := opts.filters["app"]; ok {
+		if !idPattern.MatchString(appID) {
+			return nil, "", ct.ValidationError{Field: "app", Message: "is invalid"}
+		}
+		q.where("app_id = $%d", appID)
+	}
+	query, args, err := q.build(opts)
+	if err != nil {
+		return nil, "", err
+	}
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return nil, "", err
+	}
+	hooks := []*ct.Webhook{}
+	for rows.Next() {
+		hook, err := scanWebhook(rows)
+		if err != nil {
+			rows.Close()
+			return nil, "", err
+		}
+		hooks = append(hooks, hook)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+	n, next := opts.page(len(hooks), func(i int) (*time.Time, string) { return hooks[i].CreatedAt, hooks[i].ID })
+	return hooks[:n], next, nil
+}
+
+const webhookDeliveryColumns = "delivery_id, webhook_id, event, payload, state, attempts, response_status, error, created_at, updated_at"
+
+func scanWebhookDelivery(s Scanner) (*ct.WebhookDelivery, error) {
+	d := &ct.WebhookDelivery{}
+	var payload string
+	err := s.Scan(&d.ID, &d.WebhookID, &d.Event, &payload, &d.State, &d.Attempts, &d.ResponseStatus, &d.Error, &d.CreatedAt, &d.UpdatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			err = ErrNotFound
+		}
+		return nil, err
+	}
+	d.ID = cleanUUID(d.ID)
+	d.WebhookID = cleanUUID(d.WebhookID)
+	raw := json.RawMessage(payload)
+	d.Payload = &raw
+	return d, nil
+}
+
+func (r *WebhookRepo) getDelivery(id string) (*ct.WebhookDelivery, error) {
+	if !idPattern.MatchString(id) {
+		return nil, ErrNotFound
+	}
+	row := r.db.QueryRow("SELECT "+webhookDeliveryColumns+" FROM webhook_deliveries WHERE delivery_id = $1", id)
+	return scanWebhookDelivery(row)
+}
+
+// listDeliveries returns the delivery history of a webhook.
+func (r *WebhookRepo) listDeliveries(hookID string, opts *listOptions) ([]*ct.WebhookDelivery, string, error) {
+	if err := opts.checkFilters("event", "state"); err != nil {
+		return nil, "", err
+	}
+	q := newListQuery("SELECT "+webhookDeliveryColumns+" FROM webhook_deliveries WHERE webhook_id = $1", "delivery_id")
+	q.args = append(q.args, hookID)
+	if event, ok := opts.filters["event"]; ok {
+		q.where("event = $%d", event)
+	}
+	if state, ok := opts.filters["state"]; ok {
+		switch state {
+		case "pending", "succeeded", "failed":
+		default:
+			return nil, "", ct.ValidationError{Field: "state", Message: "is invalid"}
+		}
+		q.where("state = $%d", state)
+	}
+	query, args, err := q.build(opts)
+	if err != nil {
+		return nil, "", err
+	}
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return nil, "", err
+	}
+	deliveries := []*ct.WebhookDelivery{}
+	for rows.Next() {
+		d, err := scanWebhookDelivery(rows)
+		if err != nil {
+			rows.Close()
+			return nil, "", err
+		}
+		deliveries = append(deliveries, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+	n, next := opts.page(len(deliveries), func(i int) (*time.Time, string) { return deliveries[i].CreatedAt, deliveries[i].ID })
+	return deliveries[:n], next, nil
+}
+
+// emit queues deliveries of an event of an app to the webhooks which are sent
+// it. The key identifies the event, so that it is delivered once even if it is
+// emitted by several controllers.
+func (r *WebhookRepo) emit(key, event, appID string, data interface{}) error {
+	rows, err := r.db.Query("SELECT "+webhookColumns+" FROM webhooks WHERE deleted_at IS NULL AND (app_id IS NULL OR app_id = $1)", appID)
+	if err != nil {
+		return err
+	}
+	var hooks []*ct.Webhook
+	for rows.Next() {
+		hook, err := scanWebhook(rows)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		if len(hook.Events) > 0 {
+			var found bool
+			for _, e := range hook.Events {
+				if e == event {
+					found = true
+					break
+				}
+			}
+			if !found {
+				continue
+			}
+		}
+		hooks = append(hooks, hook)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(hooks) == 0 {
+		return nil
+	}
+
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	for _, hook := range hooks {
+		_, err := r.addDelivery(hook.ID, key, event, appID, raw, time.Now())
+		if e, ok := err.(*pq.Error); ok && e.Code.Name() == "unique_violation" {
+			// already queued by another controller
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	r.wakeWorker()
+	return nil
+}
+
+// addDelivery queues a delivery which is due at next.
+func (r *WebhookRepo) addDelivery(hookID, key, event, appID string, data json.RawMessage, next time.Time) (*ct.WebhookDelivery, error) {
+	id := random.UUID()
+	payload, err := json.Marshal(&ct.WebhookPayload{
+		DeliveryID: cleanUUID(id),
+		Event:      event,
+		AppID:      cleanUUID(appID),
+		Data:       &data,
+		CreatedAt:  time.Now().UTC(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	row := r.db.QueryRow("INSERT INTO webhook_deliveries (delivery_id, webhook_id, event_key, event, payload, next_attempt_at) VALUES ($1, $2, $3, $4, $5, $6) RETURNING "+webhookDeliveryColumns,
+		id, hookID, key, event, string(payload), next)
+	return scanWebhookDelivery(row)
+}
+
+// test fires a ping event at a webhook and attempts to deliver it at once,
+// returning the delivery with the result of the attempt. It is retried like
+// other deliveries if it failed.
+func (r *WebhookRepo) test(hook *ct.Webhook) (*ct.WebhookDelivery, error) {
+	var secret string
+	if err := r.db.QueryRow("SELECT secret FROM webhooks WHERE webhook_id = $1", hook.ID).Scan(&secret); err != nil {
+		return nil, err
+	}
+	d, err := r.addDelivery(hook.ID, "ping:"+random.UUID(), ct.WebhookEventPing, hook.AppID, json.RawMessage("{}"), time.Now().Add(webhookLease))
+	if err != nil {
+		return nil, err
+	}
+	if err := r.attempt(d.ID, d.Event, hook.URL, secret, []byte(*d.Payload), 0); err != nil {
+		return nil, err
+	}
+	return r.getDelivery(d.ID)
+}
+
+func (r *WebhookRepo) wakeWorker() {
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+// start listens for the notifications which webhook events are made from,
+// and starts delivering pending deliveries.
+func (r *WebhookRepo) start() error {
+	listenerEvent := func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Printf("Webhook listener error: %s", err)
+		}
+	}
+	listener := pq.NewListener(r.db.DSN(), 10*time.Second, time.Minute, listenerEvent)
+	for _, channel := range []string{"formation_scales", "job_events", "app_releases"} {
+		if err := listener.Listen(channel); err != nil {
+			listener.Close()
+			return err
+		}
+	}
+	go func() {
+		for n := range listener.Notify {
+			// n is nil after the listener reconnects
+			if n == nil {
+				continue
+			}
+			if err := r.handleNotification(n.Channel, n.Extra); err != nil {
+				log.Printf("Error handling %s notification %q for webhooks: %s", n.Channel, n.Extra, err)
+			}
+		}
+	}()
+	go r.deliverLoop()
+	return nil
+}
+
+// handleNotification emits the webhook event of a notification of the
+// formation scale, job event or app release triggers.
+func (r *WebhookRepo) handleNotification(channel, extra string) error {
+	switch channel {
+	case "formation_scales":
+		ids := strings.SplitN(extra, ":", 2)
+		if len(ids) != 2 {
+			return fmt.Errorf("invalid notification")
+		}
+		f, err := r.formations.Get(ids[0], ids[1])
+		if err == ErrNotFound {
+			// the formation was deleted
+			return nil
+		} else if err != nil {
+			return err
+		}
+		key := fmt.Sprintf("scale:%s:%s:%d", f.AppID, f.ReleaseID, f.UpdatedAt.UnixNano())
+		return r.emit(key, ct.WebhookEventScale, f.AppID, f)
+	case "job_events":
+		id, err := strconv.ParseInt(extra, 10, 64)
+		if err != nil {
+			return err
+		}
+		e, err := r.jobs.getEvent(id)
+		if err != nil {
+			return err
+		}
+		if e.State != "crashed" && e.State != "oom" {
+			return nil
+		}
+		return r.emit("job_crash:"+extra, ct.WebhookEventJobCrash, e.AppID, e)
+	case "app_releases":
+		// app_id:release_id:previous_release_id:txid
+		ids := strings.SplitN(extra, ":", 4)
+		if len(ids) != 4 {
+			return fmt.Errorf("invalid notification")
+		}
+		appID := cleanUUID(ids[0])
+		return r.emit("deploy:"+extra, ct.WebhookEventDeploy, appID, map[string]string{
+			"release":          cleanUUID(ids[1]),
+			"previous_release": cleanUUID(ids[2]),
+		})
+	}
+	return nil
+}
+
+func (r *WebhookRepo) deliverLoop() {
+	ticker := time.NewTicker(webhookPollInterval)
+	defer ticker.Stop()
+	for {
+		if err := r.deliverDue(); err != nil {
+			log.Printf("Error delivering webhooks: %s", err)
+		}
+		select {
+		case <-r.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// deliverDue attempts the deliveries which are due. Each is claimed by
+// moving its next attempt past the lease, so that other controllers skip it.
+func (r *WebhookRepo) deliverDue() error {
+	rows, err := r.db.Query("SELECT delivery_id, next_attempt_at FROM webhook_deliveries WHERE state = 'pending' AND next_attempt_at <= now() ORDER BY next_attempt_at LIMIT 100")
+	if err != nil {
+		return err
+	}
+	type due struct {
+		id   string
+		next time.Time
+	}
+	var deliveries []due
+	for rows.Next() {
+		var d due
+		if err := rows.Scan(&d.id, &d.next); err != nil {
+			rows.Close()
+			return err
+		}
+		deliveries = append(deliveries, d)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, d := range deliveries {
+		var event, payload, hookURL, secret string
+		var attempts int
+		var deleted bool
+		err := r.db.QueryRow(`
+UPDATE webhook_deliveries d SET next_attempt_at = $3 FROM webhooks w
+WHERE w.webhook_id = d.webhook_id AND d.delivery_id = $1 AND d.next_attempt_at = $2 AND d.state = 'pending'
+RETURNING d.event, d.payload, d.attempts, w.url, w.secret, w.deleted_at IS NOT NULL`,
+			d.id, d.next, time.Now().Add(webhookLease)).Scan(&event, &payload, &attempts, &hookURL, &secret, &deleted)
+		if err == sql.ErrNoRows {
+			// claimed by another controller
+			continue
+		} else if err != nil {
+			return err
+		}
+		if deleted {
+			if err := r.db.Exec("UPDATE webhook_deliveries SET state = 'failed', error = 'webhook deleted', updated_at = now() WHERE delivery_id = $1", d.id); err != nil {
+				return err
+			}
+			continue
+		}
+		go func(id string) {
+			if err := r.attempt(id, event, hookURL, secret, []byte(payload), attempts); err != nil {
+				log.Printf("Error recording attempt of webhook delivery %s: %s", id, err)
+			}
+		}(d.id)
+	}
+	return nil
+}
+
+// attempt posts a delivery to its webhook and records the result, scheduling
+// a retry if it failed and has attempts left.
+func (r *WebhookRepo) attempt(id, event, hookURL, secret string, payload []byte, attempts int) error {
+	status, err := r.post(id, event, hookURL, secret, payload)
+	attempts++
+	state, next, errMsg := "succeeded", time.Now(), ""
+	if err != nil {
+		errMsg = err.Error()
+		if attempts >= r.maxAttempts {
+			state = "failed"
+		} else {
+			state = "pending"
+			delay := r.backoff(attempts)
+			next = next.Add(delay)
+			time.AfterFunc(delay, r.wakeWorker)
+		}
+	}
+	return r.db.Exec("UPDATE webhook_deliveries SET state = $2, attempts = $3, response_status = $4, error = $5, next_attempt_at = $6, updated_at = now() WHERE delivery_id = $1",
+		id, state, attempts, status, errMsg, next)
+}
+
+// post sends a signed payload to a webhook, returning the response status.
+func (r *WebhookRepo) post(id, event, hookURL, secret string, payload []byte) (int, error) {
+	req, err := http.NewRequest("POST", hookURL, bytes.NewReader(payload))
+	if err != nil {
+		return 0, err
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "flynn-controller")
+	req.Header.Set("Flynn-Event", event)
+	req.Header.Set("Flynn-Delivery", cleanUUID(id))
+	req.Header.Set("Flynn-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	res, err := r.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	io.Copy(ioutil.Discard, res.Body)
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return res.StatusCode, fmt.Errorf("unexpected status %d", res.StatusCode)
+	}
+	return res.StatusCode, nil
+}
+
+func createAppWebhook(app *ct.App, hook ct.Webhook, repo *WebhookRepo, r ResponseHelper) {
+	hook.AppID = app.ID
+	if err := repo.Add(&hook); err != nil {
+		r.Error(err)
+		return
+	}
+	r.JSON(200, &hook)
+}
+
+func listAppWebhooks(req *http.Request, w http.ResponseWriter, app *ct.App, repo *WebhookRepo, r ResponseHelper) {
+	opts, err := parseListOptions(req)
+	if err != nil {
+		r.Error(err)
+		return
+	}
+	opts.filters["app"] = app.ID
+	list, next, err := repo.List(opts)
+	if err != nil {
+		r.Error(err)
+		return
+	}
+	setNextPage(w, req, next)
+	r.JSON(200, list)
+}
+
+func listWebhookDeliveries(req *http.Request, w http.ResponseWriter, hook *ct.Webhook, repo *WebhookRepo, r ResponseHelper) {
+	opts, err := parseListOptions(req)
+	if err != nil {
+		r.Error(err)
+		return
+	}
+	list, next, err := repo.listDeliveries(hook.ID, opts)
+	if err != nil {
+		r.Error(err)
+		return
+	}
+	setNextPage(w, req, next)
+	r.JSON(200, list)
+}
+
+func getWebhookDelivery(params martini.Params, hook *ct.Webhook, repo *WebhookRepo, r ResponseHelper) {
+	d, err := repo.getDelivery(params["deliveries_id"])
+	if err == nil && d.WebhookID != hook.ID {
+		err = ErrNotFound
+	}
+	if err != nil {
+		r.Error(err)
+		return
+	}
+	r.JSON(200, d)
+}
+
+func testWebhook(hook *ct.Webhook, repo *WebhookRepo, r ResponseHelper) {
+	d, err := repo.test(hook)
+	if err != nil {
+		r.Error(err)
+		return
+	}
+	r.JSON(200, d)
+}
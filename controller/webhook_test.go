@@ -0,0 +1,223 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"time"
+
+	. "github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-check"
+	ct "github.com/flynn/flynn/controller/types"
+)
+
+type webhookRequest struct {
+	header  http.Header
+	payload *ct.WebhookPayload
+	body    []byte
+}
+
+// webhookReceiver is a webhook endpoint which responds to each request with
+// the next of its statuses, or 200 once they run out.
+type webhookReceiver struct {
+	*httptest.Server
+	requests chan *webhookRequest
+	statuses chan int
+}
+
+func newWebhookReceiver(statuses ...int) *webhookReceiver {
+	r := &webhookReceiver{
+		requests: make(chan *webhookRequest, 10),
+		statuses: make(chan int, len(statuses)),
+	}
+	for _, s := range statuses {
+		r.statuses <- s
+	}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		payload := &ct.WebhookPayload{}
+		json.Unmarshal(body, payload)
+		r.requests <- &webhookRequest{header: req.Header, payload: payload, body: body}
+		select {
+		case status := <-r.statuses:
+			w.WriteHeader(status)
+		default:
+		}
+	}))
+	return r
+}
+
+// wait returns the next request with the given event, skipping others.
+func (r *webhookReceiver) wait(c *C, event string) *webhookRequest {
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case req := <-r.requests:
+			if req.payload.Event == event {
+				return req
+			}
+		case <-timeout:
+			c.Fatalf("timed out waiting for %s webhook", event)
+		}
+	}
+}
+
+func (s *S) createTestWebhook(c *C, in *ct.Webhook) *ct.Webhook {
+	out := &ct.Webhook{}
+	res, err := s.Post("/webhooks", in, out)
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 200)
+	return out
+}
+
+func checkWebhookSignature(c *C, req *webhookRequest, secret string) {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(req.body)
+	c.Assert(req.header.Get("Flynn-Signature"), Equals, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	c.Assert(req.header.Get("Flynn-Event"), Equals, req.payload.Event)
+	c.Assert(req.header.Get("Flynn-Delivery"), Equals, req.payload.DeliveryID)
+}
+
+func (s *S) TestCreateWebhook(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "create-webhook"})
+
+	hook := &ct.Webhook{}
+	res, err := s.Post("/apps/"+app.Name+"/webhooks", &ct.Webhook{URL: "https://example.com/hook", Events: []string{"deploy"}}, hook)
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 200)
+	c.Assert(hook.ID, Not(Equals), "")
+	c.Assert(hook.AppID, Equals, app.ID)
+	c.Assert(hook.Secret, Not(Equals), "")
+
+	var list []*ct.Webhook
+	res, err = s.Get("/apps/"+app.ID+"/webhooks", &list)
+	c.Assert(err, IsNil)
+	c.Assert(list, HasLen, 1)
+	c.Assert(list[0].ID, Equals, hook.ID)
+	c.Assert(list[0].Events, DeepEquals, []string{"deploy"})
+	c.Assert(list[0].Secret, Equals, "")
+	got := &ct.Webhook{}
+	_, err = s.Get("/webhooks/"+hook.ID, got)
+	c.Assert(err, IsNil)
+	c.Assert(got.Secret, Equals, "")
+
+	for _, in := range []*ct.Webhook{
+		{URL: "ftp://example.com"},
+		{URL: "http://example.com", Events: []string{"foo"}},
+		{URL: "http://example.com", AppID: "not-an-app"},
+	} {
+		res, err = s.Post("/webhooks", in, &ct.Webhook{})
+		c.Assert(res.StatusCode, Equals, 400)
+	}
+
+	_, err = s.Delete("/webhooks/" + hook.ID)
+	c.Assert(err, IsNil)
+	res, err = s.Get("/webhooks/"+hook.ID, &ct.Webhook{})
+	c.Assert(res.StatusCode, Equals, 404)
+}
+
+func (s *S) TestWebhookTestFire(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "webhook-test-fire"})
+	receiver := newWebhookReceiver(500)
+	defer receiver.Close()
+	hook := s.createTestWebhook(c, &ct.Webhook{AppID: app.ID, URL: receiver.URL, Secret: "foo"})
+
+	// the first attempt fails, and is recorded in the delivery
+	delivery := &ct.WebhookDelivery{}
+	res, err := s.Post("/webhooks/"+hook.ID+"/test", nil, delivery)
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 200)
+	c.Assert(delivery.State, Equals, "pending")
+	c.Assert(delivery.Attempts, Equals, 1)
+	c.Assert(delivery.ResponseStatus, Equals, 500)
+	req := receiver.wait(c, ct.WebhookEventPing)
+	checkWebhookSignature(c, req, "foo")
+
+	res, err = s.Post("/webhooks/"+hook.ID+"/test", nil, delivery)
+	c.Assert(err, IsNil)
+	c.Assert(delivery.State, Equals, "succeeded")
+	c.Assert(delivery.Attempts, Equals, 1)
+	c.Assert(delivery.ResponseStatus, Equals, 200)
+	req = receiver.wait(c, ct.WebhookEventPing)
+	checkWebhookSignature(c, req, "foo")
+
+	var list []*ct.WebhookDelivery
+	_, err = s.Get("/webhooks/"+hook.ID+"/deliveries?state=succeeded", &list)
+	c.Assert(err, IsNil)
+	c.Assert(list, HasLen, 1)
+	c.Assert(list[0].ID, Equals, delivery.ID)
+}
+
+func (s *S) TestWebhookRetry(c *C) {
+	repo := s.m.Get(reflect.TypeOf(&WebhookRepo{})).Interface().(*WebhookRepo)
+	backoff := repo.backoff
+	repo.backoff = func(int) time.Duration { return 10 * time.Millisecond }
+	defer func() { repo.backoff = backoff }()
+
+	app := s.createTestApp(c, &ct.App{Name: "webhook-retry"})
+	receiver := newWebhookReceiver(500, 502)
+	defer receiver.Close()
+	hook := s.createTestWebhook(c, &ct.Webhook{AppID: app.ID, URL: receiver.URL})
+
+	delivery := &ct.WebhookDelivery{}
+	_, err := s.Post("/webhooks/"+hook.ID+"/test", nil, delivery)
+	c.Assert(err, IsNil)
+	c.Assert(delivery.State, Equals, "pending")
+	for i := 0; i < 3; i++ {
+		receiver.wait(c, ct.WebhookEventPing)
+	}
+
+	// the result of the last attempt is recorded after its response
+	timeout := time.After(5 * time.Second)
+	for {
+		_, err = s.Get("/webhooks/"+hook.ID+"/deliveries/"+delivery.ID, delivery)
+		c.Assert(err, IsNil)
+		if delivery.State != "pending" {
+			break
+		}
+		select {
+		case <-timeout:
+			c.Fatal("timed out waiting for delivery to succeed")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	c.Assert(delivery.State, Equals, "succeeded")
+	c.Assert(delivery.Attempts, Equals, 3)
+}
+
+func (s *S) TestWebhookEvents(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "webhook-events"})
+	receiver := newWebhookReceiver()
+	defer receiver.Close()
+	hook := s.createTestWebhook(c, &ct.Webhook{AppID: app.ID, URL: receiver.URL, Events: []string{"deploy", "scale"}})
+
+	release := s.createTestRelease(c, &ct.Release{})
+	s.setAppRelease(c, app.ID, release.ID)
+	req := receiver.wait(c, ct.WebhookEventDeploy)
+	checkWebhookSignature(c, req, hook.Secret)
+	c.Assert(req.payload.AppID, Equals, app.ID)
+	var deploy map[string]string
+	c.Assert(json.Unmarshal(*req.payload.Data, &deploy), IsNil)
+	c.Assert(deploy["release"], Equals, release.ID)
+
+	s.createTestFormation(c, &ct.Formation{AppID: app.ID, ReleaseID: release.ID, Processes: map[string]int{"web": 2}})
+	req = receiver.wait(c, ct.WebhookEventScale)
+	formation := &ct.Formation{}
+	c.Assert(json.Unmarshal(*req.payload.Data, formation), IsNil)
+	c.Assert(formation.Processes, DeepEquals, map[string]int{"web": 2})
+
+	// deploying a release moves the formation without scaling it
+	next := s.createTestRelease(c, &ct.Release{})
+	s.setAppRelease(c, app.ID, next.ID)
+	receiver.wait(c, ct.WebhookEventDeploy)
+	s.createTestFormation(c, &ct.Formation{AppID: app.ID, ReleaseID: next.ID, Processes: map[string]int{"web": 3}})
+	req = receiver.wait(c, ct.WebhookEventScale)
+	formation = &ct.Formation{}
+	c.Assert(json.Unmarshal(*req.payload.Data, formation), IsNil)
+	c.Assert(formation.ReleaseID, Equals, next.ID)
+	c.Assert(formation.Processes, DeepEquals, map[string]int{"web": 3})
+}
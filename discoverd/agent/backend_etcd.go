@@ -196,3 +196,189 @@ func (b *EtcdBackend) Unregister(name, addr string) error {
 	_, err := b.Client.Delete(servicePath(name, addr), false)
 	return err
 }
+
+func configPath(key string) string {
+	if key == "" {
+		return KeyPrefix + "/config"
+	}
+	return KeyPrefix + "/config/" + key
+}
+
+func configKey(path string) string {
+	return strings.TrimPrefix(path, KeyPrefix+"/config/")
+}
+
+func isNotFound(err error) bool {
+	e, ok := err.(*etcd.EtcdError)
+	return ok && e.ErrorCode == 100
+}
+
+// GetKey returns the current value of a configuration key.
+func (b *EtcdBackend) GetKey(key string) (*KeyUpdate, error) {
+	response, err := b.Client.Get(configPath(key), false, false)
+	if isNotFound(err) {
+		return nil, ErrKeyNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	if response.Node.Dir {
+		return nil, ErrKeyNotFound
+	}
+	return &KeyUpdate{Key: key, Value: response.Node.Value, Index: response.Node.ModifiedIndex}, nil
+}
+
+// SetKey sets a configuration key in etcd. Configuration keys do not expire.
+func (b *EtcdBackend) SetKey(key, value string) error {
+	_, err := b.Client.Set(configPath(key), value, 0)
+	return err
+}
+
+// CreateKey atomically creates a configuration key in etcd, failing with
+// ErrKeyExists if it is already set.
+func (b *EtcdBackend) CreateKey(key, value string) error {
+	_, err := b.Client.Create(configPath(key), value, 0)
+	if e, ok := err.(*etcd.EtcdError); ok && e.ErrorCode == 105 {
+		return ErrKeyExists
+	}
+	return err
+}
+
+// SwapKey atomically sets a configuration key in etcd if it has the value
+// prev, failing with ErrKeyChanged if it has another value.
+func (b *EtcdBackend) SwapKey(key, prev, value string) error {
+	_, err := b.Client.CompareAndSwap(configPath(key), value, 0, prev, 0)
+	if isNotFound(err) {
+		return ErrKeyNotFound
+	}
+	if e, ok := err.(*etcd.EtcdError); ok && e.ErrorCode == 101 {
+		return ErrKeyChanged
+	}
+	return err
+}
+
+// DeleteKey removes a configuration key from etcd.
+func (b *EtcdBackend) DeleteKey(key string) error {
+	_, err := b.Client.Delete(configPath(key), false)
+	if isNotFound(err) {
+		return ErrKeyNotFound
+	}
+	return err
+}
+
+// WatchKeys subscribes to changes of configuration keys under prefix.
+func (b *EtcdBackend) WatchKeys(prefix string) (KeyUpdateStream, error) {
+	stream := &etcdKeyStream{ch: make(chan *KeyUpdate), stop: make(chan bool)}
+	go func() {
+		send := func(u *KeyUpdate) bool {
+			select {
+			case stream.ch <- u:
+				return true
+			case <-stream.stop:
+				return false
+			}
+		}
+
+		var sentinel bool
+		// known are the keys which have been sent and not deleted, so that
+		// keys deleted while resyncing are sent as deleted
+		known := make(map[string]struct{})
+		path := configPath(prefix)
+	sync:
+		for {
+			nextIndex := uint64(1)
+			response, err := b.Client.Get(path, false, true)
+			if response != nil || isNotFound(err) {
+				current := make(map[string]struct{})
+				if response != nil {
+					for _, n := range flattenNodes(response.Node) {
+						key := configKey(n.Key)
+						current[key] = struct{}{}
+						if !send(&KeyUpdate{Key: key, Value: n.Value, Index: n.ModifiedIndex}) {
+							return
+						}
+					}
+					nextIndex = response.EtcdIndex + 1
+				}
+				for key := range known {
+					if _, ok := current[key]; !ok {
+						if !send(&KeyUpdate{Key: key, Deleted: true}) {
+							return
+						}
+					}
+				}
+				known = current
+			}
+			if e, ok := err.(*etcd.EtcdError); ok {
+				nextIndex = e.Index + 1
+			}
+			if !sentinel {
+				if !send(&KeyUpdate{}) {
+					return
+				}
+				sentinel = true
+			}
+
+			for {
+				watch := make(chan *etcd.Response)
+				watchDone := make(chan struct{})
+				var watchErr error
+				go func() {
+					_, watchErr = b.Client.Watch(path, nextIndex, true, watch, stream.stop)
+					close(watchDone)
+				}()
+				for resp := range watch {
+					nextIndex = resp.EtcdIndex + 1
+					if resp.Node.Dir {
+						continue
+					}
+					update := &KeyUpdate{Key: configKey(resp.Node.Key), Index: resp.Node.ModifiedIndex}
+					switch resp.Action {
+					case "delete", "expire", "compareAndDelete":
+						update.Deleted = true
+						delete(known, update.Key)
+					default:
+						update.Value = resp.Node.Value
+						known[update.Key] = struct{}{}
+					}
+					if !send(update) {
+						return
+					}
+				}
+				<-watchDone
+				select {
+				case <-stream.stop:
+					return
+				default:
+				}
+				if e, ok := watchErr.(*etcd.EtcdError); ok && e.ErrorCode == 401 {
+					// event log has been pruned beyond our waitIndex, force full sync
+					log.Printf("Got etcd error 401, doing full sync")
+					continue sync
+				}
+				log.Printf("Restarting etcd watch %s due to error: %s", path, watchErr)
+			}
+		}
+	}()
+	return stream, nil
+}
+
+func flattenNodes(node *etcd.Node) []*etcd.Node {
+	if !node.Dir {
+		return []*etcd.Node{node}
+	}
+	var nodes []*etcd.Node
+	for _, n := range node.Nodes {
+		nodes = append(nodes, flattenNodes(n)...)
+	}
+	return nodes
+}
+
+type etcdKeyStream struct {
+	ch       chan *KeyUpdate
+	stop     chan bool
+	stopOnce sync.Once
+}
+
+func (s *etcdKeyStream) Chan() chan *KeyUpdate { return s.ch }
+
+func (s *etcdKeyStream) Close() { s.stopOnce.Do(func() { close(s.stop) }) }
@@ -119,3 +119,58 @@ func TestEtcdBackend_Subscribe(t *testing.T) {
 		t.Fatal("Expected service to be offline:", update)
 	}
 }
+
+func TestEtcdBackend_Keys(t *testing.T) {
+	client, done := runEtcdServer(t)
+	defer done()
+
+	backend := EtcdBackend{Client: client}
+
+	if _, err := backend.GetKey("test_keys/a"); err != ErrKeyNotFound {
+		t.Fatal("Expected ErrKeyNotFound, got:", err)
+	}
+	if err := backend.SetKey("test_keys/a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := backend.CreateKey("test_keys/nested/b", "2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := backend.CreateKey("test_keys/nested/b", "3"); err != ErrKeyExists {
+		t.Fatal("Expected ErrKeyExists, got:", err)
+	}
+	if err := backend.SwapKey("test_keys/nested/b", "3", "4"); err != ErrKeyChanged {
+		t.Fatal("Expected ErrKeyChanged, got:", err)
+	}
+	if err := backend.SwapKey("test_keys/nested/c", "3", "4"); err != ErrKeyNotFound {
+		t.Fatal("Expected ErrKeyNotFound, got:", err)
+	}
+	if err := backend.SwapKey("test_keys/nested/b", "2", "2"); err != nil {
+		t.Fatal(err)
+	}
+
+	updates, _ := backend.WatchKeys("test_keys")
+	defer updates.Close()
+
+	current := make(map[string]string)
+	for update := range updates.Chan() {
+		if update.Key == "" {
+			break // the update that signals "up to current" event
+		}
+		current[update.Key] = update.Value
+	}
+	if current["test_keys/a"] != "1" || current["test_keys/nested/b"] != "2" {
+		t.Fatal("Unexpected current keys: ", current)
+	}
+
+	backend.SetKey("test_keys/a", "3")
+	backend.DeleteKey("test_keys/nested/b")
+
+	update := <-updates.Chan()
+	if update.Key != "test_keys/a" || update.Value != "3" {
+		t.Fatal("Unexpected update: ", update)
+	}
+	update = <-updates.Chan()
+	if update.Key != "test_keys/nested/b" || !update.Deleted {
+		t.Fatal("Expected key to be deleted: ", update)
+	}
+}
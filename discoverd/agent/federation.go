@@ -0,0 +1,269 @@
+package agent
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/flynn/flynn/pkg/rpcplus"
+)
+
+// RegionAttr is the attribute added to services imported from a remote
+// discoverd cluster, set to the region name of the remote. Clients do not
+// elect services with it as the leader, so local services must not set it.
+const RegionAttr = "region"
+
+// ErrFederatedService is returned when trying to unregister a service
+// instance that was imported from a remote cluster.
+var ErrFederatedService = errors.New("discoverd: cannot modify federated service")
+
+// FederationRetryDelay is how long to wait before reconnecting to a remote
+// discoverd cluster after a failure.
+var FederationRetryDelay = time.Second
+
+// Remote is a remote discoverd cluster that services are imported from.
+type Remote struct {
+	// Region is the value of RegionAttr set on imported services.
+	Region string
+	// Addr is the address of a discoverd agent in the remote cluster.
+	Addr string
+	// Services are the names of the services to import.
+	Services []string
+}
+
+func (r *Remote) imports(name string) bool {
+	for _, s := range r.Services {
+		if s == name {
+			return true
+		}
+	}
+	return false
+}
+
+// FederatedBackend wraps a DiscoveryBackend and merges read-only service
+// instances imported from remote clusters into the local subscriptions.
+// Registration and configuration keys are always handled by the local backend.
+type FederatedBackend struct {
+	DiscoveryBackend
+	Remotes []*Remote
+
+	mtx      sync.Mutex
+	imported map[string]map[string]int // service name -> imported addr -> subscription count
+}
+
+// NewFederatedBackend returns a backend that imports services from remotes
+// into subscriptions to the local backend.
+func NewFederatedBackend(local DiscoveryBackend, remotes []*Remote) *FederatedBackend {
+	return &FederatedBackend{
+		DiscoveryBackend: local,
+		Remotes:          remotes,
+		imported:         make(map[string]map[string]int),
+	}
+}
+
+func (b *FederatedBackend) setImported(name, addr string, online bool) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	addrs, ok := b.imported[name]
+	if !ok {
+		addrs = make(map[string]int)
+		b.imported[name] = addrs
+	}
+	if online {
+		addrs[addr]++
+	} else if addrs[addr] > 1 {
+		addrs[addr]--
+	} else {
+		delete(addrs, addr)
+	}
+}
+
+func (b *FederatedBackend) isImported(name, addr string) bool {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	_, ok := b.imported[name][addr]
+	return ok
+}
+
+// Unregister unregisters a local service. Imported services cannot be
+// unregistered.
+func (b *FederatedBackend) Unregister(name, addr string) error {
+	if b.isImported(name, addr) {
+		return ErrFederatedService
+	}
+	return b.DiscoveryBackend.Unregister(name, addr)
+}
+
+// Subscribe to changes in local services and services imported from remotes.
+func (b *FederatedBackend) Subscribe(name string) (UpdateStream, error) {
+	var remotes []*Remote
+	for _, r := range b.Remotes {
+		if r.imports(name) {
+			remotes = append(remotes, r)
+		}
+	}
+	if len(remotes) == 0 {
+		return b.DiscoveryBackend.Subscribe(name)
+	}
+
+	local, err := b.DiscoveryBackend.Subscribe(name)
+	if err != nil {
+		return nil, err
+	}
+	stream := &federatedStream{ch: make(chan *ServiceUpdate), stop: make(chan bool)}
+	send := func(u *ServiceUpdate) bool {
+		select {
+		case stream.ch <- u:
+			return true
+		case <-stream.stop:
+			return false
+		}
+	}
+
+	// only send one "up to current" sentinel, once the local backend and
+	// every remote have sent theirs (or failed to connect)
+	var sentinelMtx sync.Mutex
+	pending := len(remotes) + 1
+	current := func() bool {
+		sentinelMtx.Lock()
+		defer sentinelMtx.Unlock()
+		if pending == 0 {
+			return true
+		}
+		if pending--; pending > 0 {
+			return true
+		}
+		return send(&ServiceUpdate{})
+	}
+
+	go func() {
+		defer local.Close()
+		for {
+			select {
+			case u, ok := <-local.Chan():
+				if !ok {
+					return
+				}
+				if u.Name == "" && u.Addr == "" {
+					if !current() {
+						return
+					}
+					continue
+				}
+				if !send(u) {
+					return
+				}
+			case <-stream.stop:
+				return
+			}
+		}
+	}()
+	for _, r := range remotes {
+		go b.importRemote(r, name, stream, send, current)
+	}
+	return stream, nil
+}
+
+func (b *FederatedBackend) importRemote(r *Remote, name string, stream *federatedStream, send func(*ServiceUpdate) bool, current func() bool) {
+	sentCurrent := false
+	known := make(map[string]*ServiceUpdate)
+	offline := func() bool {
+		for addr, u := range known {
+			b.setImported(name, addr, false)
+			delete(known, addr)
+			if !send(&ServiceUpdate{Name: u.Name, Addr: u.Addr, Attrs: u.Attrs, Created: u.Created}) {
+				return false
+			}
+		}
+		return true
+	}
+	defer func() {
+		for addr := range known {
+			b.setImported(name, addr, false)
+		}
+	}()
+
+	for {
+		client, err := rpcplus.DialHTTP("tcp", r.Addr)
+		if err != nil {
+			log.Printf("Federation: failed to connect to %s (%s): %s", r.Region, r.Addr, err)
+		} else {
+			updates := make(chan *ServiceUpdate)
+			call := client.StreamGo("Agent.Subscribe", &Args{Name: name, LocalOnly: true}, updates)
+			done := make(chan struct{})
+			go func() {
+				select {
+				case <-stream.stop:
+					call.CloseStream()
+				case <-done:
+				}
+			}()
+			for u := range updates {
+				if u.Name == "" && u.Addr == "" {
+					if !sentCurrent {
+						sentCurrent = true
+						if !current() {
+							close(done)
+							client.Close()
+							return
+						}
+					}
+					continue
+				}
+				attrs := make(map[string]string, len(u.Attrs)+1)
+				for k, v := range u.Attrs {
+					attrs[k] = v
+				}
+				attrs[RegionAttr] = r.Region
+				u.Attrs = attrs
+				if _, ok := known[u.Addr]; ok != u.Online {
+					b.setImported(name, u.Addr, u.Online)
+				}
+				if u.Online {
+					known[u.Addr] = u
+				} else {
+					delete(known, u.Addr)
+				}
+				if !send(u) {
+					close(done)
+					client.Close()
+					return
+				}
+			}
+			close(done)
+			client.Close()
+			select {
+			case <-stream.stop:
+				return
+			default:
+			}
+			log.Printf("Federation: lost connection to %s (%s): %v", r.Region, r.Addr, call.Error)
+		}
+		if !sentCurrent {
+			// don't block the subscription on an unreachable remote
+			sentCurrent = true
+			if !current() {
+				return
+			}
+		}
+		if !offline() {
+			return
+		}
+		select {
+		case <-stream.stop:
+			return
+		case <-time.After(FederationRetryDelay):
+		}
+	}
+}
+
+type federatedStream struct {
+	ch       chan *ServiceUpdate
+	stop     chan bool
+	stopOnce sync.Once
+}
+
+func (s *federatedStream) Chan() chan *ServiceUpdate { return s.ch }
+
+func (s *federatedStream) Close() { s.stopOnce.Do(func() { close(s.stop) }) }
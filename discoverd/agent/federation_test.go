@@ -0,0 +1,187 @@
+package agent
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/flynn/flynn/pkg/rpcplus"
+	"github.com/flynn/flynn/pkg/rpcplus/comborpc"
+)
+
+// memoryBackend is a DiscoveryBackend which keeps services in memory.
+type memoryBackend struct {
+	mtx      sync.Mutex
+	services map[string]map[string]map[string]string
+	streams  map[string][]*memoryStream
+}
+
+func newMemoryBackend() *memoryBackend {
+	return &memoryBackend{
+		services: make(map[string]map[string]map[string]string),
+		streams:  make(map[string][]*memoryStream),
+	}
+}
+
+type memoryStream struct {
+	ch chan *ServiceUpdate
+}
+
+func (s *memoryStream) Chan() chan *ServiceUpdate { return s.ch }
+func (s *memoryStream) Close()                    {}
+
+func (b *memoryBackend) Subscribe(name string) (UpdateStream, error) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	stream := &memoryStream{ch: make(chan *ServiceUpdate, 100)}
+	for addr, attrs := range b.services[name] {
+		stream.ch <- &ServiceUpdate{Name: name, Addr: addr, Online: true, Attrs: attrs}
+	}
+	stream.ch <- &ServiceUpdate{}
+	b.streams[name] = append(b.streams[name], stream)
+	return stream, nil
+}
+
+func (b *memoryBackend) Register(name, addr string, attrs map[string]string) error {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	if b.services[name] == nil {
+		b.services[name] = make(map[string]map[string]string)
+	}
+	b.services[name][addr] = attrs
+	for _, s := range b.streams[name] {
+		s.ch <- &ServiceUpdate{Name: name, Addr: addr, Online: true, Attrs: attrs}
+	}
+	return nil
+}
+
+func (b *memoryBackend) Unregister(name, addr string) error {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	delete(b.services[name], addr)
+	for _, s := range b.streams[name] {
+		s.ch <- &ServiceUpdate{Name: name, Addr: addr}
+	}
+	return nil
+}
+
+func (b *memoryBackend) GetKey(key string) (*KeyUpdate, error)            { return nil, ErrKeyNotFound }
+func (b *memoryBackend) SetKey(key, value string) error                   { return nil }
+func (b *memoryBackend) CreateKey(key, value string) error                { return nil }
+func (b *memoryBackend) SwapKey(key, prev, value string) error            { return ErrKeyNotFound }
+func (b *memoryBackend) DeleteKey(key string) error                       { return ErrKeyNotFound }
+func (b *memoryBackend) WatchKeys(prefix string) (KeyUpdateStream, error) { return nil, ErrInvalidKey }
+
+func runRemoteAgent(t *testing.T, backend DiscoveryBackend) *httptest.Server {
+	server := rpcplus.NewServer()
+	if err := server.Register(&Agent{Backend: backend}); err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle(rpcplus.DefaultRPCPath, comborpc.New(server))
+	return httptest.NewServer(mux)
+}
+
+func receiveUpdate(t *testing.T, stream UpdateStream) *ServiceUpdate {
+	select {
+	case u := <-stream.Chan():
+		return u
+	case <-time.After(3 * time.Second):
+		t.Fatal("Timeout waiting for update")
+	}
+	return nil
+}
+
+func TestFederatedBackend_Subscribe(t *testing.T) {
+	remoteBackend := newMemoryBackend()
+	remoteBackend.Register("pg", "10.1.0.1:5432", map[string]string{"foo": "bar"})
+	remoteBackend.Register("other", "10.1.0.2:80", nil)
+	remote := runRemoteAgent(t, remoteBackend)
+	defer remote.Close()
+
+	localBackend := newMemoryBackend()
+	localBackend.Register("pg", "10.0.0.1:5432", nil)
+	backend := NewFederatedBackend(localBackend, []*Remote{{
+		Region:   "us-west",
+		Addr:     strings.TrimPrefix(remote.URL, "http://"),
+		Services: []string{"pg"},
+	}})
+
+	stream, err := backend.Subscribe("pg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+
+	updates := make(map[string]*ServiceUpdate)
+	for {
+		u := receiveUpdate(t, stream)
+		if u.Name == "" && u.Addr == "" {
+			break
+		}
+		updates[u.Addr] = u
+	}
+	if len(updates) != 2 {
+		t.Fatal("Expected local and remote services, got: ", updates)
+	}
+	if region, ok := updates["10.0.0.1:5432"].Attrs[RegionAttr]; ok {
+		t.Fatal("Local service should not have a region, got: ", region)
+	}
+	imported := updates["10.1.0.1:5432"]
+	if imported == nil || !imported.Online || imported.Attrs[RegionAttr] != "us-west" || imported.Attrs["foo"] != "bar" {
+		t.Fatal("Unexpected imported service: ", imported)
+	}
+
+	if err := backend.Unregister("pg", "10.1.0.1:5432"); err != ErrFederatedService {
+		t.Fatal("Expected ErrFederatedService, got: ", err)
+	}
+
+	remoteBackend.Unregister("pg", "10.1.0.1:5432")
+	u := receiveUpdate(t, stream)
+	if u.Addr != "10.1.0.1:5432" || u.Online {
+		t.Fatal("Expected imported service to go offline, got: ", u)
+	}
+}
+
+func TestFederatedBackend_SubscribeNotImported(t *testing.T) {
+	localBackend := newMemoryBackend()
+	backend := NewFederatedBackend(localBackend, []*Remote{{
+		Region:   "us-west",
+		Addr:     "127.0.0.1:0",
+		Services: []string{"pg"},
+	}})
+
+	stream, err := backend.Subscribe("other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := stream.(*memoryStream); !ok {
+		t.Fatal("Expected services which are not imported to use the local backend")
+	}
+}
+
+func TestFederatedBackend_UnreachableRemote(t *testing.T) {
+	localBackend := newMemoryBackend()
+	localBackend.Register("pg", "10.0.0.1:5432", nil)
+	backend := NewFederatedBackend(localBackend, []*Remote{{
+		Region:   "us-west",
+		Addr:     "127.0.0.1:0",
+		Services: []string{"pg"},
+	}})
+
+	stream, err := backend.Subscribe("pg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+
+	if u := receiveUpdate(t, stream); u.Addr != "10.0.0.1:5432" {
+		t.Fatal("Unexpected update: ", u)
+	}
+	if u := receiveUpdate(t, stream); u.Name != "" || u.Addr != "" {
+		t.Fatal("Expected current sentinel, got: ", u)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/coreos/go-etcd/etcd"
@@ -34,6 +35,10 @@ type Args struct {
 	Name  string
 	Addr  string
 	Attrs map[string]string
+
+	// LocalOnly excludes services imported from remote clusters from a
+	// subscription. It is set by federating agents to avoid re-importing.
+	LocalOnly bool
 }
 
 // UpdateStream represents a subscription to changes in service registration.
@@ -42,11 +47,41 @@ type UpdateStream interface {
 	Close()
 }
 
+// KeyUpdate is sent when a configuration key is set or deleted.
+type KeyUpdate struct {
+	Key     string
+	Value   string
+	Deleted bool
+	Index   uint64
+}
+
+// KeyArgs represents the data sent to discoverd's configuration API methods.
+type KeyArgs struct {
+	Key   string
+	Value string
+	Prev  string // the value SwapKey expects the key to have
+}
+
+// KeyUpdateStream represents a subscription to changes in configuration keys.
+type KeyUpdateStream interface {
+	Chan() chan *KeyUpdate
+	Close()
+}
+
 // DiscoveryBackend represents a system that registers/unregisters services and notifies on updates.
 type DiscoveryBackend interface {
 	Subscribe(name string) (UpdateStream, error)
 	Register(name string, addr string, attrs map[string]string) error
 	Unregister(name string, addr string) error
+
+	// GetKey, SetKey, DeleteKey and WatchKeys operate on the configuration
+	// key/value namespace, which is separate from service registrations.
+	GetKey(key string) (*KeyUpdate, error)
+	SetKey(key string, value string) error
+	CreateKey(key string, value string) error
+	SwapKey(key string, prev string, value string) error
+	DeleteKey(key string) error
+	WatchKeys(prefix string) (KeyUpdateStream, error)
 }
 
 // Agent represents the discoverd server--the backend its using, where it's listening, etc.
@@ -102,7 +137,11 @@ func expandAddr(addr string) string {
 
 // Subscribe returns a stream of ServiceUpdate objects for the given service name.
 func (s *Agent) Subscribe(args *Args, stream rpcplus.Stream) error {
-	updates, err := s.Backend.Subscribe(args.Name)
+	backend := s.Backend
+	if f, ok := backend.(*FederatedBackend); ok && args.LocalOnly {
+		backend = f.DiscoveryBackend
+	}
+	updates, err := backend.Subscribe(args.Name)
 	if err != nil {
 		log.Println("Subscribe: error:", err)
 		stream.Send <- &ServiceUpdate{} // be sure to unblock client
@@ -140,6 +179,128 @@ func (s *Agent) Register(args *Args, ret *string) error {
 	return nil
 }
 
+// ErrInvalidKey is returned by the configuration methods when a key is empty
+// or contains empty path segments.
+var ErrInvalidKey = errors.New("discoverd: invalid key")
+
+// ErrKeyNotFound is returned by GetKey and DeleteKey when a key does not exist.
+var ErrKeyNotFound = errors.New("discoverd: key not found")
+
+// ErrKeyExists is returned by CreateKey when a key already exists.
+var ErrKeyExists = errors.New("discoverd: key already exists")
+
+// ErrKeyChanged is returned by SwapKey when a key does not have the expected
+// value.
+var ErrKeyChanged = errors.New("discoverd: key changed")
+
+func validKey(key string) bool {
+	if key == "" {
+		return false
+	}
+	for _, part := range strings.Split(key, "/") {
+		if part == "" || part == "." || part == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+// GetKey returns the current value of a configuration key.
+func (s *Agent) GetKey(args *KeyArgs, ret *KeyUpdate) error {
+	if !validKey(args.Key) {
+		return ErrInvalidKey
+	}
+	update, err := s.Backend.GetKey(args.Key)
+	if err != nil {
+		return err
+	}
+	*ret = *update
+	return nil
+}
+
+// SetKey sets a configuration key to a value.
+func (s *Agent) SetKey(args *KeyArgs, ret *struct{}) error {
+	if !validKey(args.Key) {
+		return ErrInvalidKey
+	}
+	if err := s.Backend.SetKey(args.Key, args.Value); err != nil {
+		log.Println("SetKey: error:", err)
+		return err
+	}
+	log.Println("SetKey:", args.Key)
+	return nil
+}
+
+// CreateKey sets a configuration key to a value if it does not already exist.
+func (s *Agent) CreateKey(args *KeyArgs, ret *struct{}) error {
+	if !validKey(args.Key) {
+		return ErrInvalidKey
+	}
+	if err := s.Backend.CreateKey(args.Key, args.Value); err != nil {
+		if err != ErrKeyExists {
+			log.Println("CreateKey: error:", err)
+		}
+		return err
+	}
+	log.Println("CreateKey:", args.Key)
+	return nil
+}
+
+// SwapKey sets a configuration key to a value if it still has the value
+// args.Prev.
+func (s *Agent) SwapKey(args *KeyArgs, ret *struct{}) error {
+	if !validKey(args.Key) {
+		return ErrInvalidKey
+	}
+	if err := s.Backend.SwapKey(args.Key, args.Prev, args.Value); err != nil {
+		if err != ErrKeyChanged && err != ErrKeyNotFound {
+			log.Println("SwapKey: error:", err)
+		}
+		return err
+	}
+	log.Println("SwapKey:", args.Key)
+	return nil
+}
+
+// DeleteKey removes a configuration key.
+func (s *Agent) DeleteKey(args *KeyArgs, ret *struct{}) error {
+	if !validKey(args.Key) {
+		return ErrInvalidKey
+	}
+	if err := s.Backend.DeleteKey(args.Key); err != nil {
+		log.Println("DeleteKey: error:", err)
+		return err
+	}
+	log.Println("DeleteKey:", args.Key)
+	return nil
+}
+
+// WatchKeys returns a stream of KeyUpdate objects for all configuration keys
+// under the given prefix. The current values are sent first, followed by an
+// empty KeyUpdate, followed by changes as they happen.
+func (s *Agent) WatchKeys(args *KeyArgs, stream rpcplus.Stream) error {
+	// errors are returned before anything is sent, so that the client
+	// receives them instead of the end of the current values
+	if args.Key != "" && !validKey(args.Key) {
+		return ErrInvalidKey
+	}
+	updates, err := s.Backend.WatchKeys(args.Key)
+	if err != nil {
+		log.Println("WatchKeys: error:", err)
+		return err
+	}
+	log.Println("WatchKeys:", args.Key)
+	for update := range updates.Chan() {
+		select {
+		case stream.Send <- update:
+		case <-stream.Error:
+			updates.Close()
+			return nil
+		}
+	}
+	return nil
+}
+
 // Unregister announces a service has gone offline.
 func (s *Agent) Unregister(args *Args, ret *struct{}) error {
 	addr := expandAddr(args.Addr)
@@ -54,7 +54,8 @@ type ServiceSet interface {
 
 	// Leader returns the current leader for a ServiceSet. It's calculated by choosing the oldest
 	// service in the set. This "lockless" approach means for any consistent set (same service, same
-	// filters) there is always an agreed upon leader.
+	// filters) there is always an agreed upon leader. Services imported from another region are
+	// never the leader, as their creation times come from a different cluster.
 	Leader() *Service
 
 	// Leaders returns a channel that will first produce the current leader service, then any following
@@ -255,12 +256,14 @@ func (s *serviceSet) matchFilters(attrs map[string]string) bool {
 }
 
 func (s *serviceSet) Leader() *Service {
-	services := s.Services()
-	if len(services) > 0 {
-		if s.self != nil && services[0].Created > s.self.Created {
+	for _, service := range s.Services() {
+		if imported(service.Attrs) {
+			continue
+		}
+		if s.self != nil && service.Created > s.self.Created {
 			return s.self
 		}
-		return services[0]
+		return service
 	}
 	if s.self != nil {
 		return s.self
@@ -268,6 +271,13 @@ func (s *serviceSet) Leader() *Service {
 	return nil
 }
 
+// imported returns whether a service with attrs was imported from a remote
+// discoverd cluster.
+func imported(attrs map[string]string) bool {
+	_, ok := attrs[agent.RegionAttr]
+	return ok
+}
+
 func (s *serviceSet) Leaders() chan *Service {
 	leaders := make(chan *Service)
 	updates := s.Watch(false)
@@ -275,7 +285,7 @@ func (s *serviceSet) Leaders() chan *Service {
 		leader := s.Leader()
 		leaders <- leader
 		for update := range updates {
-			if (!update.Online && leader != nil && update.Addr == leader.Addr) || (update.Online && leader == nil) {
+			if (!update.Online && leader != nil && update.Addr == leader.Addr) || (update.Online && leader == nil && !imported(update.Attrs)) {
 				leader = s.Leader()
 				leaders <- leader
 			}
@@ -592,6 +592,32 @@ func TestLeaderChannel(t *testing.T) {
 	assert(set.Close(), t)
 }
 
+func TestLeaderNotImported(t *testing.T) {
+	client, cleanup := testutil.SetupDiscoverd(t)
+	defer cleanup()
+
+	serviceName := "importedLeaderTest"
+
+	// a service with the region attribute looks like one imported by a
+	// federating agent
+	assert(client.RegisterWithAttributes(serviceName, ":1111", map[string]string{agent.RegionAttr: "remote"}), t)
+
+	set, err := client.NewServiceSet(serviceName)
+	assert(err, t)
+	defer set.Close()
+	if leader := set.Leader(); leader != nil {
+		t.Fatal("Expected no leader, got:", leader.Addr)
+	}
+
+	updates := set.Watch(false)
+	defer set.Unwatch(updates)
+	assert(client.Register(serviceName, ":2222"), t)
+	<-updates
+	if leader := set.Leader(); leader == nil || leader.Addr != "127.0.0.1:2222" {
+		t.Fatal("Incorrect leader", leader)
+	}
+}
+
 func TestRegisterWithSetLeaderSelf(t *testing.T) {
 	client, cleanup := testutil.SetupDiscoverd(t)
 	defer cleanup()
@@ -692,3 +718,61 @@ func TestHeartbeat(t *testing.T) {
 		t.Fatal("Missing services")
 	}
 }
+
+func TestKeys(t *testing.T) {
+	client, cleanup := testutil.SetupDiscoverd(t)
+	defer cleanup()
+
+	if _, err := client.GetKey("keysTest/foo"); err != discoverd.ErrKeyNotFound {
+		t.Fatal("Expected ErrKeyNotFound, got:", err)
+	}
+
+	assert(client.SetKey("keysTest/foo", "bar"), t)
+	value, err := client.GetKey("keysTest/foo")
+	assert(err, t)
+	if value != "bar" {
+		t.Fatal("Unexpected value:", value)
+	}
+
+	if err := client.CreateKey("keysTest/foo", "baz"); err != discoverd.ErrKeyExists {
+		t.Fatal("Expected ErrKeyExists, got:", err)
+	}
+	if err := client.SwapKey("keysTest/foo", "baz", "qux"); err != discoverd.ErrKeyChanged {
+		t.Fatal("Expected ErrKeyChanged, got:", err)
+	}
+
+	if _, err := client.WatchKeys("keysTest//foo"); err != discoverd.ErrInvalidKey {
+		t.Fatal("Expected ErrInvalidKey, got:", err)
+	}
+
+	watch, err := client.WatchKeys("keysTest")
+	assert(err, t)
+	defer watch.Close()
+	if v, _ := watch.Get("keysTest/foo"); v != "bar" {
+		t.Fatal("Unexpected watch value:", v)
+	}
+
+	assert(client.SetKey("keysTest/baz", "qux"), t)
+	assert(client.DeleteKey("keysTest/foo"), t)
+
+	expected := []*agent.KeyUpdate{
+		{Key: "keysTest/foo", Value: "bar"},
+		{Key: "keysTest/baz", Value: "qux"},
+		{Key: "keysTest/foo", Deleted: true},
+	}
+	for i, e := range expected {
+		var update *agent.KeyUpdate
+		select {
+		case update = <-watch.Chan():
+		case <-time.After(3 * time.Second):
+			t.Fatal("Timeout exceeded", i)
+		}
+		if update.Key != e.Key || update.Value != e.Value || update.Deleted != e.Deleted {
+			t.Fatal("Unexpected key update:", update, i)
+		}
+	}
+
+	if _, ok := watch.Get("keysTest/foo"); ok {
+		t.Fatal("Deleted key should not be present in watch")
+	}
+}
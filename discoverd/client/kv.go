@@ -0,0 +1,291 @@
+package discoverd
+
+import (
+	"errors"
+	"io"
+	"log"
+	"sync"
+
+	"github.com/flynn/flynn/discoverd/agent"
+	"github.com/flynn/flynn/pkg/rpcplus"
+)
+
+// ErrKeyNotFound is returned by GetKey and DeleteKey when the key does not exist.
+var ErrKeyNotFound = errors.New("discover: key not found")
+
+// ErrKeyExists is returned by CreateKey when the key already exists.
+var ErrKeyExists = errors.New("discover: key already exists")
+
+// ErrKeyChanged is returned by SwapKey when the key does not have the
+// expected value.
+var ErrKeyChanged = errors.New("discover: key changed")
+
+// ErrInvalidKey is returned when a key or the prefix of a watch is not a valid
+// path.
+var ErrInvalidKey = errors.New("discover: invalid key")
+
+func keyError(err error) error {
+	if err == nil {
+		return nil
+	}
+	switch err.Error() {
+	case agent.ErrKeyNotFound.Error():
+		return ErrKeyNotFound
+	case agent.ErrKeyExists.Error():
+		return ErrKeyExists
+	case agent.ErrKeyChanged.Error():
+		return ErrKeyChanged
+	case agent.ErrInvalidKey.Error():
+		return ErrInvalidKey
+	}
+	return err
+}
+
+// GetKey returns the current value of a configuration key.
+func (c *Client) GetKey(key string) (string, error) {
+	var ret agent.KeyUpdate
+	if err := c.call("Agent.GetKey", &agent.KeyArgs{Key: key}, &ret, false); err != nil {
+		return "", keyError(err)
+	}
+	return ret.Value, nil
+}
+
+// SetKey sets the value of a configuration key. Configuration keys are
+// persistent and are not tied to the lifetime of the client.
+func (c *Client) SetKey(key, value string) error {
+	return c.call("Agent.SetKey", &agent.KeyArgs{Key: key, Value: value}, &struct{}{}, false)
+}
+
+// CreateKey sets the value of a configuration key if it does not already
+// exist, returning ErrKeyExists otherwise. It can be used to claim a key
+// without racing other clients.
+func (c *Client) CreateKey(key, value string) error {
+	return keyError(c.call("Agent.CreateKey", &agent.KeyArgs{Key: key, Value: value}, &struct{}{}, false))
+}
+
+// SwapKey sets the value of a configuration key if it still has the value
+// prev, returning ErrKeyChanged otherwise. It can be used to take over a key
+// without racing other clients.
+func (c *Client) SwapKey(key, prev, value string) error {
+	return keyError(c.call("Agent.SwapKey", &agent.KeyArgs{Key: key, Prev: prev, Value: value}, &struct{}{}, false))
+}
+
+// DeleteKey removes a configuration key.
+func (c *Client) DeleteKey(key string) error {
+	return keyError(c.call("Agent.DeleteKey", &agent.KeyArgs{Key: key}, &struct{}{}, false))
+}
+
+// A KeyWatch is a long-running query of configuration keys under a prefix. Keys
+// are slash-separated paths, so watching "scheduler" will receive updates for
+// "scheduler/BACKOFF_PERIOD" but not "schedulerfoo".
+type KeyWatch interface {
+	// Get returns the last known value of a key in the watched prefix.
+	Get(key string) (string, bool)
+
+	// Keys returns a snapshot of all known keys and values in the watched prefix.
+	Keys() map[string]string
+
+	// Chan returns the channel that updates are sent on. The current values
+	// are sent first, and after that changes are sent as they happen. After
+	// a reconnect the current values are sent again. You must always be
+	// receiving on the channel until the KeyWatch is closed.
+	Chan() chan *agent.KeyUpdate
+
+	// Close stops the watch and closes the update channel.
+	Close() error
+}
+
+type keyWatch struct {
+	l      sync.Mutex
+	keys   map[string]string
+	ch     chan *agent.KeyUpdate
+	call   *rpcplus.Call
+	closed bool
+	c      *Client
+}
+
+// WatchKeys starts watching all configuration keys under prefix. It blocks
+// until the current values have been received.
+func (c *Client) WatchKeys(prefix string) (KeyWatch, error) {
+	if c.isReconnecting() {
+		return nil, ErrDisconnected
+	}
+	w := &keyWatch{
+		keys: make(map[string]string),
+		c:    c,
+	}
+	current := make(chan error)
+	go w.run(prefix, current)
+	if err := <-current; err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *keyWatch) run(prefix string, current chan error) {
+	// initial buffers the current state so that the caller can start
+	// receiving after WatchKeys returns
+	var initial []*agent.KeyUpdate
+	isCurrent := false
+	// seen is set after reconnecting so that keys deleted whilst we were
+	// disconnected can be detected once the current state is received
+	var seen map[string]struct{}
+	for {
+		updates := make(chan *agent.KeyUpdate)
+		client, call := w.c.streamGo("Agent.WatchKeys", &agent.KeyArgs{Key: prefix}, updates)
+		w.l.Lock()
+		w.call = call
+		w.l.Unlock()
+		for update := range updates {
+			if update.Key == "" {
+				if !isCurrent {
+					isCurrent = true
+					w.ch = make(chan *agent.KeyUpdate, len(initial))
+					for _, u := range initial {
+						w.ch <- u
+					}
+					initial = nil
+					close(current)
+				} else if seen != nil {
+					w.l.Lock()
+					var deleted []*agent.KeyUpdate
+					for key := range w.keys {
+						if _, ok := seen[key]; !ok {
+							delete(w.keys, key)
+							deleted = append(deleted, &agent.KeyUpdate{Key: key, Deleted: true})
+						}
+					}
+					w.l.Unlock()
+					for _, u := range deleted {
+						w.ch <- u
+					}
+					seen = nil
+				}
+				continue
+			}
+			if seen != nil {
+				seen[update.Key] = struct{}{}
+			}
+			w.l.Lock()
+			if update.Deleted {
+				delete(w.keys, update.Key)
+			} else {
+				w.keys[update.Key] = update.Value
+			}
+			w.l.Unlock()
+			if isCurrent {
+				w.ch <- update
+			} else {
+				initial = append(initial, update)
+			}
+		}
+		if !isCurrent {
+			err := keyError(call.Error)
+			if err == nil || err == rpcplus.ErrShutdown || err == io.ErrUnexpectedEOF {
+				err = ErrDisconnected
+				go w.c.reconnect(client)
+			}
+			current <- err
+			return
+		}
+		if (call.Error == rpcplus.ErrShutdown || call.Error == io.ErrUnexpectedEOF) && !w.isClosed() {
+			err := w.c.reconnect(client)
+			if err == nil {
+				seen = make(map[string]struct{})
+				continue
+			}
+			log.Printf("discover: failed to reconnect: %s", err)
+		}
+		break
+	}
+	close(w.ch)
+}
+
+func (w *keyWatch) Get(key string) (string, bool) {
+	w.l.Lock()
+	defer w.l.Unlock()
+	v, ok := w.keys[key]
+	return v, ok
+}
+
+func (w *keyWatch) Keys() map[string]string {
+	w.l.Lock()
+	defer w.l.Unlock()
+	keys := make(map[string]string, len(w.keys))
+	for k, v := range w.keys {
+		keys[k] = v
+	}
+	return keys
+}
+
+func (w *keyWatch) Chan() chan *agent.KeyUpdate {
+	return w.ch
+}
+
+func (w *keyWatch) isClosed() bool {
+	w.l.Lock()
+	defer w.l.Unlock()
+	return w.closed
+}
+
+func (w *keyWatch) Close() error {
+	w.l.Lock()
+	w.closed = true
+	call := w.call
+	w.l.Unlock()
+	go func() {
+		// drain channel to prevent deadlock
+		for range w.ch {
+		}
+	}()
+	return call.CloseStream()
+}
+
+// GetKey returns the current value of a configuration key.
+func GetKey(key string) (string, error) {
+	if err := ensureDefaultConnected(); err != nil {
+		return "", err
+	}
+	return DefaultClient.GetKey(key)
+}
+
+// SetKey sets the value of a configuration key.
+func SetKey(key, value string) error {
+	if err := ensureDefaultConnected(); err != nil {
+		return err
+	}
+	return DefaultClient.SetKey(key, value)
+}
+
+// CreateKey sets the value of a configuration key if it does not already exist.
+func CreateKey(key, value string) error {
+	if err := ensureDefaultConnected(); err != nil {
+		return err
+	}
+	return DefaultClient.CreateKey(key, value)
+}
+
+// SwapKey sets the value of a configuration key if it still has the value
+// prev.
+func SwapKey(key, prev, value string) error {
+	if err := ensureDefaultConnected(); err != nil {
+		return err
+	}
+	return DefaultClient.SwapKey(key, prev, value)
+}
+
+// DeleteKey removes a configuration key.
+func DeleteKey(key string) error {
+	if err := ensureDefaultConnected(); err != nil {
+		return err
+	}
+	return DefaultClient.DeleteKey(key)
+}
+
+// WatchKeys starts watching all configuration keys under prefix.
+func WatchKeys(prefix string) (KeyWatch, error) {
+	if err := ensureDefaultConnected(); err != nil {
+		return nil, err
+	}
+	return DefaultClient.WatchKeys(prefix)
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"log"
 	"strings"
 
@@ -11,9 +12,43 @@ import (
 var addr = flag.String("bind", ":1111", "address to bind on")
 var etcd = flag.String("etcd", "http://127.0.0.1:4001", "etcd servers")
 
+// remotesFlag parses repeated -federate flags of the form
+// region=host:port/service1,service2
+type remotesFlag []*agent.Remote
+
+func (r *remotesFlag) String() string {
+	s := make([]string, len(*r))
+	for i, remote := range *r {
+		s[i] = fmt.Sprintf("%s=%s/%s", remote.Region, remote.Addr, strings.Join(remote.Services, ","))
+	}
+	return strings.Join(s, " ")
+}
+
+func (r *remotesFlag) Set(value string) error {
+	eq := strings.Index(value, "=")
+	slash := strings.LastIndex(value, "/")
+	if eq < 1 || slash < eq+2 || slash == len(value)-1 {
+		return fmt.Errorf("invalid remote %q, expected region=host:port/service1,service2", value)
+	}
+	*r = append(*r, &agent.Remote{
+		Region:   value[:eq],
+		Addr:     value[eq+1 : slash],
+		Services: strings.Split(value[slash+1:], ","),
+	})
+	return nil
+}
+
 func main() {
+	var remotes remotesFlag
+	flag.Var(&remotes, "federate", "import services from a remote discoverd (region=host:port/service1,service2), may be repeated")
 	flag.Parse()
 	server := agent.NewServer(*addr, strings.Split(*etcd, ","))
+	if len(remotes) > 0 {
+		server.Backend = agent.NewFederatedBackend(server.Backend, remotes)
+		for _, r := range remotes {
+			log.Printf("Importing %s from %s (%s)\n", strings.Join(r.Services, ", "), r.Region, r.Addr)
+		}
+	}
 	log.Printf("Starting server on %s...\n", server.Address)
 	log.Fatal(agent.ListenAndServe(server))
 }
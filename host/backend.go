@@ -3,8 +3,12 @@ package main
 import (
 	"encoding/json"
 	"io"
+	"time"
 
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/technoweenie/grohl"
+	"github.com/flynn/flynn/host/logbuf"
 	"github.com/flynn/flynn/host/types"
+	"github.com/flynn/flynn/pinkerton"
 )
 
 type AttachRequest struct {
@@ -27,6 +31,10 @@ type Backend interface {
 	Signal(string, int) error
 	ResizeTTY(id string, height, width uint16) error
 	Attach(*AttachRequest) error
+	Stats(id string) (*host.JobStats, error)
+	OpenLog(id string) *logbuf.Log
+	Pull(uri string, progress chan<- pinkerton.LayerPullInfo) error
+	SetNetwork(*Network)
 	Cleanup() error
 	RestoreState(map[string]*host.ActiveJob, *json.Decoder) error
 }
@@ -34,3 +42,32 @@ type Backend interface {
 type StateSaver interface {
 	SaveState(*json.Encoder) error
 }
+
+// recordOOMKills records the OOM kills sent to ch by oom.Watch in the state of
+// a job until the job's cgroup is removed.
+func recordOOMKills(state *State, jobID string, ch <-chan uint64) {
+	for n := range ch {
+		grohl.Log(grohl.Data{"fn": "recordOOMKills", "job.id": jobID, "count": n})
+		state.AddOOMKills(jobID, int(n))
+	}
+}
+
+const (
+	imageGCInterval = time.Hour
+	imageGCMinAge   = time.Hour // grace period for images pulled but not yet started
+)
+
+// collectImages periodically deletes the image layers which are not used by a
+// job while the layer store is larger than maxSize.
+func collectImages(ctx *pinkerton.Context, maxSize int64) {
+	g := grohl.NewContext(grohl.Data{"fn": "collectImages", "max_size": maxSize})
+	for range time.Tick(imageGCInterval) {
+		removed, err := ctx.GC(maxSize, imageGCMinAge)
+		if err != nil {
+			g.Log(grohl.Data{"status": "error", "err": err})
+		}
+		for _, id := range removed {
+			g.Log(grohl.Data{"at": "removed", "image.id": id})
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package cli
+
+import (
+	"fmt"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-docopt"
+	"github.com/flynn/flynn/pkg/cluster"
+)
+
+func init() {
+	Register("drain", runDrain, `
+usage: flynn-host drain [--undo] HOSTID
+
+Take a host out of service. No new jobs are placed on a draining host and the
+scheduler moves its formation jobs to other hosts, so it can then be stopped.
+Jobs with volumes are not moved, as their data is local to the host. The
+draining state is kept when the cluster leader changes.
+
+Options:
+  --undo  put the host back in service`)
+}
+
+func runDrain(args *docopt.Args, client *cluster.Client) error {
+	hostID := args.String["HOSTID"]
+	undo := args.Bool["--undo"]
+	if err := client.SetDraining(hostID, !undo); err != nil {
+		return fmt.Errorf("could not set draining state of host %s: %s", hostID, err)
+	}
+	if undo {
+		fmt.Println(hostID, "back in service")
+	} else {
+		fmt.Println(hostID, "draining")
+	}
+	return nil
+}
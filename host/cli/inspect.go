@@ -6,6 +6,7 @@ import (
 	"os"
 	"strings"
 	"text/tabwriter"
+	"time"
 
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-docopt"
 	"github.com/flynn/flynn/host/types"
@@ -14,9 +15,13 @@ import (
 
 func init() {
 	Register("inspect", runInspect, `
-usage: flynn-host inspect ID
+usage: flynn-host inspect [--events] ID
 
-Get low-level information about a job.`)
+Get low-level information about a job.
+
+Options:
+  --events  show the lifecycle event history of the job, which is kept after
+            the job is removed from the host`)
 }
 
 func runInspect(args *docopt.Args, client *cluster.Client) error {
@@ -32,11 +37,43 @@ func runInspect(args *docopt.Args, client *cluster.Client) error {
 	if err != nil {
 		return fmt.Errorf("no such job")
 	}
+	if !args.Bool["--events"] {
+		if job.Job == nil {
+			return fmt.Errorf("no such job")
+		}
+		printJobDesc(job, os.Stdout)
+		return nil
+	}
 
-	printJobDesc(job, os.Stdout)
+	events, err := hostClient.JobEvents(jobID)
+	if err != nil {
+		return fmt.Errorf("no such job")
+	}
+	// the job may have been removed from the host, leaving only its events
+	if job.Job != nil {
+		printJobDesc(job, os.Stdout)
+		fmt.Println()
+	}
+	printJobEvents(events, os.Stdout)
 	return nil
 }
 
+func printJobEvents(events []*host.JobEvent, out io.Writer) {
+	w := tabwriter.NewWriter(out, 1, 2, 2, ' ', 0)
+	defer w.Flush()
+	listRec(w, "TIME", "EVENT", "DETAIL")
+	for _, e := range events {
+		var detail string
+		switch e.Event {
+		case host.JobEventStop:
+			detail = fmt.Sprintf("exit status %d", e.ExitStatus)
+		case host.JobEventError:
+			detail = e.Error
+		}
+		listRec(w, e.Time.Format(time.RFC3339), e.Event, detail)
+	}
+}
+
 func printJobDesc(job *host.ActiveJob, out io.Writer) {
 	w := tabwriter.NewWriter(out, 1, 2, 2, ' ', 0)
 	defer w.Flush()
@@ -47,6 +84,7 @@ func printJobDesc(job *host.ActiveJob, out io.Writer) {
 	listRec(w, "StartedAt", job.StartedAt)
 	listRec(w, "EndedAt", job.EndedAt)
 	listRec(w, "ExitStatus", job.ExitStatus)
+	listRec(w, "OOMKills", job.OOMKills)
 	listRec(w, "IP Address", job.InternalIP)
 	for k, v := range job.Job.Metadata {
 		listRec(w, k, v)
@@ -0,0 +1,902 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/docker/docker/daemon/networkdriver/ipallocator"
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/docker/docker/pkg/term"
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/natefinch/lumberjack"
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/technoweenie/grohl"
+	"github.com/flynn/flynn/host/containerinit"
+	"github.com/flynn/flynn/host/logbuf"
+	"github.com/flynn/flynn/host/logdrain"
+	"github.com/flynn/flynn/host/ports"
+	"github.com/flynn/flynn/host/types"
+	"github.com/flynn/flynn/host/volume"
+	"github.com/flynn/flynn/pinkerton"
+	"github.com/flynn/flynn/pkg/iptables"
+)
+
+const bridgeName = "flynnbr0"
+
+// bridgeAddr and bridgeNet are the bootstrap network of the bridge, see
+// bootstrapNetwork.
+var bridgeAddr, bridgeNet, _ = net.ParseCIDR("192.168.200.1/24")
+
+// containerBackend is the part of the libvirt-lxc and namespaces backends
+// which doesn't depend on how containers are created. It prepares the root
+// filesystem of jobs, allocates their ports and controls them through
+// containerinit.
+type containerBackend struct {
+	LogPath   string
+	InitPath  string
+	name      string
+	state     *State
+	volumes   *volume.Manager
+	shipper   *logdrain.Shipper
+	ports     map[string]*ports.Allocator
+	forwarder *ports.Forwarder
+	pinkerton *pinkerton.Context
+
+	logsMtx sync.Mutex
+	logs    map[string]*logbuf.Log
+
+	containersMtx sync.RWMutex
+	containers    map[string]backendContainer
+
+	networkState
+}
+
+// backendContainer is implemented by the containers of each backend.
+type backendContainer interface {
+	base() *jobContainer
+
+	// watchOOM returns a channel of the number of OOM kills in the container.
+	watchOOM() (<-chan uint64, error)
+
+	// cleanup releases the resources of the container after it has stopped.
+	cleanup() error
+}
+
+// jobContainer is the state of a container which is common to the backends,
+// the exported fields are saved with the state of the host.
+type jobContainer struct {
+	RootPath string
+	IP       net.IP
+	job      *host.Job
+	b        *containerBackend
+	done     chan struct{}
+	// secrets is where the secrets of the job are fetched from, it is
+	// dropped once they are
+	secrets *host.Secrets
+	*containerinit.Client
+}
+
+func newContainerBackend(name string, state *State, portAlloc map[string]*ports.Allocator, volumes *volume.Manager, shipper *logdrain.Shipper, logPath, initPath string, imageGCSize int64) (*containerBackend, error) {
+	pinkertonCtx, err := pinkerton.BuildContext("aufs", "/var/lib/docker")
+	if err != nil {
+		return nil, err
+	}
+	if imageGCSize > 0 {
+		go collectImages(pinkertonCtx, imageGCSize)
+	}
+
+	if err := writeResolvConf("/etc/flynn/resolv.conf"); err != nil {
+		return nil, fmt.Errorf("Could not create resolv.conf: %s", err)
+	}
+	return &containerBackend{
+		LogPath:    logPath,
+		InitPath:   initPath,
+		name:       name,
+		state:      state,
+		volumes:    volumes,
+		shipper:    shipper,
+		ports:      portAlloc,
+		pinkerton:  pinkertonCtx,
+		logs:       make(map[string]*logbuf.Log),
+		containers: make(map[string]backendContainer),
+	}, nil
+}
+
+// forwardBridge forwards the ports of jobs to the bridge once it is up.
+func (b *containerBackend) forwardBridge() error {
+	iptables.RemoveExistingChain("FLYNN", bridgeName)
+	chain, err := iptables.NewChain("FLYNN", bridgeName)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile("/proc/sys/net/ipv4/conf/"+bridgeName+"/route_localnet", []byte("1"), 0666); err != nil {
+		return err
+	}
+	b.forwarder = ports.NewForwarder(net.ParseIP("0.0.0.0"), chain)
+	return nil
+}
+
+// newContainer returns a container for job. The token of the job's secrets is
+// moved from the job to the container, so that it is neither persisted in the
+// host state nor returned by the host API.
+func (b *containerBackend) newContainer(job *host.Job) jobContainer {
+	c := jobContainer{job: job, b: b, done: make(chan struct{})}
+	if s := job.Config.Secrets; s != nil {
+		c.secrets = &host.Secrets{URL: s.URL, Token: s.Token}
+		job.Config.Secrets = &host.Secrets{URL: s.URL}
+	}
+	return c
+}
+
+// prepare allocates an IP in network for the container, and sets up the root
+// filesystem, volumes, ports and environment of its job. It returns the config
+// of the job's image.
+func (b *containerBackend) prepare(c *jobContainer, network *Network, g *grohl.Context) (*dockerImageConfig, error) {
+	job := c.job
+	var err error
+	if !job.Config.HostNetwork {
+		c.IP, err = ipallocator.RequestIP(network.Subnet, nil)
+		if err != nil {
+			g.Log(grohl.Data{"at": "request_ip", "status": "error", "err": err})
+			return nil, err
+		}
+	}
+
+	g.Log(grohl.Data{"at": "pull_image"})
+	layers, err := b.pinkertonPull(job.Artifact.URI)
+	if err != nil {
+		g.Log(grohl.Data{"at": "pull_image", "status": "error", "err": err})
+		return nil, err
+	}
+	b.state.AddJobEvent(&host.JobEvent{JobID: job.ID, Event: host.JobEventPull})
+	imageID, err := pinkerton.ImageID(job.Artifact.URI)
+	if err == pinkerton.ErrNoImageID && len(layers) > 0 {
+		imageID = layers[len(layers)-1].ID
+	} else if err != nil {
+		g.Log(grohl.Data{"at": "image_id", "status": "error", "err": err})
+		return nil, err
+	}
+
+	g.Log(grohl.Data{"at": "read_config"})
+	imageConfig, err := readDockerImageConfig(imageID)
+	if err != nil {
+		g.Log(grohl.Data{"at": "read_config", "status": "error", "err": err})
+		return nil, err
+	}
+
+	g.Log(grohl.Data{"at": "checkout"})
+	rootPath, err := b.pinkerton.Checkout(job.ID, imageID)
+	if err != nil {
+		g.Log(grohl.Data{"at": "checkout", "status": "error", "err": err})
+		return nil, err
+	}
+	c.RootPath = rootPath
+
+	g.Log(grohl.Data{"at": "mount"})
+	if err := bindMount(b.InitPath, filepath.Join(rootPath, ".containerinit"), false, true); err != nil {
+		g.Log(grohl.Data{"at": "mount", "file": ".containerinit", "status": "error", "err": err})
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Join(rootPath, "etc"), 0755); err != nil {
+		g.Log(grohl.Data{"at": "mkdir", "dir": "etc", "status": "error", "err": err})
+		return nil, err
+	}
+	if err := bindMount("/etc/flynn/resolv.conf", filepath.Join(rootPath, "etc/resolv.conf"), false, true); err != nil {
+		g.Log(grohl.Data{"at": "mount", "file": "resolv.conf", "status": "error", "err": err})
+		return nil, err
+	}
+	if err := writeHostname(filepath.Join(rootPath, "etc/hosts"), job.ID); err != nil {
+		g.Log(grohl.Data{"at": "write_hosts", "status": "error", "err": err})
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Join(rootPath, ".container-shared"), 0700); err != nil {
+		g.Log(grohl.Data{"at": "mkdir", "dir": ".container-shared", "status": "error", "err": err})
+		return nil, err
+	}
+	for i, m := range job.Config.Mounts {
+		if err := os.MkdirAll(filepath.Join(rootPath, m.Location), 0755); err != nil {
+			g.Log(grohl.Data{"at": "mkdir_mount", "dir": m.Location, "status": "error", "err": err})
+			return nil, err
+		}
+		if m.Target == "" {
+			if err := attachVolume(b.volumes, &job.Config.Mounts[i], job.ID); err != nil {
+				g.Log(grohl.Data{"at": "attach_volume", "volume.id": m.VolumeID, "status": "error", "err": err})
+				return nil, err
+			}
+			m = job.Config.Mounts[i]
+		}
+		if err := bindMount(m.Target, filepath.Join(rootPath, m.Location), m.Writeable, true); err != nil {
+			g.Log(grohl.Data{"at": "mount", "target": m.Target, "location": m.Location, "status": "error", "err": err})
+			return nil, err
+		}
+	}
+
+	if job.Config.Env == nil {
+		job.Config.Env = make(map[string]string)
+	}
+	if !job.Config.HostNetwork {
+		if err := allocatePorts(b.ports, job); err != nil {
+			g.Log(grohl.Data{"at": "alloc_port", "status": "error", "err": err})
+			return nil, err
+		}
+	}
+
+	g.Log(grohl.Data{"at": "fetch_secrets"})
+	secrets, err := fetchSecrets(c.secrets)
+	if err != nil {
+		g.Log(grohl.Data{"at": "fetch_secrets", "status": "error", "err": err})
+		return nil, err
+	}
+	c.secrets = nil
+
+	g.Log(grohl.Data{"at": "write_env"})
+	err = writeContainerEnv(filepath.Join(rootPath, ".containerenv"),
+		map[string]string{
+			"PATH": "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin",
+			"TERM": "xterm",
+			"HOME": "/",
+		},
+		job.Config.Env,
+		secrets,
+		map[string]string{
+			"HOSTNAME": job.ID,
+		},
+	)
+	if err != nil {
+		g.Log(grohl.Data{"at": "write_env", "status": "error", "err": err})
+		return nil, err
+	}
+	return imageConfig, nil
+}
+
+// allocatePorts allocates the ports of a job from alloc, and sets the PORT and
+// PORT_<n> environment variables to the allocated ports.
+func allocatePorts(alloc map[string]*ports.Allocator, job *host.Job) error {
+	for i, p := range job.Config.Ports {
+		if p.Proto != "tcp" && p.Proto != "udp" {
+			return fmt.Errorf("unknown port proto %q", p.Proto)
+		}
+
+		if 0 < p.RangeEnd && p.RangeEnd < p.Port {
+			return fmt.Errorf("port range end %d cannot be less than port %d", p.RangeEnd, p.Port)
+		}
+
+		var port uint16
+		var err error
+		if p.Port <= 0 {
+			job.Config.Ports[i].RangeEnd = 0
+			port, err = alloc[p.Proto].Get()
+		} else if p.RangeEnd > p.Port {
+			for j := p.RangeEnd; j >= p.Port; j-- {
+				port, err = alloc[p.Proto].GetPort(uint16(j))
+				if err != nil {
+					break
+				}
+			}
+		} else {
+			port, err = alloc[p.Proto].GetPort(uint16(p.Port))
+		}
+		if err != nil {
+			return err
+		}
+		job.Config.Ports[i].Port = int(port)
+		if job.Config.Ports[i].RangeEnd == 0 {
+			job.Config.Ports[i].RangeEnd = int(port)
+		}
+
+		if i == 0 {
+			job.Config.Env["PORT"] = strconv.Itoa(int(port))
+		}
+		job.Config.Env[fmt.Sprintf("PORT_%d", i)] = strconv.Itoa(int(port))
+	}
+	return nil
+}
+
+// containerArgs returns the containerinit arguments which run a job, after
+// those which configure the network.
+func containerArgs(job *host.Job, imageConfig *dockerImageConfig) []string {
+	var args []string
+	if job.Config.TTY {
+		args = append(args, "-tty")
+	}
+	if job.Config.Stdin {
+		args = append(args, "-stdin")
+	}
+	if job.Config.WorkingDir != "" {
+		args = append(args, "-w", job.Config.WorkingDir)
+	} else if imageConfig.WorkingDir != "" {
+		args = append(args, "-w", imageConfig.WorkingDir)
+	}
+	if job.Config.Uid > 0 {
+		args = append(args, "-u", strconv.Itoa(job.Config.Uid))
+	} else if imageConfig.User != "" {
+		// TODO: check and lookup user from image config
+	}
+	if job.Resources.MaxOpenFiles > 0 {
+		args = append(args, "-nofile", strconv.Itoa(job.Resources.MaxOpenFiles))
+	}
+	if len(job.Config.Entrypoint) > 0 {
+		args = append(args, job.Config.Entrypoint...)
+		args = append(args, job.Config.Cmd...)
+	} else {
+		args = append(args, imageConfig.Entrypoint...)
+		if len(job.Config.Cmd) > 0 {
+			args = append(args, job.Config.Cmd...)
+		} else {
+			args = append(args, imageConfig.Cmd...)
+		}
+	}
+	return args
+}
+
+// forwardPorts forwards the ports of the container's job to its IP.
+func (b *containerBackend) forwardPorts(c *jobContainer, g *grohl.Context) error {
+	for _, p := range c.job.Config.Ports {
+		if err := b.forwarder.Add(&net.TCPAddr{IP: c.IP, Port: p.Port}, p.RangeEnd, p.Proto); err != nil {
+			g.Log(grohl.Data{"at": "forward_port", "port": p.Port, "status": "error", "err": err})
+			return err
+		}
+	}
+	return nil
+}
+
+// release unmounts the filesystems of a stopped container, and releases its
+// volumes, ports and IP.
+func (b *containerBackend) release(c *jobContainer, g *grohl.Context) {
+	if err := syscall.Unmount(filepath.Join(c.RootPath, ".containerinit"), 0); err != nil {
+		g.Log(grohl.Data{"at": "unmount", "file": ".containerinit", "status": "error", "err": err})
+	}
+	if err := syscall.Unmount(filepath.Join(c.RootPath, "etc/resolv.conf"), 0); err != nil {
+		g.Log(grohl.Data{"at": "unmount", "file": "resolv.conf", "status": "error", "err": err})
+	}
+	if err := b.pinkerton.Cleanup(c.job.ID); err != nil {
+		g.Log(grohl.Data{"at": "pinkerton", "status": "error", "err": err})
+	}
+	for _, m := range c.job.Config.Mounts {
+		if err := syscall.Unmount(filepath.Join(c.RootPath, m.Location), 0); err != nil {
+			g.Log(grohl.Data{"at": "unmount", "location": m.Location, "status": "error", "err": err})
+		}
+	}
+	detachVolumes(b.volumes, c.job)
+	if !c.job.Config.HostNetwork && c.IP != nil {
+		for _, p := range c.job.Config.Ports {
+			if err := b.forwarder.Remove(&net.TCPAddr{IP: c.IP, Port: p.Port}, p.RangeEnd, p.Proto); err != nil {
+				g.Log(grohl.Data{"at": "iptables", "status": "error", "err": err, "port": p.Port})
+			}
+			if p.RangeEnd == 0 {
+				p.RangeEnd = p.Port
+			}
+			for i := p.Port; i <= p.RangeEnd; i++ {
+				b.ports[p.Proto].Put(uint16(i))
+			}
+		}
+		ipallocator.ReleaseIP(subnetFor(c.IP), c.IP)
+	}
+}
+
+func (b *containerBackend) OpenLog(id string) *logbuf.Log {
+	b.logsMtx.Lock()
+	defer b.logsMtx.Unlock()
+	if _, ok := b.logs[id]; !ok {
+		// TODO: configure retention and log size
+		b.logs[id] = logbuf.NewLog(&lumberjack.Logger{Filename: filepath.Join(b.LogPath, id, id+".log")})
+	}
+	// TODO: do reference counting and remove logs that are not in use from memory
+	return b.logs[id]
+}
+
+// watch connects to containerinit in the container and follows the state of
+// its job until it exits. The result of connecting is sent to ready if it is
+// not nil.
+func (b *containerBackend) watch(container backendContainer, ready chan<- error) error {
+	c := container.base()
+	g := grohl.NewContext(grohl.Data{"backend": b.name, "fn": "watch_container", "job.id": c.job.ID})
+	g.Log(grohl.Data{"at": "start"})
+
+	defer func() {
+		// TODO: kill containerinit/domain if it is still running
+		b.containersMtx.Lock()
+		delete(b.containers, c.job.ID)
+		b.containersMtx.Unlock()
+		container.cleanup()
+		close(c.done)
+	}()
+
+	var symlinked bool
+	var err error
+	symlink := "/tmp/containerinit-rpc." + c.job.ID
+	socketPath := path.Join(c.RootPath, containerinit.SocketPath)
+	for startTime := time.Now(); time.Since(startTime) < 5*time.Second; time.Sleep(time.Millisecond) {
+		if !symlinked {
+			// We can't connect to the socket file directly because
+			// the path to it is longer than 108 characters (UNIX_PATH_MAX).
+			// Create a temporary symlink to connect to.
+			if err = os.Symlink(socketPath, symlink); err != nil && !os.IsExist(err) {
+				g.Log(grohl.Data{"at": "symlink_socket", "status": "error", "err": err, "source": socketPath, "target": symlink})
+				continue
+			}
+			defer os.Remove(symlink)
+			symlinked = true
+		}
+
+		c.Client, err = containerinit.NewClient(symlink)
+		if err == nil {
+			break
+		}
+	}
+	if ready != nil {
+		ready <- err
+	}
+	if err != nil {
+		g.Log(grohl.Data{"at": "connect", "status": "error", "err": err})
+		return err
+	}
+	defer c.Client.Close()
+
+	b.containersMtx.Lock()
+	b.containers[c.job.ID] = container
+	b.containersMtx.Unlock()
+
+	if !c.job.Config.TTY {
+		g.Log(grohl.Data{"at": "get_stdout"})
+		stdout, stderr, err := c.Client.GetStdout()
+		if err != nil {
+			g.Log(grohl.Data{"at": "get_stdout", "status": "error", "err": err.Error()})
+			return err
+		}
+		log := b.OpenLog(c.job.ID)
+		defer log.Close()
+		if sink := b.shipper.Sink(c.job); sink != nil {
+			log.AddSink(sink)
+		}
+		// TODO: log errors from these
+		go log.Follow(1, stdout)
+		go log.Follow(2, stderr)
+	}
+
+	g.Log(grohl.Data{"at": "watch_oom"})
+	if ch, err := container.watchOOM(); err != nil {
+		g.Log(grohl.Data{"at": "watch_oom", "status": "error", "err": err})
+	} else {
+		go recordOOMKills(b.state, c.job.ID, ch)
+	}
+
+	g.Log(grohl.Data{"at": "watch_changes"})
+	for change := range c.Client.StreamState() {
+		g.Log(grohl.Data{"at": "change", "state": change.State.String()})
+		if change.Error != "" {
+			err := errors.New(change.Error)
+			g.Log(grohl.Data{"at": "change", "status": "error", "err": err})
+			b.state.SetStatusFailed(c.job.ID, err)
+			return err
+		}
+		switch change.State {
+		case containerinit.StateInitial:
+			g.Log(grohl.Data{"at": "wait_attach"})
+			b.state.WaitAttach(c.job.ID)
+			g.Log(grohl.Data{"at": "resume"})
+			c.Client.Resume()
+		case containerinit.StateRunning:
+			g.Log(grohl.Data{"at": "running"})
+			b.state.SetStatusRunning(c.job.ID)
+
+			// if the job was stopped before it started, exit
+			if b.state.GetJob(c.job.ID).ForceStop {
+				c.Stop()
+			}
+		case containerinit.StateExited:
+			g.Log(grohl.Data{"at": "exited", "status": change.ExitStatus})
+			c.Client.Resume()
+			b.state.SetStatusDone(c.job.ID, change.ExitStatus)
+			return nil
+		case containerinit.StateFailed:
+			g.Log(grohl.Data{"at": "failed"})
+			c.Client.Resume()
+			b.state.SetStatusFailed(c.job.ID, errors.New("container failed to start"))
+			return nil
+		}
+	}
+	g.Log(grohl.Data{"at": "unknown_failure"})
+	b.state.SetStatusFailed(c.job.ID, errors.New("unknown failure"))
+
+	return nil
+}
+
+func (c *jobContainer) WaitStop(timeout time.Duration) error {
+	job := c.b.state.GetJob(c.job.ID)
+	if job.Status == host.StatusDone || job.Status == host.StatusFailed {
+		return nil
+	}
+	select {
+	case <-c.done:
+		return nil
+	case <-time.After(timeout):
+		return fmt.Errorf("Timed out: %v", timeout)
+	}
+}
+
+func (c *jobContainer) Stop() error {
+	if err := c.Signal(int(syscall.SIGTERM)); err != nil {
+		return err
+	}
+	if err := c.WaitStop(10 * time.Second); err != nil {
+		return c.Signal(int(syscall.SIGKILL))
+	}
+	return nil
+}
+
+func (b *containerBackend) Stop(id string) error {
+	c, err := b.getContainer(id)
+	if err != nil {
+		return err
+	}
+	return c.Stop()
+}
+
+func (b *containerBackend) getContainer(id string) (*jobContainer, error) {
+	b.containersMtx.RLock()
+	defer b.containersMtx.RUnlock()
+	c := b.containers[id]
+	if c == nil {
+		return nil, fmt.Errorf("%s: unknown container", b.name)
+	}
+	return c.base(), nil
+}
+
+func (b *containerBackend) ResizeTTY(id string, height, width uint16) error {
+	container, err := b.getContainer(id)
+	if err != nil {
+		return err
+	}
+	if !container.job.Config.TTY {
+		return errors.New("job doesn't have a TTY")
+	}
+	pty, err := container.GetPtyMaster()
+	if err != nil {
+		return err
+	}
+	return term.SetWinsize(pty.Fd(), &term.Winsize{Height: height, Width: width})
+}
+
+func (b *containerBackend) Signal(id string, sig int) error {
+	container, err := b.getContainer(id)
+	if err != nil {
+		return err
+	}
+	return container.Signal(sig)
+}
+
+func (b *containerBackend) Attach(req *AttachRequest) (err error) {
+	var client *jobContainer
+	if req.Stdin != nil || req.Job.Job.Config.TTY {
+		client, err = b.getContainer(req.Job.Job.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	defer func() {
+		if client != nil && (req.Job.Job.Config.TTY || req.Stream) && err == io.EOF {
+			<-client.done
+			job := b.state.GetJob(req.Job.Job.ID)
+			if job.Status == host.StatusDone || job.Status == host.StatusCrashed {
+				err = ExitError(job.ExitStatus)
+				return
+			}
+			err = errors.New(*job.Error)
+		}
+	}()
+
+	if req.Job.Job.Config.TTY {
+		pty, err := client.GetPtyMaster()
+		if err != nil {
+			return err
+		}
+		if err := term.SetWinsize(pty.Fd(), &term.Winsize{Height: req.Height, Width: req.Width}); err != nil {
+			return err
+		}
+		if req.Attached != nil {
+			req.Attached <- struct{}{}
+		}
+		if req.Stdin != nil && req.Stdout != nil {
+			go io.Copy(pty, req.Stdin)
+		} else if req.Stdin != nil {
+			io.Copy(pty, req.Stdin)
+		}
+		if req.Stdout != nil {
+			io.Copy(req.Stdout, pty)
+		}
+		pty.Close()
+		return io.EOF
+	}
+	if req.Stdin != nil {
+		stdinPipe, err := client.GetStdin()
+		if err != nil {
+			return err
+		}
+		go func() {
+			io.Copy(stdinPipe, req.Stdin)
+			stdinPipe.Close()
+		}()
+	}
+
+	if req.Attached != nil {
+		req.Attached <- struct{}{}
+	}
+
+	lines := -1
+	if !req.Logs {
+		lines = 0
+	}
+
+	log := b.OpenLog(req.Job.Job.ID)
+	ch := make(chan logbuf.Data)
+	done := make(chan struct{})
+	go log.Read(lines, req.Stream, ch, done)
+	defer close(done)
+
+	for data := range ch {
+		var w io.Writer
+		switch data.Stream {
+		case 1:
+			w = req.Stdout
+		case 2:
+			w = req.Stderr
+		}
+		if w == nil {
+			continue
+		}
+		if _, err := w.Write([]byte(data.Message)); err != nil {
+			return nil
+		}
+	}
+
+	return io.EOF
+}
+
+func (b *containerBackend) Cleanup() error {
+	g := grohl.NewContext(grohl.Data{"backend": b.name, "fn": "Cleanup"})
+	b.containersMtx.Lock()
+	ids := make([]string, 0, len(b.containers))
+	for id := range b.containers {
+		ids = append(ids, id)
+	}
+	b.containersMtx.Unlock()
+	g.Log(grohl.Data{"at": "start", "count": len(ids)})
+	errs := make(chan error)
+	for _, id := range ids {
+		go func(id string) {
+			g.Log(grohl.Data{"at": "stop", "job.id": id})
+			err := b.Stop(id)
+			if err != nil {
+				g.Log(grohl.Data{"at": "error", "job.id": id, "err": err})
+			}
+			errs <- err
+		}(id)
+	}
+	var err error
+	for i := 0; i < len(ids); i++ {
+		stopErr := <-errs
+		if stopErr != nil {
+			err = stopErr
+		}
+	}
+	g.Log(grohl.Data{"at": "finish"})
+	return err
+}
+
+// restore watches a container which was running before the host restarted,
+// and reserves its volumes and ports.
+func (b *containerBackend) restore(container backendContainer, job *host.Job) {
+	// checkouts made before images were garbage collected have no ref, so
+	// one is added for the image of the job. If it isn't known the ref keeps
+	// GC from removing any image until the job stops.
+	if !b.pinkerton.HasRef(job.ID) {
+		imageID, _ := pinkerton.ImageID(job.Artifact.URI)
+		if err := b.pinkerton.AddRef(job.ID, imageID); err != nil {
+			grohl.Log(grohl.Data{"fn": "restore", "at": "add_ref", "job.id": job.ID, "image.id": imageID, "status": "error", "err": err})
+		}
+	}
+
+	c := container.base()
+	c.b = b
+	c.job = job
+	c.done = make(chan struct{})
+	status := make(chan error)
+	go b.watch(container, status)
+	if err := <-status; err != nil {
+		// log error
+		b.state.RemoveJob(job.ID)
+		container.cleanup()
+		return
+	}
+	reattachVolumes(b.volumes, job)
+
+	for _, p := range job.Config.Ports {
+		for i := p.Port; i <= p.RangeEnd; i++ {
+			b.ports[p.Proto].GetPort(uint16(i))
+		}
+	}
+}
+
+func (b *containerBackend) SaveState(e *json.Encoder) error {
+	b.containersMtx.RLock()
+	defer b.containersMtx.RUnlock()
+	return e.Encode(b.containers)
+}
+
+// Pull downloads an image so that jobs using it start without waiting for it.
+// progress is closed when Pull returns.
+func (b *containerBackend) Pull(uri string, progress chan<- pinkerton.LayerPullInfo) error {
+	return b.pinkerton.Pull(uri, progress)
+}
+
+func (b *containerBackend) pinkertonPull(url string) ([]pinkerton.LayerPullInfo, error) {
+	var layers []pinkerton.LayerPullInfo
+	info := make(chan pinkerton.LayerPullInfo)
+	go func() {
+		for l := range info {
+			layers = append(layers, l)
+		}
+	}()
+	if err := b.pinkerton.Pull(url, info); err != nil {
+		return nil, err
+	}
+	return layers, nil
+}
+
+const dockerBase = "/var/lib/docker"
+
+type dockerImageConfig struct {
+	User       string
+	Env        []string
+	Cmd        []string
+	Entrypoint []string
+	WorkingDir string
+	Volumes    map[string]struct{}
+}
+
+// writeResolvConf copies /etc/resolv.conf to the given path, removing any IPV6
+// nameservers in the process (as IPV6 routing is currently not supported).
+func writeResolvConf(path string) error {
+	// do nothing if the file exists
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	file, err := os.Open("/etc/resolv.conf")
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	var buf bytes.Buffer
+	s := bufio.NewScanner(file)
+	for s.Scan() {
+		line := strings.Split(s.Text(), " ")
+		if len(line) > 0 && line[0] == "nameserver" && isIPv6(line[1]) {
+			continue
+		}
+		buf.Write(s.Bytes())
+		buf.WriteByte('\n')
+	}
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	return nil
+}
+
+func isIPv6(s string) bool {
+	ip := net.ParseIP(s)
+	return ip != nil && ip.To4() == nil
+}
+
+func writeContainerEnv(path string, envs ...map[string]string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var length int
+	for _, e := range envs {
+		length += len(e)
+	}
+	data := make([]string, 0, length)
+
+	for _, e := range envs {
+		for k, v := range e {
+			data = append(data, k+"="+v)
+		}
+	}
+
+	return json.NewEncoder(f).Encode(data)
+}
+
+func writeHostname(path, hostname string) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	pos, err := f.Seek(0, os.SEEK_END)
+	if err != nil {
+		return err
+	}
+	if pos > 0 {
+		if _, err := f.Write([]byte("\n")); err != nil {
+			return err
+		}
+	}
+	_, err = fmt.Fprintf(f, "127.0.0.1 %s\n", hostname)
+	return err
+}
+
+func readDockerImageConfig(id string) (*dockerImageConfig, error) {
+	res := &struct{ Config dockerImageConfig }{}
+	f, err := os.Open(filepath.Join(dockerBase, "graph", id, "json"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if err := json.NewDecoder(f).Decode(res); err != nil {
+		return nil, err
+	}
+	return &res.Config, nil
+}
+
+func enableHairpinMode(iface string) error {
+	return ioutil.WriteFile("/sys/class/net/"+iface+"/brport/hairpin_mode", []byte("1"), 0666)
+}
+
+func bindMount(src, dest string, writeable, private bool) error {
+	srcStat, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(dest); os.IsNotExist(err) {
+		if srcStat.IsDir() {
+			if err := os.MkdirAll(dest, 0755); err != nil {
+				return err
+			}
+		} else {
+			if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+				return err
+			}
+			f, err := os.OpenFile(dest, os.O_CREATE, 0755)
+			if err != nil {
+				return err
+			}
+			f.Close()
+		}
+	} else if err != nil {
+		return err
+	}
+
+	flags := syscall.MS_BIND | syscall.MS_REC
+	if !writeable {
+		flags |= syscall.MS_RDONLY
+	}
+
+	if err := syscall.Mount(src, dest, "bind", uintptr(flags), ""); err != nil {
+		return err
+	}
+	if private {
+		if err := syscall.Mount("", dest, "none", uintptr(syscall.MS_PRIVATE), ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
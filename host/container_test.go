@@ -0,0 +1,102 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/flynn/flynn/host/ports"
+	"github.com/flynn/flynn/host/types"
+)
+
+func TestAllocatePorts(t *testing.T) {
+	alloc := map[string]*ports.Allocator{
+		"tcp": ports.NewAllocator(55000, 55010),
+		"udp": ports.NewAllocator(55000, 55010),
+	}
+	job := &host.Job{Config: host.ContainerConfig{
+		Env: map[string]string{},
+		Ports: []host.Port{
+			{Proto: "tcp"},
+			{Proto: "udp", Port: 53},
+			{Proto: "tcp", Port: 8000, RangeEnd: 8002},
+		},
+	}}
+	if err := allocatePorts(alloc, job); err != nil {
+		t.Fatal(err)
+	}
+	expected := []host.Port{
+		{Proto: "tcp", Port: 55000, RangeEnd: 55000},
+		{Proto: "udp", Port: 53, RangeEnd: 53},
+		{Proto: "tcp", Port: 8000, RangeEnd: 8002},
+	}
+	if !reflect.DeepEqual(job.Config.Ports, expected) {
+		t.Errorf("expected ports %v, got %v", expected, job.Config.Ports)
+	}
+	for k, v := range map[string]string{"PORT": "55000", "PORT_0": "55000", "PORT_1": "53", "PORT_2": "8000"} {
+		if job.Config.Env[k] != v {
+			t.Errorf("expected %s to be %s, got %q", k, v, job.Config.Env[k])
+		}
+	}
+	for _, port := range []uint16{8000, 8001, 8002} {
+		if _, err := alloc["tcp"].GetPort(port); err == nil {
+			t.Errorf("expected port %d to be allocated", port)
+		}
+	}
+
+	// a fixed port which is already in use fails
+	job = &host.Job{Config: host.ContainerConfig{
+		Env:   map[string]string{},
+		Ports: []host.Port{{Proto: "udp", Port: 53}},
+	}}
+	if _, ok := allocatePorts(alloc, job).(ports.InUseError); !ok {
+		t.Error("expected an InUseError for a port which is in use")
+	}
+
+	for _, port := range []host.Port{
+		{Proto: "sctp", Port: 80},
+		{Proto: "tcp", Port: 80, RangeEnd: 79},
+	} {
+		job = &host.Job{Config: host.ContainerConfig{
+			Env:   map[string]string{},
+			Ports: []host.Port{port},
+		}}
+		if err := allocatePorts(alloc, job); err == nil {
+			t.Errorf("expected an error for port %v", port)
+		}
+	}
+}
+
+func TestContainerArgs(t *testing.T) {
+	imageConfig := &dockerImageConfig{
+		Entrypoint: []string{"/bin/entry"},
+		Cmd:        []string{"image-cmd"},
+		WorkingDir: "/app",
+	}
+	for _, test := range []struct {
+		config    host.ContainerConfig
+		resources host.JobResources
+		expected  []string
+	}{
+		{
+			expected: []string{"-w", "/app", "/bin/entry", "image-cmd"},
+		},
+		{
+			config:   host.ContainerConfig{Cmd: []string{"job-cmd"}},
+			expected: []string{"-w", "/app", "/bin/entry", "job-cmd"},
+		},
+		{
+			config:   host.ContainerConfig{Entrypoint: []string{"/bin/sh"}, Cmd: []string{"-c", "true"}},
+			expected: []string{"-w", "/app", "/bin/sh", "-c", "true"},
+		},
+		{
+			config:    host.ContainerConfig{TTY: true, Stdin: true, WorkingDir: "/tmp", Uid: 1000},
+			resources: host.JobResources{MaxOpenFiles: 1024},
+			expected:  []string{"-tty", "-stdin", "-w", "/tmp", "-u", "1000", "-nofile", "1024", "/bin/entry", "image-cmd"},
+		},
+	} {
+		job := &host.Job{Config: test.config, Resources: test.resources}
+		if args := containerArgs(job, imageConfig); !reflect.DeepEqual(args, test.expected) {
+			t.Errorf("expected args %v, got %v", test.expected, args)
+		}
+	}
+}
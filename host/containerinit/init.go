@@ -44,6 +44,9 @@ type ContainerInitArgs struct {
 	gateway    string
 	workDir    string
 	ip         string
+	veth       string
+	mounts     bool
+	nofile     uint64
 	privileged bool
 	tty        bool
 	openStdin  bool
@@ -328,6 +331,16 @@ func setupNetworking(args *ContainerInitArgs) error {
 	if err := netlink.NetworkLinkUp(iface); err != nil {
 		return fmt.Errorf("Unable to set up networking: %v", err)
 	}
+	if args.veth != "" {
+		// the backend created the interface with a unique name in the
+		// host namespace, so rename it now that it is in the container
+		if iface, err = net.InterfaceByName(args.veth); err != nil {
+			return fmt.Errorf("Unable to set up networking: %v", err)
+		}
+		if err := netlink.NetworkChangeName(iface, "eth0"); err != nil {
+			return fmt.Errorf("Unable to set up networking: %v", err)
+		}
+	}
 	if iface, err = net.InterfaceByName("eth0"); err != nil {
 		return fmt.Errorf("Unable to set up networking: %v", err)
 	}
@@ -350,6 +363,72 @@ func setupNetworking(args *ContainerInitArgs) error {
 	return nil
 }
 
+type mount struct {
+	source string
+	target string
+	fstype string
+	flags  uintptr
+	data   string
+}
+
+var defaultMounts = []mount{
+	{"proc", "/proc", "proc", syscall.MS_NOSUID | syscall.MS_NOEXEC | syscall.MS_NODEV, ""},
+	{"sysfs", "/sys", "sysfs", syscall.MS_NOSUID | syscall.MS_NOEXEC | syscall.MS_NODEV | syscall.MS_RDONLY, ""},
+	{"tmpfs", "/dev", "tmpfs", syscall.MS_NOSUID | syscall.MS_STRICTATIME, "mode=755"},
+	{"devpts", "/dev/pts", "devpts", syscall.MS_NOSUID | syscall.MS_NOEXEC, "newinstance,ptmxmode=0666,mode=0620"},
+	{"shm", "/dev/shm", "tmpfs", syscall.MS_NOSUID | syscall.MS_NOEXEC | syscall.MS_NODEV, "mode=1777"},
+}
+
+var defaultDevices = []struct {
+	path  string
+	major uint32
+	minor uint32
+}{
+	{"/dev/null", 1, 3},
+	{"/dev/zero", 1, 5},
+	{"/dev/full", 1, 7},
+	{"/dev/random", 1, 8},
+	{"/dev/urandom", 1, 9},
+	{"/dev/tty", 5, 0},
+}
+
+// setupMounts mounts the pseudo-filesystems and creates the device nodes that
+// a container expects. It is used when the backend does not do this itself
+// (i.e. when running directly in Linux namespaces rather than with libvirt).
+func setupMounts() error {
+	// don't propagate any mounts back to the host
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		log.Printf("Unable to make mounts private: %v", err)
+	}
+	for _, m := range defaultMounts {
+		if err := os.MkdirAll(m.target, 0755); err != nil {
+			return fmt.Errorf("Unable to create %s: %v", m.target, err)
+		}
+		if err := syscall.Mount(m.source, m.target, m.fstype, m.flags, m.data); err != nil {
+			return fmt.Errorf("Unable to mount %s: %v", m.target, err)
+		}
+	}
+	for _, d := range defaultDevices {
+		dev := int((d.major << 8) | (d.minor & 0xff) | ((d.minor & 0xfff00) << 12))
+		if err := syscall.Mknod(d.path, syscall.S_IFCHR|0666, dev); err != nil {
+			return fmt.Errorf("Unable to create %s: %v", d.path, err)
+		}
+		// mknod is subject to the umask
+		if err := os.Chmod(d.path, 0666); err != nil {
+			return err
+		}
+	}
+	if err := os.Symlink("pts/ptmx", "/dev/ptmx"); err != nil {
+		return fmt.Errorf("Unable to create /dev/ptmx: %v", err)
+	}
+	for i, name := range []string{"stdin", "stdout", "stderr"} {
+		if err := os.Symlink(fmt.Sprintf("/proc/self/fd/%d", i), "/dev/"+name); err != nil {
+			return fmt.Errorf("Unable to create /dev/%s: %v", name, err)
+		}
+	}
+	return nil
+}
+
 func getCredential(args *ContainerInitArgs) (*syscall.Credential, error) {
 	if args.user == "" {
 		return nil, nil
@@ -376,6 +455,22 @@ func setupCommon(args *ContainerInitArgs) error {
 		return err
 	}
 
+	if err := setupRlimits(args); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// setupRlimits sets the resource limits inherited by the app.
+func setupRlimits(args *ContainerInitArgs) error {
+	if args.nofile == 0 {
+		return nil
+	}
+	limit := &syscall.Rlimit{Cur: args.nofile, Max: args.nofile}
+	if err := syscall.Setrlimit(syscall.RLIMIT_NOFILE, limit); err != nil {
+		return fmt.Errorf("Unable to set open file limit: %v", err)
+	}
 	return nil
 }
 
@@ -440,6 +535,12 @@ func babySit(process *os.Process) int {
 
 // Run as pid 1 and monitor the contained process to return its exit code.
 func containerInitApp(args *ContainerInitArgs) error {
+	if args.mounts {
+		if err := setupMounts(); err != nil {
+			return err
+		}
+	}
+
 	init := newContainerInit(args)
 	if err := rpcplus.Register(init); err != nil {
 		return err
@@ -546,6 +647,9 @@ func Main() {
 	gateway := flag.String("g", "", "gateway address")
 	workDir := flag.String("w", "", "workdir")
 	ip := flag.String("i", "", "ip address")
+	veth := flag.String("veth", "", "network interface to rename to eth0")
+	mounts := flag.Bool("mounts", false, "mount /proc, /sys and /dev")
+	nofile := flag.Uint64("nofile", 0, "open file limit")
 	privileged := flag.Bool("privileged", false, "privileged mode")
 	tty := flag.Bool("tty", false, "use pseudo-tty")
 	openStdin := flag.Bool("stdin", false, "open stdin")
@@ -569,6 +673,9 @@ func Main() {
 		gateway:    *gateway,
 		workDir:    *workDir,
 		ip:         *ip,
+		veth:       *veth,
+		mounts:     *mounts,
+		nofile:     *nofile,
 		privileged: *privileged,
 		tty:        *tty,
 		openStdin:  *openStdin,
@@ -4,17 +4,21 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"os"
 	"strings"
 	"time"
 
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/docker/docker/pkg/units"
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-docopt"
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/technoweenie/grohl"
 	"github.com/flynn/flynn/discoverd/client"
 	"github.com/flynn/flynn/host/cli"
+	"github.com/flynn/flynn/host/logdrain"
 	"github.com/flynn/flynn/host/ports"
 	"github.com/flynn/flynn/host/sampi"
 	"github.com/flynn/flynn/host/types"
+	"github.com/flynn/flynn/host/volume"
 	"github.com/flynn/flynn/pkg/attempt"
 	"github.com/flynn/flynn/pkg/cluster"
 	rpc "github.com/flynn/flynn/pkg/rpcplus/comborpc"
@@ -42,10 +46,12 @@ options:
   --id=ID                host id
   --force                kill all containers booted by flynn-host before starting
   --volpath=PATH         directory to create volumes in [default: /var/lib/flynn-host]
-  --backend=BACKEND      runner backend [default: libvirt-lxc]
+  --backend=BACKEND      runner backend (libvirt-lxc or namespaces) [default: libvirt-lxc]
   --meta=<KEY=VAL>...    key=value pair to add as metadata
   --bind=IP              bind containers to IP
+  --overlay=CIDR         overlay network to allocate each host a routable /24 subnet from, e.g. 10.200.0.0/16
   --flynn-init=PATH      path to flynn-init binary [default: /usr/bin/flynn-init]
+  --image-gc-size=SIZE   delete unused images while they take up more than SIZE, 0 to disable [default: 10g]
 	`)
 }
 
@@ -59,6 +65,7 @@ Commands:
   help                       Show usage for a specific command
   daemon                     Start the daemon
   download                   Download container images
+  drain                      Take a host out of service
   bootstrap                  Bootstrap layer 1
   inspect                    Get low-level information about a job
   log                        Get the logs of a job
@@ -100,7 +107,12 @@ func runDaemon(args *docopt.Args) {
 	volPath := args.String["--volpath"]
 	backendName := args.String["--backend"]
 	flynnInit := args.String["--flynn-init"]
+	overlayCIDR := args.String["--overlay"]
 	metadata := args.All["--meta"].([]string)
+	imageGCSize, err := units.RAMInBytes(args.String["--image-gc-size"])
+	if err != nil {
+		log.Fatalf("invalid --image-gc-size: %s", err)
+	}
 
 	grohl.AddContext("app", "host")
 	grohl.Log(grohl.Data{"at": "start"})
@@ -112,6 +124,12 @@ func runDaemon(args *docopt.Args) {
 	if strings.Contains(hostID, "-") {
 		log.Fatal("host id must not contain dashes")
 	}
+	var overlayNet *net.IPNet
+	if overlayCIDR != "" {
+		if _, overlayNet, err = net.ParseCIDR(overlayCIDR); err != nil {
+			log.Fatalf("invalid overlay network %q: %s", overlayCIDR, err)
+		}
+	}
 
 	portAlloc := map[string]*ports.Allocator{
 		"tcp": ports.NewAllocator(55000, 65535),
@@ -120,12 +138,18 @@ func runDaemon(args *docopt.Args) {
 
 	sh := shutdown.NewHandler()
 	state := NewState(hostID)
+	volumes, err := volume.NewManager(volPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	shipper := logdrain.NewShipper()
 	var backend Backend
-	var err error
 
 	switch backendName {
 	case "libvirt-lxc":
-		backend, err = NewLibvirtLXCBackend(state, portAlloc, volPath, "/tmp/flynn-host-logs", flynnInit)
+		backend, err = NewLibvirtLXCBackend(state, portAlloc, volumes, shipper, "/tmp/flynn-host-logs", flynnInit, imageGCSize)
+	case "namespaces":
+		backend, err = NewNamespacesBackend(state, portAlloc, volumes, shipper, "/tmp/flynn-host-logs", flynnInit, imageGCSize)
 	default:
 		log.Fatalf("unknown backend %q", backendName)
 	}
@@ -133,7 +157,7 @@ func runDaemon(args *docopt.Args) {
 		sh.Fatal(err)
 	}
 
-	if err := serveHTTP(&Host{state: state, backend: backend}, &attachHandler{state: state, backend: backend}, sh); err != nil {
+	if err := serveHTTP(&Host{state: state, backend: backend}, &Volume{volumes: volumes}, &attachHandler{state: state, backend: backend}, sh); err != nil {
 		sh.Fatal(err)
 	}
 
@@ -190,7 +214,6 @@ func runDaemon(args *docopt.Args) {
 
 		if d, ok := services["discoverd"]; ok {
 			discAddr = fmt.Sprintf("%s:%d", d.ExternalIP, d.TCPPorts[0])
-			var disc *discoverd.Client
 			err = Attempts.Run(func() (err error) {
 				disc, err = discoverd.NewClientWithAddr(discAddr)
 				return
@@ -213,13 +236,27 @@ func runDaemon(args *docopt.Args) {
 		}
 	}
 	sh.BeforeExit(func() { disc.UnregisterAll() })
+
+	if overlayNet != nil {
+		network, err := joinOverlay(disc, hostID, externalAddr, overlayNet)
+		if err != nil {
+			sh.Fatal(err)
+		}
+		g.Log(grohl.Data{"at": "overlay_joined", "subnet": network.Subnet.String()})
+		backend.SetNetwork(network)
+	}
+	if err := watchLogDrains(disc, shipper); err != nil {
+		sh.Fatal(err)
+	}
+	sh.BeforeExit(shipper.Close)
+
 	sampiStandby, err := disc.RegisterAndStandby("flynn-host", externalAddr+":1113", map[string]string{"id": hostID})
 	if err != nil {
 		sh.Fatal(err)
 	}
 
 	// Check if we are the leader so that we can use the cluster functions directly
-	sampiCluster := sampi.NewCluster(sampi.NewState())
+	sampiCluster := sampi.NewCluster(sampi.NewState(), disc)
 	select {
 	case <-sampiStandby:
 		g.Log(grohl.Data{"at": "sampi_leader"})
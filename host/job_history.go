@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/technoweenie/grohl"
+	"github.com/flynn/flynn/host/types"
+)
+
+const (
+	maxJobEvents   = 50   // events kept per job
+	maxHistoryJobs = 1000 // jobs which events are kept for
+)
+
+// jobHistory is a bounded history of the lifecycle events of jobs which is
+// kept after the jobs are removed from the state.
+type jobHistory struct {
+	mtx    sync.Mutex
+	events map[string][]*host.JobEvent // job ID -> events, oldest first
+	order  []string                    // job IDs in the order they were first seen
+
+	saveMtx sync.Mutex
+	file    string
+}
+
+func newJobHistory() *jobHistory {
+	return &jobHistory{events: make(map[string][]*host.JobEvent)}
+}
+
+// historyFile returns the path of the history file kept next to a state file.
+func historyFile(stateFile string) string {
+	return strings.TrimSuffix(stateFile, filepath.Ext(stateFile)) + "-events.json"
+}
+
+// load reads the history from file, and persists it there from now on.
+func (h *jobHistory) load(file string) error {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	h.file = file
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	var events []*host.JobEvent
+	if err := json.NewDecoder(f).Decode(&events); err != nil {
+		return err
+	}
+	for _, e := range events {
+		h.add(e)
+	}
+	return nil
+}
+
+func (h *jobHistory) Add(e *host.JobEvent) {
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	h.mtx.Lock()
+	h.add(e)
+	h.mtx.Unlock()
+	go h.save()
+}
+
+func (h *jobHistory) add(e *host.JobEvent) {
+	events, ok := h.events[e.JobID]
+	if !ok {
+		h.order = append(h.order, e.JobID)
+		if len(h.order) > maxHistoryJobs {
+			delete(h.events, h.order[0])
+			h.order = h.order[1:]
+		}
+	}
+	if len(events) >= maxJobEvents {
+		events = events[1:]
+	}
+	h.events[e.JobID] = append(events, e)
+}
+
+// Get returns the events of a job, oldest first.
+func (h *jobHistory) Get(jobID string) []*host.JobEvent {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	events, ok := h.events[jobID]
+	if !ok {
+		return nil
+	}
+	res := make([]*host.JobEvent, len(events))
+	copy(res, events)
+	return res
+}
+
+func (h *jobHistory) save() {
+	h.saveMtx.Lock()
+	defer h.saveMtx.Unlock()
+
+	h.mtx.Lock()
+	if h.file == "" {
+		h.mtx.Unlock()
+		return
+	}
+	file := h.file
+	var events []*host.JobEvent
+	for _, id := range h.order {
+		events = append(events, h.events[id]...)
+	}
+	h.mtx.Unlock()
+
+	if err := writeJSONFile(file, events); err != nil {
+		grohl.Log(grohl.Data{"fn": "save_job_history", "status": "error", "err": err})
+	}
+}
+
+func writeJSONFile(path string, v interface{}) error {
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(f).Encode(v); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
@@ -13,8 +13,9 @@ type Domain struct {
 	OS    OS     `xml:"os"`
 	IDMap *IDMap `xml:"idmap,omitempty"`
 
-	Memory UnitInt `xml:"memory"`
-	VCPU   int     `xml:"vcpu"`
+	Memory  UnitInt  `xml:"memory"`
+	VCPU    int      `xml:"vcpu"`
+	CPUTune *CPUTune `xml:"cputune,omitempty"`
 
 	OnPoweroff string `xml:"on_poweroff,omitempty"`
 	OnReboot   string `xml:"on_reboot,omitempty"`
@@ -51,6 +52,12 @@ type IDMapping struct {
 	Count  int `xml:"count,attr"`
 }
 
+type CPUTune struct {
+	Shares int `xml:"shares,omitempty"`
+	Period int `xml:"period,omitempty"`
+	Quota  int `xml:"quota,omitempty"`
+}
+
 type UnitInt struct {
 	Value int    `xml:",chardata"`
 	Unit  string `xml:"unit,attr,omitempty"`
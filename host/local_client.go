@@ -40,6 +40,10 @@ func (s localStream) Err() error {
 	return s.err
 }
 
+func (c *localClient) SetDraining(hostID string, draining bool) error {
+	return c.c.SetDraining(&host.SetDrainingReq{HostID: hostID, Draining: draining}, nil)
+}
+
 func (c *localClient) RegisterHost(h *host.Host, jobs chan *host.Job) cluster.Stream {
 	ch := make(chan interface{})
 	err := make(chan error)
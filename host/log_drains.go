@@ -0,0 +1,38 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/technoweenie/grohl"
+	"github.com/flynn/flynn/discoverd/client"
+	"github.com/flynn/flynn/host/logdrain"
+	"github.com/flynn/flynn/host/types"
+)
+
+// watchLogDrains keeps the drains of shipper in sync with the log drains the
+// controller publishes in discoverd.
+func watchLogDrains(disc *discoverd.Client, shipper *logdrain.Shipper) error {
+	watch, err := disc.WatchKeys(host.LogDrainsKey)
+	if err != nil {
+		return err
+	}
+	g := grohl.NewContext(grohl.Data{"fn": "watchLogDrains"})
+	go func() {
+		for u := range watch.Chan() {
+			appID := strings.TrimPrefix(u.Key, host.LogDrainsKey+"/")
+			if u.Deleted {
+				shipper.SetDrains(appID, nil)
+				continue
+			}
+			var urls []string
+			if err := json.Unmarshal([]byte(u.Value), &urls); err != nil {
+				g.Log(grohl.Data{"at": "decode", "app.id": appID, "status": "error", "err": err})
+				continue
+			}
+			g.Log(grohl.Data{"at": "set_drains", "app.id": appID, "count": len(urls)})
+			shipper.SetDrains(appID, urls)
+		}
+	}()
+	return nil
+}
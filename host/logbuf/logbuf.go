@@ -1,6 +1,7 @@
 package logbuf
 
 import (
+	"bufio"
 	"encoding/json"
 	"errors"
 	"io"
@@ -10,6 +11,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/ActiveState/tail"
@@ -61,6 +63,17 @@ type Log struct {
 	l      *lumberjack.Logger
 	buf    map[int]*Data
 	closed bool
+
+	sinksMtx sync.RWMutex
+	sinks    []func(Data)
+}
+
+// AddSink registers f to receive a copy of every log event written after it
+// is added. f is called synchronously from Write, so it must not block.
+func (l *Log) AddSink(f func(Data)) {
+	l.sinksMtx.Lock()
+	l.sinks = append(l.sinks, f)
+	l.sinksMtx.Unlock()
 }
 
 // Watch stream for new log events and transmit them.
@@ -86,15 +99,33 @@ func (l *Log) Follow(stream int, r io.Reader) error {
 
 // Write a log event to the logfile.
 func (l *Log) Write(data Data) error {
+	l.sinksMtx.RLock()
+	for _, f := range l.sinks {
+		f(data)
+	}
+	l.sinksMtx.RUnlock()
 	return json.NewEncoder(l.l).Encode(data)
 }
 
-// Read old log lines from a logfile.
+// Read old log lines from a logfile. lines is the number of old lines to
+// send before following, -1 sends all of them. Reading stops when done is
+// closed, ch is closed once reading stops.
 func (l *Log) Read(lines int, follow bool, ch chan Data, done chan struct{}) error {
 	name := l.l.Filename
 
+	// send returns false if the reader has gone away
+	send := func(data Data) bool {
+		select {
+		case ch <- data:
+			return true
+		case <-done:
+			close(ch)
+			return false
+		}
+	}
+
 	var seek int64
-	if lines == 0 {
+	if lines >= 0 {
 		f, err := os.Open(name)
 		defer f.Close()
 		if err != nil {
@@ -103,22 +134,25 @@ func (l *Log) Read(lines int, follow bool, ch chan Data, done chan struct{}) err
 		if seek, err = f.Seek(0, os.SEEK_END); err != nil {
 			return err
 		}
+	}
+	if lines > 0 {
+		history, err := l.lastLines(lines, seek)
+		if err != nil {
+			return err
+		}
+		for _, data := range history {
+			if !send(data) {
+				return nil
+			}
+		}
 	} else if lines == -1 {
 		// return all lines
-		dir := filepath.Dir(name)
-		files, err := ioutil.ReadDir(dir)
+		files, err := l.rotatedFiles()
 		if err != nil {
 			return err
 		}
-		basename := filepath.Base(name)
-		ext := filepath.Ext(basename)
-		id := strings.TrimSuffix(basename, ext)
 		for _, f := range files {
-			if !(strings.HasPrefix(f.Name(), id+"-") && strings.HasSuffix(f.Name(), ext)) {
-				continue
-			}
-
-			t, err := tail.TailFile(filepath.Join(dir, f.Name()), tail.Config{
+			t, err := tail.TailFile(f, tail.Config{
 				Logger: tail.DiscardingLogger,
 			})
 			if err != nil {
@@ -127,9 +161,13 @@ func (l *Log) Read(lines int, follow bool, ch chan Data, done chan struct{}) err
 			for line := range t.Lines {
 				data := Data{}
 				if err := json.Unmarshal([]byte(line.Text), &data); err != nil {
+					stopTail(t)
 					return err
 				}
-				ch <- data
+				if !send(data) {
+					stopTail(t)
+					return nil
+				}
 			}
 		}
 	}
@@ -155,9 +193,13 @@ outer:
 			}
 			data := Data{}
 			if err := json.Unmarshal([]byte(line.Text), &data); err != nil {
+				stopTail(t)
 				return err
 			}
-			ch <- data
+			if !send(data) {
+				stopTail(t)
+				return nil
+			}
 		case <-done:
 			break outer
 		case <-time.After(200 * time.Millisecond):
@@ -167,10 +209,95 @@ outer:
 			break outer
 		}
 	}
+	stopTail(t)
 	close(ch) // send a close event so we know everything was read
 	return nil
 }
 
+// stopTail stops t, draining a line it may be blocked sending.
+func stopTail(t *tail.Tail) {
+	go func() {
+		for range t.Lines {
+		}
+	}()
+	t.Stop()
+}
+
+// rotatedFiles returns the paths of the rotated log files, oldest first.
+func (l *Log) rotatedFiles() ([]string, error) {
+	name := l.l.Filename
+	dir := filepath.Dir(name)
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	basename := filepath.Base(name)
+	ext := filepath.Ext(basename)
+	id := strings.TrimSuffix(basename, ext)
+	var paths []string
+	for _, f := range files {
+		if strings.HasPrefix(f.Name(), id+"-") && strings.HasSuffix(f.Name(), ext) {
+			paths = append(paths, filepath.Join(dir, f.Name()))
+		}
+	}
+	return paths, nil
+}
+
+// lastLines returns the last n lines of the log, reading the current logfile
+// up to offset end.
+func (l *Log) lastLines(n int, end int64) ([]Data, error) {
+	ring := make([]Data, 0, n)
+	var next int
+	read := func(r io.Reader) error {
+		br := bufio.NewReader(r)
+		for {
+			line, err := br.ReadBytes('\n')
+			if len(line) > 0 {
+				var data Data
+				if err := json.Unmarshal(line, &data); err != nil {
+					return err
+				}
+				if len(ring) < n {
+					ring = append(ring, data)
+				} else {
+					ring[next] = data
+					next = (next + 1) % n
+				}
+			}
+			if err == io.EOF {
+				return nil
+			} else if err != nil {
+				return err
+			}
+		}
+	}
+
+	paths, err := l.rotatedFiles()
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		err = read(f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	f, err := os.Open(l.l.Filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if err := read(io.LimitReader(f, end)); err != nil {
+		return nil, err
+	}
+	return append(ring[next:], ring[:next]...), nil
+}
+
 func (l *Log) Close() error {
 	l.closed = true
 	return l.l.Close()
@@ -108,3 +108,58 @@ func (s *S) TestStreaming(c *C) {
 	l.Close()
 	<-ch
 }
+
+func (s *S) TestReadLastLines(c *C) {
+	l := NewLog(&lumberjack.Logger{})
+	defer l.Close()
+	write := func(from, to int) {
+		for i := from; i < to; i++ {
+			c.Assert(l.Write(Data{Stream: 1, Timestamp: UnixTime{time.Now()}, Message: strconv.Itoa(i)}), IsNil)
+		}
+	}
+	write(0, 5)
+	l.l.Rotate()
+	write(5, 7)
+
+	read := func(lines int) []string {
+		ch := make(chan Data)
+		go func() {
+			if err := l.Read(lines, false, ch, nil); err != nil {
+				c.Error(err)
+			}
+		}()
+		var msgs []string
+		for data := range ch {
+			msgs = append(msgs, data.Message)
+		}
+		return msgs
+	}
+	c.Assert(read(3), DeepEquals, []string{"4", "5", "6"})
+	c.Assert(read(10), DeepEquals, []string{"0", "1", "2", "3", "4", "5", "6"})
+	c.Assert(read(0), IsNil)
+}
+
+func (s *S) TestReadDone(c *C) {
+	l := NewLog(&lumberjack.Logger{})
+	defer l.Close()
+	for i := 0; i < 5; i++ {
+		c.Assert(l.Write(Data{Stream: 1, Timestamp: UnixTime{time.Now()}, Message: strconv.Itoa(i)}), IsNil)
+	}
+
+	for _, follow := range []bool{false, true} {
+		ch := make(chan Data)
+		done := make(chan struct{})
+		errc := make(chan error)
+		go func() { errc <- l.Read(-1, follow, ch, done) }()
+		<-ch
+
+		// the reader going away stops the read while it is sending
+		close(done)
+		select {
+		case err := <-errc:
+			c.Assert(err, IsNil)
+		case <-time.After(time.Second):
+			c.Fatalf("timed out waiting for Read to return (follow=%t)", follow)
+		}
+	}
+}
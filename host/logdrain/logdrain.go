@@ -0,0 +1,358 @@
+// Package logdrain ships the output of jobs to the external log drains of
+// their apps.
+//
+// Each drain has a bounded buffer of messages which is written to the drain by
+// a single goroutine. If a drain is slow or unavailable the buffer fills up and
+// further messages are dropped rather than blocking the job, the number of
+// dropped messages is reported to the drain once it catches up.
+package logdrain
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/technoweenie/grohl"
+	"github.com/flynn/flynn/host/logbuf"
+	"github.com/flynn/flynn/host/types"
+)
+
+const (
+	bufferSize    = 1000 // messages buffered per drain before dropping
+	maxBatch      = 500  // messages sent to a drain in a single write
+	writeTimeout  = 10 * time.Second
+	minRetryDelay = time.Second
+	maxRetryDelay = 30 * time.Second
+)
+
+// Message is a line of output from a job.
+type Message struct {
+	AppID       string    `json:"app_id"`
+	AppName     string    `json:"app_name,omitempty"`
+	ProcessType string    `json:"process_type,omitempty"`
+	JobID       string    `json:"job_id"`
+	Stream      int       `json:"stream"` // 1 is stdout, 2 is stderr
+	Timestamp   time.Time `json:"timestamp"`
+	Message     string    `json:"message"`
+}
+
+// ValidURL returns an error if the drain URL is not supported. Drains are
+// syslog over TCP (syslog://host:port), syslog over TLS
+// (syslog+tls://host:port), or HTTP endpoints which receive batches of
+// messages as a POSTed JSON array (http:// or https://).
+func ValidURL(rawurl string) error {
+	_, err := newWriter(rawurl)
+	return err
+}
+
+type Shipper struct {
+	mtx    sync.RWMutex
+	drains map[string]map[string]*drain // app ID -> drain URL -> drain
+}
+
+func NewShipper() *Shipper {
+	return &Shipper{drains: make(map[string]map[string]*drain)}
+}
+
+// SetDrains sets the drain URLs of an app, starting new drains and stopping
+// drains which are no longer configured.
+func (s *Shipper) SetDrains(appID string, urls []string) {
+	g := grohl.NewContext(grohl.Data{"fn": "SetDrains", "app.id": appID})
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	existing := s.drains[appID]
+	drains := make(map[string]*drain, len(urls))
+	for _, u := range urls {
+		if d, ok := existing[u]; ok {
+			drains[u] = d
+			delete(existing, u)
+			continue
+		}
+		d, err := newDrain(u)
+		if err != nil {
+			g.Log(grohl.Data{"at": "new_drain", "status": "error", "err": err})
+			continue
+		}
+		go d.run()
+		drains[u] = d
+	}
+	for _, d := range existing {
+		d.close()
+	}
+	if len(drains) == 0 {
+		delete(s.drains, appID)
+	} else {
+		s.drains[appID] = drains
+	}
+}
+
+// Sink returns a function which ships the output of job to the drains of its
+// app, or nil if the job does not belong to an app.
+func (s *Shipper) Sink(job *host.Job) func(logbuf.Data) {
+	appID := job.Metadata["flynn-controller.app"]
+	if appID == "" {
+		return nil
+	}
+	appName := job.Metadata["flynn-controller.app_name"]
+	typ := job.Metadata["flynn-controller.type"]
+	return func(data logbuf.Data) {
+		s.mtx.RLock()
+		defer s.mtx.RUnlock()
+		drains := s.drains[appID]
+		if len(drains) == 0 {
+			return
+		}
+		for _, line := range strings.Split(strings.TrimSuffix(data.Message, "\n"), "\n") {
+			msg := &Message{
+				AppID:       appID,
+				AppName:     appName,
+				ProcessType: typ,
+				JobID:       job.ID,
+				Stream:      data.Stream,
+				Timestamp:   data.Timestamp.Time,
+				Message:     line,
+			}
+			for _, d := range drains {
+				d.send(msg)
+			}
+		}
+	}
+}
+
+// Close stops all drains.
+func (s *Shipper) Close() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for _, drains := range s.drains {
+		for _, d := range drains {
+			d.close()
+		}
+	}
+	s.drains = make(map[string]map[string]*drain)
+}
+
+type writer interface {
+	Write(msgs []*Message) error
+	Close() error
+}
+
+func newWriter(rawurl string) (writer, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("logdrain: missing host in %q", rawurl)
+	}
+	switch u.Scheme {
+	case "syslog":
+		return &syslogWriter{addr: u.Host}, nil
+	case "syslog+tls":
+		return &syslogWriter{addr: u.Host, tls: true}, nil
+	case "http", "https":
+		return &httpWriter{url: rawurl, client: &http.Client{Timeout: writeTimeout}}, nil
+	default:
+		return nil, fmt.Errorf("logdrain: unsupported scheme %q", u.Scheme)
+	}
+}
+
+type drain struct {
+	host    string // for logging, the URL may contain credentials
+	w       writer
+	msgs    chan *Message
+	dropped uint64
+	done    chan struct{}
+	once    sync.Once
+}
+
+func newDrain(rawurl string) (*drain, error) {
+	w, err := newWriter(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	u, _ := url.Parse(rawurl)
+	return &drain{
+		host: u.Host,
+		w:    w,
+		msgs: make(chan *Message, bufferSize),
+		done: make(chan struct{}),
+	}, nil
+}
+
+// send queues a message for the drain, dropping it if the buffer is full.
+func (d *drain) send(msg *Message) {
+	select {
+	case d.msgs <- msg:
+	default:
+		atomic.AddUint64(&d.dropped, 1)
+	}
+}
+
+func (d *drain) close() {
+	d.once.Do(func() { close(d.done) })
+}
+
+func (d *drain) run() {
+	g := grohl.NewContext(grohl.Data{"fn": "drain", "drain.host": d.host})
+	defer d.w.Close()
+
+	batch := make([]*Message, 0, maxBatch+1)
+	for {
+		select {
+		case msg := <-d.msgs:
+			batch = append(batch[:0], msg)
+		case <-d.done:
+			return
+		}
+	fill:
+		for len(batch) < maxBatch {
+			select {
+			case msg := <-d.msgs:
+				batch = append(batch, msg)
+			default:
+				break fill
+			}
+		}
+		if n := atomic.SwapUint64(&d.dropped, 0); n > 0 {
+			g.Log(grohl.Data{"at": "dropped", "count": n})
+			batch = append(batch, droppedMessage(batch[0], n))
+		}
+		if !d.write(g, batch) {
+			return
+		}
+	}
+}
+
+// write writes a batch to the drain, retrying with backoff until it succeeds
+// or the drain is closed.
+func (d *drain) write(g *grohl.Context, batch []*Message) bool {
+	delay := minRetryDelay
+	for {
+		err := d.w.Write(batch)
+		if err == nil {
+			return true
+		}
+		g.Log(grohl.Data{"at": "write", "status": "error", "err": err, "retry": delay})
+		select {
+		case <-time.After(delay):
+		case <-d.done:
+			return false
+		}
+		if delay *= 2; delay > maxRetryDelay {
+			delay = maxRetryDelay
+		}
+	}
+}
+
+func droppedMessage(m *Message, n uint64) *Message {
+	return &Message{
+		AppID:       m.AppID,
+		AppName:     m.AppName,
+		ProcessType: "flynn",
+		Stream:      2,
+		Timestamp:   time.Now().UTC(),
+		Message:     fmt.Sprintf("dropped %d log messages because the drain is not keeping up", n),
+	}
+}
+
+type syslogWriter struct {
+	addr string
+	tls  bool
+	conn net.Conn
+}
+
+func (w *syslogWriter) Write(msgs []*Message) error {
+	if w.conn == nil {
+		dialer := &net.Dialer{Timeout: writeTimeout}
+		var err error
+		if w.tls {
+			w.conn, err = tls.DialWithDialer(dialer, "tcp", w.addr, nil)
+		} else {
+			w.conn, err = dialer.Dial("tcp", w.addr)
+		}
+		if err != nil {
+			w.conn = nil
+			return err
+		}
+	}
+	var buf bytes.Buffer
+	for _, m := range msgs {
+		buf.Write(formatSyslog(m))
+	}
+	w.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	if _, err := w.conn.Write(buf.Bytes()); err != nil {
+		w.Close()
+		return err
+	}
+	return nil
+}
+
+func (w *syslogWriter) Close() error {
+	if w.conn == nil {
+		return nil
+	}
+	err := w.conn.Close()
+	w.conn = nil
+	return err
+}
+
+// formatSyslog formats a message as an RFC 5424 syslog message with octet
+// counted framing (RFC 6587). The hostname is the app name, the app-name is
+// the process type and the procid is the job ID.
+func formatSyslog(m *Message) []byte {
+	severity := 6 // informational
+	if m.Stream == 2 {
+		severity = 3 // error
+	}
+	msg := fmt.Sprintf("<%d>1 %s %s %s %s - - %s",
+		8+severity, // user-level facility
+		m.Timestamp.UTC().Format(time.RFC3339Nano),
+		syslogField(m.AppName, 255),
+		syslogField(m.ProcessType, 48),
+		syslogField(m.JobID, 128),
+		m.Message,
+	)
+	return []byte(fmt.Sprintf("%d %s", len(msg), msg))
+}
+
+func syslogField(s string, max int) string {
+	if s == "" {
+		return "-"
+	}
+	if len(s) > max {
+		return s[:max]
+	}
+	return s
+}
+
+type httpWriter struct {
+	url    string
+	client *http.Client
+}
+
+func (w *httpWriter) Write(msgs []*Message) error {
+	body, err := json.Marshal(msgs)
+	if err != nil {
+		return err
+	}
+	res, err := w.client.Post(w.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("logdrain: unexpected status %d", res.StatusCode)
+	}
+	return nil
+}
+
+func (w *httpWriter) Close() error { return nil }
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/docker/libcontainer/netlink"
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/technoweenie/grohl"
+	"github.com/flynn/flynn/host/logdrain"
+	"github.com/flynn/flynn/host/oom"
+	"github.com/flynn/flynn/host/ports"
+	"github.com/flynn/flynn/host/types"
+	"github.com/flynn/flynn/host/volume"
+	"github.com/flynn/flynn/pkg/random"
+)
+
+// defaultMemory is the memory limit of jobs which don't specify one, and
+// matches the limit set on libvirt domains.
+const defaultMemory = 1024 * 1024 // in KiB
+
+// cpuPeriod is the CFS period in microseconds that CPUQuota is relative to.
+const cpuPeriod = 100000
+
+// cgroupRoot is where the cgroup hierarchies are mounted.
+var cgroupRoot = "/sys/fs/cgroup"
+
+// cgroupSubsystems are the cgroup subsystems each job is placed in.
+var cgroupSubsystems = []string{"memory", "cpu", "cpuacct", "devices", "freezer"}
+
+// NewNamespacesBackend returns a backend which runs jobs directly in Linux
+// namespaces and cgroups, without depending on libvirt.
+func NewNamespacesBackend(state *State, portAlloc map[string]*ports.Allocator, volumes *volume.Manager, shipper *logdrain.Shipper, logPath, initPath string, imageGCSize int64) (Backend, error) {
+	base, err := newContainerBackend("namespaces", state, portAlloc, volumes, shipper, logPath, initPath, imageGCSize)
+	if err != nil {
+		return nil, err
+	}
+
+	bridge, err := net.InterfaceByName(bridgeName)
+	if err != nil {
+		if err := netlink.CreateBridge(bridgeName, true); err != nil {
+			return nil, err
+		}
+		if bridge, err = net.InterfaceByName(bridgeName); err != nil {
+			return nil, err
+		}
+		if err := netlink.NetworkLinkAddIp(bridge, bridgeAddr, bridgeNet); err != nil {
+			return nil, err
+		}
+	}
+	if err := netlink.NetworkLinkUp(bridge); err != nil {
+		return nil, err
+	}
+
+	if err := base.forwardBridge(); err != nil {
+		return nil, err
+	}
+	return &NamespacesBackend{base}, nil
+}
+
+type NamespacesBackend struct {
+	*containerBackend
+}
+
+type nsContainer struct {
+	jobContainer
+	Pid  int
+	Veth string
+	cmd  *exec.Cmd
+}
+
+func (c *nsContainer) base() *jobContainer { return &c.jobContainer }
+
+func (b *NamespacesBackend) Run(job *host.Job) (err error) {
+	g := grohl.NewContext(grohl.Data{"backend": "namespaces", "fn": "run", "job.id": job.ID})
+	g.Log(grohl.Data{"at": "start", "job.artifact.uri": job.Artifact.URI, "job.cmd": job.Config.Cmd})
+	b.state.AddJobEvent(&host.JobEvent{JobID: job.ID, Event: host.JobEventCreate})
+
+	container := &nsContainer{jobContainer: b.newContainer(job)}
+	defer func() {
+		if err != nil {
+			go container.cleanup()
+		}
+	}()
+
+	network := b.network()
+	imageConfig, err := b.prepare(&container.jobContainer, network, g)
+	if err != nil {
+		return err
+	}
+
+	args := []string{"/.containerinit", "-mounts"}
+	cloneFlags := uintptr(syscall.CLONE_NEWNS | syscall.CLONE_NEWUTS | syscall.CLONE_NEWIPC | syscall.CLONE_NEWPID)
+	if !job.Config.HostNetwork {
+		// the interface names must be unique on the host and at most 15 characters
+		container.Veth = "veth" + random.Hex(5)
+		cloneFlags |= syscall.CLONE_NEWNET
+		args = append(args,
+			"-i", network.containerIP(container.IP),
+			"-g", network.Gateway.String(),
+			"-veth", container.Veth+"c",
+		)
+	}
+	args = append(args, containerArgs(job, imageConfig)...)
+
+	b.state.AddJob(job)
+	b.state.SetInternalIP(job.ID, container.IP.String())
+
+	g.Log(grohl.Data{"at": "create_cgroup"})
+	if err := createCgroup(job); err != nil {
+		g.Log(grohl.Data{"at": "create_cgroup", "status": "error", "err": err})
+		return err
+	}
+
+	g.Log(grohl.Data{"at": "start_init"})
+	// containerinit waits for Resume before running the job, so
+	// everything below is done before the job process starts
+	container.cmd = &exec.Cmd{
+		Path: args[0],
+		Args: args,
+		Env:  []string{"container=flynn-namespaces"},
+		SysProcAttr: &syscall.SysProcAttr{
+			Chroot:     container.RootPath,
+			Cloneflags: cloneFlags,
+		},
+	}
+	if err := container.cmd.Start(); err != nil {
+		g.Log(grohl.Data{"at": "start_init", "status": "error", "err": err})
+		return err
+	}
+	container.Pid = container.cmd.Process.Pid
+	b.state.SetContainerID(job.ID, strconv.Itoa(container.Pid))
+
+	if err := joinCgroup(job.ID, container.Pid); err != nil {
+		g.Log(grohl.Data{"at": "join_cgroup", "status": "error", "err": err})
+		container.cmd.Process.Kill()
+		return err
+	}
+
+	if !job.Config.HostNetwork {
+		g.Log(grohl.Data{"at": "create_veth"})
+		if err := container.setupVeth(); err != nil {
+			g.Log(grohl.Data{"at": "create_veth", "status": "error", "err": err})
+			container.cmd.Process.Kill()
+			return err
+		}
+
+		if err := b.forwardPorts(&container.jobContainer, g); err != nil {
+			container.cmd.Process.Kill()
+			return err
+		}
+	}
+
+	go b.watch(container, nil)
+
+	g.Log(grohl.Data{"at": "finish"})
+	return nil
+}
+
+// setupVeth creates a veth pair, attaches one end to the bridge and moves the
+// other into the network namespace of the container. containerinit renames
+// it to eth0 and configures the IP address.
+func (c *nsContainer) setupVeth() error {
+	peer := c.Veth + "c"
+	if err := netlink.NetworkCreateVethPair(c.Veth, peer, 0); err != nil {
+		return err
+	}
+	iface, err := net.InterfaceByName(c.Veth)
+	if err != nil {
+		return err
+	}
+	bridge, err := net.InterfaceByName(bridgeName)
+	if err != nil {
+		return err
+	}
+	if err := netlink.AddToBridge(iface, bridge); err != nil {
+		return err
+	}
+	if err := netlink.NetworkLinkUp(iface); err != nil {
+		return err
+	}
+	if err := enableHairpinMode(c.Veth); err != nil {
+		return err
+	}
+	peerIface, err := net.InterfaceByName(peer)
+	if err != nil {
+		return err
+	}
+	return netlink.NetworkSetNsPid(peerIface, c.Pid)
+}
+
+func cgroupPath(subsystem, id string) string {
+	return filepath.Join(cgroupRoot, subsystem, "flynn", id)
+}
+
+// createCgroup creates the cgroups for a job and applies its resource limits.
+func createCgroup(job *host.Job) error {
+	for _, subsystem := range cgroupSubsystems {
+		if err := os.MkdirAll(cgroupPath(subsystem, job.ID), 0755); err != nil {
+			return err
+		}
+	}
+	r := job.Resources
+	memory := r.Memory
+	if memory <= 0 {
+		memory = defaultMemory
+	}
+	if err := writeCgroupFile("memory", job.ID, "memory.limit_in_bytes", strconv.FormatInt(int64(memory)*1024, 10)); err != nil {
+		return err
+	}
+	if r.CPUShares > 0 {
+		if err := writeCgroupFile("cpu", job.ID, "cpu.shares", strconv.Itoa(r.CPUShares)); err != nil {
+			return err
+		}
+	}
+	if r.CPUQuota > 0 {
+		if err := writeCgroupFile("cpu", job.ID, "cpu.cfs_period_us", strconv.Itoa(cpuPeriod)); err != nil {
+			return err
+		}
+		if err := writeCgroupFile("cpu", job.ID, "cpu.cfs_quota_us", strconv.Itoa(r.CPUQuota)); err != nil {
+			return err
+		}
+	}
+	if r.MaxPIDs > 0 {
+		if err := os.MkdirAll(cgroupPath("pids", job.ID), 0755); err != nil {
+			return err
+		}
+		if err := writeCgroupFile("pids", job.ID, "pids.max", strconv.Itoa(r.MaxPIDs)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeCgroupFile(subsystem, id, name, value string) error {
+	return ioutil.WriteFile(filepath.Join(cgroupPath(subsystem, id), name), []byte(value), 0644)
+}
+
+func readCgroupUint(subsystem, id, name string) (uint64, error) {
+	data, err := ioutil.ReadFile(filepath.Join(cgroupPath(subsystem, id), name))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+}
+
+func joinCgroup(id string, pid int) error {
+	for _, subsystem := range cgroupSubsystems {
+		if err := writeCgroupFile(subsystem, id, "cgroup.procs", strconv.Itoa(pid)); err != nil {
+			return err
+		}
+	}
+	// the pids cgroup is only created for jobs with a process limit
+	if _, err := os.Stat(cgroupPath("pids", id)); err == nil {
+		return writeCgroupFile("pids", id, "cgroup.procs", strconv.Itoa(pid))
+	}
+	return nil
+}
+
+func removeCgroup(id string) error {
+	var err error
+	for _, subsystem := range append(cgroupSubsystems, "pids") {
+		if e := os.Remove(cgroupPath(subsystem, id)); e != nil && !os.IsNotExist(e) {
+			err = e
+		}
+	}
+	return err
+}
+
+// killCgroup sends SIGKILL to every process remaining in the job's cgroup.
+func killCgroup(id string) error {
+	data, err := ioutil.ReadFile(filepath.Join(cgroupPath("freezer", id), "cgroup.procs"))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, field := range strings.Fields(string(data)) {
+		if pid, err := strconv.Atoi(field); err == nil {
+			syscall.Kill(pid, syscall.SIGKILL)
+		}
+	}
+	return nil
+}
+
+func (c *nsContainer) watchOOM() (<-chan uint64, error) {
+	return oom.Watch(cgroupPath("memory", c.job.ID))
+}
+
+func (c *nsContainer) cleanup() error {
+	g := grohl.NewContext(grohl.Data{"backend": "namespaces", "fn": "cleanup", "job.id": c.job.ID})
+	g.Log(grohl.Data{"at": "start"})
+
+	// containerinit is pid 1 in the container's pid namespace, so once it
+	// exits the kernel kills everything else in the container. Kill any
+	// stragglers in case it didn't start in a new pid namespace.
+	if err := killCgroup(c.job.ID); err != nil {
+		g.Log(grohl.Data{"at": "kill_cgroup", "status": "error", "err": err})
+	}
+	if c.cmd != nil {
+		c.cmd.Wait()
+	} else if c.Pid > 0 {
+		// the process was started by a previous flynn-host, so it can't be
+		// reaped, wait for it to disappear instead
+		for i := 0; i < 100 && syscall.Kill(c.Pid, 0) == nil; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	if err := removeCgroup(c.job.ID); err != nil {
+		g.Log(grohl.Data{"at": "remove_cgroup", "status": "error", "err": err})
+	}
+
+	if c.Veth != "" {
+		// the host end is usually removed along with the namespace
+		netlink.NetworkLinkDel(c.Veth)
+	}
+	c.b.release(&c.jobContainer, g)
+	g.Log(grohl.Data{"at": "finish"})
+	return nil
+}
+
+func (b *NamespacesBackend) Stats(id string) (*host.JobStats, error) {
+	if _, err := b.getContainer(id); err != nil {
+		return nil, err
+	}
+	stats := &host.JobStats{JobID: id, Time: time.Now().UTC()}
+	var err error
+	if stats.MemoryUsage, err = readCgroupUint("memory", id, "memory.usage_in_bytes"); err != nil {
+		return nil, err
+	}
+	if stats.MemoryLimit, err = readCgroupUint("memory", id, "memory.limit_in_bytes"); err != nil {
+		return nil, err
+	}
+	if stats.CPUUsage, err = readCgroupUint("cpuacct", id, "cpuacct.usage"); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+func (b *NamespacesBackend) RestoreState(jobs map[string]*host.ActiveJob, dec *json.Decoder) error {
+	containers := make(map[string]*nsContainer)
+	if err := dec.Decode(&containers); err != nil {
+		return err
+	}
+	for _, j := range jobs {
+		if container, ok := containers[j.Job.ID]; ok {
+			b.restore(container, j.Job)
+		}
+	}
+	return nil
+}
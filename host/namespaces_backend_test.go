@@ -0,0 +1,101 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/flynn/flynn/host/types"
+)
+
+func withCgroupRoot(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "flynn-cgroup-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := cgroupRoot
+	cgroupRoot = dir
+	return func() {
+		cgroupRoot = root
+		os.RemoveAll(dir)
+	}
+}
+
+func readCgroupFile(t *testing.T, subsystem, id, name string) string {
+	data, err := ioutil.ReadFile(filepath.Join(cgroupPath(subsystem, id), name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestCreateCgroup(t *testing.T) {
+	defer withCgroupRoot(t)()
+
+	job := &host.Job{ID: "a", Resources: host.JobResources{
+		Memory:    2048,
+		CPUShares: 512,
+		CPUQuota:  50000,
+		MaxPIDs:   100,
+	}}
+	if err := createCgroup(job); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []struct {
+		subsystem, name, value string
+	}{
+		{"memory", "memory.limit_in_bytes", "2097152"},
+		{"cpu", "cpu.shares", "512"},
+		{"cpu", "cpu.cfs_period_us", "100000"},
+		{"cpu", "cpu.cfs_quota_us", "50000"},
+		{"pids", "pids.max", "100"},
+	} {
+		if v := readCgroupFile(t, f.subsystem, job.ID, f.name); v != f.value {
+			t.Errorf("expected %s to be %s, got %s", f.name, f.value, v)
+		}
+	}
+	if n, err := readCgroupUint("memory", job.ID, "memory.limit_in_bytes"); err != nil || n != 2097152 {
+		t.Errorf("expected to read memory limit 2097152, got %d (err: %v)", n, err)
+	}
+
+	if err := joinCgroup(job.ID, 42); err != nil {
+		t.Fatal(err)
+	}
+	for _, subsystem := range append(cgroupSubsystems, "pids") {
+		if v := readCgroupFile(t, subsystem, job.ID, "cgroup.procs"); v != "42" {
+			t.Errorf("expected %s cgroup.procs to be 42, got %s", subsystem, v)
+		}
+	}
+}
+
+func TestCreateCgroupDefaults(t *testing.T) {
+	defer withCgroupRoot(t)()
+
+	job := &host.Job{ID: "a"}
+	if err := createCgroup(job); err != nil {
+		t.Fatal(err)
+	}
+	if v := readCgroupFile(t, "memory", job.ID, "memory.limit_in_bytes"); v != "1073741824" {
+		t.Errorf("expected the default memory limit, got %s", v)
+	}
+	for _, f := range []struct {
+		subsystem, name string
+	}{
+		{"cpu", "cpu.shares"},
+		{"cpu", "cpu.cfs_quota_us"},
+		{"pids", ""},
+	} {
+		if _, err := os.Stat(filepath.Join(cgroupPath(f.subsystem, job.ID), f.name)); !os.IsNotExist(err) {
+			t.Errorf("expected %s to not exist, got %v", filepath.Join(f.subsystem, f.name), err)
+		}
+	}
+
+	// jobs without a process limit don't join a pids cgroup
+	if err := joinCgroup(job.ID, 42); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(cgroupPath("pids", job.ID)); !os.IsNotExist(err) {
+		t.Errorf("expected the pids cgroup to not exist, got %v", err)
+	}
+}
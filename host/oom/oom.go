@@ -0,0 +1,95 @@
+// Package oom watches memory cgroups for processes killed by the kernel for
+// exceeding the memory limit of the cgroup.
+package oom
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// MemoryRoot is where the memory cgroup hierarchy is mounted.
+var MemoryRoot = "/sys/fs/cgroup/memory"
+
+// Watch registers for the OOM notifications of the memory cgroup at dir using
+// cgroup.event_control. The number of processes killed is sent to the
+// returned channel, which is closed when the cgroup is removed.
+func Watch(dir string) (<-chan uint64, error) {
+	oomControl, err := os.Open(filepath.Join(dir, "memory.oom_control"))
+	if err != nil {
+		return nil, err
+	}
+	fd, _, errno := syscall.RawSyscall(syscall.SYS_EVENTFD2, 0, syscall.O_CLOEXEC, 0)
+	if errno != 0 {
+		oomControl.Close()
+		return nil, errno
+	}
+	eventfd := os.NewFile(fd, "eventfd")
+	control := fmt.Sprintf("%d %d", eventfd.Fd(), oomControl.Fd())
+	if err := ioutil.WriteFile(filepath.Join(dir, "cgroup.event_control"), []byte(control), 0700); err != nil {
+		eventfd.Close()
+		oomControl.Close()
+		return nil, err
+	}
+
+	ch := make(chan uint64, 1)
+	go func() {
+		defer close(ch)
+		defer eventfd.Close()
+		defer oomControl.Close()
+		buf := make([]byte, 8)
+		for {
+			if _, err := eventfd.Read(buf); err != nil {
+				return
+			}
+			// the eventfd is also signalled when the cgroup is removed
+			if _, err := os.Stat(filepath.Join(dir, "cgroup.event_control")); os.IsNotExist(err) {
+				return
+			}
+			ch <- binary.LittleEndian.Uint64(buf)
+		}
+	}()
+	return ch, nil
+}
+
+// MemoryCgroup returns the directory of the memory cgroup of a process.
+func MemoryCgroup(pid int) (string, error) {
+	f, err := os.Open(fmt.Sprintf("/proc/%d/cgroup", pid))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	path, err := memoryCgroupPath(f)
+	if err != nil {
+		return "", err
+	}
+	if path == "" {
+		return "", fmt.Errorf("oom: process %d is not in a memory cgroup", pid)
+	}
+	return filepath.Join(MemoryRoot, path), nil
+}
+
+// memoryCgroupPath returns the path of the memory cgroup in the hierarchy from
+// the contents of /proc/PID/cgroup.
+func memoryCgroupPath(r io.Reader) (string, error) {
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		// hierarchy-ID:subsystems:path
+		fields := strings.SplitN(s.Text(), ":", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		for _, subsystem := range strings.Split(fields[1], ",") {
+			if subsystem == "memory" {
+				return fields[2], nil
+			}
+		}
+	}
+	return "", s.Err()
+}
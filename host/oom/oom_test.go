@@ -0,0 +1,22 @@
+package oom
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMemoryCgroupPath(t *testing.T) {
+	for input, expected := range map[string]string{
+		"4:cpu,cpuacct:/machine/foo.libvirt-lxc\n3:memory:/machine/foo.libvirt-lxc\n": "/machine/foo.libvirt-lxc",
+		"2:memory,hugetlb:/flynn/a\n": "/flynn/a",
+		"0::/user.slice\n":            "",
+	} {
+		path, err := memoryCgroupPath(strings.NewReader(input))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if path != expected {
+			t.Errorf("%q: expected %q, got %q", input, expected, path)
+		}
+	}
+}
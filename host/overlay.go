@@ -0,0 +1,435 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/docker/libcontainer/netlink"
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/technoweenie/grohl"
+	"github.com/flynn/flynn/discoverd/client"
+	"github.com/flynn/flynn/pkg/iptables"
+)
+
+const (
+	vxlanName = "flynnvx0"
+	vxlanID   = 1
+	vxlanPort = 4789
+
+	// subnetsKey is the discoverd configuration key prefix that host subnet
+	// leases are stored under, keyed by the network address of the subnet.
+	subnetsKey = "flynn-host/subnets"
+)
+
+// subnetMask is the size of the subnet allocated to each host from the
+// overlay network.
+var subnetMask = net.CIDRMask(24, 32)
+
+// Network is a subnet of the flynnbr0 bridge that jobs are allocated IPs in.
+type Network struct {
+	Subnet  *net.IPNet
+	Gateway net.IP // the address of the bridge in Subnet
+}
+
+// bootstrapNetwork is used until the host joins the overlay network, and for
+// every job if the overlay is disabled. It is the same on every host, so IPs
+// in it are only reachable through port forwards.
+var bootstrapNetwork = &Network{Subnet: bridgeNet, Gateway: bridgeAddr}
+
+func (n *Network) containerIP(ip net.IP) string {
+	ones, _ := n.Subnet.Mask.Size()
+	return ip.String() + "/" + strconv.Itoa(ones)
+}
+
+// subnetFor returns the subnet that ip was allocated from.
+func subnetFor(ip net.IP) *net.IPNet {
+	if bridgeNet.Contains(ip) {
+		return bridgeNet
+	}
+	return &net.IPNet{IP: ip.Mask(subnetMask), Mask: subnetMask}
+}
+
+// networkState holds the network that new jobs are started in, and is shared
+// by the backends.
+type networkState struct {
+	mtx     sync.RWMutex
+	current *Network
+}
+
+// SetNetwork sets the network that new jobs are allocated IPs in.
+func (s *networkState) SetNetwork(n *Network) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.current = n
+}
+
+func (s *networkState) network() *Network {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	if s.current == nil {
+		return bootstrapNetwork
+	}
+	return s.current
+}
+
+// subnetLease is stored in discoverd for each host that has joined the overlay.
+type subnetLease struct {
+	HostID  string `json:"host_id"`
+	Addr    string `json:"addr"`     // the external IP of the host, which VXLAN packets are sent to
+	VtepMAC string `json:"vtep_mac"` // the MAC address of the host's VXLAN device
+}
+
+// overlay routes the subnets of every host in the cluster over a VXLAN
+// device, so that job IPs are reachable from every host.
+type overlay struct {
+	hostID     string
+	externalIP net.IP
+	network    *net.IPNet
+	subnet     *net.IPNet
+	vxlan      *net.Interface
+	disc       *discoverd.Client
+
+	remotes map[string]*subnetLease // subnet key -> lease
+}
+
+// joinOverlay allocates a subnet of network to the host, creates the VXLAN
+// device and routes to the subnets of other hosts, and returns the network
+// that jobs should be started in.
+func joinOverlay(disc *discoverd.Client, hostID, externalAddr string, network *net.IPNet) (*Network, error) {
+	g := grohl.NewContext(grohl.Data{"fn": "join_overlay", "network": network.String()})
+	externalIP := net.ParseIP(externalAddr).To4()
+	if externalIP == nil {
+		return nil, errors.New("host: overlay networking requires an external IPv4 address")
+	}
+	if ones, _ := network.Mask.Size(); ones > 23 {
+		return nil, fmt.Errorf("host: overlay network %s is too small, it must be at least a /23", network)
+	}
+	o := &overlay{
+		hostID:     hostID,
+		externalIP: externalIP,
+		network:    network,
+		disc:       disc,
+		remotes:    make(map[string]*subnetLease),
+	}
+
+	g.Log(grohl.Data{"at": "create_vxlan"})
+	if err := o.createVXLAN(); err != nil {
+		g.Log(grohl.Data{"at": "create_vxlan", "status": "error", "err": err})
+		return nil, err
+	}
+
+	watch, err := disc.WatchKeys(subnetsKey)
+	if err != nil {
+		return nil, err
+	}
+	g.Log(grohl.Data{"at": "allocate_subnet"})
+	if err := o.allocateSubnet(watch.Keys()); err != nil {
+		g.Log(grohl.Data{"at": "allocate_subnet", "status": "error", "err": err})
+		watch.Close()
+		return nil, err
+	}
+	g.Log(grohl.Data{"at": "allocated_subnet", "subnet": o.subnet.String()})
+
+	gateway := nextIP(o.subnet.IP)
+	if err := o.configureHost(gateway); err != nil {
+		g.Log(grohl.Data{"at": "configure_host", "status": "error", "err": err})
+		watch.Close()
+		return nil, err
+	}
+
+	for key, value := range watch.Keys() {
+		o.updateRemote(key, value)
+	}
+	go func() {
+		for u := range watch.Chan() {
+			if u.Deleted {
+				o.removeRemote(u.Key)
+			} else {
+				o.updateRemote(u.Key, u.Value)
+			}
+		}
+	}()
+
+	return &Network{Subnet: o.subnet, Gateway: gateway}, nil
+}
+
+// createVXLAN (re)creates the VXLAN device, sending encapsulated packets from
+// the interface with the external IP of the host.
+func (o *overlay) createVXLAN() error {
+	dev, err := interfaceByIP(o.externalIP)
+	if err != nil {
+		return err
+	}
+	// the device is recreated on start so that stale routes are removed
+	if _, err := net.InterfaceByName(vxlanName); err == nil {
+		if err := netlink.NetworkLinkDel(vxlanName); err != nil {
+			return err
+		}
+	}
+	if err := ipCmd("ip", "link", "add", vxlanName, "type", "vxlan",
+		"id", strconv.Itoa(vxlanID),
+		"local", o.externalIP.String(),
+		"dev", dev.Name,
+		"dstport", strconv.Itoa(vxlanPort),
+		"nolearning",
+	); err != nil {
+		return err
+	}
+	if o.vxlan, err = net.InterfaceByName(vxlanName); err != nil {
+		return err
+	}
+	return netlink.NetworkLinkUp(o.vxlan)
+}
+
+// allocateSubnet reuses the subnet previously leased to this host, or claims
+// the first free subnet of the overlay network. If there are none, it takes
+// over the lease of a host which has left the cluster.
+func (o *overlay) allocateSubnet(leases map[string]string) error {
+	data, err := json.Marshal(&subnetLease{
+		HostID:  o.hostID,
+		Addr:    o.externalIP.String(),
+		VtepMAC: o.vxlan.HardwareAddr.String(),
+	})
+	if err != nil {
+		return err
+	}
+
+	for key, value := range leases {
+		var lease subnetLease
+		if err := json.Unmarshal([]byte(value), &lease); err != nil || lease.HostID != o.hostID {
+			continue
+		}
+		subnet := subnetFromKey(key)
+		if subnet == nil || !o.network.Contains(subnet.IP) {
+			continue
+		}
+		// the VXLAN device has a new MAC address, so update the lease
+		if err := o.disc.SetKey(key, string(data)); err != nil {
+			return err
+		}
+		o.subnet = subnet
+		return nil
+	}
+
+	ones, _ := o.network.Mask.Size()
+	count := 1 << uint(24-ones)
+	base := binary.BigEndian.Uint32(o.network.IP.To4())
+	for i := 0; i < count; i++ {
+		ip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, base+uint32(i)<<8)
+		subnet := &net.IPNet{IP: ip, Mask: subnetMask}
+		if subnet.Contains(bridgeAddr) {
+			continue
+		}
+		key := subnetKey(subnet)
+		if _, ok := leases[key]; ok {
+			continue
+		}
+		if err := o.disc.CreateKey(key, string(data)); err == discoverd.ErrKeyExists {
+			// another host claimed it since the leases were read
+			continue
+		} else if err != nil {
+			return err
+		}
+		o.subnet = subnet
+		return nil
+	}
+
+	if ok, err := o.reclaimSubnet(leases, string(data)); err != nil || ok {
+		return err
+	}
+	return fmt.Errorf("host: no free subnets in overlay network %s", o.network)
+}
+
+// reclaimSubnet takes over the lease of a host which is not registered in
+// discoverd, as leases are not removed when a host leaves the cluster. Hosts
+// register after joining the overlay, so this is only done once every subnet
+// is leased, to avoid taking the subnet of a host which is restarting.
+func (o *overlay) reclaimSubnet(leases map[string]string, data string) (bool, error) {
+	set, err := o.disc.NewServiceSet("flynn-host")
+	if err != nil {
+		return false, err
+	}
+	hosts := make(map[string]struct{})
+	for _, s := range set.Services() {
+		hosts[s.Attrs["id"]] = struct{}{}
+	}
+	set.Close()
+
+	for key, value := range leases {
+		var lease subnetLease
+		if err := json.Unmarshal([]byte(value), &lease); err != nil {
+			continue
+		}
+		if _, ok := hosts[lease.HostID]; ok {
+			continue
+		}
+		subnet := subnetFromKey(key)
+		if subnet == nil || !o.network.Contains(subnet.IP) {
+			continue
+		}
+		grohl.Log(grohl.Data{"fn": "reclaim_subnet", "subnet": subnet.String(), "host.id": lease.HostID})
+		if err := o.disc.SwapKey(key, value, data); err == discoverd.ErrKeyChanged || err == discoverd.ErrKeyNotFound {
+			// the lease was renewed or taken over since it was read
+			continue
+		} else if err != nil {
+			return false, err
+		}
+		o.subnet = subnet
+		return true, nil
+	}
+	return false, nil
+}
+
+// configureHost adds the addresses of the host to the bridge and VXLAN device,
+// and the firewall rules which allow jobs to reach other hosts and the
+// outside world.
+func (o *overlay) configureHost(gateway net.IP) error {
+	bridge, err := net.InterfaceByName(bridgeName)
+	if err != nil {
+		return err
+	}
+	if !hasAddr(bridge, gateway) {
+		if err := netlink.NetworkLinkAddIp(bridge, gateway, o.subnet); err != nil {
+			return err
+		}
+	}
+	// the network address of the subnet is the VXLAN endpoint that remote
+	// hosts route the subnet through
+	if err := netlink.NetworkLinkAddIp(o.vxlan, o.subnet.IP, &net.IPNet{IP: o.subnet.IP, Mask: net.CIDRMask(32, 32)}); err != nil {
+		return err
+	}
+
+	subnet, network := o.subnet.String(), o.network.String()
+	rules := [][]string{
+		{"filter", "FORWARD", "-i", bridgeName, "-s", subnet, "-j", "ACCEPT"},
+		{"filter", "FORWARD", "-o", bridgeName, "-s", network, "-d", subnet, "-j", "ACCEPT"},
+		{"filter", "FORWARD", "-o", bridgeName, "-d", subnet, "-m", "conntrack", "--ctstate", "ESTABLISHED,RELATED", "-j", "ACCEPT"},
+		{"nat", "POSTROUTING", "-s", subnet, "!", "-d", network, "-j", "MASQUERADE"},
+	}
+	for _, rule := range rules {
+		if err := insertRule(rule[0], rule[1], rule[2:]...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (o *overlay) updateRemote(key, value string) {
+	g := grohl.NewContext(grohl.Data{"fn": "overlay_update_remote", "key": key})
+	subnet := subnetFromKey(key)
+	if subnet == nil || subnet.IP.Equal(o.subnet.IP) {
+		return
+	}
+	lease := &subnetLease{}
+	if err := json.Unmarshal([]byte(value), lease); err != nil {
+		g.Log(grohl.Data{"at": "decode", "status": "error", "err": err})
+		return
+	}
+	if prev, ok := o.remotes[key]; ok && *prev == *lease {
+		return
+	}
+	o.removeRemote(key)
+	g.Log(grohl.Data{"at": "add_route", "subnet": subnet.String(), "addr": lease.Addr, "host.id": lease.HostID})
+	cmds := [][]string{
+		{"ip", "neigh", "replace", subnet.IP.String(), "lladdr", lease.VtepMAC, "dev", vxlanName, "nud", "permanent"},
+		{"bridge", "fdb", "replace", lease.VtepMAC, "dev", vxlanName, "dst", lease.Addr},
+		{"ip", "route", "replace", subnet.String(), "via", subnet.IP.String(), "dev", vxlanName, "onlink"},
+	}
+	for _, cmd := range cmds {
+		if err := ipCmd(cmd[0], cmd[1:]...); err != nil {
+			g.Log(grohl.Data{"at": "add_route", "status": "error", "err": err})
+			return
+		}
+	}
+	o.remotes[key] = lease
+}
+
+func (o *overlay) removeRemote(key string) {
+	lease, ok := o.remotes[key]
+	if !ok {
+		return
+	}
+	delete(o.remotes, key)
+	subnet := subnetFromKey(key)
+	grohl.Log(grohl.Data{"fn": "overlay_remove_remote", "subnet": subnet.String(), "host.id": lease.HostID})
+	// ignore errors, the entries may have already been removed
+	ipCmd("ip", "route", "del", subnet.String(), "dev", vxlanName)
+	ipCmd("ip", "neigh", "del", subnet.IP.String(), "dev", vxlanName)
+	ipCmd("bridge", "fdb", "del", lease.VtepMAC, "dev", vxlanName)
+}
+
+func subnetKey(subnet *net.IPNet) string {
+	return path.Join(subnetsKey, subnet.IP.String())
+}
+
+func subnetFromKey(key string) *net.IPNet {
+	ip := net.ParseIP(strings.TrimPrefix(key, subnetsKey+"/")).To4()
+	if ip == nil {
+		return nil
+	}
+	return &net.IPNet{IP: ip.Mask(subnetMask), Mask: subnetMask}
+}
+
+func nextIP(ip net.IP) net.IP {
+	next := make(net.IP, len(ip))
+	copy(next, ip)
+	for i := len(next) - 1; i >= 0; i-- {
+		if next[i]++; next[i] != 0 {
+			break
+		}
+	}
+	return next
+}
+
+func interfaceByIP(ip net.IP) (*net.Interface, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	for _, iface := range ifaces {
+		if hasAddr(&iface, ip) {
+			return &iface, nil
+		}
+	}
+	return nil, fmt.Errorf("host: no interface has the address %s", ip)
+}
+
+func hasAddr(iface *net.Interface, ip net.IP) bool {
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// insertRule inserts an iptables rule at the start of chain, replacing it if
+// it already exists.
+func insertRule(table, chain string, rule ...string) error {
+	iptables.Raw(append([]string{"-t", table, "-D", chain}, rule...)...)
+	if output, err := iptables.Raw(append([]string{"-t", table, "-I", chain}, rule...)...); err != nil {
+		return err
+	} else if len(output) != 0 {
+		return fmt.Errorf("host: error inserting iptables rule: %s", output)
+	}
+	return nil
+}
+
+func ipCmd(name string, args ...string) error {
+	if out, err := exec.Command(name, args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("host: %s %s failed: %s: %s", name, strings.Join(args, " "), err, out)
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestSubnetKey(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("10.200.3.0/24")
+	key := subnetKey(subnet)
+	if key != "flynn-host/subnets/10.200.3.0" {
+		t.Fatalf("unexpected key %q", key)
+	}
+	if actual := subnetFromKey(key); actual.String() != subnet.String() {
+		t.Errorf("incorrect subnet from key: got %s, want %s", actual, subnet)
+	}
+	if actual := subnetFromKey("flynn-host/subnets/foo"); actual != nil {
+		t.Errorf("expected invalid key to have no subnet, got %s", actual)
+	}
+}
+
+func TestSubnetFor(t *testing.T) {
+	for ip, expected := range map[string]string{
+		"192.168.200.34": "192.168.200.0/24",
+		"10.200.3.5":     "10.200.3.0/24",
+	} {
+		if actual := subnetFor(net.ParseIP(ip)); actual.String() != expected {
+			t.Errorf("incorrect subnet for %s: got %s, want %s", ip, actual, expected)
+		}
+	}
+}
+
+func TestNetworkContainerIP(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("10.200.3.0/24")
+	n := &Network{Subnet: subnet, Gateway: nextIP(subnet.IP)}
+	if n.Gateway.String() != "10.200.3.1" {
+		t.Errorf("incorrect gateway: got %s, want 10.200.3.1", n.Gateway)
+	}
+	if actual := n.containerIP(net.ParseIP("10.200.3.2")); actual != "10.200.3.2/24" {
+		t.Errorf("incorrect container IP: got %s, want 10.200.3.2/24", actual)
+	}
+}
@@ -4,17 +4,24 @@ import (
 	"errors"
 	"net"
 	"net/http"
+	"time"
 
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/technoweenie/grohl"
+	"github.com/flynn/flynn/host/logbuf"
 	"github.com/flynn/flynn/host/types"
+	"github.com/flynn/flynn/pinkerton"
 	"github.com/flynn/flynn/pkg/rpcplus"
 	rpc "github.com/flynn/flynn/pkg/rpcplus/comborpc"
 	"github.com/flynn/flynn/pkg/shutdown"
 )
 
-func serveHTTP(host *Host, attach *attachHandler, sh *shutdown.Handler) error {
+func serveHTTP(host *Host, vol *Volume, attach *attachHandler, sh *shutdown.Handler) error {
 	if err := rpc.Register(host); err != nil {
 		return err
 	}
+	if err := rpc.Register(vol); err != nil {
+		return err
+	}
 	rpc.HandleHTTP()
 	http.Handle("/attach", attach)
 
@@ -45,10 +52,19 @@ func (h *Host) GetJob(id string, res *host.ActiveJob) error {
 	return nil
 }
 
+func (h *Host) JobEvents(id string, res *[]*host.JobEvent) error {
+	events := h.state.JobEvents(id)
+	if events == nil {
+		return host.ErrUnknownJob
+	}
+	*res = events
+	return nil
+}
+
 func (h *Host) StopJob(id string, res *struct{}) error {
 	job := h.state.GetJob(id)
 	if job == nil {
-		return errors.New("host: unknown job")
+		return host.ErrUnknownJob
 	}
 	switch job.Status {
 	case host.StatusStarting:
@@ -77,3 +93,110 @@ func (h *Host) StreamEvents(id string, stream rpcplus.Stream) error {
 		}
 	}
 }
+
+// statsInterval is how often JobStats samples the resource usage of a job.
+var statsInterval = time.Second
+
+func (h *Host) JobStats(id string, stream rpcplus.Stream) error {
+	job := h.state.GetJob(id)
+	if job == nil {
+		return host.ErrUnknownJob
+	}
+	if job.Status != host.StatusRunning {
+		return errors.New("host: job is not running")
+	}
+	ticker := time.NewTicker(statsInterval)
+	defer ticker.Stop()
+	for {
+		stats, err := h.backend.Stats(id)
+		if err != nil {
+			// the job may have stopped since the last sample
+			if job := h.state.GetJob(id); job == nil || job.Status != host.StatusRunning {
+				return nil
+			}
+			return err
+		}
+		select {
+		case stream.Send <- stats:
+		case <-stream.Error:
+			return nil
+		}
+		select {
+		case <-ticker.C:
+		case <-stream.Error:
+			return nil
+		}
+	}
+}
+
+func (h *Host) StreamLog(req host.LogReq, stream rpcplus.Stream) error {
+	job := h.state.GetJob(req.JobID)
+	if job == nil {
+		return host.ErrUnknownJob
+	}
+	// the log of a stopped job is never closed, so following it would block
+	// forever
+	follow := req.Follow && (job.Status == host.StatusStarting || job.Status == host.StatusRunning)
+
+	ch := make(chan logbuf.Data)
+	done := make(chan struct{})
+	defer close(done)
+	errc := make(chan error, 1)
+	go func() {
+		// Read closes ch once it has sent everything
+		if err := h.backend.OpenLog(req.JobID).Read(req.Lines, follow, ch, done); err != nil {
+			errc <- err
+		}
+	}()
+	for {
+		select {
+		case data, ok := <-ch:
+			if !ok {
+				return nil
+			}
+			line := &host.LogLine{
+				JobID:     req.JobID,
+				Stream:    data.Stream,
+				Timestamp: data.Timestamp.Time,
+				Message:   data.Message,
+			}
+			select {
+			case stream.Send <- line:
+			case <-stream.Error:
+				return nil
+			}
+		case err := <-errc:
+			return err
+		case <-stream.Error:
+			return nil
+		}
+	}
+}
+
+// PullImage pulls an image ahead of jobs using it, streaming the progress of
+// each layer. The pull continues if the client goes away.
+func (h *Host) PullImage(uri string, stream rpcplus.Stream) error {
+	g := grohl.NewContext(grohl.Data{"fn": "PullImage", "uri": uri})
+	g.Log(grohl.Data{"at": "start"})
+	progress := make(chan pinkerton.LayerPullInfo)
+	errc := make(chan error, 1)
+	go func() { errc <- h.backend.Pull(uri, progress) }()
+
+	send := true
+	for info := range progress {
+		if !send {
+			continue
+		}
+		select {
+		case stream.Send <- &host.LayerPullInfo{ID: info.ID, Status: string(info.Status)}:
+		case <-stream.Error:
+			send = false
+		}
+	}
+	if err := <-errc; err != nil {
+		g.Log(grohl.Data{"at": "finish", "status": "error", "err": err})
+		return err
+	}
+	g.Log(grohl.Data{"at": "finish"})
+	return nil
+}
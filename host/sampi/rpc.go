@@ -4,16 +4,30 @@ import (
 	"errors"
 	"io"
 
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/technoweenie/grohl"
+	"github.com/flynn/flynn/discoverd/client"
 	"github.com/flynn/flynn/host/types"
 	"github.com/flynn/flynn/pkg/rpcplus"
 )
 
+// KeyStore stores the state which must outlive the leader, it is implemented
+// by *discoverd.Client.
+type KeyStore interface {
+	GetKey(key string) (string, error)
+	SetKey(key, value string) error
+	DeleteKey(key string) error
+}
+
 type Cluster struct {
 	state *State
+	keys  KeyStore
 }
 
-func NewCluster(state *State) *Cluster {
-	return &Cluster{state}
+// NewCluster returns a Cluster which stores the draining state of hosts in
+// keys, so that it is restored when hosts register with a new leader. keys may
+// be nil.
+func NewCluster(state *State, keys KeyStore) *Cluster {
+	return &Cluster{state: state, keys: keys}
 }
 
 // Scheduler Methods
@@ -43,6 +57,37 @@ func (s *Cluster) AddJobs(req *host.AddJobsReq, res *host.AddJobsRes) error {
 	return nil
 }
 
+// SetDraining marks a host as draining, or back in service, and sends a
+// "drain" or "undrain" host event.
+func (s *Cluster) SetDraining(req *host.SetDrainingReq, res *struct{}) error {
+	s.state.Begin()
+	if err := s.state.SetDraining(req.HostID, req.Draining); err != nil {
+		s.state.Rollback()
+		return err
+	}
+	if s.keys != nil {
+		key := host.DrainingKey + "/" + req.HostID
+		var err error
+		if req.Draining {
+			err = s.keys.SetKey(key, "true")
+		} else if err = s.keys.DeleteKey(key); err == discoverd.ErrKeyNotFound {
+			err = nil
+		}
+		if err != nil {
+			s.state.Rollback()
+			return err
+		}
+	}
+	s.state.Commit()
+
+	event := "drain"
+	if !req.Draining {
+		event = "undrain"
+	}
+	go s.state.sendEvent(req.HostID, event)
+	return nil
+}
+
 // Host Service methods
 
 func (s *Cluster) RegisterHost(hostID *string, h *host.Host, stream rpcplus.Stream) error {
@@ -51,6 +96,16 @@ func (s *Cluster) RegisterHost(hostID *string, h *host.Host, stream rpcplus.Stre
 		return errors.New("sampi: host id must not be blank")
 	}
 
+	if s.keys != nil {
+		// the host may have been drained while registered with another leader
+		_, err := s.keys.GetKey(host.DrainingKey + "/" + h.ID)
+		if err == nil {
+			h.Draining = true
+		} else if err != discoverd.ErrKeyNotFound {
+			grohl.Log(grohl.Data{"fn": "RegisterHost", "at": "get_draining", "host.id": h.ID, "status": "error", "err": err})
+		}
+	}
+
 	s.state.Begin()
 
 	if s.state.HostExists(*hostID) {
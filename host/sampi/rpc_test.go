@@ -0,0 +1,98 @@
+package sampi
+
+import (
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/flynn/flynn/discoverd/client"
+	"github.com/flynn/flynn/host/types"
+	"github.com/flynn/flynn/pkg/rpcplus"
+)
+
+type fakeKeyStore struct {
+	mtx  sync.Mutex
+	keys map[string]string
+}
+
+func (s *fakeKeyStore) GetKey(key string) (string, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	v, ok := s.keys[key]
+	if !ok {
+		return "", discoverd.ErrKeyNotFound
+	}
+	return v, nil
+}
+
+func (s *fakeKeyStore) SetKey(key, value string) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.keys[key] = value
+	return nil
+}
+
+func (s *fakeKeyStore) DeleteKey(key string) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if _, ok := s.keys[key]; !ok {
+		return discoverd.ErrKeyNotFound
+	}
+	delete(s.keys, key)
+	return nil
+}
+
+// registerHost registers a host with c until the returned function is called.
+func registerHost(t *testing.T, c *Cluster, id string) func() {
+	stream := rpcplus.Stream{Send: make(chan interface{}), Error: make(chan error)}
+	done := make(chan struct{})
+	go func() {
+		var hostID string
+		if err := c.RegisterHost(&hostID, &host.Host{ID: id}, stream); err != nil {
+			t.Error(err)
+		}
+		close(done)
+	}()
+	for start := time.Now(); ; time.Sleep(time.Millisecond) {
+		if _, ok := c.state.Get()[id]; ok {
+			break
+		}
+		if time.Since(start) > time.Second {
+			t.Fatalf("timed out waiting for %s to register", id)
+		}
+	}
+	return func() {
+		stream.Error <- io.EOF
+		<-done
+	}
+}
+
+func TestDrainingPersisted(t *testing.T) {
+	keys := &fakeKeyStore{keys: make(map[string]string)}
+
+	c := NewCluster(NewState(), keys)
+	unregister := registerHost(t, c, "foo")
+	if err := c.SetDraining(&host.SetDrainingReq{HostID: "foo", Draining: true}, &struct{}{}); err != nil {
+		t.Fatal(err)
+	}
+	unregister()
+	if _, err := keys.GetKey(host.DrainingKey + "/foo"); err != nil {
+		t.Errorf("Expected the draining key to be set, got %s", err)
+	}
+
+	// a new leader restores the draining state when the host registers
+	c = NewCluster(NewState(), keys)
+	unregister = registerHost(t, c, "foo")
+	defer unregister()
+	if !c.state.Get()["foo"].Draining {
+		t.Error("Expected 'foo' to be draining")
+	}
+
+	if err := c.SetDraining(&host.SetDrainingReq{HostID: "foo", Draining: false}, &struct{}{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := keys.GetKey(host.DrainingKey + "/foo"); err != discoverd.ErrKeyNotFound {
+		t.Errorf("Expected the draining key to be deleted, got %v", err)
+	}
+}
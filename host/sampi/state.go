@@ -75,10 +75,16 @@ func (s *State) AddJobs(hostID string, jobs []*host.Job) error {
 	if !ok {
 		return fmt.Errorf("sampi: Unknown host %s", hostID)
 	}
+	if h.Draining {
+		return fmt.Errorf("sampi: host %s is draining", hostID)
+	}
 
 	newJobs := make([]*host.Job, len(h.Jobs), len(h.Jobs)+len(jobs))
 	copy(newJobs, h.Jobs)
-	newJobs = append(newJobs, jobs...)
+	for _, job := range jobs {
+		// the secrets token is only sent to the host
+		newJobs = append(newJobs, job.Redacted())
+	}
 	h.Jobs = newJobs
 
 	(*s.next)[hostID] = h
@@ -86,6 +92,17 @@ func (s *State) AddJobs(hostID string, jobs []*host.Job) error {
 	return nil
 }
 
+func (s *State) SetDraining(hostID string, draining bool) error {
+	h, ok := s.host(hostID)
+	if !ok {
+		return fmt.Errorf("sampi: Unknown host %s", hostID)
+	}
+	h.Draining = draining
+	(*s.next)[hostID] = h
+	s.nextModified = true
+	return nil
+}
+
 func (s *State) SendJob(host string, job *host.Job) {
 	if ch, ok := s.streams[host]; ok {
 		ch <- job
@@ -45,3 +45,60 @@ func TestStateRace(t *testing.T) {
 		t.Log("Got '2'")
 	}
 }
+
+func TestStateDraining(t *testing.T) {
+	state := NewState()
+	addHost("foo", state)
+
+	state.Begin()
+	if err := state.SetDraining("foo", true); err != nil {
+		t.Fatal(err)
+	}
+	if !state.Commit()["foo"].Draining {
+		t.Error("Expected 'foo' to be draining")
+	}
+
+	state.Begin()
+	err := state.AddJobs("foo", []*host.Job{{ID: "job1"}})
+	state.Rollback()
+	if err == nil {
+		t.Error("Expected adding jobs to a draining host to fail")
+	}
+
+	state.Begin()
+	state.SetDraining("foo", false)
+	if err := state.AddJobs("foo", []*host.Job{{ID: "job1"}}); err != nil {
+		t.Error(err)
+	}
+	if jobs := state.Commit()["foo"].Jobs; len(jobs) != 1 {
+		t.Errorf("Expected 1 job, got %d", len(jobs))
+	}
+
+	state.Begin()
+	err = state.SetDraining("bar", true)
+	state.Rollback()
+	if err == nil {
+		t.Error("Expected draining an unknown host to fail")
+	}
+}
+
+func TestStateAddJobsRedacted(t *testing.T) {
+	state := NewState()
+	addHost("foo", state)
+
+	job := &host.Job{ID: "a", Config: host.ContainerConfig{Secrets: &host.Secrets{URL: "http://secrets", Token: "token"}}}
+	state.Begin()
+	if err := state.AddJobs("foo", []*host.Job{job}); err != nil {
+		t.Fatal(err)
+	}
+	jobs := state.Commit()["foo"].Jobs
+	if len(jobs) != 1 {
+		t.Fatalf("Expected 1 job, got %d", len(jobs))
+	}
+	if s := jobs[0].Config.Secrets; s == nil || s.URL != "http://secrets" || s.Token != "" {
+		t.Errorf("Expected the secrets of the stored job to have no token, got %+v", s)
+	}
+	if job.Config.Secrets.Token != "token" {
+		t.Error("Expected the token of the added job to be kept")
+	}
+}
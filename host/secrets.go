@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/flynn/flynn/discoverd/client"
+	"github.com/flynn/flynn/discoverd/client/dialer"
+	"github.com/flynn/flynn/host/types"
+)
+
+// fetchSecrets fetches the secret environment variables of a job. They are
+// only written to the environment of the container, and neither they nor the
+// token which authorizes fetching them are in the job config which is
+// persisted in the host state.
+func fetchSecrets(s *host.Secrets) (map[string]string, error) {
+	if s == nil {
+		return nil, nil
+	}
+	if err := discoverd.Connect(""); err != nil {
+		return nil, err
+	}
+	d := dialer.New(discoverd.DefaultClient, nil)
+	defer d.Close()
+	client := &http.Client{Transport: &http.Transport{Dial: d.Dial}, Timeout: 30 * time.Second}
+
+	req, err := http.NewRequest("GET", s.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth("", s.Token)
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("unexpected status %d fetching secrets", res.StatusCode)
+	}
+	var secrets map[string]string
+	if err := json.NewDecoder(res.Body).Decode(&secrets); err != nil {
+		return nil, err
+	}
+	return secrets, nil
+}
@@ -23,6 +23,7 @@ type State struct {
 	listeners  map[string]map[chan host.Event]struct{} // job id -> listener list (ID "all" gets all events)
 	listenMtx  sync.RWMutex
 	attachers  map[string]map[chan struct{}]struct{}
+	history    *jobHistory
 
 	stateFileMtx sync.Mutex
 	stateFile    *os.File
@@ -36,6 +37,7 @@ func NewState(id string) *State {
 		containers: make(map[string]*host.ActiveJob),
 		listeners:  make(map[string]map[chan host.Event]struct{}),
 		attachers:  make(map[string]map[chan struct{}]struct{}),
+		history:    newJobHistory(),
 	}
 }
 
@@ -48,6 +50,9 @@ func (s *State) Restore(file string, backend Backend) error {
 	}
 	s.stateFile = f
 	s.backend = backend
+	if err := s.history.load(historyFile(file)); err != nil {
+		return err
+	}
 	d := json.NewDecoder(f)
 	if err := d.Decode(&s.jobs); err != nil {
 		if err == io.EOF {
@@ -183,6 +188,7 @@ func (s *State) SetStatusRunning(jobID string) {
 	job.StartedAt = time.Now().UTC()
 	job.Status = host.StatusRunning
 	s.sendEvent(job, "start")
+	s.history.Add(&host.JobEvent{JobID: jobID, Event: host.JobEventStart})
 	go s.persist()
 }
 
@@ -219,6 +225,23 @@ func (s *State) setStatusDone(job *host.ActiveJob, exitStatus int) {
 		job.Status = host.StatusCrashed
 	}
 	s.sendEvent(job, "stop")
+	s.history.Add(&host.JobEvent{JobID: job.Job.ID, Event: host.JobEventStop, ExitStatus: exitStatus})
+	go s.persist()
+}
+
+// AddOOMKills records that n processes of a job were killed for exceeding its
+// memory limit.
+func (s *State) AddOOMKills(jobID string, n int) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	job, ok := s.jobs[jobID]
+	if !ok {
+		return
+	}
+	job.OOMKills += n
+	s.sendEvent(job, "oom")
+	s.history.Add(&host.JobEvent{JobID: jobID, Event: host.JobEventOOM})
 	go s.persist()
 }
 
@@ -227,7 +250,12 @@ func (s *State) SetStatusFailed(jobID string, err error) {
 	defer s.mtx.Unlock()
 
 	job, ok := s.jobs[jobID]
-	if !ok || job.Status == host.StatusDone || job.Status == host.StatusCrashed || job.Status == host.StatusFailed {
+	if !ok {
+		// the job failed before it was added, e.g. while pulling its image
+		s.history.Add(&host.JobEvent{JobID: jobID, Event: host.JobEventError, Error: err.Error()})
+		return
+	}
+	if job.Status == host.StatusDone || job.Status == host.StatusCrashed || job.Status == host.StatusFailed {
 		return
 	}
 	job.Status = host.StatusFailed
@@ -235,10 +263,22 @@ func (s *State) SetStatusFailed(jobID string, err error) {
 	errStr := err.Error()
 	job.Error = &errStr
 	s.sendEvent(job, "error")
+	s.history.Add(&host.JobEvent{JobID: jobID, Event: host.JobEventError, Error: errStr})
 	go s.persist()
 	go s.WaitAttach(jobID)
 }
 
+// AddJobEvent records an event in the history of a job.
+func (s *State) AddJobEvent(e *host.JobEvent) {
+	s.history.Add(e)
+}
+
+// JobEvents returns the event history of a job, which is kept after the job is
+// removed.
+func (s *State) JobEvents(jobID string) []*host.JobEvent {
+	return s.history.Get(jobID)
+}
+
 func (s *State) AddAttacher(jobID string, ch chan struct{}) *host.ActiveJob {
 	s.mtx.Lock()
 	defer s.mtx.Unlock()
@@ -1,6 +1,10 @@
 package main
 
 import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/flynn/flynn/host/types"
@@ -15,3 +19,88 @@ func TestStateHostID(t *testing.T) {
 		t.Errorf("expected job.HostID to equal %s, got %s", hostID, job.HostID)
 	}
 }
+
+func TestStateJobEvents(t *testing.T) {
+	state := NewState("abc123")
+	state.AddJobEvent(&host.JobEvent{JobID: "a", Event: host.JobEventCreate})
+	state.AddJob(&host.Job{ID: "a"})
+	state.SetStatusRunning("a")
+	state.SetStatusDone("a", 2)
+	state.RemoveJob("a")
+
+	events := state.JobEvents("a")
+	if len(events) != 3 {
+		t.Fatalf("expected 3 events, got %d", len(events))
+	}
+	for i, typ := range []string{host.JobEventCreate, host.JobEventStart, host.JobEventStop} {
+		if events[i].Event != typ {
+			t.Errorf("expected event %d to be %s, got %s", i, typ, events[i].Event)
+		}
+	}
+	if events[2].ExitStatus != 2 {
+		t.Errorf("expected exit status 2, got %d", events[2].ExitStatus)
+	}
+	if state.JobEvents("b") != nil {
+		t.Error("expected unknown job to have no events")
+	}
+}
+
+func TestStateFailedBeforeAdd(t *testing.T) {
+	state := NewState("abc123")
+	state.AddJobEvent(&host.JobEvent{JobID: "a", Event: host.JobEventCreate})
+	state.SetStatusFailed("a", errors.New("pull failed"))
+
+	events := state.JobEvents("a")
+	if len(events) != 2 {
+		t.Fatalf("expected 2 events, got %d", len(events))
+	}
+	if e := events[1]; e.Event != host.JobEventError || e.Error != "pull failed" {
+		t.Errorf("expected an error event, got %+v", e)
+	}
+	if state.GetJob("a") != nil {
+		t.Error("expected the job to not be added")
+	}
+}
+
+func TestStateOOMKills(t *testing.T) {
+	state := NewState("abc123")
+	state.AddJob(&host.Job{ID: "a"})
+	state.AddOOMKills("a", 2)
+	if n := state.GetJob("a").OOMKills; n != 2 {
+		t.Errorf("expected 2 OOM kills, got %d", n)
+	}
+	events := state.JobEvents("a")
+	if e := events[len(events)-1]; e.Event != host.JobEventOOM {
+		t.Errorf("expected an oom event, got %s", e.Event)
+	}
+}
+
+func TestJobHistoryPersist(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flynn-host-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := historyFile(filepath.Join(dir, "state.json"))
+
+	h := newJobHistory()
+	if err := h.load(file); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < maxJobEvents+5; i++ {
+		h.add(&host.JobEvent{JobID: "a", Event: host.JobEventStart})
+	}
+	h.add(&host.JobEvent{JobID: "b", Event: host.JobEventError, Error: "boom"})
+	h.save()
+
+	h = newJobHistory()
+	if err := h.load(file); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(h.Get("a")); n != maxJobEvents {
+		t.Errorf("expected %d events, got %d", maxJobEvents, n)
+	}
+	if events := h.Get("b"); len(events) != 1 || events[0].Error != "boom" {
+		t.Errorf("unexpected events: %v", events)
+	}
+}
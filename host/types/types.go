@@ -1,9 +1,14 @@
 package host
 
 import (
+	"errors"
 	"time"
 )
 
+// ErrUnknownJob is returned for requests about jobs which the host does not
+// know. Errors returned over RPC are strings, so clients compare messages.
+var ErrUnknownJob = errors.New("host: unknown job")
+
 type Job struct {
 	ID string
 
@@ -52,12 +57,57 @@ func (j *Job) Dup() *Job {
 			job.Config.Mounts[i] = m
 		}
 	}
+	if j.Config.Secrets != nil {
+		secrets := *j.Config.Secrets
+		job.Config.Secrets = &secrets
+	}
 
 	return &job
 }
 
+// Redacted returns a copy of the job without the token of its secrets. Only
+// the host starting a job needs the token, so it is removed from jobs which are
+// stored or returned by an API.
+func (j *Job) Redacted() *Job {
+	job := j.Dup()
+	if job.Config.Secrets != nil {
+		job.Config.Secrets.Token = ""
+	}
+	return job
+}
+
 type JobResources struct {
-	Memory int // in KiB
+	Memory       int // in KiB
+	CPUShares    int // relative CPU weight, 1024 is one share
+	CPUQuota     int // in microseconds per 100ms period, zero is unlimited
+	MaxPIDs      int // maximum number of processes, zero is unlimited
+	MaxOpenFiles int // RLIMIT_NOFILE, zero uses the default
+}
+
+// JobStats is a sample of the resources used by a running job, read from its
+// cgroups.
+type JobStats struct {
+	JobID       string
+	Time        time.Time
+	MemoryUsage uint64 // in bytes
+	MemoryLimit uint64 // in bytes
+	CPUUsage    uint64 // total CPU time in nanoseconds
+}
+
+// LogReq is a request for the output of a job.
+type LogReq struct {
+	JobID string
+	Lines int // the number of previous lines to send, -1 sends all of them
+	// Follow streams new output until the job stops.
+	Follow bool
+}
+
+// LogLine is a chunk of output written by a job.
+type LogLine struct {
+	JobID     string
+	Stream    int // 1 is stdout, 2 is stderr
+	Timestamp time.Time
+	Message   string
 }
 
 type ContainerConfig struct {
@@ -72,8 +122,28 @@ type ContainerConfig struct {
 	WorkingDir  string
 	Uid         int
 	HostNetwork bool
+	// Secrets are environment variables which are fetched when the job
+	// starts, so that they are not part of its config.
+	Secrets *Secrets
 }
 
+// Secrets is where the host fetches the secret environment variables of a job
+// from. A GET request to URL authorized with Token responds with a JSON
+// object of the variables. The host of URL is looked up in discoverd. Token is
+// removed from jobs before they are stored, see Job.Redacted.
+type Secrets struct {
+	URL   string
+	Token string
+}
+
+// LogDrainsKey is the discoverd key prefix which the controller publishes the
+// log drains of each app under, as a JSON array of URLs at LogDrainsKey/<app id>.
+const LogDrainsKey = "flynn-host/log-drains"
+
+// DrainingKey is the discoverd key prefix which the draining state of hosts is
+// stored under, a host is draining while DrainingKey/<host id> exists.
+const DrainingKey = "flynn-host/draining"
+
 type Port struct {
 	Port     int
 	Proto    string
@@ -84,6 +154,27 @@ type Mount struct {
 	Location  string
 	Target    string
 	Writeable bool
+
+	// VolumeID is the persistent volume mounted at Location when Target is
+	// empty. If it is empty a new volume is created and its ID is recorded
+	// here, if the volume does not exist on the host it is created with this
+	// ID.
+	VolumeID string
+}
+
+// Volume is a named directory managed by a host which persists across the
+// jobs it is mounted into.
+type Volume struct {
+	ID        string
+	Name      string
+	Path      string
+	CreatedAt time.Time
+
+	// SnapshotOf is the ID of the volume this volume is a snapshot of.
+	SnapshotOf string
+
+	// JobID is the job the volume is attached to, if any.
+	JobID string
 }
 
 type Artifact struct {
@@ -91,11 +182,28 @@ type Artifact struct {
 	Type string
 }
 
+// LayerPullInfo is the progress of pulling an image, sent for each of its
+// layers. It mirrors pinkerton.LayerPullInfo.
+type LayerPullInfo struct {
+	ID     string `json:"id"`
+	Status string `json:"status"` // "exists" or "downloaded"
+}
+
 type Host struct {
 	ID string
 
 	Jobs     []*Job
 	Metadata map[string]string
+
+	// Draining is set when the host is being taken out of service, no new jobs
+	// are placed on a draining host and the scheduler moves its formation jobs
+	// to other hosts.
+	Draining bool
+}
+
+type SetDrainingReq struct {
+	HostID   string
+	Draining bool
 }
 
 type AddJobsReq struct {
@@ -114,6 +222,25 @@ type Event struct {
 	Job   *ActiveJob
 }
 
+// JobEvent is an entry in the lifecycle history which flynn-host keeps for
+// each job.
+type JobEvent struct {
+	JobID      string
+	Event      string
+	Time       time.Time
+	ExitStatus int    `json:",omitempty"` // set for stop events
+	Error      string `json:",omitempty"` // set for error events
+}
+
+const (
+	JobEventCreate = "create"
+	JobEventPull   = "pull" // the image of the job was pulled
+	JobEventStart  = "start"
+	JobEventStop   = "stop"
+	JobEventError  = "error"
+	JobEventOOM    = "oom" // a process of the job was killed for exceeding its memory limit
+)
+
 type HostEvent struct {
 	Event  string
 	HostID string
@@ -131,6 +258,9 @@ type ActiveJob struct {
 	ExitStatus  int
 	Error       *string
 	ManifestID  string
+	// OOMKills is the number of processes of the job killed by the kernel for
+	// exceeding its memory limit.
+	OOMKills int
 }
 
 type AttachReq struct {
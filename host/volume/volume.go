@@ -0,0 +1,264 @@
+// Package volume manages the persistent data volumes of a host.
+//
+// Each volume is a directory below the manager's root. Volume metadata is
+// stored in a JSON file in the root so that volumes and their names survive
+// host restarts, attachments to jobs are not persisted and must be restored by
+// the backend which owns the jobs. Directories in the root without metadata,
+// such as the data directories of jobs created before volumes were managed,
+// are adopted as volumes named after the directory.
+package volume
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/flynn/flynn/host/types"
+	"github.com/flynn/flynn/pkg/random"
+)
+
+var (
+	ErrNotFound = errors.New("volume: volume not found")
+	ErrExists   = errors.New("volume: volume already exists")
+	ErrAttached = errors.New("volume: volume is attached to a job")
+	ErrInvalid  = errors.New("volume: invalid volume id")
+)
+
+// stateFile is the file in the root which volume metadata is saved to.
+const stateFile = "volumes.json"
+
+type Manager struct {
+	root    string
+	mtx     sync.RWMutex
+	volumes map[string]*host.Volume
+}
+
+// NewManager returns a manager of the volumes in root, loading any volumes
+// previously created there.
+func NewManager(root string) (*Manager, error) {
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, err
+	}
+	m := &Manager{root: root, volumes: make(map[string]*host.Volume)}
+	if err := m.load(); err != nil {
+		return nil, err
+	}
+	if err := m.adopt(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *Manager) load() error {
+	f, err := os.Open(filepath.Join(m.root, stateFile))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := json.NewDecoder(f).Decode(&m.volumes); err != nil {
+		return fmt.Errorf("volume: error loading %s: %s", stateFile, err)
+	}
+	for _, v := range m.volumes {
+		v.JobID = ""
+	}
+	return nil
+}
+
+// adopt adds the directories in the root which are not known volumes.
+func (m *Manager) adopt() error {
+	infos, err := ioutil.ReadDir(m.root)
+	if err != nil {
+		return err
+	}
+	adopted := false
+	for _, info := range infos {
+		id := info.Name()
+		if _, ok := m.volumes[id]; ok || !info.IsDir() || !validID(id) {
+			continue
+		}
+		m.volumes[id] = &host.Volume{
+			ID:        id,
+			Path:      filepath.Join(m.root, id),
+			CreatedAt: info.ModTime().UTC(),
+		}
+		adopted = true
+	}
+	if !adopted {
+		return nil
+	}
+	return m.save()
+}
+
+// Create creates an empty volume. If id is empty a random ID is generated.
+func (m *Manager) Create(id, name string) (*host.Volume, error) {
+	if id == "" {
+		id = random.UUID()
+	} else if !validID(id) {
+		return nil, ErrInvalid
+	}
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if _, ok := m.volumes[id]; ok {
+		return nil, ErrExists
+	}
+	vol := &host.Volume{
+		ID:        id,
+		Name:      name,
+		Path:      filepath.Join(m.root, id),
+		CreatedAt: time.Now().UTC(),
+	}
+	if err := os.MkdirAll(vol.Path, 0755); err != nil {
+		return nil, err
+	}
+	m.volumes[id] = vol
+	if err := m.save(); err != nil {
+		delete(m.volumes, id)
+		return nil, err
+	}
+	return dup(vol), nil
+}
+
+// Get returns the volume with the given ID.
+func (m *Manager) Get(id string) (*host.Volume, error) {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+	vol, ok := m.volumes[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return dup(vol), nil
+}
+
+// Lookup returns the volume stored at path.
+func (m *Manager) Lookup(path string) (*host.Volume, error) {
+	if filepath.Dir(filepath.Clean(path)) != filepath.Clean(m.root) {
+		return nil, ErrNotFound
+	}
+	return m.Get(filepath.Base(path))
+}
+
+// List returns all volumes, oldest first.
+func (m *Manager) List() []*host.Volume {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+	list := make(sortVolumes, 0, len(m.volumes))
+	for _, vol := range m.volumes {
+		list = append(list, dup(vol))
+	}
+	sort.Sort(list)
+	return list
+}
+
+// Snapshot creates a new volume containing a copy of the data in the volume
+// with the given ID. The copy shares blocks with the original where the
+// filesystem supports it.
+func (m *Manager) Snapshot(id string) (*host.Volume, error) {
+	src, err := m.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	snap, err := m.Create("", src.Name)
+	if err != nil {
+		return nil, err
+	}
+	if out, err := exec.Command("cp", "-a", "--reflink=auto", src.Path+"/.", snap.Path).CombinedOutput(); err != nil {
+		m.Delete(snap.ID)
+		return nil, fmt.Errorf("volume: error copying %s: %s: %s", id, err, out)
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.volumes[snap.ID].SnapshotOf = id
+	if err := m.save(); err != nil {
+		return nil, err
+	}
+	return dup(m.volumes[snap.ID]), nil
+}
+
+// Delete removes a volume and its data. Volumes which are attached to a job
+// cannot be deleted.
+func (m *Manager) Delete(id string) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	vol, ok := m.volumes[id]
+	if !ok {
+		return ErrNotFound
+	}
+	if vol.JobID != "" {
+		return ErrAttached
+	}
+	if err := os.RemoveAll(vol.Path); err != nil {
+		return err
+	}
+	delete(m.volumes, id)
+	return m.save()
+}
+
+// Attach marks the volume as in use by a job. A volume may only be attached to
+// one job at a time.
+func (m *Manager) Attach(id, jobID string) (*host.Volume, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	vol, ok := m.volumes[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	if vol.JobID != "" && vol.JobID != jobID {
+		return nil, ErrAttached
+	}
+	vol.JobID = jobID
+	return dup(vol), nil
+}
+
+// Detach releases the volume from a job, it is a no-op if the volume is not
+// attached to the job.
+func (m *Manager) Detach(id, jobID string) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if vol, ok := m.volumes[id]; ok && vol.JobID == jobID {
+		vol.JobID = ""
+	}
+}
+
+// save writes the volume metadata to the state file, the caller must hold
+// m.mtx.
+func (m *Manager) save() error {
+	path := filepath.Join(m.root, stateFile)
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(f).Encode(m.volumes); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// validID checks that id can be used as a directory name in the root.
+func validID(id string) bool {
+	return id != stateFile && id != "." && id != ".." && filepath.Base(id) == id
+}
+
+func dup(vol *host.Volume) *host.Volume {
+	v := *vol
+	return &v
+}
+
+type sortVolumes []*host.Volume
+
+func (s sortVolumes) Len() int           { return len(s) }
+func (s sortVolumes) Less(i, j int) bool { return s[i].CreatedAt.Before(s[j].CreatedAt) }
+func (s sortVolumes) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
@@ -0,0 +1,205 @@
+package volume
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTestManager(t *testing.T) (*Manager, string) {
+	root, err := ioutil.TempDir("", "volume-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := NewManager(root)
+	if err != nil {
+		os.RemoveAll(root)
+		t.Fatal(err)
+	}
+	return m, root
+}
+
+func TestCreate(t *testing.T) {
+	m, root := newTestManager(t)
+	defer os.RemoveAll(root)
+
+	vol, err := m.Create("", "pg-data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vol.ID == "" || vol.Name != "pg-data" || vol.Path != filepath.Join(root, vol.ID) {
+		t.Fatalf("unexpected volume %+v", vol)
+	}
+	if _, err := os.Stat(vol.Path); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := m.Create("foo", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Create("foo", ""); err != ErrExists {
+		t.Errorf("expected ErrExists, got %v", err)
+	}
+	for _, id := range []string{"..", "a/b", stateFile} {
+		if _, err := m.Create(id, ""); err != ErrInvalid {
+			t.Errorf("expected ErrInvalid for %q, got %v", id, err)
+		}
+	}
+	if list := m.List(); len(list) != 2 || list[0].ID != vol.ID || list[1].ID != "foo" {
+		t.Errorf("unexpected volume list %+v", list)
+	}
+}
+
+func TestAttach(t *testing.T) {
+	m, root := newTestManager(t)
+	defer os.RemoveAll(root)
+
+	vol, err := m.Create("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Attach("unknown", "job1"); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+	if _, err := m.Attach(vol.ID, "job1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Attach(vol.ID, "job2"); err != ErrAttached {
+		t.Errorf("expected ErrAttached, got %v", err)
+	}
+	if err := m.Delete(vol.ID); err != ErrAttached {
+		t.Errorf("expected ErrAttached, got %v", err)
+	}
+
+	m.Detach(vol.ID, "job2")
+	if v, _ := m.Get(vol.ID); v.JobID != "job1" {
+		t.Errorf("expected volume to be attached to job1, got %q", v.JobID)
+	}
+	m.Detach(vol.ID, "job1")
+	if _, err := m.Attach(vol.ID, "job2"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	m, root := newTestManager(t)
+	defer os.RemoveAll(root)
+
+	vol, err := m.Create("", "data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(vol.Path, "foo"), []byte("bar"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	snap, err := m.Snapshot(vol.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snap.ID == vol.ID || snap.SnapshotOf != vol.ID || snap.Name != "data" {
+		t.Fatalf("unexpected snapshot %+v", snap)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(snap.Path, "foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "bar" {
+		t.Errorf("unexpected snapshot data %q", data)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	m, root := newTestManager(t)
+	defer os.RemoveAll(root)
+
+	vol, err := m.Create("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Delete(vol.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(vol.Path); !os.IsNotExist(err) {
+		t.Errorf("expected volume directory to be removed, got %v", err)
+	}
+	if _, err := m.Get(vol.ID); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+	if err := m.Delete(vol.ID); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestRestore(t *testing.T) {
+	m, root := newTestManager(t)
+	defer os.RemoveAll(root)
+
+	vol, err := m.Create("", "data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Attach(vol.ID, "job1"); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err = NewManager(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored, err := m.Get(vol.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.Name != "data" || restored.Path != vol.Path {
+		t.Errorf("unexpected restored volume %+v", restored)
+	}
+	if restored.JobID != "" {
+		t.Errorf("expected attachments not to be restored, got %q", restored.JobID)
+	}
+}
+
+func TestAdopt(t *testing.T) {
+	root, err := ioutil.TempDir("", "volume-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	dir := filepath.Join(root, "old-job")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "not-a-dir"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := NewManager(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vol, err := m.Lookup(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vol.ID != "old-job" || vol.Path != dir {
+		t.Errorf("unexpected adopted volume %+v", vol)
+	}
+	if list := m.List(); len(list) != 1 {
+		t.Errorf("expected only the directory to be adopted, got %+v", list)
+	}
+	if _, err := m.Lookup(filepath.Join(dir, "sub")); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+
+	// adopted volumes are saved
+	if err := os.Remove(filepath.Join(root, "not-a-dir")); err != nil {
+		t.Fatal(err)
+	}
+	m, err = NewManager(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Get("old-job"); err != nil {
+		t.Fatal(err)
+	}
+}
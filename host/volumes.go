@@ -0,0 +1,104 @@
+package main
+
+import (
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/technoweenie/grohl"
+	"github.com/flynn/flynn/host/types"
+	"github.com/flynn/flynn/host/volume"
+)
+
+// Volume is the RPC service which manages the persistent volumes of the host.
+// Volumes are attached to a job by setting VolumeID in one of its mounts.
+type Volume struct {
+	volumes *volume.Manager
+}
+
+func (v *Volume) Create(req host.Volume, res *host.Volume) error {
+	vol, err := v.volumes.Create(req.ID, req.Name)
+	if err != nil {
+		return err
+	}
+	*res = *vol
+	return nil
+}
+
+func (v *Volume) Get(id string, res *host.Volume) error {
+	vol, err := v.volumes.Get(id)
+	if err != nil {
+		return err
+	}
+	*res = *vol
+	return nil
+}
+
+func (v *Volume) List(arg struct{}, res *[]*host.Volume) error {
+	*res = v.volumes.List()
+	return nil
+}
+
+func (v *Volume) Snapshot(id string, res *host.Volume) error {
+	vol, err := v.volumes.Snapshot(id)
+	if err != nil {
+		return err
+	}
+	*res = *vol
+	return nil
+}
+
+func (v *Volume) Delete(id string, res *struct{}) error {
+	return v.volumes.Delete(id)
+}
+
+// attachVolume attaches the volume of a data mount to a job, creating it if it
+// does not exist, and sets the mount target to the volume path.
+func attachVolume(volumes *volume.Manager, m *host.Mount, jobID string) error {
+	if m.VolumeID != "" {
+		if _, err := volumes.Get(m.VolumeID); err == nil {
+			vol, err := volumes.Attach(m.VolumeID, jobID)
+			if err != nil {
+				return err
+			}
+			m.Target = vol.Path
+			return nil
+		} else if err != volume.ErrNotFound {
+			return err
+		}
+	}
+	vol, err := volumes.Create(m.VolumeID, "")
+	if err != nil {
+		return err
+	}
+	if vol, err = volumes.Attach(vol.ID, jobID); err != nil {
+		return err
+	}
+	m.VolumeID = vol.ID
+	m.Target = vol.Path
+	return nil
+}
+
+// detachVolumes releases the volumes mounted by a job.
+func detachVolumes(volumes *volume.Manager, job *host.Job) {
+	for _, m := range job.Config.Mounts {
+		if m.VolumeID != "" {
+			volumes.Detach(m.VolumeID, job.ID)
+		}
+	}
+}
+
+// reattachVolumes restores the volume attachments of a job which was running
+// before the host restarted. Data mounts of jobs started before volumes were
+// managed are recorded as mounts of the adopted volume at their target.
+func reattachVolumes(volumes *volume.Manager, job *host.Job) {
+	for i, m := range job.Config.Mounts {
+		if m.VolumeID == "" {
+			vol, err := volumes.Lookup(m.Target)
+			if err != nil {
+				continue
+			}
+			m.VolumeID = vol.ID
+			job.Config.Mounts[i].VolumeID = vol.ID
+		}
+		if _, err := volumes.Attach(m.VolumeID, job.ID); err != nil {
+			grohl.Log(grohl.Data{"fn": "reattachVolumes", "job.id": job.ID, "volume.id": m.VolumeID, "status": "error", "err": err})
+		}
+	}
+}
@@ -3,7 +3,9 @@ package main
 import (
 	"fmt"
 	"log"
+	"time"
 
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/docker/docker/pkg/units"
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-docopt"
 	"github.com/flynn/flynn/pinkerton"
 )
@@ -15,12 +17,14 @@ Usage:
   pinkerton pull [options] <image-url>
   pinkerton checkout [options] <id> <image-id>
   pinkerton cleanup [options] <id>
+  pinkerton gc [options] [--max-size=<size>] [--min-age=<duration>]
   pinkerton -h | --help
 
 Commands:
   pull      Download a Docker image
   checkout  Create a working copy of an image
   cleanup   Destroy a working copy of an image
+  gc        Delete least recently used images which have no working copies
 
 Examples:
   pinkerton pull https://registry.hub.docker.com/redis
@@ -28,12 +32,15 @@ Examples:
   pinkerton pull https://registry.hub.docker.com/flynn/slugrunner?id=1443bd6a675b959693a1a4021d660bebbdbff688d00c65ff057c46702e4b8933
   pinkerton checkout slugrunner-test 1443bd6a675b959693a1a4021d660bebbdbff688d00c65ff057c46702e4b8933
   pinkerton cleanup slugrunner-test
+  pinkerton gc --max-size=10g
 
 Options:
-  -h, --help       show this message and exit
-  --driver=<name>  storage driver [default: aufs]
-  --root=<path>    storage root [default: /var/lib/docker]
-  --json           emit json-formatted output
+  -h, --help              show this message and exit
+  --driver=<name>         storage driver [default: aufs]
+  --root=<path>           storage root [default: /var/lib/docker]
+  --json                  emit json-formatted output
+  --max-size=<size>       delete images until the store is at most this size [default: 0]
+  --min-age=<duration>    keep images used within this duration [default: 0]
 `
 
 	args, _ := docopt.Parse(usage, nil, true, "", false)
@@ -58,5 +65,21 @@ Options:
 		if err := ctx.Cleanup(args.String["<id>"]); err != nil {
 			log.Fatal(err)
 		}
+	case args.Bool["gc"]:
+		maxSize, err := units.RAMInBytes(args.String["--max-size"])
+		if err != nil {
+			log.Fatalf("invalid --max-size: %s", err)
+		}
+		minAge, err := time.ParseDuration(args.String["--min-age"])
+		if err != nil {
+			log.Fatalf("invalid --min-age: %s", err)
+		}
+		removed, err := ctx.GC(maxSize, minAge)
+		for _, id := range removed {
+			fmt.Println(id, "deleted")
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
 	}
 }
@@ -68,6 +68,9 @@ func (c *Context) Pull(url string, progress chan<- LayerPullInfo) error {
 		return err
 	}
 
+	// layers which exist are used as parents, so they are kept from GC
+	defer c.Use()()
+
 	if id := ref.ImageID(); id != "" && c.Exists(id) {
 		if progress != nil {
 			progress <- LayerPullInfo{ID: id, Status: LayerStatusExists}
@@ -115,12 +118,18 @@ func (c *Context) Pull(url string, progress chan<- LayerPullInfo) error {
 	return nil
 }
 
+// Checkout creates a working copy of an image. The image is kept by GC until
+// the working copy is destroyed with Cleanup.
 func (c *Context) Checkout(id, imageID string) (string, error) {
-	id = "tmp-" + id
-	if err := c.driver.Create(id, imageID); err != nil {
+	defer c.Use()()
+	if err := c.AddRef(id, imageID); err != nil {
+		return "", err
+	}
+	if err := c.driver.Create("tmp-"+id, imageID); err != nil {
+		c.RemoveRef(id)
 		return "", err
 	}
-	path, err := c.driver.Get(id, "")
+	path, err := c.driver.Get("tmp-"+id, "")
 	if err != nil {
 		return "", err
 	}
@@ -128,7 +137,10 @@ func (c *Context) Checkout(id, imageID string) (string, error) {
 }
 
 func (c *Context) Cleanup(id string) error {
-	return c.driver.Remove("tmp-" + id)
+	if err := c.driver.Remove("tmp-" + id); err != nil {
+		return err
+	}
+	return c.RemoveRef(id)
 }
 
 func InfoPrinter(jsonOut bool) chan<- LayerPullInfo {
@@ -21,22 +21,30 @@ func NewRef(s string) (*Ref, error) {
 	}
 
 	q := u.Query()
-	if q.Get("tag") != "" && q.Get("id") != "" {
-		return nil, fmt.Errorf("registry: only one of id or tag may be provided")
+	var n int
+	for _, k := range []string{"tag", "id", "digest"} {
+		if q.Get(k) != "" {
+			n++
+		}
+	}
+	if n > 1 {
+		return nil, fmt.Errorf("registry: only one of id, tag or digest may be provided")
 	}
 
 	ref := &Ref{
 		tag:     q.Get("tag"),
 		repo:    strings.TrimPrefix(u.Path, "/"),
 		imageID: q.Get("id"),
+		digest:  q.Get("digest"),
 		index:   fmt.Sprintf("%s://%s/v1", u.Scheme, u.Host),
+		base:    fmt.Sprintf("%s://%s/v2", u.Scheme, u.Host),
 		scheme:  u.Scheme,
 	}
 	if u.User != nil {
 		ref.username = u.User.Username()
 		ref.password, _ = u.User.Password()
 	}
-	if ref.tag == "" && ref.imageID == "" {
+	if ref.tag == "" && ref.imageID == "" && ref.digest == "" {
 		ref.tag = "latest"
 	}
 
@@ -52,14 +60,35 @@ type Ref struct {
 	repo      string
 	tag       string
 	imageID   string
+	digest    string
 	scheme    string
+
+	// v2 registry state
+	base        string
+	bearerToken string
+	layers      []*Image // layers of the pulled manifest, top layer first
 }
 
 func (r *Ref) ImageID() string {
 	return r.imageID
 }
 
+// Get returns the image the ref points to. The v2 protocol is used if the
+// registry supports it, unless the ref is a v1 image ID.
 func (r *Ref) Get() (*Image, error) {
+	if r.imageID == "" {
+		img, err := r.getV2()
+		if err != errV2Unsupported {
+			return img, err
+		}
+		if r.digest != "" {
+			return nil, fmt.Errorf("registry: digest %s requires a v2 registry", r.digest)
+		}
+	}
+	return r.getV1()
+}
+
+func (r *Ref) getV1() (*Image, error) {
 	req, err := http.NewRequest("GET", fmt.Sprintf("%s/repositories/%s/images", r.index, r.repo), nil)
 	if err != nil {
 		return nil, err
@@ -200,8 +229,9 @@ type Image struct {
 	OS              string           `json:"os,omitempty"`
 	Size            int64            `json:"size,omitempty"`
 
-	ref   *Ref
-	layer io.ReadCloser
+	ref     *Ref
+	layer   io.ReadCloser
+	blobSum string // digest of the layer in a v2 registry
 }
 
 func (i *Image) Read(p []byte) (int, error) {
@@ -210,7 +240,11 @@ func (i *Image) Read(p []byte) (int, error) {
 	}
 	if i.layer == nil {
 		var err error
-		i.layer, err = i.ref.layer(i.ID)
+		if i.blobSum != "" {
+			i.layer, err = i.ref.blob(i.blobSum)
+		} else {
+			i.layer, err = i.ref.layer(i.ID)
+		}
 		if err != nil {
 			return 0, err
 		}
@@ -222,6 +256,10 @@ func (i *Image) Fetch() error {
 	if i.ref == nil {
 		return errors.New("registry: improperly initialized Image")
 	}
+	if i.blobSum != "" {
+		// the JSON of v2 layers is part of the manifest
+		return nil
+	}
 	_, err := i.ref.registryGet(fmt.Sprintf("/images/%s/json", i.ID), i)
 	return err
 }
@@ -239,6 +277,9 @@ func (img *Image) Ancestors() ([]*Image, error) {
 	if img.ParentID == "" {
 		return nil, ErrNoParent
 	}
+	if img.blobSum != "" {
+		return img.ref.layers, nil
+	}
 	var ids []string
 	_, err := img.ref.registryGet(fmt.Sprintf("/images/%s/ancestry", img.ID), &ids)
 	if err != nil {
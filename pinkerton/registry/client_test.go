@@ -0,0 +1,267 @@
+package registry
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testToken = "test-token"
+
+type testLayer struct {
+	id, parent string
+	data       []byte
+}
+
+func (l *testLayer) digest() string {
+	sum := sha256.Sum256(l.data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// fakeRegistry is a v2 registry which serves the repo foo/bar and requires a
+// bearer token from its auth server if auth is set. It serves the v1 API
+// instead if v1 is set.
+type fakeRegistry struct {
+	*httptest.Server
+	layers   []*testLayer // top layer first
+	auth     bool
+	v1       bool
+	scopes   []string
+	corrupt  bool
+	manifest []byte
+}
+
+func newFakeRegistry() *fakeRegistry {
+	r := &fakeRegistry{layers: []*testLayer{
+		{id: "c", parent: "b", data: []byte("layer c")},
+		{id: "b", parent: "a", data: []byte("layer b")},
+		{id: "a", data: []byte("layer a")},
+	}}
+	var m manifest
+	m.SchemaVersion = 1
+	m.Name = "foo/bar"
+	m.Tag = "latest"
+	for _, l := range r.layers {
+		v1, _ := json.Marshal(&Image{ID: l.id, ParentID: l.parent})
+		m.FSLayers = append(m.FSLayers, struct {
+			BlobSum string `json:"blobSum"`
+		}{l.digest()})
+		m.History = append(m.History, struct {
+			V1Compatibility string `json:"v1Compatibility"`
+		}{string(v1)})
+	}
+	r.manifest, _ = json.Marshal(m)
+	r.Server = httptest.NewServer(r)
+	return r
+}
+
+func (r *fakeRegistry) manifestDigest() string {
+	sum := sha256.Sum256(r.manifest)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+func (r *fakeRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path == "/token" {
+		user, pass, _ := req.BasicAuth()
+		if user != "user" || pass != "pass" {
+			w.WriteHeader(401)
+			return
+		}
+		r.scopes = append(r.scopes, req.URL.Query().Get("scope"))
+		json.NewEncoder(w).Encode(map[string]string{"token": testToken})
+		return
+	}
+
+	if r.v1 {
+		r.serveV1(w, req)
+		return
+	}
+	if !strings.HasPrefix(req.URL.Path, "/v2/") {
+		http.NotFound(w, req)
+		return
+	}
+	if r.auth && req.Header.Get("Authorization") != "Bearer "+testToken {
+		w.Header().Set("Www-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="fake"`, r.URL))
+		w.WriteHeader(401)
+		return
+	}
+
+	switch path := strings.TrimPrefix(req.URL.Path, "/v2"); {
+	case path == "/":
+		w.WriteHeader(200)
+	case path == "/foo/bar/manifests/latest" || path == "/foo/bar/manifests/"+r.manifestDigest():
+		w.Header().Set("Content-Type", manifestV1MediaType)
+		w.Write(r.manifest)
+	case strings.HasPrefix(path, "/foo/bar/blobs/"):
+		for _, l := range r.layers {
+			if path == "/foo/bar/blobs/"+l.digest() {
+				if r.corrupt {
+					w.Write([]byte("corrupt"))
+				} else {
+					w.Write(l.data)
+				}
+				return
+			}
+		}
+		http.NotFound(w, req)
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+func (r *fakeRegistry) serveV1(w http.ResponseWriter, req *http.Request) {
+	enc := json.NewEncoder(w)
+	switch path := req.URL.Path; {
+	case path == "/v1/repositories/foo/bar/images":
+		w.WriteHeader(200)
+	case path == "/v1/repositories/foo/bar/tags":
+		enc.Encode(map[string]string{"latest": "c"})
+	case path == "/v1/images/c/ancestry":
+		enc.Encode([]string{"c", "b", "a"})
+	case strings.HasPrefix(path, "/v1/images/"):
+		for _, l := range r.layers {
+			switch path {
+			case "/v1/images/" + l.id + "/json":
+				enc.Encode(&Image{ID: l.id, ParentID: l.parent})
+				return
+			case "/v1/images/" + l.id + "/layer":
+				w.Write(l.data)
+				return
+			}
+		}
+		http.NotFound(w, req)
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+// ref returns a ref to path in the registry, with credentials in the URL if
+// userinfo is set.
+func (r *fakeRegistry) ref(t *testing.T, userinfo, path string) *Ref {
+	u := r.URL + path
+	if userinfo != "" {
+		u = strings.Replace(u, "://", "://"+userinfo+"@", 1)
+	}
+	ref, err := NewRef(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ref
+}
+
+func pull(t *testing.T, ref *Ref) (ids []string, data []string) {
+	img, err := ref.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	layers, err := img.Ancestors()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, l := range layers {
+		if err := l.Fetch(); err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(l)
+		l.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, l.ID)
+		data = append(data, string(b))
+	}
+	return ids, data
+}
+
+func assertPulled(t *testing.T, ref *Ref) {
+	ids, data := pull(t, ref)
+	if expected := []string{"c", "b", "a"}; !reflect.DeepEqual(ids, expected) {
+		t.Errorf("expected layers %v, got %v", expected, ids)
+	}
+	if expected := []string{"layer c", "layer b", "layer a"}; !reflect.DeepEqual(data, expected) {
+		t.Errorf("expected layer data %v, got %v", expected, data)
+	}
+	if ref.ImageID() != "c" {
+		t.Errorf("expected image id c, got %q", ref.ImageID())
+	}
+}
+
+func TestPullV2(t *testing.T) {
+	r := newFakeRegistry()
+	defer r.Close()
+
+	for _, path := range []string{"/foo/bar", "/foo/bar?tag=latest", "/foo/bar?digest=" + r.manifestDigest()} {
+		assertPulled(t, r.ref(t, "", path))
+	}
+
+	if _, err := r.ref(t, "", "/foo/bar?tag=missing").Get(); err == nil {
+		t.Error("expected error for missing tag")
+	}
+}
+
+func TestPullV2Auth(t *testing.T) {
+	r := newFakeRegistry()
+	r.auth = true
+	defer r.Close()
+
+	assertPulled(t, r.ref(t, "user:pass", "/foo/bar"))
+	if expected := []string{"repository:foo/bar:pull"}; !reflect.DeepEqual(r.scopes, expected) {
+		t.Errorf("expected token requests for %v, got %v", expected, r.scopes)
+	}
+
+	if _, err := r.ref(t, "user:wrong", "/foo/bar").Get(); err == nil {
+		t.Error("expected error for invalid credentials")
+	}
+	if _, err := r.ref(t, "", "/foo/bar").Get(); err == nil {
+		t.Error("expected error without credentials")
+	}
+}
+
+func TestPullV2DigestMismatch(t *testing.T) {
+	r := newFakeRegistry()
+	r.corrupt = true
+	defer r.Close()
+
+	img, err := r.ref(t, "", "/foo/bar").Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+	if _, err := ioutil.ReadAll(img); err == nil || !strings.Contains(err.Error(), "digest mismatch") {
+		t.Errorf("expected digest mismatch error, got %v", err)
+	}
+}
+
+func TestPullV1Fallback(t *testing.T) {
+	r := newFakeRegistry()
+	r.v1 = true
+	defer r.Close()
+
+	assertPulled(t, r.ref(t, "", "/foo/bar"))
+	if _, err := r.ref(t, "", "/foo/bar?digest="+r.manifestDigest()).Get(); err == nil {
+		t.Error("expected error pulling a digest from a v1 registry")
+	}
+}
+
+func TestParseChallenge(t *testing.T) {
+	scheme, params := parseChallenge(`Bearer realm="https://auth.example.com/token",service="registry", scope="repository:foo:pull,push",error=invalid_token`)
+	if scheme != "bearer" {
+		t.Errorf("expected bearer scheme, got %q", scheme)
+	}
+	expected := map[string]string{
+		"realm":   "https://auth.example.com/token",
+		"service": "registry",
+		"scope":   "repository:foo:pull,push",
+		"error":   "invalid_token",
+	}
+	if !reflect.DeepEqual(params, expected) {
+		t.Errorf("expected %v, got %v", expected, params)
+	}
+}
@@ -0,0 +1,267 @@
+package registry
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+var errV2Unsupported = errors.New("registry: v2 protocol not supported")
+
+const manifestV1MediaType = "application/vnd.docker.distribution.manifest.v1+json"
+
+// manifest is a v2 image manifest (schema version 1). The layers and their v1
+// image JSON are listed top layer first.
+type manifest struct {
+	SchemaVersion int    `json:"schemaVersion"`
+	Name          string `json:"name"`
+	Tag           string `json:"tag"`
+	FSLayers      []struct {
+		BlobSum string `json:"blobSum"`
+	} `json:"fsLayers"`
+	History []struct {
+		V1Compatibility string `json:"v1Compatibility"`
+	} `json:"history"`
+}
+
+func (r *Ref) getV2() (*Image, error) {
+	res, err := r.v2Do("GET", "/", nil)
+	if err != nil {
+		return nil, err
+	}
+	res.Body.Close()
+	if res.StatusCode != 200 {
+		return nil, errV2Unsupported
+	}
+
+	reference := r.digest
+	if reference == "" {
+		reference = r.tag
+	}
+	res, err = r.v2Do("GET", fmt.Sprintf("/%s/manifests/%s", r.repo, reference), http.Header{
+		"Accept": {manifestV1MediaType, "application/vnd.docker.distribution.manifest.v1+prettyjws", "application/json"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == 404 {
+		return nil, fmt.Errorf("registry: manifest %s:%s not found", r.repo, reference)
+	}
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("registry: unexpected status %d", res.StatusCode)
+	}
+	var m manifest
+	if err := json.NewDecoder(res.Body).Decode(&m); err != nil {
+		return nil, err
+	}
+	if m.SchemaVersion != 1 {
+		return nil, fmt.Errorf("registry: unsupported manifest schema version %d", m.SchemaVersion)
+	}
+	if len(m.FSLayers) == 0 || len(m.FSLayers) != len(m.History) {
+		return nil, errors.New("registry: invalid manifest")
+	}
+
+	r.layers = make([]*Image, len(m.History))
+	for i, h := range m.History {
+		img := &Image{ref: r, blobSum: m.FSLayers[i].BlobSum}
+		if err := json.Unmarshal([]byte(h.V1Compatibility), img); err != nil {
+			return nil, err
+		}
+		if img.ID == "" {
+			return nil, errors.New("registry: invalid manifest, missing layer id")
+		}
+		if i > 0 && r.layers[i-1].ParentID != img.ID {
+			return nil, fmt.Errorf("registry: invalid manifest, layer %s is not the parent of %s", img.ID, r.layers[i-1].ID)
+		}
+		r.layers[i] = img
+	}
+	r.imageID = r.layers[0].ID
+	return r.layers[0], nil
+}
+
+// blob returns the contents of a blob, which fail to read if they don't match
+// the digest.
+func (r *Ref) blob(digest string) (io.ReadCloser, error) {
+	v, err := newVerifier(digest)
+	if err != nil {
+		return nil, err
+	}
+	res, err := r.v2Do("GET", fmt.Sprintf("/%s/blobs/%s", r.repo, digest), nil)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != 200 {
+		res.Body.Close()
+		return nil, fmt.Errorf("registry: unexpected status %d for blob %s", res.StatusCode, digest)
+	}
+	v.body = res.Body
+	return v, nil
+}
+
+// v2Do performs a request against the v2 API, authenticating and retrying
+// once if the registry requires it.
+func (r *Ref) v2Do(method, path string, header http.Header) (*http.Response, error) {
+	newReq := func() (*http.Request, error) {
+		req, err := http.NewRequest(method, r.base+path, nil)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		if r.bearerToken != "" {
+			req.Header.Set("Authorization", "Bearer "+r.bearerToken)
+		} else if r.username != "" {
+			req.SetBasicAuth(r.username, r.password)
+		}
+		return req, nil
+	}
+
+	req, err := newReq()
+	if err != nil {
+		return nil, err
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil || res.StatusCode != 401 {
+		return res, err
+	}
+	res.Body.Close()
+
+	scheme, params := parseChallenge(res.Header.Get("Www-Authenticate"))
+	if scheme != "bearer" {
+		return nil, errors.New("registry: unauthorized")
+	}
+	if err := r.authenticate(params); err != nil {
+		return nil, err
+	}
+	if req, err = newReq(); err != nil {
+		return nil, err
+	}
+	return http.DefaultClient.Do(req)
+}
+
+// authenticate gets a bearer token from the auth server in a challenge, using
+// the credentials of the ref if there are any.
+func (r *Ref) authenticate(challenge map[string]string) error {
+	realm, err := url.Parse(challenge["realm"])
+	if err != nil || realm.Host == "" {
+		return fmt.Errorf("registry: invalid auth realm %q", challenge["realm"])
+	}
+	q := realm.Query()
+	if service := challenge["service"]; service != "" {
+		q.Set("service", service)
+	}
+	scope := challenge["scope"]
+	if scope == "" {
+		scope = fmt.Sprintf("repository:%s:pull", r.repo)
+	}
+	q.Set("scope", scope)
+	realm.RawQuery = q.Encode()
+
+	req, err := http.NewRequest("GET", realm.String(), nil)
+	if err != nil {
+		return err
+	}
+	if r.username != "" {
+		req.SetBasicAuth(r.username, r.password)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return fmt.Errorf("registry: auth server returned status %d", res.StatusCode)
+	}
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&token); err != nil {
+		return err
+	}
+	if r.bearerToken = token.Token; r.bearerToken == "" {
+		r.bearerToken = token.AccessToken
+	}
+	if r.bearerToken == "" {
+		return errors.New("registry: auth server returned no token")
+	}
+	return nil
+}
+
+// parseChallenge parses a WWW-Authenticate header like:
+//
+//	Bearer realm="https://auth.example.com/token",service="registry",scope="repository:foo:pull,push"
+//
+// into its lowercased scheme and parameters.
+func parseChallenge(header string) (string, map[string]string) {
+	header = strings.TrimSpace(header)
+	i := strings.IndexByte(header, ' ')
+	if i == -1 {
+		return strings.ToLower(header), nil
+	}
+	scheme, s := strings.ToLower(header[:i]), header[i+1:]
+	params := make(map[string]string)
+	for {
+		s = strings.TrimLeft(s, " ,")
+		i := strings.IndexByte(s, '=')
+		if i == -1 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(s[:i]))
+		s = s[i+1:]
+		var val string
+		if strings.HasPrefix(s, `"`) {
+			end := strings.IndexByte(s[1:], '"')
+			if end == -1 {
+				val, s = s[1:], ""
+			} else {
+				val, s = s[1:end+1], s[end+2:]
+			}
+		} else if end := strings.IndexByte(s, ','); end == -1 {
+			val, s = s, ""
+		} else {
+			val, s = s[:end], s[end:]
+		}
+		params[key] = val
+	}
+	return scheme, params
+}
+
+// verifier reads a blob and checks that its contents match the digest once
+// it is read to the end.
+type verifier struct {
+	body     io.ReadCloser
+	hash     hash.Hash
+	expected string
+}
+
+func newVerifier(digest string) (*verifier, error) {
+	if !strings.HasPrefix(digest, "sha256:") {
+		return nil, fmt.Errorf("registry: unsupported digest %q", digest)
+	}
+	return &verifier{hash: sha256.New(), expected: strings.TrimPrefix(digest, "sha256:")}, nil
+}
+
+func (v *verifier) Read(p []byte) (int, error) {
+	n, err := v.body.Read(p)
+	v.hash.Write(p[:n])
+	if err == io.EOF {
+		if actual := hex.EncodeToString(v.hash.Sum(nil)); actual != v.expected {
+			return n, fmt.Errorf("registry: digest mismatch, expected sha256:%s, got sha256:%s", v.expected, actual)
+		}
+	}
+	return n, err
+}
+
+func (v *verifier) Close() error {
+	return v.body.Close()
+}
@@ -0,0 +1,198 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/flynn/flynn/pinkerton/registry"
+)
+
+// ErrUnknownRef is returned by GC while a checkout uses an unknown image.
+var ErrUnknownRef = errors.New("store: a checkout uses an unknown image, not collecting")
+
+// AddRef records that the checkout id uses the image imageID, which keeps the
+// image and its ancestors from being removed by GC. It also marks the image
+// as used now. An empty imageID records a checkout of an unknown image, which
+// keeps GC from removing any layer until the ref is removed.
+func (s *Store) AddRef(id, imageID string) error {
+	if err := ioutil.WriteFile(filepath.Join(s.Root, "_refs", id), []byte(imageID), 0600); err != nil {
+		return err
+	}
+	if imageID == "" {
+		return nil
+	}
+	now := time.Now()
+	if err := os.Chtimes(s.root(imageID), now, now); err != nil {
+		s.RemoveRef(id)
+		return err
+	}
+	return nil
+}
+
+// RemoveRef removes the reference of the checkout id.
+func (s *Store) RemoveRef(id string) error {
+	err := os.Remove(filepath.Join(s.Root, "_refs", id))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// HasRef returns whether the checkout id has a reference.
+func (s *Store) HasRef(id string) bool {
+	_, err := os.Stat(filepath.Join(s.Root, "_refs", id))
+	return err == nil
+}
+
+func (s *Store) refs() ([]string, error) {
+	files, err := ioutil.ReadDir(filepath.Join(s.Root, "_refs"))
+	if err != nil {
+		return nil, err
+	}
+	refs := make([]string, 0, len(files))
+	for _, f := range files {
+		data, err := ioutil.ReadFile(filepath.Join(s.Root, "_refs", f.Name()))
+		if err != nil {
+			return nil, err
+		}
+		refs = append(refs, strings.TrimSpace(string(data)))
+	}
+	return refs, nil
+}
+
+type layer struct {
+	id         string
+	parent     string
+	size       int64
+	lastUsed   time.Time
+	children   int
+	referenced bool
+}
+
+func (s *Store) layers() (map[string]*layer, error) {
+	dirs, err := ioutil.ReadDir(s.Root)
+	if err != nil {
+		return nil, err
+	}
+	layers := make(map[string]*layer, len(dirs))
+	for _, d := range dirs {
+		// _tmp, _locks and _refs are not layers
+		if !d.IsDir() || strings.HasPrefix(d.Name(), "_") {
+			continue
+		}
+		l := &layer{id: d.Name(), lastUsed: d.ModTime()}
+		f, err := os.Open(filepath.Join(s.root(l.id), "json"))
+		if err != nil {
+			return nil, err
+		}
+		var img registry.Image
+		err = json.NewDecoder(f).Decode(&img)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		l.parent = img.ParentID
+		if data, err := ioutil.ReadFile(filepath.Join(s.root(l.id), "layersize")); err == nil {
+			l.size, _ = strconv.ParseInt(string(data), 10, 64)
+		}
+		layers[l.id] = l
+	}
+	return layers, nil
+}
+
+// GC removes layers which are not used by a checkout, least recently used
+// first, until the total size of the layers is at most maxSize. Layers used
+// within minAge are kept, so that an image which was just pulled is not
+// removed before it is checked out. It returns the IDs of the removed layers.
+func (s *Store) GC(maxSize int64, minAge time.Duration) ([]string, error) {
+	s.gcMtx.Lock()
+	defer s.gcMtx.Unlock()
+
+	layers, err := s.layers()
+	if err != nil {
+		return nil, err
+	}
+	refs, err := s.refs()
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range refs {
+		if id == "" {
+			return nil, ErrUnknownRef
+		}
+		for l, ok := layers[id]; ok && !l.referenced; l, ok = layers[l.parent] {
+			l.referenced = true
+		}
+	}
+	var total int64
+	for _, l := range layers {
+		total += l.size
+		if p, ok := layers[l.parent]; ok {
+			p.children++
+		}
+		// a layer is as recently used as its most recently used descendant
+		for p, ok := layers[l.parent]; ok; p, ok = layers[p.parent] {
+			if p.lastUsed.Before(l.lastUsed) {
+				p.lastUsed = l.lastUsed
+			}
+		}
+	}
+
+	var removed []string
+	cutoff := time.Now().Add(-minAge)
+	for total > maxSize {
+		// only layers without children can be removed
+		var next *layer
+		for _, l := range layers {
+			if l.referenced || l.children > 0 || l.lastUsed.After(cutoff) {
+				continue
+			}
+			if next == nil || l.lastUsed.Before(next.lastUsed) {
+				next = l
+			}
+		}
+		if next == nil {
+			break
+		}
+		if err := s.remove(next.id); err != nil {
+			return removed, err
+		}
+		removed = append(removed, next.id)
+		total -= next.size
+		delete(layers, next.id)
+		if p, ok := layers[next.parent]; ok {
+			p.children--
+		}
+	}
+	return removed, nil
+}
+
+func (s *Store) remove(id string) error {
+	if err := s.lock(id); err != nil {
+		return err
+	}
+	defer s.unlock(id)
+
+	// the metadata is moved away first so that the layer no longer exists
+	// while it is removed from the driver, and moved back if that fails
+	tmp, err := s.tempDir()
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	meta := filepath.Join(tmp, "meta")
+	if err := os.Rename(s.root(id), meta); err != nil {
+		return err
+	}
+	if err := s.driver.Remove(id); err != nil {
+		os.Rename(meta, s.root(id))
+		return err
+	}
+	return nil
+}
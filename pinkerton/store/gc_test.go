@@ -0,0 +1,187 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/docker/docker/daemon/graphdriver"
+	"github.com/flynn/flynn/pinkerton/registry"
+)
+
+type fakeDriver struct {
+	graphdriver.Driver
+	removed   []string
+	removeErr error
+}
+
+func (d *fakeDriver) Remove(id string) error {
+	if d.removeErr != nil {
+		return d.removeErr
+	}
+	d.removed = append(d.removed, id)
+	return nil
+}
+
+func addLayer(t *testing.T, s *Store, id, parent string, size int64, lastUsed time.Time) {
+	dir := s.root(id)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := json.Marshal(&registry.Image{ID: id, ParentID: parent})
+	if err := ioutil.WriteFile(filepath.Join(dir, "json"), data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "layersize"), []byte(strconv.FormatInt(size, 10)), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(dir, lastUsed, lastUsed); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGC(t *testing.T) {
+	root, err := ioutil.TempDir("", "pinkerton-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	driver := &fakeDriver{}
+	s, err := New(root, driver)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// base <- app1 (used by a checkout)
+	//      <- app2 <- app3
+	// other
+	now := time.Now()
+	addLayer(t, s, "base", "", 100, now.Add(-5*time.Hour))
+	addLayer(t, s, "app1", "base", 10, now.Add(-4*time.Hour))
+	addLayer(t, s, "app2", "base", 10, now.Add(-3*time.Hour))
+	addLayer(t, s, "app3", "app2", 10, now.Add(-1*time.Hour))
+	addLayer(t, s, "other", "", 50, now.Add(-2*time.Hour))
+	if err := s.AddRef("job1", "app1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// other is the least recently used, app3 makes app2 recent
+	removed, err := s.GC(130, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(removed, []string{"other"}) {
+		t.Errorf("expected other to be removed, got %v", removed)
+	}
+
+	// layers used within minAge are kept
+	removed, err = s.GC(0, 90*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 0 {
+		t.Errorf("expected no layers to be removed, got %v", removed)
+	}
+
+	// referenced layers are kept
+	removed, err = s.GC(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(removed, []string{"app3", "app2"}) {
+		t.Errorf("expected app3 and app2 to be removed, got %v", removed)
+	}
+
+	// base is removed once it is no longer referenced
+	if err := s.RemoveRef("job1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.GC(0, 0); err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(driver.removed)
+	if expected := []string{"app1", "app2", "app3", "base", "other"}; !reflect.DeepEqual(driver.removed, expected) {
+		t.Errorf("expected %v to be removed, got %v", expected, driver.removed)
+	}
+	for _, id := range driver.removed {
+		if s.Exists(id) {
+			t.Errorf("expected %s to not exist", id)
+		}
+	}
+}
+
+func TestGCUnknownRef(t *testing.T) {
+	root, err := ioutil.TempDir("", "pinkerton-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	s, err := New(root, &fakeDriver{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addLayer(t, s, "base", "", 100, time.Now().Add(-time.Hour))
+
+	// a checkout of an unknown image keeps every layer
+	if err := s.AddRef("job1", ""); err != nil {
+		t.Fatal(err)
+	}
+	if !s.HasRef("job1") {
+		t.Error("expected job1 to have a ref")
+	}
+	if _, err := s.GC(0, 0); err != ErrUnknownRef {
+		t.Errorf("expected ErrUnknownRef, got %v", err)
+	}
+	if !s.Exists("base") {
+		t.Error("expected base to exist")
+	}
+
+	if err := s.RemoveRef("job1"); err != nil {
+		t.Fatal(err)
+	}
+	removed, err := s.GC(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(removed, []string{"base"}) {
+		t.Errorf("expected base to be removed, got %v", removed)
+	}
+}
+
+func TestGCRemoveError(t *testing.T) {
+	root, err := ioutil.TempDir("", "pinkerton-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	driver := &fakeDriver{removeErr: errors.New("busy")}
+	s, err := New(root, driver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addLayer(t, s, "base", "", 100, time.Now().Add(-time.Hour))
+
+	// a layer which the driver fails to remove still exists, so that it is
+	// removed by a later GC
+	if _, err := s.GC(0, 0); err != driver.removeErr {
+		t.Errorf("expected the driver error, got %v", err)
+	}
+	if !s.Exists("base") {
+		t.Error("expected base to exist")
+	}
+	driver.removeErr = nil
+	removed, err := s.GC(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(removed, []string{"base"}) || s.Exists("base") {
+		t.Errorf("expected base to be removed, got %v", removed)
+	}
+}
@@ -19,6 +19,10 @@ type Store struct {
 	driver graphdriver.Driver
 	locks  map[string]*os.File
 	mtx    sync.Mutex
+
+	// gcMtx is held for reading while layers are used, and for writing by
+	// GC, see Use
+	gcMtx sync.RWMutex
 }
 
 func New(root string, driver graphdriver.Driver) (*Store, error) {
@@ -32,6 +36,9 @@ func New(root string, driver graphdriver.Driver) (*Store, error) {
 	if err := os.MkdirAll(filepath.Join(path, "_locks"), 0700); err != nil {
 		return nil, err
 	}
+	if err := os.MkdirAll(filepath.Join(path, "_refs"), 0700); err != nil {
+		return nil, err
+	}
 
 	return &Store{Root: path, driver: driver, locks: make(map[string]*os.File)}, nil
 }
@@ -85,6 +92,14 @@ func (s *Store) Add(img *registry.Image) (err error) {
 	return os.Rename(tmp, s.root(img.ID))
 }
 
+// Use keeps GC in this process from removing layers until the returned
+// function is called, so that a layer which exists can be used as the parent
+// of a new layer or be checked out.
+func (s *Store) Use() func() {
+	s.gcMtx.RLock()
+	return s.gcMtx.RUnlock
+}
+
 func (s *Store) Exists(id string) bool {
 	_, err := os.Stat(s.root(id))
 	return err == nil
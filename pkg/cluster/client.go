@@ -61,6 +61,7 @@ func newClient(services ServiceSetFunc) (*Client, error) {
 type LocalClient interface {
 	ListHosts() (map[string]host.Host, error)
 	AddJobs(*host.AddJobsReq) (*host.AddJobsRes, error)
+	SetDraining(string, bool) error
 	RegisterHost(*host.Host, chan *host.Job) Stream
 	RemoveJobs([]string) error
 }
@@ -204,6 +205,19 @@ func (c *Client) AddJobs(req *host.AddJobsReq) (*host.AddJobsRes, error) {
 	return &res, client.Call("Cluster.AddJobs", req, &res)
 }
 
+// SetDraining marks a host as draining or back in service. The scheduler does
+// not place new jobs on a draining host and moves its jobs to other hosts.
+func (c *Client) SetDraining(hostID string, draining bool) error {
+	if c := c.local(); c != nil {
+		return c.SetDraining(hostID, draining)
+	}
+	client, err := c.RPCClient()
+	if err != nil {
+		return err
+	}
+	return client.Call("Cluster.SetDraining", &host.SetDrainingReq{HostID: hostID, Draining: draining}, &struct{}{})
+}
+
 // DialHost dials and returns a host client for the specified host identifier.
 func (c *Client) DialHost(id string) (Host, error) {
 	// TODO: reuse connection if leader id == id
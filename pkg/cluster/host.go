@@ -15,6 +15,10 @@ type Host interface {
 	// GetJob retrieves job details by ID.
 	GetJob(id string) (*host.ActiveJob, error)
 
+	// JobEvents returns the lifecycle event history of a job, which the host
+	// keeps after the job is removed.
+	JobEvents(id string) ([]*host.JobEvent, error)
+
 	// StopJob stops a running job.
 	StopJob(id string) error
 
@@ -22,10 +26,39 @@ type Host interface {
 	// job ID.
 	StreamEvents(id string, ch chan<- *host.Event) Stream
 
+	// JobStats streams samples of the resource usage of a running job to ch
+	// until the job stops.
+	JobStats(id string, ch chan<- *host.JobStats) Stream
+
+	// StreamLog streams the output of a job to ch. If req.Follow is set the
+	// stream stays open until the job stops.
+	StreamLog(req *host.LogReq, ch chan<- *host.LogLine) Stream
+
+	// PullImage downloads the image at uri ahead of jobs using it, streaming
+	// the progress of each layer to ch.
+	PullImage(uri string, ch chan<- *host.LayerPullInfo) Stream
+
 	// Attach attaches to a job, optionally waiting for it to start before
 	// attaching.
 	Attach(req *host.AttachReq, wait bool) (AttachClient, error)
 
+	// CreateVolume creates a persistent volume. If vol.ID is empty an ID is
+	// generated by the host.
+	CreateVolume(vol *host.Volume) (*host.Volume, error)
+
+	// GetVolume returns the volume with the given ID.
+	GetVolume(id string) (*host.Volume, error)
+
+	// ListVolumes lists the volumes on the host.
+	ListVolumes() ([]*host.Volume, error)
+
+	// SnapshotVolume creates a new volume containing a copy of the volume with
+	// the given ID.
+	SnapshotVolume(id string) (*host.Volume, error)
+
+	// DeleteVolume deletes a volume which is not attached to a job.
+	DeleteVolume(id string) error
+
 	// Close frees the underlying connection to the host.
 	Close() error
 }
@@ -58,6 +91,12 @@ func (c *hostClient) GetJob(id string) (*host.ActiveJob, error) {
 	return &res, err
 }
 
+func (c *hostClient) JobEvents(id string) ([]*host.JobEvent, error) {
+	var res []*host.JobEvent
+	err := c.c.Call("Host.JobEvents", id, &res)
+	return res, err
+}
+
 func (c *hostClient) StopJob(id string) error {
 	return c.c.Call("Host.StopJob", id, &struct{}{})
 }
@@ -66,6 +105,46 @@ func (c *hostClient) StreamEvents(id string, ch chan<- *host.Event) Stream {
 	return rpcStream{c.c.StreamGo("Host.StreamEvents", id, ch)}
 }
 
+func (c *hostClient) JobStats(id string, ch chan<- *host.JobStats) Stream {
+	return rpcStream{c.c.StreamGo("Host.JobStats", id, ch)}
+}
+
+func (c *hostClient) StreamLog(req *host.LogReq, ch chan<- *host.LogLine) Stream {
+	return rpcStream{c.c.StreamGo("Host.StreamLog", req, ch)}
+}
+
+func (c *hostClient) PullImage(uri string, ch chan<- *host.LayerPullInfo) Stream {
+	return rpcStream{c.c.StreamGo("Host.PullImage", uri, ch)}
+}
+
+func (c *hostClient) CreateVolume(vol *host.Volume) (*host.Volume, error) {
+	var res host.Volume
+	err := c.c.Call("Volume.Create", vol, &res)
+	return &res, err
+}
+
+func (c *hostClient) GetVolume(id string) (*host.Volume, error) {
+	var res host.Volume
+	err := c.c.Call("Volume.Get", id, &res)
+	return &res, err
+}
+
+func (c *hostClient) ListVolumes() ([]*host.Volume, error) {
+	var volumes []*host.Volume
+	err := c.c.Call("Volume.List", struct{}{}, &volumes)
+	return volumes, err
+}
+
+func (c *hostClient) SnapshotVolume(id string) (*host.Volume, error) {
+	var res host.Volume
+	err := c.c.Call("Volume.Snapshot", id, &res)
+	return &res, err
+}
+
+func (c *hostClient) DeleteVolume(id string) error {
+	return c.c.Call("Volume.Delete", id, &struct{}{})
+}
+
 func (c *hostClient) Close() error {
 	return c.c.Close()
 }
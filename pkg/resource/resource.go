@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
+	"strings"
 
 	"github.com/flynn/flynn/discoverd/client"
 	"github.com/flynn/flynn/discoverd/client/balancer"
@@ -77,6 +78,37 @@ func (s *Server) Provision(config []byte) (*Resource, error) {
 	return resource, nil
 }
 
+// Deprovision destroys the resource with the external ID id, which is the path
+// of the resource on the provider. Providers respond 410 Gone for a resource
+// which was already destroyed, any status other than 200, 204 or 410 (including
+// 404 from a provider which doesn't support deprovisioning) is an error.
+func (s *Server) Deprovision(id string) error {
+	server, err := s.lb.Next()
+	if err != nil {
+		return err
+	}
+
+	path := id
+	if !strings.HasPrefix(path, "/") {
+		path = s.path + "/" + id
+	}
+	req, err := http.NewRequest("DELETE", fmt.Sprintf("http://%s%s", server.Addr, path), nil)
+	if err != nil {
+		return err
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	switch res.StatusCode {
+	case 200, 204, 410:
+		return nil
+	default:
+		return fmt.Errorf("resource: unexpected status code %d", res.StatusCode)
+	}
+}
+
 func (s *Server) Close() error {
 	return s.set.Close()
 }
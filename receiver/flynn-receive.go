@@ -98,8 +98,10 @@ func main() {
 	}
 
 	release := &ct.Release{
+		AppID:      app.ID,
 		ArtifactID: artifact.ID,
 		Env:        prevRelease.Env,
+		Secrets:    prevRelease.Secrets,
 	}
 	procs := make(map[string]ct.ProcessType)
 	for _, t := range types {
@@ -123,7 +125,10 @@ func main() {
 	if err := client.CreateRelease(release); err != nil {
 		log.Fatalln("Error creating release:", err)
 	}
-	if err := client.SetAppRelease(app.Name, release.ID); err != nil {
+	if _, ok := procs[ct.ReleasePhaseType]; ok {
+		fmt.Println("=====> Running release phase")
+	}
+	if err := client.DeployAppRelease(app.Name, release.ID, os.Stdout); err != nil {
 		log.Fatalln("Error setting app release:", err)
 	}
 
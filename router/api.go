@@ -30,6 +30,7 @@ func apiHandler(rtr *Router) http.Handler {
 	r.Get("/routes", getRoutes)
 	r.Get("/routes/:route_type/:route_id", getRoute)
 	r.Delete("/routes/:route_type/:route_id", deleteRoute)
+	r.Get("/services/:service/stats", getServiceStats)
 	return m
 }
 
@@ -177,3 +178,16 @@ func deleteRoute(params martini.Params, router *Router, r render.Render) {
 
 	r.JSON(200, struct{}{})
 }
+
+type statsListener interface {
+	ServiceStats(service string) *router.ServiceStats
+}
+
+func getServiceStats(params martini.Params, router *Router, r render.Render) {
+	l, ok := router.HTTP.(statsListener)
+	if !ok {
+		r.JSON(404, struct{}{})
+		return
+	}
+	r.JSON(200, l.ServiceStats(params["service"]))
+}
@@ -74,6 +74,9 @@ type Client interface {
 	// ListRoutes returns a list of routes. If parentRef is not empty, routes
 	// are filtered by the reference (ex: "controller/apps/myapp").
 	ListRoutes(parentRef string) ([]*router.Route, error)
+	// ServiceStats returns the counters of the HTTP requests which the
+	// router has proxied to a service.
+	ServiceStats(service string) (*router.ServiceStats, error)
 	// Closer allows closing the underlying transport connection.
 	io.Closer
 }
@@ -117,3 +120,9 @@ func (c *client) ListRoutes(parentRef string) ([]*router.Route, error) {
 	err := c.Get(path, &res)
 	return res, err
 }
+
+func (c *client) ServiceStats(service string) (*router.ServiceStats, error) {
+	res := &router.ServiceStats{}
+	err := c.Get("/services/"+service+"/stats", res)
+	return res, err
+}
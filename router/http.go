@@ -17,6 +17,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/flynn/flynn/Godeps/_workspace/src/golang.org/x/crypto/nacl/secretbox"
@@ -37,6 +38,8 @@ type HTTPListener struct {
 	domains  map[string]*httpRoute
 	routes   map[string]*httpRoute
 	services map[string]*httpService
+	// stats outlives the services so that the counters never go backwards
+	stats map[string]*serviceStats
 
 	discoverd DiscoverdClient
 	ds        DataStore
@@ -61,6 +64,7 @@ func NewHTTPListener(addr, tlsAddr string, cookieKey *[32]byte, ds DataStore, di
 		routes:    make(map[string]*httpRoute),
 		domains:   make(map[string]*httpRoute),
 		services:  make(map[string]*httpService),
+		stats:     make(map[string]*serviceStats),
 		wm:        NewWatchManager(),
 		cookieKey: cookieKey,
 	}
@@ -186,7 +190,12 @@ func (h *httpSyncHandler) Set(data *router.Route) error {
 		if err != nil {
 			return err
 		}
-		service = &httpService{name: r.Service, ss: ss, cookieKey: h.l.cookieKey}
+		stats, ok := h.l.stats[r.Service]
+		if !ok {
+			stats = &serviceStats{}
+			h.l.stats[r.Service] = stats
+		}
+		service = &httpService{name: r.Service, ss: ss, stats: stats, cookieKey: h.l.cookieKey}
 		h.l.services[r.Service] = service
 	}
 	service.refs++
@@ -221,6 +230,20 @@ func (h *httpSyncHandler) Remove(id string) error {
 	return nil
 }
 
+// ServiceStats returns the request counters of a service, which are zero if
+// no requests have been proxied to it.
+func (s *HTTPListener) ServiceStats(service string) *router.ServiceStats {
+	s.mtx.RLock()
+	stats, ok := s.stats[service]
+	s.mtx.RUnlock()
+	res := &router.ServiceStats{Service: service}
+	if ok {
+		res.Requests = atomic.LoadUint64(&stats.requests)
+		res.ResponseTime = atomic.LoadUint64(&stats.responseTime)
+	}
+	return res
+}
+
 func (s *HTTPListener) serve(started chan<- error) {
 	var err error
 	s.listener, err = net.Listen("tcp", s.Addr)
@@ -345,9 +368,20 @@ type httpService struct {
 	ss   discoverd.ServiceSet
 	refs int
 
+	stats     *serviceStats
 	cookieKey *[32]byte
 }
 
+type serviceStats struct {
+	requests     uint64
+	responseTime uint64
+}
+
+func (s *serviceStats) record(d time.Duration) {
+	atomic.AddUint64(&s.requests, 1)
+	atomic.AddUint64(&s.responseTime, uint64(d))
+}
+
 func (s *httpService) getBackend() *httputil.ClientConn {
 	backend, _ := s.connectBackend()
 	return backend
@@ -430,6 +464,7 @@ func (s *httpService) getBackendSticky(req *http.Request) (*httputil.ClientConn,
 }
 
 func (s *httpService) handle(req *http.Request, sc *httputil.ServerConn, tls, sticky bool) (done bool) {
+	start := time.Now()
 	req.Header.Set("X-Request-Start", strconv.FormatInt(time.Now().UnixNano()/int64(time.Millisecond), 10))
 	req.Header.Set("X-Request-Id", random.UUID())
 
@@ -479,6 +514,7 @@ func (s *httpService) handle(req *http.Request, sc *httputil.ServerConn, tls, st
 	}
 	res, err := backend.Read(req)
 	if res != nil {
+		s.stats.record(time.Since(start))
 		if stickyCookie != nil {
 			res.Header.Add("Set-Cookie", stickyCookie.String())
 		}
@@ -277,6 +277,33 @@ func (s *S) TestHTTPServiceHandlerBackendConnectionClosed(c *C) {
 	assertGet(c, "http://"+l.Addr, "example.com", "1")
 }
 
+func (s *S) TestHTTPServiceStats(c *C) {
+	srv := httptest.NewServer(httpTestHandler("1"))
+	defer srv.Close()
+
+	l, discoverd := newHTTPListener(c)
+	defer l.Close()
+
+	r := addRoute(c, l, (&router.HTTPRoute{Domain: "example.com", Service: "test"}).ToRoute())
+
+	discoverdRegisterHTTP(c, l, srv.Listener.Addr().String())
+	defer discoverd.UnregisterAll()
+
+	c.Assert(l.ServiceStats("test").Requests, Equals, uint64(0))
+	assertGet(c, "http://"+l.Addr, "example.com", "1")
+	assertGet(c, "http://"+l.Addr, "example.com", "1")
+	stats := l.ServiceStats("test")
+	c.Assert(stats.Service, Equals, "test")
+	c.Assert(stats.Requests, Equals, uint64(2))
+	c.Assert(stats.ResponseTime > 0, Equals, true)
+
+	// the counters are kept when the service is removed
+	wait := waitForEvent(c, l, "remove", r.ID)
+	c.Assert(l.RemoveRoute(r.ID), IsNil)
+	wait()
+	c.Assert(l.ServiceStats("test").Requests, Equals, uint64(2))
+}
+
 // Act as an app to test HTTP headers
 func httpHeaderTestHandler(c *C, ip string) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
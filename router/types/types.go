@@ -85,6 +85,18 @@ func (r *TCPRoute) ToRoute() *Route {
 	return &route
 }
 
+// ServiceStats are counters of the HTTP requests which a router has proxied to
+// a service since it started.
+type ServiceStats struct {
+	Service string `json:"service"`
+	// Requests is the number of requests which received a response from a
+	// backend.
+	Requests uint64 `json:"requests"`
+	// ResponseTime is the total time in nanoseconds between receiving those
+	// requests and reading the response headers from the backend.
+	ResponseTime uint64 `json:"response_time"`
+}
+
 type Event struct {
 	Event string
 	ID    string
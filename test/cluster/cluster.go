@@ -172,7 +172,7 @@ func (c *Cluster) RemoveHost(id string) error {
 
 	var cmd string
 	switch c.bc.Backend {
-	case "libvirt-lxc":
+	case "libvirt-lxc", "namespaces":
 		cmd = "sudo start-stop-daemon --stop --pidfile /var/run/flynn-host.pid --retry 15"
 	case "docker":
 		cmd = "docker stop -t 15 flynn-host"
@@ -220,8 +220,9 @@ func (c *Cluster) startVMs(rootFS string, count int) error {
 
 		var script bytes.Buffer
 		data := hostScriptData{
-			ID: inst.ID,
-			IP: inst.IP,
+			ID:      inst.ID,
+			IP:      inst.IP,
+			Backend: c.bc.Backend,
 		}
 		if len(c.Instances) > 1 {
 			data.Peers = fmt.Sprintf("%s:7001", c.Instances[0].IP)
@@ -337,13 +338,13 @@ func buildFlynn(inst *Instance, commit string, merge bool, out io.Writer) error
 }
 
 type hostScriptData struct {
-	ID    string
-	IP    string
-	Peers string
+	ID      string
+	IP      string
+	Peers   string
+	Backend string
 }
 
-var flynnHostScripts = map[string]*template.Template{
-	"libvirt-lxc": template.Must(template.New("flynn-host-libvirt").Parse(`
+var flynnHostScript = template.Must(template.New("flynn-host").Parse(`
 sudo start-stop-daemon \
   --start \
   --background \
@@ -359,9 +360,13 @@ sudo start-stop-daemon \
   --manifest /etc/flynn-host.json \
   --external {{ .IP }} \
   --force \
-  --backend libvirt-lxc \
+  --backend {{ .Backend }} \
   &>/tmp/flynn-host.log
-`[1:])),
+`[1:]))
+
+var flynnHostScripts = map[string]*template.Template{
+	"libvirt-lxc": flynnHostScript,
+	"namespaces":  flynnHostScript,
 }
 
 type bootstrapMsg struct {